@@ -0,0 +1,412 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	BACKUP_VERSION       = 1
+	BACKUP_MANIFEST_NAME = "tattoo-backup.json"
+	BACKUP_FILE_PREFIX   = "tattoo-backup-"
+	BACKUP_FILE_SUFFIX   = ".tar.gz"
+	BACKUP_TIME_LAYOUT   = "20060102-150405"
+	ERROR_BACKUP_MEMORY  = "Storages with the memory backend can't be backed up"
+)
+
+// BackupManifest is the last entry of a backup archive, it lists the sha256
+// checksum of every other file in the archive.
+type BackupManifest struct {
+	Version     int
+	CreatedTime int64
+	ThemeName   string
+	Files       map[string]string
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:  "backup",
+		Usage: "backup [-o file]",
+		Help:  "Write storage, settings.json and the active theme to a tar.gz archive, refused while the server is running, which serves it at /writer/backup.",
+		Run:   runBackup,
+		// PauseWrites only pauses this process, a running server would keep
+		// writing under the archive
+		Locked: "or download the backup from /writer/backup of the running server",
+	})
+	RegisterCommand(&Command{
+		Name:  "restore",
+		Usage: "restore file",
+		Help:  "Validate a backup archive and replace the live data with it, refused while the server is running.",
+		Run:   runRestore,
+	})
+}
+
+func runBackup(app *webapp.App, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", BackupFileName(time.Now()), "Archive to write")
+	flags.Parse(args)
+	if err := TattooDB.Load(app); err != nil {
+		return err
+	}
+	defer TattooDB.Close()
+	if err := WriteBackupFile(*output); err != nil {
+		return err
+	}
+	app.Log("Backup", "Written to "+*output)
+	return nil
+}
+
+func runRestore(app *webapp.App, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: restore file")
+	}
+	return RestoreBackup(app, args[0])
+}
+
+func BackupFileName(t time.Time) string {
+	return BACKUP_FILE_PREFIX + t.Format(BACKUP_TIME_LAYOUT) + BACKUP_FILE_SUFFIX
+}
+
+// TattooStorage.PauseWrites blocks every write until ResumeWrites is called.
+// All writes go through a transaction, so this waits for the running one.
+func (s *TattooStorage) PauseWrites() {
+	s.txLock.Lock()
+}
+
+func (s *TattooStorage) ResumeWrites() {
+	s.txLock.Unlock()
+}
+
+// writeBackup writes a tar.gz archive of the storage directory, settings.json
+// and the active theme to w. The caller pauses the writes, so the archive is
+// a consistent snapshot.
+func writeBackup(w io.Writer) error {
+	// fold the journals into the index files
+	for _, store := range TattooDB.Stores() {
+		store.DB.Flush()
+	}
+	themeName := GetConfig().ThemeName
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	manifest := BackupManifest{
+		Version:     BACKUP_VERSION,
+		CreatedTime: time.Now().Unix(),
+		ThemeName:   themeName,
+		Files:       make(map[string]string),
+	}
+	roots := []string{"storage", CONFIG_NAME, path.Join("theme", themeName)}
+	for _, root := range roots {
+		err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || isTempFile(info.Name()) {
+				return nil
+			}
+			sum, err := addBackupFile(tw, filepath.ToSlash(name), name, info)
+			if err != nil {
+				return err
+			}
+			manifest.Files[filepath.ToSlash(name)] = sum
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	buff, err := json.MarshalIndent(&manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:     BACKUP_MANIFEST_NAME,
+		Mode:     0644,
+		Size:     int64(len(buff)),
+		ModTime:  time.Unix(manifest.CreatedTime, 0),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(buff); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func addBackupFile(tw *tar.Writer, name string, filename string, info os.FileInfo) (string, error) {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return "", err
+	}
+	header.Name = name
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if err := tw.WriteHeader(header); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, hash), file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// SnapshotBackup writes a backup to a new temporary file in dir, named by
+// pattern as ioutil.TempFile does, and returns it open. Writes are paused
+// only while the archive is written to the file, whoever reads it afterwards
+// doesn't hold them up. The caller closes and removes the file.
+func SnapshotBackup(dir string, pattern string) (*os.File, error) {
+	if GetConfig().StorageBackend == webapp.STORAGE_BACKEND_MEMORY {
+		return nil, errors.New(ERROR_BACKUP_MEMORY)
+	}
+	tmp, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	TattooDB.PauseWrites()
+	err = writeBackup(tmp)
+	TattooDB.ResumeWrites()
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// WriteBackupFile writes a backup to filename, the file only appears once
+// the archive is complete.
+func WriteBackupFile(filename string) error {
+	dir, base := filepath.Split(filename)
+	if len(dir) == 0 {
+		dir = "."
+	}
+	tmp, err := SnapshotBackup(dir, "."+base+webapp.TEMP_FILE_SUFFIX)
+	if err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// RestoreBackup extracts an archive to a staging directory and validates it
+// against its manifest and by loading every storage from it. Only then the
+// live storage, settings.json and theme are moved aside and replaced.
+func RestoreBackup(app *webapp.App, filename string) error {
+	suffix := ".before-restore-" + time.Now().Format(BACKUP_TIME_LAYOUT)
+	staging := ".restore-" + time.Now().Format(BACKUP_TIME_LAYOUT)
+	defer os.RemoveAll(staging)
+	app.Log("Restore", "Extract "+filename)
+	manifest, err := extractBackup(filename, staging)
+	if err != nil {
+		return fmt.Errorf("invalid backup '%s': %v", filename, err)
+	}
+	app.Log("Restore", "Validate storages")
+	// the archive may come from a blog with another backend
+	backend := GetConfig().StorageBackend
+	if buff, err := ioutil.ReadFile(path.Join(staging, CONFIG_NAME)); err == nil {
+		staged := new(Config)
+		if err := json.Unmarshal(buff, staged); err == nil {
+			backend = staged.StorageBackend
+		}
+	}
+	check := new(TattooStorage)
+	if err := check.Open(backend, staging); err != nil {
+		return fmt.Errorf("invalid backup '%s': %v", filename, err)
+	}
+	check.Close()
+	roots := []string{"storage", CONFIG_NAME}
+	if len(manifest.ThemeName) != 0 {
+		roots = append(roots, path.Join("theme", manifest.ThemeName))
+	}
+	for _, root := range roots {
+		if _, err := os.Stat(path.Join(staging, root)); err != nil {
+			continue
+		}
+		if _, err := os.Stat(root); err == nil {
+			app.Log("Restore", fmt.Sprintf("Move %s to %s", root, root+suffix))
+			if err := os.Rename(root, root+suffix); err != nil {
+				return err
+			}
+		}
+		os.MkdirAll(filepath.Dir(root), 0755)
+		if err := os.Rename(path.Join(staging, root), root); err != nil {
+			return err
+		}
+	}
+	app.Log("Restore", "Done, the replaced data is kept with suffix "+suffix)
+	return nil
+}
+
+// extractBackup extracts an archive to dir and checks its content against the manifest.
+func extractBackup(filename string, dir string) (*BackupManifest, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	sums := make(map[string]string)
+	var manifest *BackupManifest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := header.Name
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry '%s'", name)
+		}
+		if name == BACKUP_MANIFEST_NAME {
+			manifest = new(BackupManifest)
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("broken manifest: %v", err)
+			}
+			continue
+		}
+		if !isBackupPath(name) {
+			return nil, fmt.Errorf("unexpected entry '%s'", name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(target), 0755)
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, hash), tr)
+		out.Close()
+		if err != nil {
+			return nil, err
+		}
+		sums[name] = fmt.Sprintf("%x", hash.Sum(nil))
+	}
+	if manifest == nil {
+		return nil, errors.New("no manifest")
+	}
+	if manifest.Version > BACKUP_VERSION {
+		return nil, fmt.Errorf("unsupported version %d", manifest.Version)
+	}
+	if len(manifest.ThemeName) != 0 && !isBackupPath(path.Join("theme", manifest.ThemeName, "x")) {
+		return nil, fmt.Errorf("unexpected theme '%s'", manifest.ThemeName)
+	}
+	for name, sum := range manifest.Files {
+		if sums[name] != sum {
+			return nil, fmt.Errorf("checksum mismatch of '%s'", name)
+		}
+	}
+	for name := range sums {
+		if _, ok := manifest.Files[name]; !ok {
+			return nil, fmt.Errorf("'%s' isn't listed in the manifest", name)
+		}
+	}
+	if _, ok := sums[CONFIG_NAME]; !ok {
+		return nil, fmt.Errorf("no %s", CONFIG_NAME)
+	}
+	return manifest, nil
+}
+
+// isBackupPath checks that an archive entry stays inside one of the backup roots.
+func isBackupPath(name string) bool {
+	if path.IsAbs(name) || path.Clean(name) != name || strings.HasPrefix(name, "../") || name == ".." {
+		return false
+	}
+	if name == CONFIG_NAME {
+		return true
+	}
+	levels := strings.Split(name, "/")
+	if levels[0] == "storage" && len(levels) >= 2 {
+		return true
+	}
+	return levels[0] == "theme" && len(levels) >= 3
+}
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, webapp.TEMP_FILE_SUFFIX)
+}
+
+// StartBackupScheduler writes a backup to Config.BackupDir every
+// Config.BackupInterval minutes and keeps the last Config.BackupKeep ones.
+func StartBackupScheduler(app *webapp.App) {
+	cfg := GetConfig()
+	if cfg.BackupInterval <= 0 {
+		return
+	}
+	interval := time.Duration(cfg.BackupInterval) * time.Minute
+	app.Log("Backup", fmt.Sprintf("Scheduled every %v to %s, keep %d", interval, cfg.BackupDir, cfg.BackupKeep))
+	go func() {
+		for {
+			time.Sleep(interval)
+			cfg := GetConfig()
+			os.MkdirAll(cfg.BackupDir, 0755)
+			filename := path.Join(cfg.BackupDir, BackupFileName(time.Now()))
+			if err := WriteBackupFile(filename); err != nil {
+				app.Log("Backup", fmt.Sprintf("Failed: %v", err))
+				continue
+			}
+			app.Log("Backup", "Written to "+filename)
+			PruneBackups(cfg.BackupDir, cfg.BackupKeep)
+		}
+	}()
+}
+
+// PruneBackups removes all but the newest keep backups in dir.
+func PruneBackups(dir string, keep int) {
+	if keep <= 0 {
+		return
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	names := make([]string, 0)
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, BACKUP_FILE_PREFIX) && strings.HasSuffix(name, BACKUP_FILE_SUFFIX) {
+			names = append(names, name)
+		}
+	}
+	// the timestamp in names sorts chronologically
+	sort.Strings(names)
+	for len(names) > keep {
+		os.Remove(path.Join(dir, names[0]))
+		names = names[1:]
+	}
+}
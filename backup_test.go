@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotBackup(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	dir := t.TempDir()
+	os.Chdir(dir)
+	ioutil.WriteFile(CONFIG_NAME, []byte("{}"), 0644)
+	themeDir := path.Join("theme", GetConfig().ThemeName, "template")
+	os.MkdirAll(themeDir, 0755)
+	ioutil.WriteFile(path.Join(themeDir, "bare.html"), []byte("bare"), 0644)
+
+	db := TattooDB
+	defer func() { TattooDB = db }()
+	TattooDB = new(TattooStorage)
+	if err := TattooDB.Open(GetConfig().StorageBackend, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer TattooDB.Close()
+	TattooDB.ArticleDB.SetString("before", "in the backup")
+
+	tmp, err := SnapshotBackup(dir, "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// the snapshot is taken, writes go on while it's still being read
+	paused := make(chan struct{})
+	go func() {
+		TattooDB.PauseWrites()
+		TattooDB.ArticleDB.SetString("after", "not in the backup")
+		TattooDB.ResumeWrites()
+		close(paused)
+	}()
+	select {
+	case <-paused:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes still paused after the snapshot")
+	}
+
+	staging := filepath.Join(dir, "staging")
+	manifest, err := extractBackup(tmp.Name(), staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manifest.Files[CONFIG_NAME]; !ok {
+		t.Errorf("%s not in the backup", CONFIG_NAME)
+	}
+	restored := new(TattooStorage)
+	if err := restored.Open(GetConfig().StorageBackend, staging); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if value, err := restored.ArticleDB.GetString("before"); err != nil || value != "in the backup" {
+		t.Errorf("Get(before) = %q, %v", value, err)
+	}
+	if restored.ArticleDB.Has("after") {
+		t.Error("a write made after the snapshot is in the backup")
+	}
+}
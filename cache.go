@@ -0,0 +1,161 @@
+package main
+
+import (
+	"github.com/shellex/tattoo/webapp"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+type CacheStat struct {
+	Name   string
+	Hits   int64
+	Misses int64
+	Size   int
+}
+
+// Cache keeps decoded values read from a storage. A reader takes the
+// generation before reading the storage and passes it to Put, so a value read
+// before an invalidation is never cached after it.
+type Cache struct {
+	Name       string
+	lock       sync.RWMutex
+	items      map[string]interface{}
+	generation uint64
+	hits       int64
+	misses     int64
+}
+
+func NewCache(name string) *Cache {
+	return &Cache{Name: name, items: make(map[string]interface{})}
+}
+
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.lock.RLock()
+	value, ok := c.items[key]
+	c.lock.RUnlock()
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+	return value, ok
+}
+
+func (c *Cache) Generation() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.generation
+}
+
+// Cache.Put stores a value read at generation gen, it's dropped if the cache
+// has been invalidated since.
+func (c *Cache) Put(key string, value interface{}, gen uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if gen == c.generation {
+		c.items[key] = value
+	}
+}
+
+func (c *Cache) Invalidate(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.items, key)
+	c.generation++
+}
+
+func (c *Cache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.items = make(map[string]interface{})
+	c.generation++
+}
+
+func (c *Cache) Stat() CacheStat {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return CacheStat{
+		Name:   c.Name,
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+		Size:   len(c.items),
+	}
+}
+
+// TattooCache holds the caches of TattooStorage. Every cache belongs to one
+// storage and is invalidated when a transaction writes to it.
+type TattooCache struct {
+	Metadata        *Cache
+	CommentMetadata *Cache
+	HTML            *Cache
+	CommentHTML     *Cache
+	// a single entry with the sorted tag list
+	Tags *Cache
+}
+
+const CACHE_KEY_TAGS = "*"
+
+func NewTattooCache() *TattooCache {
+	return &TattooCache{
+		Metadata:        NewCache("Article Metadata"),
+		CommentMetadata: NewCache("Comment Metadata"),
+		HTML:            NewCache("Article HTML"),
+		CommentHTML:     NewCache("Comment HTML"),
+		Tags:            NewCache("Tags"),
+	}
+}
+
+func (tc *TattooCache) All() []*Cache {
+	return []*Cache{tc.Metadata, tc.CommentMetadata, tc.HTML, tc.CommentHTML, tc.Tags}
+}
+
+func (tc *TattooCache) Purge() {
+	for _, c := range tc.All() {
+		c.Purge()
+	}
+}
+
+// TattooStorage.invalidate drops what's cached for a key written by a
+// transaction, and reloads a written timeline.
+func (s *TattooStorage) invalidate(fs *webapp.Store, key string) {
+	switch fs {
+	case &s.MetadataDB:
+		s.cache.Metadata.Invalidate(key)
+	case &s.CommentMetadataDB:
+		s.cache.CommentMetadata.Invalidate(key)
+	case &s.ArticleHTMLDB:
+		s.cache.HTML.Invalidate(key)
+	case &s.CommentHTMLDB:
+		s.cache.CommentHTML.Invalidate(key)
+	case &s.TagIndexDB:
+		s.cache.Tags.Purge()
+	case &s.TimelineDB:
+		if err := s.loadTimeline(key); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+}
+
+// TattooStorage.CacheStats returns the counters of every cache.
+func (s *TattooStorage) CacheStats() []CacheStat {
+	stats := make([]CacheStat, 0)
+	for _, c := range s.cache.All() {
+		stats = append(stats, c.Stat())
+	}
+	return stats
+}
+
+// getCachedBytes reads a value through a cache of raw values.
+func getCachedBytes(c *Cache, fs *webapp.Store, key string) ([]byte, error) {
+	if value, ok := c.Get(key); ok {
+		return value.([]byte), nil
+	}
+	gen := c.Generation()
+	value, err := fs.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	c.Put(key, value, gen)
+	return value, nil
+}
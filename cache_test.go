@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestDB replaces TattooDB with one of memory storages until the test
+// ends.
+func openTestDB(t testing.TB) *TattooStorage {
+	db := TattooDB
+	t.Cleanup(func() { TattooDB = db })
+	TattooDB = new(TattooStorage)
+	TattooDB.cache = NewTattooCache()
+	if err := TattooDB.Open(webapp.STORAGE_BACKEND_MEMORY, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { TattooDB.Close() })
+	if err := TattooDB.LoadTimelines(&webapp.App{}); err != nil {
+		t.Fatal(err)
+	}
+	return TattooDB
+}
+
+func newTestArticle(name string, text string, tags ...string) *Article {
+	now := time.Now().Unix()
+	return &Article{
+		Metadata: ArticleMetadata{
+			Version:      ARTICLE_METADATA_VERSION,
+			Name:         name,
+			Title:        "Title of " + name,
+			Status:       ARTICLE_STATUS_PUBLISHED,
+			Tags:         tags,
+			CreatedTime:  now,
+			ModifiedTime: now,
+		},
+		Text: template.HTML(text),
+	}
+}
+
+func newTestComment(article string, uuid string, text string) *Comment {
+	return &Comment{
+		Metadata: CommentMetadata{
+			Version:     COMMENT_METADATA_VERSION,
+			Name:        uuid,
+			Author:      "reader",
+			ArticleName: article,
+			CreatedTime: time.Now().Unix(),
+		},
+		Text: template.HTML(text),
+	}
+}
+
+// cacheHits returns the hits of a cache, to tell a value came from it.
+func cacheHits(c *Cache) int64 {
+	return c.Stat().Hits
+}
+
+// tagCounts returns the tags of TattooDB with their counts, by name.
+func tagCounts() string {
+	counts := make([]string, 0)
+	for _, tag := range TattooDB.GetTags() {
+		counts = append(counts, fmt.Sprintf("%s:%d", tag.Name, tag.Count))
+	}
+	sort.Strings(counts)
+	return strings.Join(counts, " ")
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.SaveArticle(newTestArticle("a", "first text", "go"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddComment(newTestComment("a", "c1", "first comment")); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		cache  *Cache
+		read   func() string
+		mutate func() error
+		want   string
+	}{
+		{
+			name:   "metadata by SaveArticle",
+			cache:  db.cache.Metadata,
+			read:   func() string { meta, _ := db.GetMeta("a"); return meta.Title },
+			mutate: func() error { return db.SaveArticle(newTestArticle("a", "first text", "go"), "a") },
+			want:   "Title of a",
+		},
+		{
+			name:  "metadata by UpdateMetadata",
+			cache: db.cache.Metadata,
+			read:  func() string { meta, _ := db.GetMeta("a"); return meta.Title },
+			mutate: func() error {
+				meta, _ := db.GetMeta("a")
+				meta.Title = "renamed"
+				return db.UpdateMetadata(meta)
+			},
+			want: "renamed",
+		},
+		{
+			name:   "metadata by AddHits",
+			cache:  db.cache.Metadata,
+			read:   func() string { meta, _ := db.GetMeta("a"); return fmt.Sprint(meta.Hits) },
+			mutate: func() error { return db.AddHits(map[string]int64{"a": 3}) },
+			want:   "3",
+		},
+		{
+			name:   "HTML by SaveArticle",
+			cache:  db.cache.HTML,
+			read:   func() string { html, _ := db.GetArticle("a"); return string(html) },
+			mutate: func() error { return db.SaveArticle(newTestArticle("a", "second text", "go"), "a") },
+			want:   "<p>second text</p>\n",
+		},
+		{
+			name:  "HTML by Rerender",
+			cache: db.cache.HTML,
+			read:  func() string { html, _ := db.GetArticle("a"); return string(html) },
+			mutate: func() error {
+				db.ArticleDB.Set("a", []byte("changed source"))
+				jobs, err := db.StaleHTML(true)
+				if err == nil {
+					_, err = db.Rerender(jobs, 1, func(int, int) {})
+				}
+				return err
+			},
+			want: "<p>changed source</p>\n",
+		},
+		{
+			name:   "comment metadata by UpdateCommentMetadata",
+			cache:  db.cache.CommentMetadata,
+			read:   func() string { meta, _ := db.GetCommentMetadata("c1"); return meta.Author },
+			mutate: func() error { return db.UpdateCommentMetadata(&newTestComment("a", "c1", "").Metadata) },
+			want:   "reader",
+		},
+		{
+			name:  "comment metadata by RenameComments",
+			cache: db.cache.CommentMetadata,
+			read:  func() string { meta, _ := db.GetCommentMetadata("c1"); return meta.ArticleName },
+			mutate: func() error {
+				return db.SaveArticle(newTestArticle("b", "second text", "go"), "a")
+			},
+			want: "b",
+		},
+		{
+			name:   "comment HTML by UpdateComment",
+			cache:  db.cache.CommentHTML,
+			read:   func() string { html, _ := db.GetComment("c1"); return string(html) },
+			mutate: func() error { return db.UpdateComment("c1", []byte("edited comment")) },
+			want:   "<p>edited comment</p>\n",
+		},
+		{
+			name:  "tags by SaveArticle",
+			cache: db.cache.Tags,
+			read:  tagCounts,
+			mutate: func() error {
+				return db.SaveArticle(newTestArticle("c", "text", "go", "rust"), "")
+			},
+			want: "go:2 rust:1",
+		},
+		{
+			name:   "tags by RenameTag",
+			cache:  db.cache.Tags,
+			read:   tagCounts,
+			mutate: func() error { return db.RenameTag("rust", "zig") },
+			want:   "go:2 zig:1",
+		},
+		{
+			name:   "tags by AddTag",
+			cache:  db.cache.Tags,
+			read:   tagCounts,
+			mutate: func() error { return db.AddTag("new") },
+			want:   "go:2 new:0 zig:1",
+		},
+		{
+			name:   "comment HTML by DeleteComment",
+			cache:  db.cache.CommentHTML,
+			read:   func() string { html, _ := db.GetComment("c1"); return string(html) },
+			mutate: func() error { return db.DeleteComment("c1") },
+			want:   "",
+		},
+		{
+			name:   "metadata by TrashArticle",
+			cache:  db.cache.Metadata,
+			read:   func() string { _, err := db.GetMeta("c"); return fmt.Sprint(err == nil) },
+			mutate: func() error { return db.TrashArticle("c") },
+			want:   "false",
+		},
+		{
+			name:   "tags by TrashArticle",
+			cache:  db.cache.Tags,
+			read:   tagCounts,
+			mutate: func() error { return db.TrashArticle("b") },
+			want:   "go:0 new:0 zig:0",
+		},
+	}
+	for _, c := range cases {
+		// read twice, the second read is served by the cache
+		c.read()
+		hits := cacheHits(c.cache)
+		before := c.read()
+		if cacheHits(c.cache) == hits {
+			t.Errorf("%s: read isn't cached", c.name)
+		}
+		if err := c.mutate(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := c.read(); got != c.want {
+			t.Errorf("%s: read %q after the mutation, %q before, want %q", c.name, got, before, c.want)
+		}
+	}
+}
+
+// storeGets returns the Gets made on all storages.
+func storeGets(db *TattooStorage) int64 {
+	var gets int64
+	for _, store := range db.Stores() {
+		gets += store.DB.Stat.GetCount
+	}
+	return gets
+}
+
+// BenchmarkRenderPage renders the home page and an article page with a warm
+// cache and with the cache emptied before every page, and reports the storage
+// Gets per page.
+func BenchmarkRenderPage(b *testing.B) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir("srv")
+	if err := LoadThemeTemplates(GetConfig().ThemeName); err != nil {
+		b.Fatal(err)
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	db := openTestDB(b)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("article-%d", i)
+		text := strings.Repeat(fmt.Sprintf("Paragraph of %s with *some* `code`.\n\n", name), 20)
+		if err := db.SaveArticle(newTestArticle(name, text, "go", fmt.Sprintf("tag-%d", i%5)), ""); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 5; j++ {
+			db.AddComment(newTestComment(name, fmt.Sprintf("%s-comment-%d", name, j), "A comment."))
+		}
+	}
+	app := &webapp.App{}
+	pages := map[string]func(ctx *webapp.Context) error{
+		"home": func(ctx *webapp.Context) error {
+			// as HandleRoot does
+			if HasTemplate("HOME") {
+				return RenderHome(ctx)
+			}
+			return RenderArticles(ctx, 0)
+		},
+		"single": func(ctx *webapp.Context) error {
+			return RenderSinglePage(ctx, "article-3", new(CommentMetadata))
+		},
+	}
+	for name, render := range pages {
+		for _, cached := range []bool{true, false} {
+			label := name + "/cold"
+			if cached {
+				label = name + "/cached"
+			}
+			b.Run(label, func(b *testing.B) {
+				gets := storeGets(db)
+				for i := 0; i < b.N; i++ {
+					if !cached {
+						db.cache.Purge()
+					}
+					ctx := &webapp.Context{
+						Writer:      httptest.NewRecorder(),
+						Request:     httptest.NewRequest("GET", "/", nil),
+						Application: app,
+					}
+					if err := render(ctx); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(storeGets(db)-gets)/float64(b.N), "gets/page")
+			})
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"strconv"
+	"time"
+)
+
+// Operations and kinds of items in the change log.
+const (
+	CHANGE_CREATE = "create"
+	CHANGE_UPDATE = "update"
+	CHANGE_DELETE = "delete"
+	CHANGE_RENAME = "rename"
+
+	CHANGE_KIND_ARTICLE = "article"
+	CHANGE_KIND_PAGE    = "page"
+	CHANGE_KIND_COMMENT = "comment"
+	CHANGE_KIND_TAG     = "tag"
+)
+
+// key of the last sequence number in Change DB, changes are keyed by their
+// zero-padded sequence number
+const CHANGE_SEQ_KEY = "seq"
+
+// key of the sequence number of the oldest change kept in Change DB, the log
+// starts at 1 without it
+const CHANGE_FIRST_KEY = "first"
+
+// changes returned by one GetChanges at most
+const CHANGE_PAGE_SIZE = 500
+
+const (
+	CHANGE_TRIM_INTERVAL  = time.Hour
+	ERROR_CHANGES_TRIMMED = "Changes trimmed from the log"
+)
+
+var errChangesTrimmed = errors.New(ERROR_CHANGES_TRIMMED)
+
+// Change is an entry of the change log. The log follows the public site:
+// drafts aren't in it, publishing an article creates it and unpublishing
+// deletes it. Seq numbers start at 1 and grow by one with each change.
+type Change struct {
+	Seq     int64
+	Time    int64
+	Op      string
+	Kind    string
+	Name    string
+	OldName string `json:",omitempty"`
+	// the article of a comment
+	Article string `json:",omitempty"`
+}
+
+func changeKey(seq int64) string {
+	return fmt.Sprintf("%016d", seq)
+}
+
+func isArticleKind(kind string) bool {
+	return kind == CHANGE_KIND_ARTICLE || kind == CHANGE_KIND_PAGE
+}
+
+// TattooStorage.logChange notes a change made by the running transaction,
+// the caller holds it. A change of an item already changed by the
+// transaction is merged with the earlier one, so e.g. creating and then
+// updating an article logs a single create.
+func (s *TattooStorage) logChange(change *Change) {
+	for i := len(s.changes) - 1; i >= 0; i-- {
+		prev := s.changes[i]
+		if prev.Name == change.Name && (prev.Kind == change.Kind || isArticleKind(prev.Kind) && isArticleKind(change.Kind)) {
+			if s.mergeChange(i, change) {
+				return
+			}
+			break
+		}
+	}
+	s.changes = append(s.changes, change)
+}
+
+// TattooStorage.mergeChange merges a change into the i-th noted one of the
+// same item, if the two add up to one.
+func (s *TattooStorage) mergeChange(i int, change *Change) bool {
+	prev := s.changes[i]
+	switch {
+	case change.Op == CHANGE_UPDATE && prev.Op != CHANGE_DELETE:
+		prev.Kind, prev.Article = change.Kind, change.Article
+	case change.Op == CHANGE_DELETE && prev.Op == CHANGE_CREATE:
+		s.changes = append(s.changes[:i], s.changes[i+1:]...)
+	case change.Op == CHANGE_DELETE && prev.Op == CHANGE_RENAME:
+		prev.Op, prev.Kind, prev.Name, prev.OldName = CHANGE_DELETE, change.Kind, prev.OldName, ""
+	case change.Op == CHANGE_DELETE && prev.Op == CHANGE_UPDATE:
+		prev.Op, prev.Kind = CHANGE_DELETE, change.Kind
+	case change.Op == CHANGE_CREATE && prev.Op == CHANGE_DELETE:
+		prev.Op, prev.Kind, prev.Article = CHANGE_UPDATE, change.Kind, change.Article
+	default:
+		return false
+	}
+	return true
+}
+
+// TattooStorage.logArticle notes how an edit of an article changed the public
+// site. old is the metadata before the edit under oldName, meta the one after,
+// either can be nil.
+func (s *TattooStorage) logArticle(oldName string, old *ArticleMetadata, meta *ArticleMetadata) {
+	wasPublic := old != nil && old.IsPublished()
+	isPublic := meta != nil && meta.IsPublished()
+	kindOf := func(meta *ArticleMetadata) string {
+		if meta.IsPage {
+			return CHANGE_KIND_PAGE
+		}
+		return CHANGE_KIND_ARTICLE
+	}
+	switch {
+	case wasPublic && isPublic && oldName != meta.Name:
+		s.logChange(&Change{Op: CHANGE_RENAME, Kind: kindOf(meta), Name: meta.Name, OldName: oldName})
+	case wasPublic && isPublic:
+		s.logChange(&Change{Op: CHANGE_UPDATE, Kind: kindOf(meta), Name: meta.Name})
+	case isPublic:
+		s.logChange(&Change{Op: CHANGE_CREATE, Kind: kindOf(meta), Name: meta.Name})
+	case wasPublic:
+		s.logChange(&Change{Op: CHANGE_DELETE, Kind: kindOf(old), Name: oldName})
+	}
+}
+
+func (s *TattooStorage) logComment(op string, meta *CommentMetadata) {
+	s.logChange(&Change{Op: op, Kind: CHANGE_KIND_COMMENT, Name: meta.Name, Article: meta.ArticleName})
+}
+
+func (s *TattooStorage) logTag(op string, name string) {
+	s.logChange(&Change{Op: op, Kind: CHANGE_KIND_TAG, Name: name})
+}
+
+// TattooStorage.writeChanges numbers the changes noted by a transaction and
+// stages them in Change DB, it runs right before the transaction commits.
+func (s *TattooStorage) writeChanges(tx *webapp.Transaction) error {
+	changes := make([]*Change, 0, len(s.changes))
+	for _, change := range s.changes {
+		// an edit of an article detaches it from its tags and attaches it
+		// again, which leaves them as they were
+		if change.Kind == CHANGE_KIND_TAG && change.Op == CHANGE_UPDATE && !s.tagChanged(tx, change.Name) {
+			continue
+		}
+		changes = append(changes, change)
+	}
+	s.changes = nil
+	if len(changes) == 0 {
+		return nil
+	}
+	seq := int64(0)
+	if tx.Has(&s.ChangeDB, CHANGE_SEQ_KEY) {
+		var err error
+		if seq, err = parseChangeSeq(tx.Get(&s.ChangeDB, CHANGE_SEQ_KEY)); err != nil {
+			return err
+		}
+	}
+	now := time.Now().Unix()
+	for _, change := range changes {
+		seq += 1
+		change.Seq = seq
+		change.Time = now
+		if err := tx.SetJSON(&s.ChangeDB, changeKey(seq), change); err != nil {
+			return err
+		}
+	}
+	// the sequence number goes last, readers never see it ahead of the changes
+	tx.SetString(&s.ChangeDB, CHANGE_SEQ_KEY, strconv.FormatInt(seq, 10))
+	return nil
+}
+
+// TattooStorage.tagChanged tells whether tx changes the articles of a tag,
+// their order aside.
+func (s *TattooStorage) tagChanged(tx *webapp.Transaction, name string) bool {
+	before := make(map[string]bool)
+	if s.TagIndexDB.Has(name) {
+		buff, err := s.TagIndexDB.Get(name)
+		if err != nil {
+			return true
+		}
+		var names []string
+		if err := json.Unmarshal(buff, &names); err != nil {
+			return true
+		}
+		for _, n := range names {
+			before[n] = true
+		}
+	}
+	after, err := getNameList(tx, &s.TagIndexDB, name)
+	if err != nil {
+		return true
+	}
+	seen := make(map[string]bool)
+	for _, n := range after {
+		if !before[n] {
+			return true
+		}
+		seen[n] = true
+	}
+	return len(seen) != len(before)
+}
+
+func parseChangeSeq(buff []byte, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.ParseInt(string(buff), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("change log sequence '%s': %v", buff, err)
+	}
+	return seq, nil
+}
+
+// TattooStorage.LastChange returns the sequence number of the last change
+// logged, 0 if there is none.
+func (s *TattooStorage) LastChange() (int64, error) {
+	if !s.ChangeDB.Has(CHANGE_SEQ_KEY) {
+		return 0, nil
+	}
+	return parseChangeSeq(s.ChangeDB.Get(CHANGE_SEQ_KEY))
+}
+
+// TattooStorage.FirstChange returns the sequence number of the oldest change
+// kept, the ones before it have been trimmed by TrimChanges.
+func (s *TattooStorage) FirstChange() (int64, error) {
+	if !s.ChangeDB.Has(CHANGE_FIRST_KEY) {
+		return 1, nil
+	}
+	return parseChangeSeq(s.ChangeDB.Get(CHANGE_FIRST_KEY))
+}
+
+// TattooStorage.GetChanges returns up to limit changes after since, in order,
+// and the sequence number of the last change logged. It returns
+// errChangesTrimmed if some of the changes after since have been trimmed.
+func (s *TattooStorage) GetChanges(since int64, limit int) ([]*Change, int64, error) {
+	last, err := s.LastChange()
+	if err != nil {
+		return nil, 0, err
+	}
+	first, err := s.FirstChange()
+	if err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 || limit > CHANGE_PAGE_SIZE {
+		limit = CHANGE_PAGE_SIZE
+	}
+	if since < 0 {
+		since = 0
+	}
+	if since < last && since+1 < first {
+		return nil, last, errChangesTrimmed
+	}
+	changes := make([]*Change, 0)
+	for seq := since + 1; seq <= last && len(changes) < limit; seq++ {
+		buff, err := s.ChangeDB.Get(changeKey(seq))
+		if err != nil {
+			return nil, 0, fmt.Errorf("change %d: %v", seq, err)
+		}
+		change := new(Change)
+		if err := json.Unmarshal(buff, change); err != nil {
+			return nil, 0, fmt.Errorf("change %d: %v", seq, err)
+		}
+		changes = append(changes, change)
+	}
+	return changes, last, nil
+}
+
+// TattooStorage.TrimChanges deletes the changes logged before the unix time
+// before, oldest first, and returns how many it deleted. The last change is
+// always kept, it holds the sequence number the log goes on from.
+func (s *TattooStorage) TrimChanges(before int64) (int, error) {
+	tx := s.Begin()
+	defer tx.Rollback()
+	first := int64(1)
+	if tx.Has(&s.ChangeDB, CHANGE_FIRST_KEY) {
+		var err error
+		if first, err = parseChangeSeq(tx.Get(&s.ChangeDB, CHANGE_FIRST_KEY)); err != nil {
+			return 0, err
+		}
+	}
+	last := int64(0)
+	if tx.Has(&s.ChangeDB, CHANGE_SEQ_KEY) {
+		var err error
+		if last, err = parseChangeSeq(tx.Get(&s.ChangeDB, CHANGE_SEQ_KEY)); err != nil {
+			return 0, err
+		}
+	}
+	seq := first
+	for ; seq < last; seq++ {
+		change := new(Change)
+		buff, err := tx.Get(&s.ChangeDB, changeKey(seq))
+		if err == nil {
+			err = json.Unmarshal(buff, change)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("change %d: %v", seq, err)
+		}
+		if change.Time >= before {
+			break
+		}
+		tx.Delete(&s.ChangeDB, changeKey(seq))
+	}
+	if seq == first {
+		return 0, nil
+	}
+	tx.SetString(&s.ChangeDB, CHANGE_FIRST_KEY, strconv.FormatInt(seq, 10))
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(seq - first), nil
+}
+
+// StartChangeScheduler trims the changes logged more than
+// Config.ChangeRetention days ago, checking every CHANGE_TRIM_INTERVAL.
+func StartChangeScheduler(app *webapp.App) {
+	trim := func() {
+		days := GetConfig().ChangeRetention
+		if days <= 0 {
+			return
+		}
+		before := time.Now().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+		count, err := TattooDB.TrimChanges(before)
+		if err != nil {
+			app.Log("Changes", fmt.Sprintf("Trim failed: %v", err))
+		} else if count != 0 {
+			app.Log("Changes", fmt.Sprintf("Trimmed %d change(s)", count))
+		}
+	}
+	trim()
+	go func() {
+		for range time.Tick(CHANGE_TRIM_INTERVAL) {
+			trim()
+		}
+	}()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/shellex/tattoo/webapp"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestTrimChanges checks the changes older than the retention are trimmed,
+// the last one always kept, and reading past the trimmed ones is refused.
+func TestTrimChanges(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	db := openTestDB(t)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := db.SaveArticle(newTestArticle(name, "text of "+name), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last, _ := db.LastChange()
+	if last != 4 {
+		t.Fatalf("%d changes logged", last)
+	}
+	// the first two changes logged an hour apart from the others
+	for seq := int64(1); seq <= last; seq++ {
+		buff, _ := db.ChangeDB.Get(changeKey(seq))
+		change := new(Change)
+		json.Unmarshal(buff, change)
+		change.Time = seq * 3600
+		db.ChangeDB.SetJSON(changeKey(seq), change)
+	}
+
+	if count, err := db.TrimChanges(3 * 3600); err != nil || count != 2 {
+		t.Fatalf("TrimChanges = %d, %v", count, err)
+	}
+	if first, _ := db.FirstChange(); first != 3 || db.ChangeDB.Has(changeKey(2)) || !db.ChangeDB.Has(changeKey(3)) {
+		t.Fatalf("log starts at %d after trimming two changes", first)
+	}
+	if count, err := db.TrimChanges(3 * 3600); err != nil || count != 0 {
+		t.Fatalf("TrimChanges again = %d, %v", count, err)
+	}
+	for _, since := range []int64{0, 1} {
+		if _, _, err := db.GetChanges(since, 0); err != errChangesTrimmed {
+			t.Errorf("GetChanges(%d) = %v, want the changes trimmed", since, err)
+		}
+	}
+	if changes, got, err := db.GetChanges(2, 0); err != nil || len(changes) != 2 || changes[0].Seq != 3 || got != last {
+		t.Errorf("GetChanges(2) = %v, %d, %v", changes, got, err)
+	}
+
+	// the last change holds the sequence number
+	if count, err := db.TrimChanges(100 * 3600); err != nil || count != 1 {
+		t.Fatalf("TrimChanges of all = %d, %v", count, err)
+	}
+	if changes, got, err := db.GetChanges(last, 0); err != nil || len(changes) != 0 || got != last {
+		t.Errorf("GetChanges(%d) of a trimmed log = %v, %d, %v", last, changes, got, err)
+	}
+	if err := db.SaveArticle(newTestArticle("e", "text of e"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if changes, _, err := db.GetChanges(last, 0); err != nil || len(changes) != 1 || changes[0].Seq != last+1 {
+		t.Errorf("change logged after trimming = %v, %v", changes, err)
+	}
+
+	for since, code := range map[string]int{"0": http.StatusGone, "4": http.StatusOK} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/changes?since="+since, nil)
+		HandleChanges(&webapp.Context{Writer: w, Request: req, Application: &webapp.App{}})
+		if w.Code != code {
+			t.Errorf("changes since %s = %d: %s", since, w.Code, w.Body.String())
+		}
+	}
+}
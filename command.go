@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"os"
+	"sort"
+)
+
+// Command is a maintenance task run as `tattoo <name> [args]` instead of
+// starting the server.
+type Command struct {
+	Name  string
+	Usage string
+	Help  string
+	Run   func(app *webapp.App, args []string) error
+	// added to the error when the storages are locked by the server
+	Locked string
+}
+
+var commands = make(map[string]*Command)
+
+// RegisterCommand makes a command available on the command line, it's called
+// from init() of the file implementing the command.
+func RegisterCommand(cmd *Command) {
+	commands[cmd.Name] = cmd
+}
+
+func HasCommand(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+// RunCommand runs the command named by args[0] with the remaining arguments,
+// holding the storage lock. Every command works on the storages, and loading
+// them cleans up the temporary files and journals, so none of them may run
+// beside the server.
+func RunCommand(app *webapp.App, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command '%s'", args[0])
+	}
+	if err := LockStorage(); err != nil {
+		if len(cmd.Locked) != 0 {
+			return fmt.Errorf("%v, %s", err, cmd.Locked)
+		}
+		return err
+	}
+	defer UnlockStorage()
+	return cmd.Run(app, args[1:])
+}
+
+func PrintUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command [args]]\n\nFlags:\n", os.Args[0])
+	flag.PrintDefaults()
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", commands[name].Usage, commands[name].Help)
+	}
+}
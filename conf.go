@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/shellex/tattoo/webapp"
 	"io/ioutil"
 	"strconv"
 	"time"
@@ -10,6 +11,12 @@ import (
 
 const CONFIG_NAME = "settings.json"
 
+// what the entries of the Atom feed carry
+const (
+	FEED_CONTENT_FULL    = "full"
+	FEED_CONTENT_EXCERPT = "excerpt"
+)
+
 type Config struct {
 	// sys config
 	Port        int
@@ -23,6 +30,43 @@ type Config struct {
 	AuthorName    string
 	TimelineCount int
 	ThemeName     string
+	// FEED_CONTENT_FULL or FEED_CONTENT_EXCERPT
+	FeedContent string
+	// storage backend: "file", one file per record; "kv", a single file;
+	// "memory", nothing is saved
+	StorageBackend string
+	// when storages are flushed after a transaction: "immediate", before it
+	// returns; "batched", once writes pause for FlushDelay; "interval", every
+	// FlushInterval only. Dirty storages are flushed every FlushInterval and on
+	// shutdown in any mode.
+	FlushMode     string
+	FlushDelay    int // milliseconds
+	FlushInterval int // seconds
+	// backup config
+	BackupDir      string
+	BackupInterval int // minutes, 0 disables scheduled backups
+	BackupKeep     int
+	// days a deleted item stays in the trash, 0 keeps it forever
+	TrashRetention int
+	// days a change stays in the change log, 0 keeps it forever
+	ChangeRetention int
+	// hit counting: views of bots are ignored with HitFilterBots, a visitor is
+	// counted once per article per HitDedupeWindow minutes, 0 counts every
+	// view; counted views are saved every HitFlushInterval seconds
+	HitFilterBots    bool
+	HitDedupeWindow  int
+	HitFlushInterval int
+	// replication: with ReplicaPrimary set, the URL of another instance, this
+	// one is a read-only follower of it, polling it every ReplicaPollInterval
+	// seconds and comparing every storage every ReplicaResyncInterval seconds.
+	// Both share ReplicaToken, a primary serves no replica without it.
+	ReplicaPrimary        string
+	ReplicaToken          string
+	ReplicaPollInterval   int
+	ReplicaResyncInterval int
+	// Markdown extensions and HTML flags of articles and comments, see
+	// MarkdownConfig; changing them renders the stored HTML again
+	Markdown MarkdownConfig
 }
 
 var config *Config = nil
@@ -40,6 +84,22 @@ func init() {
 	config.AuthorName = "root"
 	config.TimelineCount = 3
 	config.ThemeName = "sealscript"
+	config.FeedContent = FEED_CONTENT_FULL
+	config.StorageBackend = webapp.STORAGE_BACKEND_FILE
+	config.FlushMode = webapp.FLUSH_MODE_BATCHED
+	config.FlushDelay = 500
+	config.FlushInterval = 120
+	config.BackupDir = "backup"
+	config.BackupInterval = 0
+	config.BackupKeep = 7
+	config.TrashRetention = 30
+	config.ChangeRetention = 30
+	config.HitFilterBots = true
+	config.HitDedupeWindow = 30
+	config.HitFlushInterval = 60
+	config.ReplicaPollInterval = 5
+	config.ReplicaResyncInterval = 300
+	config.Markdown = DefaultMarkdownConfig()
 	sessionToken = GenerateSessionToken()
 }
 
@@ -84,8 +144,13 @@ func (config *Config) Save() error {
 		fmt.Println("Marshal json failed:", err)
 		return err
 	}
-	ioutil.WriteFile(CONFIG_NAME, jsobj, 0644)
-	return nil
+	return webapp.WriteFileAtomic(CONFIG_NAME, jsobj, 0644)
+}
+
+// Config.FeedExcerpt tells if the Atom feed carries the excerpts of the
+// articles rather than their text.
+func (config *Config) FeedExcerpt() bool {
+	return config.FeedContent == FEED_CONTENT_EXCERPT
 }
 
 func (config *Config) Update(newcfg *Config) bool {
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var devMode = flag.Bool("dev", false, "Reload the templates when they change and show their errors in the browser")
+
+// how often the template directories are checked for changes, milliseconds
+const DEV_POLL_INTERVAL = 500
+
+// lines of the template shown around the line of an error
+const DEV_ERROR_CONTEXT = 5
+
+// html/template reports parse errors as "template: name:line: message"
+var templateErrorPattern = regexp.MustCompile(`template: ([^:\s]+):(\d+):`)
+
+// TemplateErrorLine is a line of the template shown by the error page.
+type TemplateErrorLine struct {
+	Number  int
+	Text    string
+	Current bool
+}
+
+// TemplateError is a template which failed to parse, with the lines around
+// the error if its file and line are known.
+type TemplateError struct {
+	File    string
+	Line    int
+	Message string
+	Lines   []TemplateErrorLine
+}
+
+func (e *TemplateError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// NewTemplateError finds the file and the line of an error parsing the
+// templates of dir.
+func NewTemplateError(err error, dir string) *TemplateError {
+	ret := &TemplateError{File: dir, Message: err.Error()}
+	match := templateErrorPattern.FindStringSubmatch(ret.Message)
+	if match == nil {
+		return ret
+	}
+	// the templates are named by their files, which are in dir or below
+	filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Name() == match[1] && ret.File == dir {
+			ret.File = filename
+		}
+		return nil
+	})
+	ret.Line, _ = strconv.Atoi(match[2])
+	buff, err := ioutil.ReadFile(ret.File)
+	if err != nil {
+		return ret
+	}
+	lines := strings.Split(string(buff), "\n")
+	for i := ret.Line - DEV_ERROR_CONTEXT; i <= ret.Line+DEV_ERROR_CONTEXT; i++ {
+		if i < 1 || i > len(lines) {
+			continue
+		}
+		ret.Lines = append(ret.Lines, TemplateErrorLine{i, lines[i-1], i == ret.Line})
+	}
+	return ret
+}
+
+// TemplateWatcher reloads the system and theme templates when a file of
+// their directories changes. Until a reload succeeds, every page is an error
+// page telling what's wrong.
+type TemplateWatcher struct {
+	app    *webapp.App
+	lock   sync.RWMutex
+	err    *TemplateError
+	stamps map[string]string
+}
+
+var DevWatcher *TemplateWatcher = nil
+
+// TemplateWatcher.Dirs returns the directories of the templates in use.
+func (w *TemplateWatcher) Dirs() []string {
+	return []string{"sys/template", path.Join("theme", GetConfig().ThemeName, "template")}
+}
+
+// TemplateWatcher.scan returns the modification time and size of every file
+// of the template directories.
+func (w *TemplateWatcher) scan() map[string]string {
+	stamps := make(map[string]string)
+	for _, dir := range w.Dirs() {
+		filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				stamps[filename] = fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+			}
+			return nil
+		})
+	}
+	return stamps
+}
+
+func (w *TemplateWatcher) changed(stamps map[string]string) bool {
+	if len(stamps) != len(w.stamps) {
+		return true
+	}
+	for filename, stamp := range stamps {
+		if w.stamps[filename] != stamp {
+			return true
+		}
+	}
+	return false
+}
+
+// TemplateWatcher.Reload parses the templates again, keeping the error if
+// they fail to. The templates in use are replaced only if all of them parse.
+func (w *TemplateWatcher) Reload() *TemplateError {
+	dirs := w.Dirs()
+	themeName := GetConfig().ThemeName
+	err := UpdateTemplates(func(set *TemplateSet) error {
+		if err := ParseSystemTemplates(set); err != nil {
+			return NewTemplateError(err, dirs[0])
+		}
+		if err := ParseThemeTemplates(set, themeName); err != nil {
+			return NewTemplateError(err, dirs[1])
+		}
+		return nil
+	})
+	var ret *TemplateError = nil
+	if err != nil {
+		ret = err.(*TemplateError)
+	} else {
+		SetThemeVars(themeName)
+	}
+	w.lock.Lock()
+	w.err = ret
+	w.lock.Unlock()
+	if ret != nil {
+		w.app.Log("Dev", fmt.Sprintf("Failed to reload templates: %v", ret))
+		return ret
+	}
+	w.app.Log("Dev", "Reloaded templates")
+	if Follower == nil {
+		// the shortcodes of the theme may have changed
+		CheckRenderer(w.app)
+	}
+	return nil
+}
+
+// TemplateWatcher.Error returns the error of the last reload, nil if it
+// succeeded.
+func (w *TemplateWatcher) Error() *TemplateError {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.err
+}
+
+// TemplateWatcher.Run reloads the templates whenever their files change.
+func (w *TemplateWatcher) Run() {
+	for {
+		time.Sleep(DEV_POLL_INTERVAL * time.Millisecond)
+		stamps := w.scan()
+		if !w.changed(stamps) {
+			continue
+		}
+		w.stamps = stamps
+		w.Reload()
+	}
+}
+
+// StartTemplateWatcher loads the templates and reloads them whenever they
+// change, in place of loading them once.
+func StartTemplateWatcher(app *webapp.App) {
+	DevWatcher = &TemplateWatcher{app: app}
+	DevWatcher.stamps = DevWatcher.scan()
+	DevWatcher.Reload()
+	app.Log("Dev", fmt.Sprintf("Watching %s", strings.Join(DevWatcher.Dirs(), ", ")))
+	go DevWatcher.Run()
+}
+
+var templateErrorTPL = template.Must(template.New("template_error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8"/>
+<title>Template Error</title>
+<style>
+body { font: 14px "Helvetica Neue", Helvetica, Arial, sans-serif; margin: 40px; color: #333; }
+h1 { color: #b94a48; font-size: 22px; }
+.file { font-family: Monaco, monospace; }
+.message { background: #f8eded; border-left: 4px #b94a48 solid; padding: 10px 15px; font-family: Monaco, monospace; white-space: pre-wrap; }
+table { border-collapse: collapse; font: 12px Monaco, monospace; margin-top: 20px; }
+td { padding: 1px 10px; white-space: pre; }
+td.number { color: gray; text-align: right; }
+tr.current { background: #fcf8e3; }
+</style>
+</head>
+<body>
+<h1>Template Error</h1>
+<p class="file">{{.File}}{{if .Line}}, line {{.Line}}{{end}}</p>
+<div class="message">{{.Message}}</div>
+{{with .Lines}}
+<table>
+{{range .}}<tr{{if .Current}} class="current"{{end}}><td class="number">{{.Number}}</td><td>{{.Text}}</td></tr>
+{{end}}
+</table>
+{{end}}
+<p>The page is shown again once the template is fixed and saved.</p>
+</body>
+</html>
+`))
+
+// RenderTemplateError writes the error page of a template error.
+func RenderTemplateError(c *webapp.Context, e *TemplateError) {
+	var buff bytes.Buffer
+	if err := templateErrorTPL.Execute(&buff, e); err != nil {
+		c.Error(e.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.Info.Message = e.Error()
+	c.Info.HttpCode = http.StatusInternalServerError
+	c.Application.ErrorLog(c)
+	c.Writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.WriteHeader(http.StatusInternalServerError)
+	c.Writer.Write(buff.Bytes())
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	DIFF_EQUAL  = "="
+	DIFF_INSERT = "+"
+	DIFF_DELETE = "-"
+)
+
+// DiffLine is one line of a line diff. OldNumber and NewNumber are the
+// 1-based line numbers in the old and new text, 0 if the line isn't there.
+type DiffLine struct {
+	Op        string
+	OldNumber int
+	NewNumber int
+	Text      string
+}
+
+func (l *DiffLine) IsInsert() bool {
+	return l.Op == DIFF_INSERT
+}
+
+func (l *DiffLine) IsDelete() bool {
+	return l.Op == DIFF_DELETE
+}
+
+func splitLines(text string) []string {
+	if len(text) == 0 {
+		return []string{}
+	}
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// lines changed at most between two texts for DiffLines to find the
+// shortest edit, more show as the whole changed block replaced
+const DIFF_MAX_EDITS = 1000
+
+// DiffLines compares two texts line by line, finding the shortest edit with
+// the O(ND) algorithm of Myers, D being the number of lines changed. The
+// common head and tail are matched first, so the usual small edit of a long
+// article stays cheap. Past DIFF_MAX_EDITS, the lines between the common head
+// and tail are shown deleted and inserted as a block, which bounds the time
+// and the memory taken by texts which have little in common.
+func DiffLines(oldText, newText string) []*DiffLine {
+	a, b := splitLines(oldText), splitLines(newText)
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		head++
+	}
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+	ret := make([]*DiffLine, 0, len(a)+len(b)-head-tail)
+	for k := 0; k < head; k++ {
+		ret = append(ret, &DiffLine{DIFF_EQUAL, k + 1, k + 1, a[k]})
+	}
+	midA, midB := a[head:len(a)-tail], b[head:len(b)-tail]
+	mid := diffMiddle(midA, midB, DIFF_MAX_EDITS)
+	if mid == nil {
+		mid = make([]*DiffLine, 0, len(midA)+len(midB))
+		for i, line := range midA {
+			mid = append(mid, &DiffLine{DIFF_DELETE, i + 1, 0, line})
+		}
+		for j, line := range midB {
+			mid = append(mid, &DiffLine{DIFF_INSERT, 0, j + 1, line})
+		}
+	}
+	for _, line := range mid {
+		if line.OldNumber != 0 {
+			line.OldNumber += head
+		}
+		if line.NewNumber != 0 {
+			line.NewNumber += head
+		}
+		ret = append(ret, line)
+	}
+	for k := tail; k > 0; k-- {
+		ret = append(ret, &DiffLine{DIFF_EQUAL, len(a) - k + 1, len(b) - k + 1, a[len(a)-k]})
+	}
+	return ret
+}
+
+// diffMiddle returns the shortest edit of a into b, or nil if it changes more
+// than maxEdits lines. Line numbers are counted from the start of a and b.
+//
+// v[k] is the furthest x reached on diagonal k = x - y, the lines a[:x] and
+// b[:y] being matched; each round d takes one more edit. The trace keeps the
+// diagonals -d-1..d+1 of v as each round starts, which is all the round reads
+// and all the walk back needs, so memory grows with d*d and not with the
+// length of the texts.
+func diffMiddle(a, b []string, maxEdits int) []*DiffLine {
+	n, m := len(a), len(b)
+	if maxEdits > n+m {
+		maxEdits = n + m
+	}
+	offset := maxEdits + 1
+	v := make([]int, 2*maxEdits+3)
+	trace := make([][]int, 0)
+	for d := 0; d <= maxEdits; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				// down from diagonal k+1, inserting b[y-1]
+				x = v[offset+k+1]
+			} else {
+				// right from diagonal k-1, deleting a[x-1]
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return diffBacktrack(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+// diffBacktrack walks the trace of diffMiddle back from the end of a and b.
+func diffBacktrack(a, b []string, trace [][]int) []*DiffLine {
+	reversed := make([]*DiffLine, 0, len(a)+len(b))
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		// the diagonals of round d, from -d-1
+		prev := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		prevX, prevY := 0, 0
+		if d > 0 {
+			prevK := k - 1
+			if k == -d || k != d && prev(k-1) < prev(k+1) {
+				prevK = k + 1
+			}
+			prevX = prev(prevK)
+			prevY = prevX - prevK
+		}
+		for x > prevX && y > prevY {
+			reversed = append(reversed, &DiffLine{DIFF_EQUAL, x, y, a[x-1]})
+			x--
+			y--
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			reversed = append(reversed, &DiffLine{DIFF_INSERT, 0, y, b[y-1]})
+		} else {
+			reversed = append(reversed, &DiffLine{DIFF_DELETE, x, 0, a[x-1]})
+		}
+		x, y = prevX, prevY
+	}
+	ret := make([]*DiffLine, len(reversed))
+	for i, line := range reversed {
+		ret[len(reversed)-1-i] = line
+	}
+	return ret
+}
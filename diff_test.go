@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// checkDiff checks a diff turns oldText into newText, with the line numbers
+// of both, and returns the number of lines it changes.
+func checkDiff(t *testing.T, oldText string, newText string, diff []*DiffLine) int {
+	t.Helper()
+	oldLines, newLines := make([]string, 0), make([]string, 0)
+	edits := 0
+	for _, line := range diff {
+		if !line.IsInsert() {
+			oldLines = append(oldLines, line.Text)
+			if line.OldNumber != len(oldLines) {
+				t.Fatalf("old line %d numbered %d", len(oldLines), line.OldNumber)
+			}
+		}
+		if !line.IsDelete() {
+			newLines = append(newLines, line.Text)
+			if line.NewNumber != len(newLines) {
+				t.Fatalf("new line %d numbered %d", len(newLines), line.NewNumber)
+			}
+		}
+		if line.Op != DIFF_EQUAL {
+			edits += 1
+		}
+	}
+	if got, want := strings.Join(oldLines, "\n"), strings.Join(splitLines(oldText), "\n"); got != want {
+		t.Fatalf("old text from the diff:\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := strings.Join(newLines, "\n"), strings.Join(splitLines(newText), "\n"); got != want {
+		t.Fatalf("new text from the diff:\n%s\nwant:\n%s", got, want)
+	}
+	return edits
+}
+
+// lcsLength is the length of the longest common subsequence of a and b, by
+// the full table, to check the diff is the shortest edit.
+func lcsLength(a []string, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs[0][0]
+}
+
+func TestDiffLines(t *testing.T) {
+	cases := []struct {
+		oldText string
+		newText string
+		want    string
+	}{
+		{"", "", ""},
+		{"", "a\nb\n", "+a +b"},
+		{"a\nb\n", "", "-a -b"},
+		{"a\nb\nc\n", "a\nb\nc\n", "=a =b =c"},
+		{"a\nb\nc\n", "a\nx\nc\n", "=a -b +x =c"},
+		{"a\r\nb\r\n", "a\nb\nc", "=a =b +c"},
+		{"a\nb\nc\nd\n", "b\nc\nd\ne\n", "-a =b =c =d +e"},
+		// the example of Myers, only the number of lines changed is checked
+		{"a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n", "*"},
+	}
+	for _, c := range cases {
+		diff := DiffLines(c.oldText, c.newText)
+		edits := checkDiff(t, c.oldText, c.newText, diff)
+		a, b := splitLines(c.oldText), splitLines(c.newText)
+		if want := len(a) + len(b) - 2*lcsLength(a, b); edits != want {
+			t.Errorf("diff of %q and %q changes %d lines, want %d", c.oldText, c.newText, edits, want)
+		}
+		if c.want != "*" {
+			got := make([]string, len(diff))
+			for i, line := range diff {
+				got[i] = line.Op + line.Text
+			}
+			if strings.Join(got, " ") != c.want {
+				t.Errorf("diff of %q and %q = %s, want %s", c.oldText, c.newText, strings.Join(got, " "), c.want)
+			}
+		}
+	}
+}
+
+// TestDiffLinesShortest compares the number of lines changed with the
+// longest common subsequence on random texts of few distinct lines.
+func TestDiffLinesShortest(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	text := func(n int) string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = fmt.Sprintf("line %d", rnd.Intn(5))
+		}
+		return strings.Join(lines, "\n")
+	}
+	for i := 0; i < 300; i++ {
+		oldText, newText := text(rnd.Intn(40)), text(rnd.Intn(40))
+		edits := checkDiff(t, oldText, newText, DiffLines(oldText, newText))
+		a, b := splitLines(oldText), splitLines(newText)
+		if want := len(a) + len(b) - 2*lcsLength(a, b); edits != want {
+			t.Fatalf("diff of %q and %q changes %d lines, want %d", oldText, newText, edits, want)
+		}
+	}
+}
+
+// TestDiffLinesBlock checks texts with more than DIFF_MAX_EDITS lines changed
+// show as one block replaced, between their common head and tail.
+func TestDiffLinesBlock(t *testing.T) {
+	oldLines, newLines := []string{"head"}, []string{"head"}
+	for i := 0; i < 2*DIFF_MAX_EDITS; i++ {
+		oldLines = append(oldLines, fmt.Sprintf("old %d", i))
+		newLines = append(newLines, fmt.Sprintf("new %d", i))
+		if i%100 == 0 {
+			// lines in common, which the block doesn't keep
+			oldLines = append(oldLines, "common")
+			newLines = append(newLines, "common")
+		}
+	}
+	oldLines, newLines = append(oldLines, "tail"), append(newLines, "tail")
+	oldText, newText := strings.Join(oldLines, "\n"), strings.Join(newLines, "\n")
+	diff := DiffLines(oldText, newText)
+	checkDiff(t, oldText, newText, diff)
+	if diff[0].Op != DIFF_EQUAL || diff[len(diff)-1].Op != DIFF_EQUAL {
+		t.Fatal("common head and tail not kept")
+	}
+	middle := diff[1 : len(diff)-1]
+	for i, line := range middle {
+		if want := i >= len(oldLines)-2; line.IsInsert() != want || line.Op == DIFF_EQUAL {
+			t.Fatalf("line %d of the block is %s%s", i, line.Op, line.Text)
+		}
+	}
+
+	// just within the limit, the shortest edit is found
+	oldText = strings.Join(oldLines[:DIFF_MAX_EDITS/2], "\n")
+	newText = strings.Join(newLines[:DIFF_MAX_EDITS/2], "\n")
+	edits := checkDiff(t, oldText, newText, DiffLines(oldText, newText))
+	if a, b := splitLines(oldText), splitLines(newText); edits != len(a)+len(b)-2*lcsLength(a, b) {
+		t.Fatalf("%d lines changed, not the shortest edit", edits)
+	}
+}
+
+func BenchmarkDiffLines(b *testing.B) {
+	lines := make([]string, 5000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	edited := append([]string(nil), lines...)
+	for i := 0; i < len(edited); i += 50 {
+		edited[i] = "edited"
+	}
+	rewritten := make([]string, len(lines))
+	for i := range rewritten {
+		rewritten[i] = fmt.Sprintf("rewritten %d", i)
+	}
+	oldText := strings.Join(lines, "\n")
+	for name, newText := range map[string]string{
+		"edited":    strings.Join(edited, "\n"),
+		"rewritten": strings.Join(rewritten, "\n"),
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				DiffLines(oldText, newText)
+			}
+		})
+	}
+}
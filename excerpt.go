@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// the marker ending the excerpt of an article, written in its source
+const EXCERPT_MARKER = "<!--more-->"
+
+// appended to an excerpt cut in the middle of a paragraph
+const EXCERPT_ELLIPSIS = "…"
+
+// elements without a closing tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true,
+	"img": true, "input": true, "link": true, "meta": true, "param": true,
+	"source": true, "track": true, "wbr": true,
+}
+
+// elements counted as paragraphs by an automatic excerpt when they're at the
+// top level
+var excerptBlocks = map[string]bool{
+	"p": true, "ul": true, "ol": true, "dl": true, "pre": true, "blockquote": true,
+	"table": true, "div": true, "figure": true, "aside": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// elements which don't end the word they're in
+var inlineElements = map[string]bool{
+	"a": true, "abbr": true, "b": true, "bdi": true, "bdo": true, "cite": true, "code": true,
+	"data": true, "del": true, "dfn": true, "em": true, "i": true, "ins": true, "kbd": true,
+	"mark": true, "q": true, "s": true, "samp": true, "small": true, "span": true,
+	"strong": true, "sub": true, "sup": true, "time": true, "u": true, "var": true, "wbr": true,
+}
+
+// htmlCut is where an HTML document is cut and the elements open there.
+type htmlCut struct {
+	pos  int
+	open []string
+	// cut in the middle of the text of an element
+	inText bool
+}
+
+// cutHTML scans HTML up to the end of its first words words or of its first
+// blocks top level blocks, 0 for no limit, and returns where it stopped.
+func cutHTML(buff []byte, words int, blocks int) *htmlCut {
+	cut := &htmlCut{pos: len(buff), open: make([]string, 0)}
+	countWords, countBlocks := 0, 0
+	inWord := false
+	for pos := 0; pos < len(buff); {
+		if buff[pos] != '<' {
+			r, size := utf8.DecodeRune(buff[pos:])
+			space := unicode.IsSpace(r)
+			if inWord && space {
+				inWord = false
+				if words > 0 && countWords >= words {
+					cut.pos, cut.inText = pos, true
+					return cut
+				}
+			} else if !inWord && !space {
+				inWord = true
+				countWords += 1
+			}
+			pos += size
+			continue
+		}
+		if bytes.HasPrefix(buff[pos:], []byte("<!--")) {
+			end := bytes.Index(buff[pos:], []byte("-->"))
+			if end < 0 {
+				break
+			}
+			pos += end + len("-->")
+			continue
+		}
+		end := tagEnd(buff, pos)
+		if end < 0 {
+			break
+		}
+		name, closing, selfClosing := parseTag(buff[pos:end])
+		if len(name) == 0 {
+			pos = end
+			continue
+		}
+		start := pos
+		pos = end
+		// an element other than an inline one, such as <br> or <li>, ends a
+		// word; the excerpt is cut there unless it's the end of a top level
+		// block
+		if inWord && !inlineElements[name] {
+			inWord = false
+			blockEnd := closing && excerptBlocks[name] && len(cut.open) == 1 && cut.open[0] == name
+			if words > 0 && countWords >= words && !blockEnd {
+				cut.pos, cut.inText = start, true
+				return cut
+			}
+		}
+		if closing {
+			for i := len(cut.open) - 1; i >= 0; i-- {
+				if cut.open[i] == name {
+					cut.open = cut.open[:i]
+					break
+				}
+			}
+			if len(cut.open) == 0 && excerptBlocks[name] {
+				inWord = false
+				countBlocks += 1
+				if (blocks > 0 && countBlocks >= blocks) || (words > 0 && countWords >= words) {
+					cut.pos = pos
+					return cut
+				}
+			}
+			continue
+		}
+		if !selfClosing && !voidElements[name] {
+			cut.open = append(cut.open, name)
+		}
+	}
+	return cut
+}
+
+// tagEnd returns the position after the tag at pos, -1 if it isn't closed.
+func tagEnd(buff []byte, pos int) int {
+	var quote byte = 0
+	for i := pos + 1; i < len(buff); i++ {
+		switch {
+		case quote != 0:
+			if buff[i] == quote {
+				quote = 0
+			}
+		case buff[i] == '"' || buff[i] == '\'':
+			quote = buff[i]
+		case buff[i] == '>':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// parseTag returns the lower case name of a tag, "" for a declaration, and if
+// it's a closing or a self closing tag.
+func parseTag(tag []byte) (string, bool, bool) {
+	body := strings.TrimSuffix(strings.TrimPrefix(string(tag), "<"), ">")
+	closing := strings.HasPrefix(body, "/")
+	selfClosing := strings.HasSuffix(body, "/")
+	body = strings.Trim(body, "/")
+	end := strings.IndexFunc(body, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '/'
+	})
+	if end >= 0 {
+		body = body[:end]
+	}
+	if len(body) == 0 || body[0] == '!' || body[0] == '?' {
+		return "", false, false
+	}
+	return strings.ToLower(body), closing, selfClosing
+}
+
+// closeHTML returns the HTML before a cut with the elements open there closed.
+func closeHTML(buff []byte, cut *htmlCut) []byte {
+	out := make([]byte, 0, cut.pos+len(EXCERPT_ELLIPSIS)+8*len(cut.open))
+	out = append(out, bytes.TrimRight(buff[:cut.pos], " \t\r\n")...)
+	if cut.inText {
+		out = append(out, EXCERPT_ELLIPSIS...)
+	}
+	for i := len(cut.open) - 1; i >= 0; i-- {
+		out = append(out, "</"+cut.open[i]+">"...)
+	}
+	return append(out, '\n')
+}
+
+// MarkdownPipeline.Excerpt returns the excerpt of the rendered HTML of an
+// article and whether it ends at EXCERPT_MARKER. Without the marker it's the
+// first ExcerptParagraphs paragraphs or ExcerptWords words, whichever is
+// shorter; nil if that's the whole article.
+func (p *MarkdownPipeline) Excerpt(buff []byte) ([]byte, bool) {
+	if marker := bytes.Index(buff, []byte(EXCERPT_MARKER)); marker >= 0 {
+		// not leaving the paragraph Markdown put a marker of its own in
+		if before := bytes.TrimRight(buff[:marker], " \t\r\n"); bytes.HasSuffix(before, []byte("<p>")) {
+			marker = len(before) - len("<p>")
+		}
+		cut := cutHTML(buff[:marker], 0, 0)
+		cut.inText = false
+		return closeHTML(buff, cut), true
+	}
+	if p.ExcerptWords <= 0 && p.ExcerptParagraphs <= 0 {
+		return nil, false
+	}
+	cut := cutHTML(buff, p.ExcerptWords, p.ExcerptParagraphs)
+	if len(bytes.TrimSpace(buff[cut.pos:])) == 0 {
+		return nil, false
+	}
+	return closeHTML(buff, cut), false
+}
+
+// SummaryExcerpt returns the HTML of the summary of an article, used as its
+// excerpt when it has no marker.
+func SummaryExcerpt(summary string) []byte {
+	return []byte("<p>" + html.EscapeString(summary) + "</p>\n")
+}
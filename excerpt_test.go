@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExcerpt(t *testing.T) {
+	p := &MarkdownPipeline{ExcerptWords: 3, ExcerptParagraphs: 2}
+	cases := []struct {
+		name   string
+		html   string
+		want   string
+		marked bool
+	}{
+		{"nested inline elements",
+			"<p>one <em>two <strong>three four</strong> five</em></p>\n",
+			"<p>one <em>two <strong>three…</strong></em></p>\n", false},
+		{"inside a link in a list",
+			"<ul>\n<li><a href=\"x\">one two <code>three</code> four</a></li>\n</ul>\n",
+			"<ul>\n<li><a href=\"x\">one two <code>three</code>…</a></li></ul>\n", false},
+		{"inside pre",
+			"<pre><code>one\ntwo &lt; three\nfour\n</code></pre>\n<p>five</p>\n",
+			"<pre><code>one\ntwo &lt;…</code></pre>\n", false},
+		{"after a void element",
+			"<p>one<br>two <img src=\"a.png\" alt=\"\"> three four</p>\n",
+			"<p>one<br>two <img src=\"a.png\" alt=\"\"> three…</p>\n", false},
+		{"at a line break",
+			"<p>one two three<br />\nfour</p>\n",
+			"<p>one two three…</p>\n", false},
+		{"list items are words of their own",
+			"<ul>\n<li>one</li>\n<li>two</li><li>three</li><li>four</li>\n</ul>\n",
+			"<ul>\n<li>one</li>\n<li>two</li><li>three…</li></ul>\n", false},
+		{"at the end of a block",
+			"<p>one two three</p>\n<p>four</p>\n",
+			"<p>one two three</p>\n", false},
+		{"by paragraphs",
+			"<p>one</p>\n<p>two</p>\n<p>three</p>\n",
+			"<p>one</p>\n<p>two</p>\n", false},
+		{"attribute values with >",
+			"<p><a title=\"a > b\" href='x>y'>one two</a> three four</p>\n",
+			"<p><a title=\"a > b\" href='x>y'>one two</a> three…</p>\n", false},
+		{"marker in a list",
+			"<ul>\n<li>one two three four five</li>\n<!--more-->\n<li>six</li>\n</ul>\n",
+			"<ul>\n<li>one two three four five</li></ul>\n", true},
+		{"marker in a list item",
+			"<ul>\n<li><p>one <em>two</em></p>\n<!--more--><p>three</p></li>\n</ul>\n",
+			"<ul>\n<li><p>one <em>two</em></p></li></ul>\n", true},
+		{"marker after a comment with >",
+			"<p>one</p>\n<!-- a > b -->\n<p title=\">\">two</p>\n<!--more-->\n<p>three</p>\n",
+			"<p>one</p>\n<!-- a > b -->\n<p title=\">\">two</p>\n", true},
+	}
+	for _, c := range cases {
+		got, marked := p.Excerpt([]byte(c.html))
+		if string(got) != c.want || marked != c.marked {
+			t.Errorf("%s: excerpt = %q, %v, want %q, %v", c.name, got, marked, c.want, c.marked)
+		}
+	}
+
+	// short enough, no excerpt
+	if got, marked := p.Excerpt([]byte("<p>one two</p>\n<p>three</p>\n")); got != nil || marked {
+		t.Errorf("excerpt of a short article = %q, %v", got, marked)
+	}
+}
+
+// TestExcerptMarkdown checks the excerpt of rendered Markdown, with the marker
+// written in a list and on a line of its own.
+func TestExcerptMarkdown(t *testing.T) {
+	cases := []struct {
+		text string
+		want string
+	}{
+		{"Intro.\n\n* one\n\n    <!--more-->\n\n* two\n", "<p>Intro.</p>\n\n<ul>\n<li><p>one</p></li></ul>\n"},
+		{"* one\n* two <!--more--> three\n", "<ul>\n<li>one</li>\n<li>two</li></ul>\n"},
+		{"Intro.\n\n  <!--more-->\n\nNext.\n", "<p>Intro.</p>\n"},
+	}
+	for _, c := range cases {
+		html, _ := markdown.RenderArticle([]byte(c.text))
+		got, marked := markdown.Excerpt(html)
+		if string(got) != c.want || !marked {
+			t.Errorf("excerpt of:\n%s\n= %q, %v, want %q", html, got, marked, c.want)
+		}
+	}
+}
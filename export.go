@@ -1,5 +1,9 @@
 package main
 
+import (
+	"html/template"
+)
+
 type Export int
 
 func (e *Export) GetPrevArticleName(name string) string {
@@ -152,11 +156,30 @@ func (e *Export) GetPageTimeline(offset int, count int) []*Article {
 	return pages
 }
 
+func (e *Export) GetDraftTimeline(offset int, count int) []*Article {
+	drafts, _ := TattooDB.GetDraftTimeline(offset, count)
+	return drafts
+}
+
 func (e *Export) GetArticle(name string) *Article {
 	article, _ := TattooDB.GetArticleFull(name)
 	return article
 }
 
+// Export.GetArticleTOC returns the table of contents of an article, a nested
+// list of links to its headings, or "" if it has none.
+func (e *Export) GetArticleTOC(name string) template.HTML {
+	toc, _ := TattooDB.GetArticleTOC(name)
+	return template.HTML(toc)
+}
+
+// Export.GetArticleExcerpt returns the excerpt of an article, see
+// TattooStorage.GetArticleExcerpt.
+func (e *Export) GetArticleExcerpt(name string) template.HTML {
+	excerpt, _, _ := TattooDB.GetArticleExcerpt(name)
+	return template.HTML(excerpt)
+}
+
 func (e *Export) GetArticleComments(name string) []*Comment {
 	return TattooDB.GetComments(name)
 }
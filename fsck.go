@@ -0,0 +1,414 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"sort"
+	"time"
+)
+
+func init() {
+	RegisterCommand(&Command{
+		Name:  "fsck",
+		Usage: "fsck [-repair]",
+		Help:  "Cross-check the storages and their indexes, fix what's possible with -repair, refused while the server is running.",
+		Run:   runFsck,
+	})
+}
+
+func runFsck(app *webapp.App, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "Fix the problems found")
+	flags.Parse(args)
+	if err := TattooDB.Load(app); err != nil {
+		return err
+	}
+	defer TattooDB.Close()
+	report, err := TattooDB.Fsck(*repair)
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%d problem(s) found, %d repaired.\n", len(report.Problems), report.Repaired)
+	if err != nil {
+		return err
+	}
+	if len(report.Problems) != report.Repaired {
+		return errors.New("the storage is inconsistent, run 'fsck -repair' to fix it")
+	}
+	return nil
+}
+
+type FsckReport struct {
+	Problems []string
+	Repaired int
+}
+
+func (r *FsckReport) add(repaired bool, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	if repaired {
+		r.Repaired += 1
+	}
+}
+
+// TattooStorage.Fsck checks the files of every storage against their indexes,
+// then metadata, sources and HTML against each other, and finally rebuilds
+// the tag and comment indexes from metadata to compare them with the stored
+// ones. With repair, the fixes are committed in a single transaction.
+func (s *TattooStorage) Fsck(repair bool) (*FsckReport, error) {
+	report := new(FsckReport)
+	report.Problems = make([]string, 0)
+	tx := s.Begin()
+	defer tx.Rollback()
+	for _, store := range s.Stores() {
+		for _, problem := range store.DB.Check(repair) {
+			report.add(repair, "%s", problem)
+		}
+	}
+	articles := s.fsckArticles(tx, report, repair)
+	s.fsckTagIndex(tx, report, repair, articles)
+	comments := s.fsckComments(tx, report, repair, articles)
+	s.fsckRevisions(tx, report, repair, articles)
+	s.fsckTimelines(tx, report, repair, articles, comments)
+	if !repair {
+		return report, nil
+	}
+	// Check repairs the storages directly, bypassing the caches
+	s.cache.Purge()
+	tx.OnCommit(func() {
+		s.loadTimelines()
+	})
+	return report, tx.Commit()
+}
+
+// fsckArticles returns the metadata of every article which has both metadata
+// and source after the repair.
+func (s *TattooStorage) fsckArticles(tx *webapp.Transaction, report *FsckReport, repair bool) map[string]*ArticleMetadata {
+	articles := make(map[string]*ArticleMetadata)
+	for _, name := range s.MetadataDB.Keys() {
+		meta, err := s.getMeta(tx, name)
+		if err != nil {
+			report.add(repair, "metadata of article '%s' is broken: %v", name, err)
+			if repair {
+				s.deleteMetadata(tx, name)
+			}
+			continue
+		}
+		if !s.ArticleDB.Has(name) {
+			report.add(repair, "metadata of article '%s' has no source", name)
+			if repair {
+				s.deleteMetadata(tx, name)
+				tx.Delete(&s.ArticleHTMLDB, name)
+			}
+			continue
+		}
+		if meta.Name != name {
+			report.add(repair, "metadata of article '%s' is named '%s'", name, meta.Name)
+			if repair {
+				meta.Name = name
+				s.updateMetadata(tx, meta)
+			}
+		}
+		articles[name] = meta
+	}
+	for _, name := range s.ArticleDB.Keys() {
+		if _, ok := articles[name]; !ok && !tx.Has(&s.MetadataDB, name) {
+			report.add(repair, "source of article '%s' has no metadata", name)
+			if repair {
+				meta := new(ArticleMetadata)
+				meta.Name = name
+				meta.Title = name
+				meta.Author = GetConfig().AuthorName
+				meta.Tags = make([]string, 0)
+				meta.CreatedTime = time.Now().Unix()
+				meta.ModifiedTime = meta.CreatedTime
+				s.updateMetadata(tx, meta)
+				articles[name] = meta
+			}
+		}
+		if !s.ArticleHTMLDB.Has(name) {
+			report.add(repair, "article '%s' has no HTML", name)
+			if repair {
+				if text, err := s.ArticleDB.Get(name); err == nil {
+					s.updateArticle(tx, name, text)
+				}
+			}
+		}
+	}
+	for _, name := range s.ArticleHTMLDB.Keys() {
+		if !s.ArticleDB.Has(name) {
+			report.add(repair, "HTML of article '%s' has no source", name)
+			if repair {
+				tx.Delete(&s.ArticleHTMLDB, name)
+			}
+		}
+	}
+	return articles
+}
+
+// fsckTagIndex compares every tag list with the tags found in the metadata of
+// published articles.
+func (s *TattooStorage) fsckTagIndex(tx *webapp.Transaction, report *FsckReport, repair bool, articles map[string]*ArticleMetadata) {
+	expected := make(map[string]*KeyPairs)
+	for name, meta := range articles {
+		if !meta.IsPublished() {
+			continue
+		}
+		for _, t := range meta.Tags {
+			if _, ok := expected[t]; !ok {
+				expected[t] = &KeyPairs{Items: make([]*KeyValuePair, 0)}
+			}
+			expected[t].Items = append(expected[t].Items, &KeyValuePair{Key: meta.CreatedTime, Value: name})
+		}
+	}
+	for _, tag := range s.TagIndexDB.Keys() {
+		want := expected[tag]
+		delete(expected, tag)
+		if want == nil {
+			report.add(repair, "tag '%s' has no articles", tag)
+			if repair {
+				tx.Delete(&s.TagIndexDB, tag)
+			}
+			continue
+		}
+		lst, err := getNameList(tx, &s.TagIndexDB, tag)
+		if err != nil {
+			report.add(repair, "tag index of '%s' is broken: %v", tag, err)
+		} else if !s.fsckNameList(report, repair, lst, want, "tag '"+tag+"'", "article") {
+			continue
+		}
+		if repair {
+			tx.SetJSON(&s.TagIndexDB, tag, sortedNames(want, true))
+		}
+	}
+	for tag, want := range expected {
+		report.add(repair, "tag '%s' isn't indexed", tag)
+		if repair {
+			tx.SetJSON(&s.TagIndexDB, tag, sortedNames(want, true))
+		}
+	}
+}
+
+// fsckComments checks comments against their article and rebuilds the
+// comment index. It returns the metadata of every comment kept.
+func (s *TattooStorage) fsckComments(tx *webapp.Transaction, report *FsckReport, repair bool, articles map[string]*ArticleMetadata) map[string]*CommentMetadata {
+	comments := make(map[string]*CommentMetadata)
+	expected := make(map[string]*KeyPairs)
+	for _, uuid := range s.CommentMetadataDB.Keys() {
+		meta, err := s.getCommentMetadata(tx, uuid)
+		if err != nil {
+			report.add(repair, "metadata of comment '%s' is broken: %v", uuid, err)
+			if repair {
+				s.dropComment(tx, uuid)
+			}
+			continue
+		}
+		if !s.CommentDB.Has(uuid) {
+			report.add(repair, "metadata of comment '%s' has no source", uuid)
+			if repair {
+				s.dropComment(tx, uuid)
+			}
+			continue
+		}
+		if _, ok := articles[meta.ArticleName]; !ok {
+			report.add(repair, "comment '%s' belongs to missing article '%s'", uuid, meta.ArticleName)
+			if repair {
+				s.dropComment(tx, uuid)
+			}
+			continue
+		}
+		if meta.Name != uuid {
+			report.add(repair, "metadata of comment '%s' is named '%s'", uuid, meta.Name)
+			if repair {
+				meta.Name = uuid
+				s.updateCommentMetadata(tx, meta)
+			}
+		}
+		if !s.CommentHTMLDB.Has(uuid) {
+			report.add(repair, "comment '%s' has no HTML", uuid)
+			if repair {
+				if text, err := s.CommentDB.Get(uuid); err == nil {
+					s.updateComment(tx, uuid, text)
+				}
+			}
+		}
+		if _, ok := expected[meta.ArticleName]; !ok {
+			expected[meta.ArticleName] = &KeyPairs{Items: make([]*KeyValuePair, 0)}
+		}
+		expected[meta.ArticleName].Items = append(expected[meta.ArticleName].Items, &KeyValuePair{Key: meta.CreatedTime, Value: uuid})
+		comments[uuid] = meta
+	}
+	for _, uuid := range s.CommentDB.Keys() {
+		if !s.CommentMetadataDB.Has(uuid) {
+			report.add(repair, "source of comment '%s' has no metadata", uuid)
+			if repair {
+				s.dropComment(tx, uuid)
+			}
+		}
+	}
+	for _, uuid := range s.CommentHTMLDB.Keys() {
+		if !s.CommentDB.Has(uuid) && !s.CommentMetadataDB.Has(uuid) {
+			report.add(repair, "HTML of comment '%s' has no source", uuid)
+			if repair {
+				s.dropComment(tx, uuid)
+			}
+		}
+	}
+	for _, name := range s.CommentIndexDB.Keys() {
+		want := expected[name]
+		delete(expected, name)
+		if _, ok := articles[name]; !ok {
+			report.add(repair, "comment index of missing article '%s'", name)
+			if repair {
+				tx.Delete(&s.CommentIndexDB, name)
+			}
+			continue
+		}
+		if want == nil {
+			want = &KeyPairs{Items: make([]*KeyValuePair, 0)}
+		}
+		lst, err := getNameList(tx, &s.CommentIndexDB, name)
+		if err != nil {
+			report.add(repair, "comment index of '%s' is broken: %v", name, err)
+		} else if !s.fsckNameList(report, repair, lst, want, "comment index of '"+name+"'", "comment") {
+			continue
+		}
+		if repair {
+			tx.SetJSON(&s.CommentIndexDB, name, sortedNames(want, false))
+		}
+	}
+	for name, want := range expected {
+		report.add(repair, "comments of article '%s' aren't indexed", name)
+		if repair {
+			tx.SetJSON(&s.CommentIndexDB, name, sortedNames(want, false))
+		}
+	}
+	return comments
+}
+
+// fsckTimelines compares the saved timelines with the ones built from the
+// metadata of the articles and comments kept.
+func (s *TattooStorage) fsckTimelines(tx *webapp.Transaction, report *FsckReport, repair bool, articles map[string]*ArticleMetadata, comments map[string]*CommentMetadata) {
+	expected := buildArticleTimelines(articles)
+	expected[TIMELINE_COMMENT] = buildCommentTimeline(comments)
+	for _, key := range allTimelines {
+		want := expected[key]
+		entries, err := s.getTimeline(tx, key)
+		if err != nil {
+			report.add(repair, "%v", err)
+		} else if timelineEqual(entries, want) {
+			continue
+		} else {
+			report.add(repair, "timeline '%s' doesn't match the metadata, %d entries instead of %d", key, len(entries), len(want))
+		}
+		if repair {
+			s.setTimeline(tx, key, want)
+		}
+	}
+	listed := make(map[string]bool)
+	for _, key := range allTimelines {
+		if t, err := s.openTimeline(tx, key); err == nil {
+			for _, seg := range t.index.Segments {
+				listed[seg.Key] = true
+			}
+		}
+	}
+	for _, key := range s.TimelineDB.Keys() {
+		if _, isSegment := timelineOfKey(key); isSegment && !listed[key] && tx.Has(&s.TimelineDB, key) {
+			report.add(repair, "timeline segment '%s' isn't in its timeline", key)
+			if repair {
+				tx.Delete(&s.TimelineDB, key)
+			}
+		}
+	}
+}
+
+// fsckRevisions checks that every revision list belongs to an article and
+// that its sources exist, and that every revision source is listed.
+func (s *TattooStorage) fsckRevisions(tx *webapp.Transaction, report *FsckReport, repair bool, articles map[string]*ArticleMetadata) {
+	listed := make(map[string]bool)
+	for _, name := range s.RevisionIndexDB.Keys() {
+		revs, err := s.getRevisions(tx, name)
+		if err != nil {
+			report.add(repair, "revision index of '%s' is broken: %v", name, err)
+			if repair {
+				tx.Delete(&s.RevisionIndexDB, name)
+			}
+			continue
+		}
+		if _, ok := articles[name]; !ok {
+			report.add(repair, "revisions of missing article '%s'", name)
+			if repair {
+				s.deleteRevisions(tx, name)
+			}
+			continue
+		}
+		kept := make([]*RevisionMetadata, 0, len(revs))
+		for _, rev := range revs {
+			key := revisionKey(name, rev.Number)
+			listed[key] = true
+			if !s.RevisionDB.Has(key) {
+				report.add(repair, "revision %d of '%s' has no source", rev.Number, name)
+				continue
+			}
+			kept = append(kept, rev)
+		}
+		if repair && len(kept) != len(revs) {
+			tx.SetJSON(&s.RevisionIndexDB, name, kept)
+		}
+	}
+	for _, key := range s.RevisionDB.Keys() {
+		if !listed[key] {
+			report.add(repair, "revision '%s' isn't listed", key)
+			if repair {
+				tx.Delete(&s.RevisionDB, key)
+			}
+		}
+	}
+}
+
+// fsckNameList reports the differences between a stored list of names and the
+// expected one, it returns true if they differ.
+func (s *TattooStorage) fsckNameList(report *FsckReport, repair bool, lst []string, want *KeyPairs, owner string, kind string) bool {
+	found := make(map[string]bool)
+	wanted := make(map[string]bool)
+	for _, item := range want.Items {
+		wanted[item.Value] = true
+	}
+	differ := false
+	for _, name := range lst {
+		if !wanted[name] || found[name] {
+			report.add(repair, "%s lists %s '%s' which doesn't belong to it", owner, kind, name)
+			differ = true
+		}
+		found[name] = true
+	}
+	for _, item := range want.Items {
+		if !found[item.Value] {
+			report.add(repair, "%s misses %s '%s'", owner, kind, item.Value)
+			differ = true
+		}
+	}
+	return differ
+}
+
+func (s *TattooStorage) dropComment(tx *webapp.Transaction, uuid string) {
+	s.deleteCommentMetadata(tx, uuid)
+	tx.Delete(&s.CommentDB, uuid)
+	tx.Delete(&s.CommentHTMLDB, uuid)
+}
+
+// sortedNames returns the names in pairs ordered by their key.
+func sortedNames(pairs *KeyPairs, reverse bool) []string {
+	sort.Sort(pairs)
+	names := make([]string, len(pairs.Items))
+	for i, item := range pairs.Items {
+		if reverse {
+			names[len(names)-1-i] = item.Value
+		} else {
+			names[i] = item.Value
+		}
+	}
+	return names
+}
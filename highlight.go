@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"github.com/russross/blackfriday"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// CSS classes of highlighted tokens, themes style them under
+// pre code.highlight
+const (
+	HL_KEYWORD  = "hl-keyword"
+	HL_TYPE     = "hl-type"
+	HL_BUILTIN  = "hl-builtin"
+	HL_LITERAL  = "hl-literal"
+	HL_STRING   = "hl-string"
+	HL_NUMBER   = "hl-number"
+	HL_COMMENT  = "hl-comment"
+	HL_FUNCTION = "hl-function"
+	HL_VARIABLE = "hl-variable"
+	HL_KEY      = "hl-key"
+	HL_META     = "hl-meta"
+	HL_INSERTED = "hl-inserted"
+	HL_DELETED  = "hl-deleted"
+)
+
+// LexerRule matches a token at the start of the remaining code. Classes holds
+// the class of the whole match, or one class per group if the pattern has
+// groups, in which case text outside the groups isn't highlighted. "" isn't
+// highlighted either.
+type LexerRule struct {
+	Pattern *regexp.Regexp
+	Classes []string
+}
+
+// Lexer splits the code of a language into tokens by trying its rules in
+// order at each position; a character no rule matches is left as it is.
+type Lexer struct {
+	Name    string
+	Aliases []string
+	Rules   []*LexerRule
+}
+
+var lexers = make(map[string]*Lexer)
+
+// RegisterLexer makes a lexer available to fenced code blocks tagged with its
+// name or one of its aliases.
+func RegisterLexer(l *Lexer) {
+	lexers[l.Name] = l
+	for _, alias := range l.Aliases {
+		lexers[alias] = l
+	}
+}
+
+// LookupLexer returns the lexer of a language tag, nil if there is none.
+func LookupLexer(lang string) *Lexer {
+	return lexers[strings.ToLower(lang)]
+}
+
+// rule compiles a rule.
+func rule(pattern string, classes ...string) *LexerRule {
+	return &LexerRule{regexp.MustCompile(pattern), classes}
+}
+
+// words matches any of a list of words as a whole.
+func words(list string) string {
+	return `\b(?:` + strings.Join(strings.Fields(list), "|") + `)\b`
+}
+
+// LexerRule.find returns the position of the next match at or after pos,
+// with the positions of its groups, or {-1, -1} if there's none.
+func (r *LexerRule) find(src string, pos int) []int {
+	loc := r.Pattern.FindStringSubmatchIndex(src[pos:])
+	if loc == nil {
+		return []int{-1, -1}
+	}
+	for i := range loc {
+		if loc[i] >= 0 {
+			loc[i] += pos
+		}
+	}
+	return loc
+}
+
+// Lexer.Highlight returns code as HTML, with the tokens highlighted by spans.
+// The next match of each rule is remembered until the lexer passes it, so
+// that a rule isn't searched again at every position, which would take
+// quadratic time on unterminated strings and comments.
+func (l *Lexer) Highlight(code []byte) []byte {
+	var out bytes.Buffer
+	class, pending := "", make([]byte, 0)
+	emit := func(c string, text []byte) {
+		if len(text) == 0 {
+			return
+		}
+		if c != class {
+			flushToken(&out, class, pending)
+			class, pending = c, pending[:0]
+		}
+		pending = append(pending, text...)
+	}
+	src := string(code)
+	next := make([][]int, len(l.Rules))
+	for pos := 0; pos < len(src); {
+		matched := false
+		for i, r := range l.Rules {
+			loc := next[i]
+			if loc == nil || loc[0] >= 0 && loc[0] < pos {
+				loc = r.find(src, pos)
+				next[i] = loc
+			}
+			if loc[0] != pos || loc[1] == pos {
+				continue
+			}
+			if len(loc) == 2 {
+				emit(r.Classes[0], code[pos:loc[1]])
+			} else {
+				last := pos
+				for g := 1; g < len(loc)/2; g++ {
+					start, end := loc[2*g], loc[2*g+1]
+					if start < 0 {
+						continue
+					}
+					emit("", code[last:start])
+					c := ""
+					if g-1 < len(r.Classes) {
+						c = r.Classes[g-1]
+					}
+					emit(c, code[start:end])
+					last = end
+				}
+				emit("", code[last:loc[1]])
+			}
+			pos = loc[1]
+			matched = true
+			break
+		}
+		if !matched {
+			emit("", code[pos:pos+1])
+			pos += 1
+		}
+	}
+	flushToken(&out, class, pending)
+	return out.Bytes()
+}
+
+func flushToken(out *bytes.Buffer, class string, text []byte) {
+	if len(text) == 0 {
+		return
+	}
+	if len(class) != 0 {
+		out.WriteString(`<span class="` + class + `">`)
+	}
+	out.WriteString(html.EscapeString(string(text)))
+	if len(class) != 0 {
+		out.WriteString("</span>")
+	}
+}
+
+// highlighter renders fenced code blocks of known languages highlighted and
+// leaves everything else to the HTML renderer it wraps.
+type highlighter struct {
+	blackfriday.Renderer
+}
+
+func (h *highlighter) BlockCode(out *bytes.Buffer, text []byte, info string) {
+	lang := strings.Fields(info)
+	if len(lang) == 0 {
+		h.Renderer.BlockCode(out, text, info)
+		return
+	}
+	lexer := LookupLexer(lang[0])
+	if lexer == nil {
+		h.Renderer.BlockCode(out, text, info)
+		return
+	}
+	if out.Len() > 0 {
+		out.WriteByte('\n')
+	}
+	out.WriteString(`<pre><code class="language-` + html.EscapeString(lang[0]) + ` highlight">`)
+	out.Write(lexer.Highlight(text))
+	out.WriteString("</code></pre>\n")
+}
+
+func init() {
+	RegisterLexer(&Lexer{
+		Name: "go", Aliases: []string{"golang"},
+		Rules: []*LexerRule{
+			rule(`//[^\n]*|/\*[\s\S]*?\*/`, HL_COMMENT),
+			rule("\"(?:[^\"\\\\\\n]|\\\\.)*\"|`[^`]*`|'(?:[^'\\\\\\n]|\\\\.)+'", HL_STRING),
+			rule(`0[xX][0-9a-fA-F_]+|0[bB][01_]+|0[oO][0-7_]+|(?:[0-9][0-9_]*\.?[0-9_]*|\.[0-9][0-9_]*)(?:[eE][+-]?[0-9_]+)?i?`, HL_NUMBER),
+			rule(`(func)(\s+)([A-Za-z_]\w*)`, HL_KEYWORD, "", HL_FUNCTION),
+			rule(words(`break case chan const continue default defer else fallthrough for func go goto
+				if import interface map package range return select struct switch type var`), HL_KEYWORD),
+			rule(words(`bool byte complex64 complex128 error float32 float64 int int8 int16 int32 int64
+				rune string uint uint8 uint16 uint32 uint64 uintptr any comparable`), HL_TYPE),
+			rule(words(`true false nil iota`), HL_LITERAL),
+			rule(words(`append cap clear close complex copy delete imag len make max min new panic
+				print println real recover`), HL_BUILTIN),
+			rule(`[A-Za-z_]\w*`, ""),
+		},
+	})
+	RegisterLexer(&Lexer{
+		Name: "shell", Aliases: []string{"sh", "bash", "zsh", "console", "shell-session"},
+		Rules: []*LexerRule{
+			rule(`#[^\n]*`, HL_COMMENT),
+			rule(`'[^']*'|"(?:[^"\\]|\\[\s\S])*"`, HL_STRING),
+			rule(`\$\{[^}\n]*\}|\$[A-Za-z_]\w*|\$[0-9@#?$!*-]`, HL_VARIABLE),
+			rule(`([A-Za-z_]\w*)(=)`, HL_VARIABLE, ""),
+			rule(words(`if then else elif fi for while until do done case esac in function select
+				return export local readonly declare`), HL_KEYWORD),
+			rule(words(`echo cd printf read set unset source exit eval exec test shift trap alias
+				pwd kill wait true false`), HL_BUILTIN),
+			rule(`\b[0-9]+\b`, HL_NUMBER),
+			rule("[^\\s;|&<>()'\"$`=]+", ""),
+		},
+	})
+	RegisterLexer(&Lexer{
+		Name: "json", Aliases: []string{"jsonc"},
+		Rules: []*LexerRule{
+			rule(`("(?:[^"\\\n]|\\.)*")\s*:`, HL_KEY),
+			rule(`"(?:[^"\\\n]|\\.)*"`, HL_STRING),
+			rule(`-?(?:0|[1-9][0-9]*)(?:\.[0-9]+)?(?:[eE][+-]?[0-9]+)?`, HL_NUMBER),
+			rule(words(`true false null`), HL_LITERAL),
+			rule(`//[^\n]*|/\*[\s\S]*?\*/`, HL_COMMENT),
+		},
+	})
+	RegisterLexer(&Lexer{
+		Name: "yaml", Aliases: []string{"yml"},
+		Rules: []*LexerRule{
+			rule(`#[^\n]*`, HL_COMMENT),
+			rule(`(?m)(?:---|\.\.\.)$`, HL_META),
+			rule(`(?m)("(?:[^"\\\n]|\\.)*"|'[^'\n]*'|[^\s#:'"\[\]{},&*!|>-][^#:\n]*?)\s*:(?:[ \t]|$)`, HL_KEY),
+			rule(`"(?:[^"\\\n]|\\.)*"|'[^'\n]*'`, HL_STRING),
+			rule(`[&*][\w-]+|!!?[\w-]*`, HL_VARIABLE),
+			rule(`[-+]?(?:0x[0-9a-fA-F]+|[0-9]+(?:\.[0-9]+)?(?:[eE][+-]?[0-9]+)?)\b`, HL_NUMBER),
+			rule(words(`true false null yes no on off True False Null`)+`|~`, HL_LITERAL),
+			rule(`[^\s#"':,\[\]{}][^\s:,\[\]{}]*`, ""),
+		},
+	})
+	RegisterLexer(&Lexer{
+		Name: "javascript", Aliases: []string{"js", "jsx", "mjs", "node"},
+		Rules: []*LexerRule{
+			rule(`//[^\n]*|/\*[\s\S]*?\*/`, HL_COMMENT),
+			rule("\"(?:[^\"\\\\\\n]|\\\\.)*\"|'(?:[^'\\\\\\n]|\\\\.)*'|`(?:[^`\\\\]|\\\\[\\s\\S])*`", HL_STRING),
+			rule(`0[xX][0-9a-fA-F_]+|0[bB][01_]+|0[oO][0-7_]+|(?:[0-9][0-9_]*\.?[0-9_]*|\.[0-9][0-9_]*)(?:[eE][+-]?[0-9]+)?n?`, HL_NUMBER),
+			rule(`(function)(\s+)([A-Za-z_$][\w$]*)`, HL_KEYWORD, "", HL_FUNCTION),
+			rule(`(class)(\s+)([A-Za-z_$][\w$]*)`, HL_KEYWORD, "", HL_TYPE),
+			rule(words(`async await break case catch class const continue debugger default delete do
+				else export extends finally for from function if import in instanceof let new of
+				return static super switch throw try typeof var void while with yield`), HL_KEYWORD),
+			rule(words(`true false null undefined NaN Infinity this`), HL_LITERAL),
+			rule(words(`Array Boolean Date Error JSON Map Math Number Object Promise RegExp Set String
+				Symbol console document window require module`), HL_BUILTIN),
+			rule(`[A-Za-z_$][\w$]*`, ""),
+		},
+	})
+	RegisterLexer(&Lexer{
+		Name: "python", Aliases: []string{"py", "python3", "py3"},
+		Rules: []*LexerRule{
+			rule(`#[^\n]*`, HL_COMMENT),
+			rule(`(?i:[rbuf]{0,2})(?:"""[\s\S]*?"""|'''[\s\S]*?'''|"(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*')`, HL_STRING),
+			rule(`0[xX][0-9a-fA-F_]+|0[bB][01_]+|0[oO][0-7_]+|(?:[0-9][0-9_]*\.?[0-9_]*|\.[0-9][0-9_]*)(?:[eE][+-]?[0-9]+)?j?`, HL_NUMBER),
+			rule(`@[A-Za-z_][\w.]*`, HL_META),
+			rule(`(def)(\s+)([A-Za-z_]\w*)`, HL_KEYWORD, "", HL_FUNCTION),
+			rule(`(class)(\s+)([A-Za-z_]\w*)`, HL_KEYWORD, "", HL_TYPE),
+			rule(words(`and as assert async await break class continue def del elif else except
+				finally for from global if import in is lambda nonlocal not or pass raise return try
+				while with yield match case`), HL_KEYWORD),
+			rule(words(`True False None self`), HL_LITERAL),
+			rule(words(`abs all any bool bytes dict dir enumerate filter float format getattr hasattr
+				int isinstance len list map max min next object open print range repr reversed set
+				setattr sorted str sum super tuple type zip`), HL_BUILTIN),
+			rule(`[A-Za-z_]\w*`, ""),
+		},
+	})
+	RegisterLexer(&Lexer{
+		Name: "diff", Aliases: []string{"patch", "udiff"},
+		Rules: []*LexerRule{
+			rule(`(?m)^(?:diff|index|new file|deleted file|similarity|rename) [^\n]*`, HL_META),
+			rule(`(?m)^(?:\+\+\+|---)(?: [^\n]*)?$`, HL_META),
+			rule(`(?m)^@@[^\n]*`, HL_META),
+			rule(`(?m)^\+[^\n]*`, HL_INSERTED),
+			rule(`(?m)^-[^\n]*`, HL_DELETED),
+			rule(`[^\n]+`, ""),
+		},
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"html"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+var spanTag = regexp.MustCompile(`<span class="hl-[a-z]+">|</span>`)
+
+// TestHighlightGolden highlights testdata/highlight/<language>.txt and
+// compares it with <language>.golden, which go test -update rewrites.
+func TestHighlightGolden(t *testing.T) {
+	for _, lang := range []string{"go", "shell", "json", "yaml", "js", "python", "diff"} {
+		code, err := ioutil.ReadFile(filepath.Join("testdata", "highlight", lang+".txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lexer := LookupLexer(lang)
+		if lexer == nil {
+			t.Fatalf("no lexer for %s", lang)
+		}
+		out := lexer.Highlight(code)
+
+		// the code comes back out of the spans, escaped and whole
+		text := spanTag.ReplaceAll(out, nil)
+		if bytes.ContainsAny(text, "<>\"") || !utf8.Valid(out) {
+			t.Errorf("%s: unescaped or broken text in:\n%s", lang, out)
+		}
+		if html.UnescapeString(string(text)) != string(code) {
+			t.Errorf("%s: the highlighted code isn't the code:\n%s", lang, out)
+		}
+
+		golden := filepath.Join("testdata", "highlight", lang+".golden")
+		if *updateGolden {
+			if err := ioutil.WriteFile(golden, out, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, want) {
+			t.Errorf("%s highlighted as:\n%s\nwant:\n%s", lang, out, want)
+		}
+	}
+}
+
+func TestHighlightFallback(t *testing.T) {
+	cases := []struct {
+		text string
+		want string
+	}{
+		{"```cobol\nA < B & C é\n```\n", `<pre><code class="language-cobol">A &lt; B &amp; C é`},
+		{"```\nA < B & C é\n```\n", `<pre><code>A &lt; B &amp; C é`},
+		{"```GO\nx < y\n```\n", `<pre><code class="language-GO highlight">x &lt; y`},
+		{"{{< code lang=\"cobol\" >}}\nA < B & é\n{{< /code >}}\n", `<pre><code class="language-cobol">A &lt; B &amp; é`},
+	}
+	for _, c := range cases {
+		out, _ := markdown.RenderArticle([]byte(c.text))
+		if !strings.Contains(string(out), c.want) {
+			t.Errorf("%q rendered as:\n%s\nwant %s", c.text, out, c.want)
+		}
+		if strings.Contains(c.want, "cobol") && strings.Contains(string(out), "hl-") {
+			t.Errorf("%q highlighted by some lexer:\n%s", c.text, out)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// substrings of the user agents of crawlers, feed fetchers and scripts, in
+// lower case
+var botUserAgents = []string{
+	"bot", "crawl", "spider", "slurp", "fetch", "preview", "monitor",
+	"curl", "wget", "python", "go-http-client", "java/", "libwww", "headless",
+}
+
+// IsBot tells whether a user agent belongs to a crawler or a script. Browsers
+// always send one, so an empty user agent is a bot too.
+func IsBot(userAgent string) bool {
+	ua := strings.ToLower(strings.TrimSpace(userAgent))
+	if len(ua) == 0 {
+		return true
+	}
+	for _, pattern := range botUserAgents {
+		if strings.Contains(ua, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// HitCounter counts article views in memory and adds them to the Hits of the
+// stored metadata on Flush, so a view costs no write and concurrent views
+// aren't lost. Views of bots can be ignored, and a visitor viewing an article
+// again within the dedupe window isn't counted again.
+type HitCounter struct {
+	FilterBots bool
+	// seconds, 0 counts every view
+	DedupeWindow int64
+	lock         sync.Mutex
+	// views not flushed yet, by article
+	pending map[string]int64
+	// time of the last counted view, by visitor and article
+	seen map[string]int64
+}
+
+var Hits *HitCounter = nil
+
+func init() {
+	Hits = NewHitCounter()
+}
+
+func NewHitCounter() *HitCounter {
+	return &HitCounter{
+		pending: make(map[string]int64),
+		seen:    make(map[string]int64),
+	}
+}
+
+// visitorOf identifies the visitor of a request by address and user agent.
+func visitorOf(c *webapp.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		host = c.Request.RemoteAddr
+	}
+	return host + "|" + c.Request.UserAgent()
+}
+
+// HitCounter.Hit counts a view of an article, it returns false if the view
+// isn't counted.
+func (h *HitCounter) Hit(c *webapp.Context, name string) bool {
+	if h.FilterBots && IsBot(c.Request.UserAgent()) {
+		return false
+	}
+	now := time.Now().Unix()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.DedupeWindow > 0 {
+		key := visitorOf(c) + "|" + name
+		if last, ok := h.seen[key]; ok && now-last < h.DedupeWindow {
+			return false
+		}
+		h.seen[key] = now
+	}
+	h.pending[name] += 1
+	return true
+}
+
+// HitCounter.Pending returns the views of an article not flushed yet.
+func (h *HitCounter) Pending(name string) int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.pending[name]
+}
+
+// HitCounter.Add adds views counted elsewhere, by a follower, to the pending
+// ones.
+func (h *HitCounter) Add(hits map[string]int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for name, n := range hits {
+		if n > 0 {
+			h.pending[name] += n
+		}
+	}
+}
+
+// HitCounter.Flush adds the pending views to the metadata of their articles
+// in one transaction. Views of articles which are gone are dropped; if the
+// transaction fails, the views are kept for the next flush.
+func (h *HitCounter) Flush(db *TattooStorage) error {
+	return h.FlushTo(db.AddHits)
+}
+
+// HitCounter.FlushTo hands the pending views to add, they're kept for the
+// next flush if it fails.
+func (h *HitCounter) FlushTo(add func(hits map[string]int64) error) error {
+	h.lock.Lock()
+	pending := h.pending
+	h.pending = make(map[string]int64)
+	// forget the visitors outside the window
+	now := time.Now().Unix()
+	for key, last := range h.seen {
+		if now-last >= h.DedupeWindow {
+			delete(h.seen, key)
+		}
+	}
+	h.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := add(pending)
+	if err != nil {
+		h.lock.Lock()
+		for name, n := range pending {
+			h.pending[name] += n
+		}
+		h.lock.Unlock()
+	}
+	return err
+}
+
+// TattooStorage.AddHits adds views to the Hits of articles.
+func (s *TattooStorage) AddHits(hits map[string]int64) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	for name, n := range hits {
+		meta, err := s.getMeta(tx, name)
+		if err != nil {
+			continue
+		}
+		meta.Hits += n
+		s.updateMetadata(tx, meta)
+	}
+	return tx.Commit()
+}
+
+// FlushHits flushes Hits to TattooDB, or to the primary on a follower.
+func FlushHits() error {
+	if Follower != nil {
+		return Hits.FlushTo(Follower.SendHits)
+	}
+	return Hits.Flush(TattooDB)
+}
+
+// StartHitCounter configures Hits and flushes it every HitFlushInterval.
+func StartHitCounter(app *webapp.App) {
+	cfg := GetConfig()
+	Hits.FilterBots = cfg.HitFilterBots
+	Hits.DedupeWindow = int64(cfg.HitDedupeWindow) * 60
+	interval := time.Duration(cfg.HitFlushInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	app.Log("Hits", fmt.Sprintf("Flushed every %v, filter bots: %v, dedupe window: %d minute(s)",
+		interval, Hits.FilterBots, cfg.HitDedupeWindow))
+	go func() {
+		for range time.Tick(interval) {
+			if err := FlushHits(); err != nil {
+				app.Log("Hits", fmt.Sprintf("Flush failed: %v", err))
+			}
+		}
+	}()
+}
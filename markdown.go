@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/russross/blackfriday"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RENDERER_VERSION is bumped whenever the code rendering Markdown changes the
+// HTML it renders, so that the stored HTML gets rendered again. Changes of
+// Config.Markdown are covered by RendererVersion.
+const RENDERER_VERSION = 4
+
+// every stored HTML record starts with this header, which carries the version
+// of the renderer it was rendered with and the lengths of the table of
+// contents and the excerpt following the header, if any. An excerpt ending at
+// EXCERPT_MARKER has the field HTML_HEADER_MORE instead of HTML_HEADER_EXCERPT.
+const (
+	HTML_HEADER_PREFIX  = "<!--render:"
+	HTML_HEADER_SUFFIX  = "-->\n"
+	HTML_HEADER_TOC     = "toc:"
+	HTML_HEADER_EXCERPT = "excerpt:"
+	HTML_HEADER_MORE    = "more:"
+)
+
+// blackfriday extensions by name in Config.Markdown
+var markdownExtensions = map[string]int{
+	"no_intra_emphasis":          blackfriday.EXTENSION_NO_INTRA_EMPHASIS,
+	"tables":                     blackfriday.EXTENSION_TABLES,
+	"fenced_code":                blackfriday.EXTENSION_FENCED_CODE,
+	"autolink":                   blackfriday.EXTENSION_AUTOLINK,
+	"strikethrough":              blackfriday.EXTENSION_STRIKETHROUGH,
+	"lax_html_blocks":            blackfriday.EXTENSION_LAX_HTML_BLOCKS,
+	"space_headers":              blackfriday.EXTENSION_SPACE_HEADERS,
+	"hard_line_break":            blackfriday.EXTENSION_HARD_LINE_BREAK,
+	"tab_size_eight":             blackfriday.EXTENSION_TAB_SIZE_EIGHT,
+	"footnotes":                  blackfriday.EXTENSION_FOOTNOTES,
+	"no_empty_line_before_block": blackfriday.EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK,
+	"header_ids":                 blackfriday.EXTENSION_HEADER_IDS,
+	"titleblock":                 blackfriday.EXTENSION_TITLEBLOCK,
+	"auto_header_ids":            blackfriday.EXTENSION_AUTO_HEADER_IDS,
+	"backslash_line_break":       blackfriday.EXTENSION_BACKSLASH_LINE_BREAK,
+	"definition_lists":           blackfriday.EXTENSION_DEFINITION_LISTS,
+	"join_lines":                 blackfriday.EXTENSION_JOIN_LINES,
+}
+
+// blackfriday HTML flags by name in Config.Markdown. The flags building whole
+// pages or tables of contents are left to MarkdownConfig.TOC.
+var markdownHTMLFlags = map[string]int{
+	"skip_html":                 blackfriday.HTML_SKIP_HTML,
+	"skip_style":                blackfriday.HTML_SKIP_STYLE,
+	"skip_images":               blackfriday.HTML_SKIP_IMAGES,
+	"skip_links":                blackfriday.HTML_SKIP_LINKS,
+	"safelink":                  blackfriday.HTML_SAFELINK,
+	"nofollow_links":            blackfriday.HTML_NOFOLLOW_LINKS,
+	"noreferrer_links":          blackfriday.HTML_NOREFERRER_LINKS,
+	"noopener_links":            blackfriday.HTML_NOOPENER_LINKS,
+	"href_target_blank":         blackfriday.HTML_HREF_TARGET_BLANK,
+	"use_xhtml":                 blackfriday.HTML_USE_XHTML,
+	"smartypants":               blackfriday.HTML_USE_SMARTYPANTS,
+	"smartypants_fractions":     blackfriday.HTML_SMARTYPANTS_FRACTIONS,
+	"smartypants_dashes":        blackfriday.HTML_SMARTYPANTS_DASHES,
+	"smartypants_latex_dashes":  blackfriday.HTML_SMARTYPANTS_LATEX_DASHES,
+	"smartypants_angled_quotes": blackfriday.HTML_SMARTYPANTS_ANGLED_QUOTES,
+	"smartypants_quotes_nbsp":   blackfriday.HTML_SMARTYPANTS_QUOTES_NBSP,
+	"footnote_return_links":     blackfriday.HTML_FOOTNOTE_RETURN_LINKS,
+}
+
+// extensions comments never get: their heading ids and footnotes could
+// collide with the ones of the article they're shown under
+const COMMENT_EXCLUDED_EXTENSIONS = blackfriday.EXTENSION_HEADER_IDS |
+	blackfriday.EXTENSION_AUTO_HEADER_IDS | blackfriday.EXTENSION_FOOTNOTES
+
+// MarkdownConfig is the Markdown section of settings.json. Extensions and
+// HTMLFlags name blackfriday's EXTENSION_ and HTML_ constants in lower case
+// without the prefix, e.g. "footnotes" or "href_target_blank".
+type MarkdownConfig struct {
+	Extensions []string
+	HTMLFlags  []string
+	// collect the headings of an article into a table of contents
+	TOC bool
+	// highlight fenced code blocks in the languages of RegisterLexer
+	Highlight bool
+	// the excerpt of an article without EXCERPT_MARKER or a summary ends
+	// after this many words or top level paragraphs, 0 for no limit
+	ExcerptWords      int
+	ExcerptParagraphs int
+}
+
+// DefaultMarkdownConfig returns blackfriday.MarkdownCommon's settings, with
+// ids made of their text on headings, a table of contents and highlighting.
+func DefaultMarkdownConfig() MarkdownConfig {
+	return MarkdownConfig{
+		Extensions: []string{"no_intra_emphasis", "tables", "fenced_code", "autolink",
+			"strikethrough", "space_headers", "header_ids", "auto_header_ids",
+			"backslash_line_break", "definition_lists"},
+		HTMLFlags: []string{"use_xhtml", "smartypants", "smartypants_fractions",
+			"smartypants_dashes", "smartypants_latex_dashes"},
+		TOC:               true,
+		Highlight:         true,
+		ExcerptWords:      60,
+		ExcerptParagraphs: 3,
+	}
+}
+
+// MarkdownPipeline renders the Markdown of articles and comments.
+type MarkdownPipeline struct {
+	Extensions        int
+	HTMLFlags         int
+	TOC               bool
+	Highlight         bool
+	ExcerptWords      int
+	ExcerptParagraphs int
+	version           string
+}
+
+var markdown *MarkdownPipeline = nil
+
+func init() {
+	cfg := DefaultMarkdownConfig()
+	markdown, _ = NewMarkdownPipeline(&cfg)
+}
+
+func markdownFlags(names []string, known map[string]int, kind string) (int, error) {
+	flags := 0
+	for _, name := range names {
+		flag, ok := known[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			names := make([]string, 0, len(known))
+			for name := range known {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return 0, fmt.Errorf("unknown Markdown %s '%s', known: %s", kind, name, strings.Join(names, ", "))
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+func NewMarkdownPipeline(cfg *MarkdownConfig) (*MarkdownPipeline, error) {
+	extensions, err := markdownFlags(cfg.Extensions, markdownExtensions, "extension")
+	if err != nil {
+		return nil, err
+	}
+	htmlFlags, err := markdownFlags(cfg.HTMLFlags, markdownHTMLFlags, "HTML flag")
+	if err != nil {
+		return nil, err
+	}
+	p := &MarkdownPipeline{Extensions: extensions, HTMLFlags: htmlFlags, TOC: cfg.TOC, Highlight: cfg.Highlight,
+		ExcerptWords: cfg.ExcerptWords, ExcerptParagraphs: cfg.ExcerptParagraphs}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%d:%v:%v:%d:%d", extensions, htmlFlags, cfg.TOC, cfg.Highlight,
+		cfg.ExcerptWords, cfg.ExcerptParagraphs)))
+	p.version = fmt.Sprintf("%d-%x", RENDERER_VERSION, sum[:4])
+	return p, nil
+}
+
+// ConfigureMarkdown makes the articles and comments saved from now on render
+// with cfg. HTML rendered before keeps its version and is found stale.
+func ConfigureMarkdown(cfg *MarkdownConfig) error {
+	p, err := NewMarkdownPipeline(cfg)
+	if err != nil {
+		return err
+	}
+	markdown = p
+	return nil
+}
+
+// MarkdownPipeline.RenderArticle renders the source of an article to HTML,
+// expanding its shortcodes, and, if TOC is set and the article has headings, a
+// table of contents.
+func (p *MarkdownPipeline) RenderArticle(text []byte) ([]byte, []byte) {
+	return p.renderArticle(newShortcodeExpander(p, text), text)
+}
+
+func (p *MarkdownPipeline) renderArticle(e *shortcodeExpander, text []byte) ([]byte, []byte) {
+	flags := p.HTMLFlags
+	if p.TOC {
+		flags |= blackfriday.HTML_TOC
+	}
+	text, calls := e.expand(text, 1)
+	out := p.renderMarkdown(text, flags, p.Extensions)
+	var toc []byte = nil
+	if p.TOC {
+		out, toc = splitTOC(out)
+		// the table of contents lists the headings without their shortcodes
+		if toc != nil {
+			toc = stripShortcodeTokens(toc, calls, true)
+		}
+	}
+	return e.substitute(out, calls), toc
+}
+
+// splitTOC takes the table of contents blackfriday puts in a <nav> before
+// the contents out of out, nil if there is none.
+func splitTOC(out []byte) ([]byte, []byte) {
+	if !bytes.HasPrefix(out, []byte("<nav>\n")) {
+		return out, nil
+	}
+	end := bytes.Index(out, []byte("</nav>\n"))
+	if end < 0 {
+		return out, nil
+	}
+	toc := out[len("<nav>\n"):end]
+	html := bytes.TrimLeft(out[end+len("</nav>\n"):], "\n")
+	if len(bytes.TrimSpace(toc)) == 0 {
+		return html, nil
+	}
+	return html, toc
+}
+
+// MarkdownPipeline.RenderComment renders the source of a comment to HTML,
+// shortcodes are left as they are written.
+func (p *MarkdownPipeline) RenderComment(text []byte) []byte {
+	return p.renderMarkdown(text, p.HTMLFlags, p.Extensions&^COMMENT_EXCLUDED_EXTENSIONS)
+}
+
+func (p *MarkdownPipeline) renderMarkdown(text []byte, flags int, extensions int) []byte {
+	return blackfriday.Markdown(text, p.renderer(flags), extensions)
+}
+
+func (p *MarkdownPipeline) renderer(flags int) blackfriday.Renderer {
+	renderer := blackfriday.HtmlRenderer(flags, "", "")
+	if p.Highlight {
+		return &highlighter{renderer}
+	}
+	return renderer
+}
+
+// RendererVersion returns the version HTML rendered now is stamped with, it
+// changes with RENDERER_VERSION, with Config.Markdown and with the shortcodes
+// of the theme.
+func RendererVersion() string {
+	if shortcodes := Templates().Shortcodes; shortcodes != nil {
+		return markdown.version + "-" + shortcodes.Sum
+	}
+	return markdown.version
+}
+
+// HTMLRecord is a record of ArticleHTMLDB or CommentHTMLDB.
+type HTMLRecord struct {
+	// "" for the records stored before they had a header
+	Version string
+	TOC     []byte
+	// nil if the whole article is short enough to be its excerpt
+	Excerpt []byte
+	// the excerpt ends at EXCERPT_MARKER
+	Marked bool
+	HTML   []byte
+}
+
+// EncodeHTMLRecord prefixes HTML with the header of a record.
+func EncodeHTMLRecord(record *HTMLRecord) []byte {
+	header := HTML_HEADER_PREFIX + record.Version
+	if len(record.TOC) != 0 {
+		header += " " + HTML_HEADER_TOC + strconv.Itoa(len(record.TOC))
+	}
+	if len(record.Excerpt) != 0 {
+		if record.Marked {
+			header += " " + HTML_HEADER_MORE + strconv.Itoa(len(record.Excerpt))
+		} else {
+			header += " " + HTML_HEADER_EXCERPT + strconv.Itoa(len(record.Excerpt))
+		}
+	}
+	header += HTML_HEADER_SUFFIX
+	buff := make([]byte, 0, len(header)+len(record.TOC)+len(record.Excerpt)+len(record.HTML))
+	buff = append(buff, header...)
+	buff = append(buff, record.TOC...)
+	buff = append(buff, record.Excerpt...)
+	return append(buff, record.HTML...)
+}
+
+// DecodeHTMLRecord splits a stored record into its parts. A record without a
+// valid header is all HTML.
+func DecodeHTMLRecord(buff []byte) *HTMLRecord {
+	legacy := &HTMLRecord{HTML: buff}
+	if !bytes.HasPrefix(buff, []byte(HTML_HEADER_PREFIX)) {
+		return legacy
+	}
+	end := bytes.Index(buff, []byte(HTML_HEADER_SUFFIX))
+	if end < 0 {
+		return legacy
+	}
+	fields := strings.Fields(string(buff[len(HTML_HEADER_PREFIX):end]))
+	if len(fields) == 0 {
+		return legacy
+	}
+	record := &HTMLRecord{Version: fields[0]}
+	body := buff[end+len(HTML_HEADER_SUFFIX):]
+	// the parts follow the header in the order of their fields
+	for _, field := range fields[1:] {
+		var part *[]byte
+		var prefix string
+		switch {
+		case strings.HasPrefix(field, HTML_HEADER_TOC):
+			part, prefix = &record.TOC, HTML_HEADER_TOC
+		case strings.HasPrefix(field, HTML_HEADER_EXCERPT):
+			part, prefix = &record.Excerpt, HTML_HEADER_EXCERPT
+		case strings.HasPrefix(field, HTML_HEADER_MORE):
+			part, prefix = &record.Excerpt, HTML_HEADER_MORE
+			record.Marked = true
+		default:
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(field, prefix))
+		if err != nil || n < 0 || n > len(body) {
+			return legacy
+		}
+		*part, body = body[:n], body[n:]
+	}
+	record.HTML = body
+	return record
+}
+
+// RenderArticleHTML renders the Markdown source of an article to the record
+// stored in ArticleHTMLDB.
+func RenderArticleHTML(text []byte) []byte {
+	html, toc := markdown.RenderArticle(text)
+	excerpt, marked := markdown.Excerpt(html)
+	return EncodeHTMLRecord(&HTMLRecord{Version: RendererVersion(), TOC: toc, Excerpt: excerpt, Marked: marked, HTML: html})
+}
+
+// RenderCommentHTML renders the Markdown source of a comment to the record
+// stored in CommentHTMLDB.
+func RenderCommentHTML(text []byte) []byte {
+	return EncodeHTMLRecord(&HTMLRecord{Version: RendererVersion(), HTML: markdown.RenderComment(text)})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+)
+
+// Versions of the stored metadata schemas. Bump one together with a new entry
+// in the according migration list when a field needs to be filled in or
+// converted for the records already stored.
+const (
+	ARTICLE_METADATA_VERSION = 2
+	COMMENT_METADATA_VERSION = 1
+)
+
+// Migration upgrades a raw metadata record from schema Version to Version+1.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(record map[string]interface{}) error
+}
+
+// articleMetadataMigrations and commentMetadataMigrations are ordered by
+// version, their length must equal the current schema version.
+var articleMetadataMigrations = []*Migration{
+	{0, "drop empty tags, mark articles without status as published", func(record map[string]interface{}) error {
+		tags := make([]interface{}, 0)
+		if lst, ok := record["Tags"].([]interface{}); ok {
+			for _, t := range lst {
+				if str, ok := t.(string); ok && len(str) != 0 {
+					tags = append(tags, str)
+				}
+			}
+		}
+		record["Tags"] = tags
+		if status, ok := record["Status"].(string); !ok || len(status) == 0 {
+			record["Status"] = ARTICLE_STATUS_PUBLISHED
+		}
+		return nil
+	}},
+	{1, "remember the published articles as first published when created", func(record map[string]interface{}) error {
+		if first, ok := record["FirstPublishTime"].(float64); ok && first != 0 {
+			return nil
+		}
+		if status, _ := record["Status"].(string); status == ARTICLE_STATUS_PUBLISHED {
+			record["FirstPublishTime"] = record["CreatedTime"]
+		}
+		return nil
+	}},
+}
+
+var commentMetadataMigrations = []*Migration{
+	{0, "fill in missing email hashes", func(record map[string]interface{}) error {
+		if hash, ok := record["EmailHash"].(string); !ok || len(hash) == 0 {
+			email, _ := record["Email"].(string)
+			record["EmailHash"] = MD5Sum(email)
+		}
+		return nil
+	}},
+}
+
+func init() {
+	if len(articleMetadataMigrations) != ARTICLE_METADATA_VERSION || len(commentMetadataMigrations) != COMMENT_METADATA_VERSION {
+		panic("metadata versions and migrations don't match")
+	}
+	RegisterCommand(&Command{
+		Name:  "migrate",
+		Usage: "migrate [-n]",
+		Help:  "Upgrade all stored metadata to the latest schema version, -n only counts the outdated records. Refused while the server is running.",
+		Run:   runMigrate,
+	})
+}
+
+func runMigrate(app *webapp.App, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "Count the outdated records without writing them")
+	flags.Parse(args)
+	if err := TattooDB.Load(app); err != nil {
+		return err
+	}
+	defer TattooDB.Close()
+	articles, comments, err := TattooDB.MigrateMetadata(*dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "Upgraded"
+	if *dryRun {
+		verb = "Outdated"
+	}
+	fmt.Printf("%s: %d article metadata (version %d), %d comment metadata (version %d).\n",
+		verb, articles, ARTICLE_METADATA_VERSION, comments, COMMENT_METADATA_VERSION)
+	return nil
+}
+
+// TattooStorage.MigrateMetadata rewrites every outdated article and comment
+// metadata record with the latest schema in one transaction, and returns how
+// many of each were outdated. Records are upgraded on load anyway, this makes
+// the upgrade permanent.
+func (s *TattooStorage) MigrateMetadata(dryRun bool) (int, int, error) {
+	tx := s.Begin()
+	defer tx.Rollback()
+	articles, err := migrateStore(tx, &s.MetadataDB, articleMetadataMigrations)
+	if err != nil {
+		return 0, 0, err
+	}
+	comments, err := migrateStore(tx, &s.CommentMetadataDB, commentMetadataMigrations)
+	if err != nil {
+		return 0, 0, err
+	}
+	if dryRun {
+		return articles, comments, nil
+	}
+	return articles, comments, tx.Commit()
+}
+
+func migrateStore(tx *webapp.Transaction, fs *webapp.Store, migrations []*Migration) (int, error) {
+	count := 0
+	for _, key := range fs.Keys() {
+		buff, err := tx.Get(fs, key)
+		if err != nil {
+			return count, err
+		}
+		buff, changed, err := MigrateRecord(buff, migrations)
+		if err != nil {
+			return count, fmt.Errorf("%s: %v", key, err)
+		}
+		if changed {
+			tx.Set(fs, key, buff)
+			count += 1
+		}
+	}
+	return count, nil
+}
+
+// recordVersion returns the schema version of a raw record, 0 for records
+// written before metadata had a version.
+func recordVersion(record map[string]interface{}) (int, error) {
+	value, ok := record["Version"]
+	if !ok || value == nil {
+		return 0, nil
+	}
+	version, ok := value.(float64)
+	if !ok {
+		return 0, fmt.Errorf("bad version %v", value)
+	}
+	return int(version), nil
+}
+
+// MigrateRecord upgrades a JSON metadata record to the latest schema version.
+// It returns the record unchanged and false if it's already up to date.
+func MigrateRecord(buff []byte, migrations []*Migration) ([]byte, bool, error) {
+	record := make(map[string]interface{})
+	if err := json.Unmarshal(buff, &record); err != nil {
+		return nil, false, err
+	}
+	version, err := recordVersion(record)
+	if err != nil {
+		return nil, false, err
+	}
+	if version > len(migrations) {
+		return nil, false, fmt.Errorf("version %d is newer than this tattoo (%d)", version, len(migrations))
+	}
+	if version == len(migrations) {
+		return buff, false, nil
+	}
+	for _, m := range migrations[version:] {
+		if err := m.Apply(record); err != nil {
+			return nil, false, fmt.Errorf("migration to version %d (%s): %v", m.Version+1, m.Description, err)
+		}
+	}
+	record["Version"] = len(migrations)
+	buff, err = json.Marshal(record)
+	if err != nil {
+		return nil, false, err
+	}
+	return buff, true, nil
+}
+
+// DecodeArticleMetadata decodes a stored article metadata record, upgrading
+// it to the latest schema first if it's older.
+func DecodeArticleMetadata(buff []byte) (*ArticleMetadata, error) {
+	buff, _, err := MigrateRecord(buff, articleMetadataMigrations)
+	if err != nil {
+		return nil, err
+	}
+	meta := new(ArticleMetadata)
+	if err := json.Unmarshal(buff, meta); err != nil {
+		return nil, err
+	}
+	if meta.Tags == nil {
+		meta.Tags = make([]string, 0)
+	}
+	return meta, nil
+}
+
+// DecodeCommentMetadata decodes a stored comment metadata record, upgrading
+// it to the latest schema first if it's older.
+func DecodeCommentMetadata(buff []byte) (*CommentMetadata, error) {
+	buff, _, err := MigrateRecord(buff, commentMetadataMigrations)
+	if err != nil {
+		return nil, err
+	}
+	meta := new(CommentMetadata)
+	if err := json.Unmarshal(buff, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
@@ -6,10 +6,20 @@ import (
 	"time"
 )
 
+const (
+	ARTICLE_STATUS_DRAFT     = "draft"
+	ARTICLE_STATUS_SCHEDULED = "scheduled"
+	ARTICLE_STATUS_PUBLISHED = "published"
+	PUBLISH_TIME_LAYOUT      = "2006-01-02T15:04"
+)
+
 type ArticleMetadata struct {
+	Version        int
 	Name           string
 	Author         string
 	IsPage         bool
+	Status         string
+	PublishTime    int64
 	Title          string
 	Tags           []string
 	FeaturedPicURL string
@@ -17,11 +27,18 @@ type ArticleMetadata struct {
 	CreatedTime    int64
 	ModifiedTime   int64
 	Hits           int64
+
+	// when the article was first published, 0 until then; it keeps its
+	// created time when published again
+	FirstPublishTime int64
 }
 
 type Article struct {
 	Metadata ArticleMetadata
 	Text     template.HTML
+	// the beginning of the article for lists, HasMore if it isn't all of it
+	Excerpt  template.HTML
+	HasMore  bool
 	Comments []*Comment
 }
 
@@ -54,6 +71,47 @@ func (meta *ArticleMetadata) TagRawList() string {
 	return strings.Join(meta.Tags, ", ")
 }
 
+// ArticleMetadata.Clone returns a copy which shares nothing with meta.
+func (meta *ArticleMetadata) Clone() *ArticleMetadata {
+	ret := *meta
+	if meta.Tags != nil {
+		ret.Tags = make([]string, len(meta.Tags))
+		copy(ret.Tags, meta.Tags)
+	}
+	return &ret
+}
+
+// ArticleMetadata.IsPublished reports if the article is public. Articles saved
+// before there was a status have none and are published.
+func (meta *ArticleMetadata) IsPublished() bool {
+	return len(meta.Status) == 0 || meta.Status == ARTICLE_STATUS_PUBLISHED
+}
+
+func (meta *ArticleMetadata) IsDraft() bool {
+	return meta.Status == ARTICLE_STATUS_DRAFT
+}
+
+func (meta *ArticleMetadata) IsScheduled() bool {
+	return meta.Status == ARTICLE_STATUS_SCHEDULED
+}
+
+// ArticleMetadata.IsDue reports if a scheduled article should be published at now.
+func (meta *ArticleMetadata) IsDue(now int64) bool {
+	return meta.IsScheduled() && meta.PublishTime <= now
+}
+
+func (meta *ArticleMetadata) PublishTimeHumanReading() string {
+	return TimeHumanReading(meta.PublishTime)
+}
+
+// ArticleMetadata.PublishTimeInput formats PublishTime for a datetime-local input.
+func (meta *ArticleMetadata) PublishTimeInput() string {
+	if meta.PublishTime == 0 {
+		return ""
+	}
+	return time.Unix(meta.PublishTime, 0).Local().Format(PUBLISH_TIME_LAYOUT)
+}
+
 func (meta *ArticleMetadata) HasFeaturedPic() bool {
 	if len(meta.FeaturedPicURL) == 0 {
 		return false
@@ -68,58 +126,13 @@ func (meta *ArticleMetadata) HasSummary() bool {
 	return true
 }
 
-func (m *ArticleMetadata) BuildFromJson(json interface{}) {
-	var jsonMap map[string]interface{}
-	jsonMap = json.(map[string]interface{})
-	for k, v := range jsonMap {
-		switch vv := v.(type) {
-		case string:
-			switch k {
-			case "Name":
-				m.Name = vv
-			case "Author":
-				m.Author = vv
-			case "Title":
-				m.Title = vv
-			case "FeaturedPicURL":
-				m.FeaturedPicURL = vv
-			case "Summary":
-				m.Summary = vv
-			}
-		case bool:
-			if k == "IsPage" {
-				m.IsPage = bool(vv)
-			}
-		case float64:
-			if k == "CreatedTime" {
-				m.CreatedTime = int64(vv)
-			} else if k == "ModifiedTime" {
-				m.ModifiedTime = int64(vv)
-			} else if k == "Hits" {
-				m.Hits = int64(vv)
-			}
-		default:
-			if k == "Tags" {
-				m.Tags = []string{}
-				if vv != nil {
-					tags := vv.([]interface{})
-					for _, t := range tags {
-						if t.(string) != "" {
-							m.Tags = append(m.Tags, t.(string))
-						}
-					}
-				}
-			}
-		}
-	}
-}
-
 type CommentIndexItem struct {
 	Name         string
 	CommentNames []string
 }
 
 type CommentMetadata struct {
+	Version     int
 	Name        string
 	Author      string
 	ArticleName string
@@ -131,40 +144,6 @@ type CommentMetadata struct {
 	CreatedTime int64
 }
 
-func (m *CommentMetadata) BuildFromJson(json interface{}) {
-	var jsonMap map[string]interface{}
-	jsonMap = json.(map[string]interface{})
-	for k, v := range jsonMap {
-		switch vv := v.(type) {
-		case string:
-			str := vv
-			switch k {
-			case "Name":
-				m.Name = str
-			case "Author":
-				m.Author = str
-			case "URL":
-				m.URL = str
-			case "IP":
-				m.IP = str
-			case "Email":
-				m.Email = str
-			case "EmailHash":
-				m.EmailHash = str
-			case "UAgent":
-				m.UAgent = str
-			case "ArticleName":
-				m.ArticleName = str
-			}
-		case float64:
-			if k == "CreatedTime" {
-				m.CreatedTime = int64(vv)
-			}
-		default:
-		}
-	}
-}
-
 func (meta *CommentMetadata) CreatedTimeHumanReading() string {
 	return TimeHumanReading(meta.CreatedTime)
 }
@@ -13,12 +13,14 @@ type T_FLAGS struct {
 	Page     bool
 	Feed     bool
 
-	WriterOverview bool
-	WriterPages    bool
-	WriterTags     bool
-	WriterComments bool
-	WriterSettings bool
-	WriterEditor   bool
+	WriterOverview  bool
+	WriterPages     bool
+	WriterTags      bool
+	WriterComments  bool
+	WriterSettings  bool
+	WriterEditor    bool
+	WriterRevisions bool
+	WriterTrash     bool
 }
 
 type T_DATA struct {
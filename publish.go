@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"time"
+)
+
+const PUBLISH_CHECK_INTERVAL = time.Minute
+
+// TattooStorage.PublishDue publishes every scheduled article whose publish
+// time is up to now. An article published for the first time takes its
+// publish time as created time, so it shows up where it belongs on the
+// timeline; one published before keeps its created time. It returns the names
+// of the articles published.
+func (s *TattooStorage) PublishDue(now int64) ([]string, error) {
+	s.timelineLock.RLock()
+	drafts := make([]string, len(s.DraftTimeline))
+	copy(drafts, s.DraftTimeline)
+	s.timelineLock.RUnlock()
+
+	tx := s.Begin()
+	defer tx.Rollback()
+	published := make([]string, 0)
+	for _, name := range drafts {
+		meta, err := s.getMeta(tx, name)
+		if err != nil || !meta.IsDue(now) {
+			continue
+		}
+		meta.Status = ARTICLE_STATUS_PUBLISHED
+		if meta.FirstPublishTime == 0 {
+			meta.CreatedTime = meta.PublishTime
+		}
+		s.updateMetadata(tx, meta)
+		s.updateArticleTagIndex(tx, name, meta.Tags)
+		if err := s.placeArticle(tx, name, meta); err != nil {
+			return nil, err
+		}
+		s.logArticle(name, nil, meta)
+		published = append(published, name)
+	}
+	if len(published) == 0 {
+		return published, nil
+	}
+	return published, tx.Commit()
+}
+
+// StartPublishScheduler publishes the scheduled articles which are due now and
+// then checks again every PUBLISH_CHECK_INTERVAL.
+func StartPublishScheduler(app *webapp.App) {
+	publish := func() {
+		names, err := TattooDB.PublishDue(time.Now().Unix())
+		if err != nil {
+			app.Log("Publish", fmt.Sprintf("Failed: %v", err))
+		}
+		for _, name := range names {
+			app.Log("Publish", "Published "+name)
+		}
+	}
+	publish()
+	go func() {
+		for range time.Tick(PUBLISH_CHECK_INTERVAL) {
+			publish()
+		}
+	}()
+}
@@ -9,17 +9,58 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 )
 
-var mainTPL *template.Template
-var writerTPL *template.Template
-var guardTPL *template.Template
-var feedTPL *template.Template
-var editorTPL *template.Template
-var notFoundTPL *template.Template
+// TemplateSet is every template the pages are rendered with. A published set
+// is never changed, loading templates publishes a new one, so a request is
+// rendered with the templates of a single set.
+type TemplateSet struct {
+	Main       *template.Template
+	Writer     *template.Template
+	Guard      *template.Template
+	Feed       *template.Template
+	Editor     *template.Template
+	NotFound   *template.Template
+	Shortcodes *ThemeShortcodes
+}
+
+var templates struct {
+	lock sync.RWMutex
+	set  *TemplateSet
+	// serializes the updates, so none is lost
+	updateLock sync.Mutex
+}
+
+// Templates returns the templates in use.
+func Templates() *TemplateSet {
+	templates.lock.RLock()
+	defer templates.lock.RUnlock()
+	if templates.set == nil {
+		return &TemplateSet{}
+	}
+	return templates.set
+}
+
+// UpdateTemplates calls parse with a copy of the templates in use and
+// publishes the copy if parse succeeds. If it fails, the templates in use are
+// kept as they are.
+func UpdateTemplates(parse func(set *TemplateSet) error) error {
+	templates.updateLock.Lock()
+	defer templates.updateLock.Unlock()
+	set := *Templates()
+	if err := parse(&set); err != nil {
+		return err
+	}
+	templates.lock.Lock()
+	templates.set = &set
+	templates.lock.Unlock()
+	return nil
+}
 
 func HasTemplate(name string) bool {
-	return mainTPL.Lookup(name) != nil
+	set := Templates()
+	return set.Main != nil && set.Main.Lookup(name) != nil
 }
 
 func parseTemplates(fileList []string) (tpl *template.Template, err error) {
@@ -37,10 +78,11 @@ func parseTemplates(fileList []string) (tpl *template.Template, err error) {
 	return
 }
 
-func LoadSystemTemplates() error {
+// ParseSystemTemplates parses the templates of the writer pages, the guard
+// and the feed into set.
+func ParseSystemTemplates(set *TemplateSet) error {
 	var err error
-	// system templates
-	writerTPL, err = template.ParseFiles(
+	set.Writer, err = template.ParseFiles(
 		"sys/template/bare.html",
 		"sys/template/nav.html",
 		"sys/template/tags.html",
@@ -48,26 +90,27 @@ func LoadSystemTemplates() error {
 		"sys/template/comments.html",
 		"sys/template/settings.html",
 		"sys/template/overview.html",
+		"sys/template/revisions.html",
+		"sys/template/trash.html",
 		"sys/template/content.html")
 	if err != nil {
 		return err
 	}
-	editorTPL, err = template.ParseFiles("sys/template/editor.html")
+	set.Editor, err = template.ParseFiles("sys/template/editor.html")
 	if err != nil {
 		return err
 	}
-	guardTPL, err = template.ParseFiles("sys/template/guard.html")
-	if err != nil {
-		return err
-	}
-	feedTPL, err = template.ParseFiles("sys/template/feed_atom.html")
+	set.Guard, err = template.ParseFiles("sys/template/guard.html")
 	if err != nil {
 		return err
 	}
+	set.Feed, err = template.ParseFiles("sys/template/feed_atom.html")
 	return err
 }
 
-func LoadThemeTemplates(themeName string) error {
+// ParseThemeTemplates parses the templates and the shortcodes of a theme into
+// set.
+func ParseThemeTemplates(set *TemplateSet, themeName string) error {
 	var err error
 	// required templates
 	required_files := []string{
@@ -89,25 +132,36 @@ func LoadThemeTemplates(themeName string) error {
 		}
 	}
 	fmt.Printf("%v, %v\n", len(files), files)
-	mainTPL, err = parseTemplates(files)
+	set.Main, err = parseTemplates(files)
 	if err != nil {
 		fmt.Printf("%v", err)
 		return err
 	}
 	// optional templates
-	notFoundTPL, err = template.ParseFiles(
+	set.NotFound, err = template.ParseFiles(
 		fmt.Sprintf("theme/%s/template/404.html", themeName))
 	if err != nil {
 		return err
 	}
+	set.Shortcodes, err = LoadThemeShortcodes(themeName)
 	return err
 }
 
+func LoadSystemTemplates() error {
+	return UpdateTemplates(ParseSystemTemplates)
+}
+
+func LoadThemeTemplates(themeName string) error {
+	return UpdateTemplates(func(set *TemplateSet) error {
+		return ParseThemeTemplates(set, themeName)
+	})
+}
+
 func RenderHome(ctx *webapp.Context) error {
 	vars := make(map[string]interface{})
 	data := MakeData(ctx, vars)
 	data.Flags.Home = true
-	err := ctx.Execute(mainTPL, &data)
+	err := ctx.Execute(Templates().Main, &data)
 	return err
 }
 
@@ -125,7 +179,7 @@ func RenderSinglePage(ctx *webapp.Context, name string, lastMeta *CommentMetadat
 	} else {
 		data.Flags.Single = true
 	}
-	err = ctx.Execute(mainTPL, &data)
+	err = ctx.Execute(Templates().Main, &data)
 	return err
 }
 
@@ -148,7 +202,7 @@ func RenderTagPage(ctx *webapp.Context, offset int, tag string) error {
 	}
 	data := MakeData(ctx, vars)
 	data.Flags.Tag = true
-	err := ctx.Execute(mainTPL, &data)
+	err := ctx.Execute(Templates().Main, &data)
 	return err
 }
 
@@ -167,7 +221,7 @@ func RenderArticles(ctx *webapp.Context, offset int) error {
 	}
 	data := MakeData(ctx, vars)
 	data.Flags.Articles = true
-	err := ctx.Execute(mainTPL, &data)
+	err := ctx.Execute(Templates().Main, &data)
 	return err
 }
 
@@ -178,7 +232,7 @@ func RenderGuard(ctx *webapp.Context, hint string) error {
 		vars["Error"] = hint
 	}
 	data := MakeData(ctx, vars)
-	err := ctx.Execute(guardTPL, &data)
+	err := ctx.Execute(Templates().Guard, &data)
 	return err
 }
 
@@ -188,16 +242,24 @@ func RenderFeedAtom(ctx *webapp.Context) error {
 	data := MakeData(ctx, vars)
 	data.Flags.Feed = true
 	ctx.SetHeader("Content-Type", "application/atom+xml")
-	err := ctx.Execute(feedTPL, &data)
+	err := ctx.Execute(Templates().Feed, &data)
 	return err
 }
 
 func RenderWriterEditor(ctx *webapp.Context, article *Article) error {
+	return RenderWriterEditorErrors(ctx, article, article.Metadata.Name, nil)
+}
+
+// RenderWriterEditorErrors renders the editor again with an article which
+// couldn't be saved, the name it had and the errors why.
+func RenderWriterEditorErrors(ctx *webapp.Context, article *Article, origName string, errs []error) error {
 	vars := make(map[string]interface{})
 	vars["Article"] = article
+	vars["OrigName"] = origName
+	vars["Errors"] = errs
 	data := MakeData(ctx, vars)
 	data.Flags.WriterEditor = true
-	err := ctx.Execute(editorTPL, &data)
+	err := ctx.Execute(Templates().Editor, &data)
 	return err
 }
 
@@ -216,7 +278,7 @@ func RenderWriterOverview(ctx *webapp.Context, offset int) error {
 	}
 	data := MakeData(ctx, vars)
 	data.Flags.WriterOverview = true
-	err := ctx.Execute(writerTPL, &data)
+	err := ctx.Execute(Templates().Writer, &data)
 	return err
 }
 
@@ -235,7 +297,7 @@ func RenderWriterPages(ctx *webapp.Context, offset int) error {
 	}
 	data := MakeData(ctx, vars)
 	data.Flags.WriterPages = true
-	err := ctx.Execute(writerTPL, &data)
+	err := ctx.Execute(Templates().Writer, &data)
 	return err
 }
 
@@ -254,32 +316,80 @@ func RenderWriterComments(ctx *webapp.Context, offset int) error {
 	}
 	data := MakeData(ctx, vars)
 	data.Flags.WriterComments = true
-	err := ctx.Execute(writerTPL, &data)
+	err := ctx.Execute(Templates().Writer, &data)
 	return err
 }
 
 func Render404page(ctx *webapp.Context, msg string) error {
-	if notFoundTPL != nil {
+	if tpl := Templates().NotFound; tpl != nil {
 		vars := make(map[string]interface{})
 		vars["Message"] = msg
 		vars["URL"] = ctx.Request.RequestURI
 		vars["Referer"] = ctx.Request.Referer()
 		data := MakeData(ctx, vars)
-		err := ctx.Execute(notFoundTPL, &data)
+		err := ctx.Execute(tpl, &data)
 		return err
 	} else {
 		ctx.Error(fmt.Sprintf("%s: %s", webapp.ErrNotFound, msg),
 			http.StatusNotFound)
 		return nil
 	}
-	return nil
 }
 
 func RenderWriterSettings(ctx *webapp.Context, msg string) error {
 	vars := make(map[string]interface{})
 	vars["Message"] = msg
+	vars["CacheStats"] = TattooDB.CacheStats()
 	data := MakeData(ctx, vars)
 	data.Flags.WriterSettings = true
-	err := ctx.Execute(writerTPL, &data)
+	err := ctx.Execute(Templates().Writer, &data)
+	return err
+}
+
+// RenderWriterRevisions lists the revisions of an article and shows the diff
+// between revision from and revision to, which default to the last two.
+func RenderWriterRevisions(ctx *webapp.Context, name string, from int, to int) error {
+	meta, err := TattooDB.GetMeta(name)
+	if err != nil {
+		return err
+	}
+	revs, err := TattooDB.GetRevisions(name)
+	if err != nil {
+		return err
+	}
+	if to <= 0 {
+		to = len(revs)
+	}
+	if from <= 0 {
+		from = to - 1
+	}
+	vars := make(map[string]interface{})
+	vars["Metadata"] = meta
+	vars["Revisions"] = revs
+	vars["From"] = from
+	vars["To"] = to
+	if _, newText, err := TattooDB.GetRevision(name, to); err == nil {
+		oldText := []byte{}
+		if from >= 1 {
+			if _, oldText, err = TattooDB.GetRevision(name, from); err != nil {
+				return err
+			}
+		}
+		vars["Diff"] = DiffLines(string(oldText), string(newText))
+	}
+	data := MakeData(ctx, vars)
+	data.Flags.WriterRevisions = true
+	err = ctx.Execute(Templates().Writer, &data)
+	return err
+}
+
+func RenderWriterTrash(ctx *webapp.Context, msg string) error {
+	vars := make(map[string]interface{})
+	vars["Message"] = msg
+	vars["Items"] = TattooDB.GetTrash()
+	vars["Retention"] = GetConfig().TrashRetention
+	data := MakeData(ctx, vars)
+	data.Flags.WriterTrash = true
+	err := ctx.Execute(Templates().Writer, &data)
 	return err
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"sync"
+	"testing"
+)
+
+func testTemplate(text string) *template.Template {
+	return template.Must(template.New("bare.html").Parse(text))
+}
+
+func TestUpdateTemplatesFailureKeepsSet(t *testing.T) {
+	UpdateTemplates(func(set *TemplateSet) error {
+		set.Main = testTemplate("main 1")
+		set.Writer = testTemplate("writer 1")
+		return nil
+	})
+	before := Templates()
+	err := UpdateTemplates(func(set *TemplateSet) error {
+		set.Main = testTemplate("main 2")
+		return errors.New("writer templates broken")
+	})
+	if err == nil {
+		t.Fatal("UpdateTemplates didn't return the error")
+	}
+	if after := Templates(); after != before || after.Main != before.Main || after.Writer != before.Writer {
+		t.Fatal("a failed update replaced templates")
+	}
+}
+
+// TestTemplatesConcurrentUpdate renders while the templates are replaced; run
+// it with -race. The main and writer templates of a set are updated together,
+// so a render never sees them from two different updates.
+func TestTemplatesConcurrentUpdate(t *testing.T) {
+	UpdateTemplates(func(set *TemplateSet) error {
+		set.Main = testTemplate("0")
+		set.Writer = testTemplate("0")
+		return nil
+	})
+	var wg sync.WaitGroup
+	quit := make(chan struct{})
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				set := Templates()
+				var main, writer bytes.Buffer
+				set.Main.Execute(&main, nil)
+				set.Writer.Execute(&writer, nil)
+				if main.String() != writer.String() {
+					errs <- fmt.Errorf("main %s and writer %s from different updates", main.String(), writer.String())
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 200; i++ {
+		text := fmt.Sprintf("%d", i)
+		UpdateTemplates(func(set *TemplateSet) error {
+			set.Main = testTemplate(text)
+			set.Writer = testTemplate(text)
+			return nil
+		})
+		// a failing update in between publishes nothing
+		UpdateTemplates(func(set *TemplateSet) error {
+			set.Main = testTemplate("broken")
+			return errors.New("broken")
+		})
+	}
+	close(quit)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
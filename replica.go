@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// carries Config.ReplicaToken on the requests of a follower
+	REPLICA_TOKEN_HEADER = "X-Tattoo-Replica-Token"
+	// records fetched by one request
+	REPLICA_BATCH_SIZE = 200
+	// bytes of a request body the primary reads at most
+	REPLICA_MAX_BODY = 4 << 20
+	REPLICA_TIMEOUT  = 30 * time.Second
+
+	REPLICA_ROLE_PRIMARY  = "primary"
+	REPLICA_ROLE_FOLLOWER = "follower"
+
+	// changes a follower catches up with one by one at most, a longer gap
+	// is closed by a full sync
+	REPLICA_MAX_CHANGES = 5000
+
+	ERROR_REPLICA_TOKEN = "ReplicaToken must be set to follow a primary"
+	ERROR_REPLICA_GAP   = "The change log of the primary can't close the gap"
+)
+
+var errReplicaGap = errors.New(ERROR_REPLICA_GAP)
+
+// ReplicaStoreSum is the record count and checksum of a storage, as computed
+// by StoreChecksum. Name is the bucket name of the storage.
+type ReplicaStoreSum struct {
+	Name  string
+	Count int
+	Sum   string
+}
+
+// ReplicaStatus tells how far a follower is behind its primary. Seq is the
+// last change it has, PrimarySeq the last one the primary had when it was
+// polled and Lag the changes in between. LagSeconds is the time since the
+// follower was last known to be in sync.
+type ReplicaStatus struct {
+	Role       string
+	Seq        int64
+	PrimarySeq int64  `json:",omitempty"`
+	Lag        int64  `json:",omitempty"`
+	SyncedTime int64  `json:",omitempty"`
+	LagSeconds int64  `json:",omitempty"`
+	Error      string `json:",omitempty"`
+}
+
+// Replica is the follower side of replication. Whenever the change log of
+// the primary moves on, it fetches the records the new changes may have
+// written into the local TattooStorage. Every ResyncInterval it compares
+// every replicated storage with the primary in any case, which brings over
+// what isn't logged such as hits.
+type Replica struct {
+	Primary        *url.URL
+	Token          string
+	PollInterval   time.Duration
+	ResyncInterval time.Duration
+	client         *http.Client
+	proxy          *httputil.ReverseProxy
+	lock           sync.Mutex
+	status         ReplicaStatus
+}
+
+// the replica of a follower, nil on a primary
+var Follower *Replica = nil
+
+func NewReplica(primary string, token string) (*Replica, error) {
+	if len(token) == 0 {
+		return nil, errors.New(ERROR_REPLICA_TOKEN)
+	}
+	u, err := url.Parse(primary)
+	if err != nil {
+		return nil, fmt.Errorf("ReplicaPrimary '%s': %v", primary, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || len(u.Host) == 0 {
+		return nil, fmt.Errorf("ReplicaPrimary '%s' isn't an http(s) URL", primary)
+	}
+	r := &Replica{
+		Primary:        u,
+		Token:          token,
+		PollInterval:   5 * time.Second,
+		ResyncInterval: 5 * time.Minute,
+		client:         &http.Client{Timeout: REPLICA_TIMEOUT},
+		status:         ReplicaStatus{Role: REPLICA_ROLE_FOLLOWER},
+	}
+	r.proxy = httputil.NewSingleHostReverseProxy(u)
+	director := r.proxy.Director
+	r.proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = u.Host
+		req.Header.Set(REPLICA_TOKEN_HEADER, token)
+	}
+	r.proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		fmt.Printf("Replica.proxy, %s %s failed:%s\n", req.Method, req.URL.Path, err)
+		http.Error(w, "The primary is unavailable", http.StatusBadGateway)
+	}
+	return r, nil
+}
+
+// TattooStorage.ReplicatedStores lists the storages a follower copies, all
+// but Vars DB, which holds the paths of the local instance.
+func (s *TattooStorage) ReplicatedStores() []*StoreInfo {
+	stores := make([]*StoreInfo, 0)
+	for _, store := range s.Stores() {
+		if store.DB != &s.VarDB {
+			stores = append(stores, store)
+		}
+	}
+	return stores
+}
+
+func (s *TattooStorage) replicatedStore(name string) *StoreInfo {
+	for _, store := range s.ReplicatedStores() {
+		if store.Bucket() == name {
+			return store
+		}
+	}
+	return nil
+}
+
+func recordSum(value []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(value))
+}
+
+// KeySums returns the sha256 of every value of a storage by key.
+func KeySums(st *webapp.Store) (map[string]string, error) {
+	sums := make(map[string]string)
+	for _, key := range st.Keys() {
+		value, err := st.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		sums[key] = recordSum(value)
+	}
+	return sums, nil
+}
+
+// isReplicaRequest checks the replica token of a request, no request passes
+// unless Config.ReplicaToken is set.
+func isReplicaRequest(c *webapp.Context) bool {
+	token := GetConfig().ReplicaToken
+	if len(token) == 0 {
+		return false
+	}
+	given := c.Request.Header.Get(REPLICA_TOKEN_HEADER)
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// UseForwardedAddr makes a request proxied by a follower look like it came
+// from the visitor, whose address the follower appended to X-Forwarded-For.
+func UseForwardedAddr(c *webapp.Context) {
+	forwarded := c.Request.Header.Get("X-Forwarded-For")
+	if len(forwarded) == 0 || !isReplicaRequest(c) {
+		return
+	}
+	addrs := strings.Split(forwarded, ",")
+	addr := strings.TrimSpace(addrs[len(addrs)-1])
+	if net.ParseIP(addr) != nil {
+		c.Request.RemoteAddr = net.JoinHostPort(addr, "0")
+	}
+}
+
+// IsProxiedPath tells whether a follower passes the requests under a path
+// level to its primary.
+func IsProxiedPath(level string) bool {
+	return level == "writer" || level == "guard" || level == "comment"
+}
+
+// Replica.Proxy passes a request to the primary and its response back.
+func (r *Replica) Proxy(c *webapp.Context) {
+	c.Info.Message = "Proxy"
+	c.Application.AccessLog(c)
+	r.proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// HandleReplica serves the replication API under /api/replica/. The status is
+// public, everything else needs the replica token.
+func HandleReplica(c *webapp.Context, pathLevels []string) {
+	if len(pathLevels) != 3 {
+		c.Error(webapp.ErrNotFound, http.StatusNotFound)
+		return
+	}
+	if pathLevels[2] == "status" && c.Request.Method == "GET" {
+		c.SetHeader("Cache-Control", "no-cache")
+		c.WriteJSON(GetReplicaStatus())
+		return
+	}
+	if !isReplicaRequest(c) {
+		c.Error("Forbidden", http.StatusForbidden)
+		return
+	}
+	var data interface{}
+	var err error
+	switch {
+	case pathLevels[2] == "manifest" && c.Request.Method == "GET":
+		data, err = replicaManifest()
+	case pathLevels[2] == "keys" && c.Request.Method == "GET":
+		data, err = replicaKeys(c.Request.FormValue("store"))
+	case pathLevels[2] == "records" && c.Request.Method == "POST":
+		keys := make([]string, 0)
+		if err = decodeReplicaBody(c, &keys); err == nil {
+			data, err = replicaRecords(c.Request.FormValue("store"), keys)
+		}
+	case pathLevels[2] == "hits" && c.Request.Method == "POST":
+		hits := make(map[string]int64)
+		if err = decodeReplicaBody(c, &hits); err == nil {
+			Hits.Add(hits)
+			data = true
+		}
+	default:
+		c.Error(webapp.ErrNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.SetHeader("Cache-Control", "no-cache")
+	c.WriteJSON(data)
+}
+
+func decodeReplicaBody(c *webapp.Context, v interface{}) error {
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, REPLICA_MAX_BODY)
+	return json.NewDecoder(body).Decode(v)
+}
+
+func replicaManifest() ([]*ReplicaStoreSum, error) {
+	sums := make([]*ReplicaStoreSum, 0)
+	for _, store := range TattooDB.ReplicatedStores() {
+		count, sum, err := StoreChecksum(store.DB)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", store.Name, err)
+		}
+		sums = append(sums, &ReplicaStoreSum{store.Bucket(), count, sum})
+	}
+	return sums, nil
+}
+
+func replicaKeys(name string) (map[string]string, error) {
+	store := TattooDB.replicatedStore(name)
+	if store == nil {
+		return nil, fmt.Errorf("unknown storage '%s'", name)
+	}
+	return KeySums(store.DB)
+}
+
+// replicaRecords returns the values of keys, keys which are gone are left out.
+func replicaRecords(name string, keys []string) (map[string][]byte, error) {
+	store := TattooDB.replicatedStore(name)
+	if store == nil {
+		return nil, fmt.Errorf("unknown storage '%s'", name)
+	}
+	records := make(map[string][]byte)
+	for _, key := range keys {
+		if !store.DB.Has(key) {
+			continue
+		}
+		value, err := store.DB.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		records[key] = value
+	}
+	return records, nil
+}
+
+// GetReplicaStatus returns the status of a follower, or the last change of a
+// primary.
+func GetReplicaStatus() *ReplicaStatus {
+	if Follower != nil {
+		return Follower.Status()
+	}
+	seq, err := TattooDB.LastChange()
+	status := &ReplicaStatus{Role: REPLICA_ROLE_PRIMARY, Seq: seq}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// Replica.call sends a request to the replication API of the primary and
+// decodes the JSON reply into result. It returns errReplicaGap if the primary
+// answers 410 Gone, for changes trimmed from its log.
+func (r *Replica) call(method string, endpoint string, query url.Values, body interface{}, result interface{}) error {
+	u := *r.Primary
+	u.Path = strings.TrimRight(u.Path, "/") + endpoint
+	u.RawQuery = query.Encode()
+	var reader *bytes.Reader
+	if body != nil {
+		buff, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(buff)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(REPLICA_TOKEN_HEADER, r.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		// the changes asked for have been trimmed from the log
+		return errReplicaGap
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, endpoint, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("%s %s: %v", method, endpoint, err)
+	}
+	return nil
+}
+
+// Replica.PrimarySeq returns the last change of the primary, from its status
+// as its change log may have been trimmed.
+func (r *Replica) PrimarySeq() (int64, error) {
+	status := new(ReplicaStatus)
+	if err := r.call("GET", "/api/replica/status", nil, nil, status); err != nil {
+		return 0, err
+	}
+	return status.Seq, nil
+}
+
+// Replica.SendHits passes views counted by the follower to the primary.
+func (r *Replica) SendHits(hits map[string]int64) error {
+	var ok bool
+	return r.call("POST", "/api/replica/hits", nil, hits, &ok)
+}
+
+// replicaUpdate is what a sync writes to a storage of the follower.
+type replicaUpdate struct {
+	store  *StoreInfo
+	values map[string][]byte
+	gone   []string
+}
+
+// Replica.fetch adds the values of keys in the storage of u on the primary to
+// u, and the keys the primary doesn't have to u.gone.
+func (r *Replica) fetch(u *replicaUpdate, keys []string) error {
+	name := u.store.Bucket()
+	for i := 0; i < len(keys); i += REPLICA_BATCH_SIZE {
+		end := i + REPLICA_BATCH_SIZE
+		if end > len(keys) {
+			end = len(keys)
+		}
+		records := make(map[string][]byte)
+		if err := r.call("POST", "/api/replica/records", url.Values{"store": {name}}, keys[i:end], &records); err != nil {
+			return err
+		}
+		for _, key := range keys[i:end] {
+			if value, ok := records[key]; ok {
+				u.values[key] = value
+			} else if u.store.DB.Has(key) {
+				u.gone = append(u.gone, key)
+			}
+		}
+	}
+	return nil
+}
+
+// Replica.diff compares a storage with the one of the primary key by key and
+// returns what differs.
+func (r *Replica) diff(store *StoreInfo) (*replicaUpdate, error) {
+	remoteKeys := make(map[string]string)
+	if err := r.call("GET", "/api/replica/keys", url.Values{"store": {store.Bucket()}}, nil, &remoteKeys); err != nil {
+		return nil, err
+	}
+	localKeys, err := KeySums(store.DB)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", store.Name, err)
+	}
+	u := &replicaUpdate{store: store, values: make(map[string][]byte), gone: make([]string, 0)}
+	missing := make([]string, 0)
+	for key, sum := range remoteKeys {
+		if localKeys[key] != sum {
+			missing = append(missing, key)
+		}
+	}
+	for key := range localKeys {
+		if _, ok := remoteKeys[key]; !ok {
+			u.gone = append(u.gone, key)
+		}
+	}
+	return u, r.fetch(u, missing)
+}
+
+// applyReplicaUpdates writes updates to db in one transaction, and seq as the
+// last change of db if it isn't 0. It returns the number of records written.
+func applyReplicaUpdates(db *TattooStorage, updates []*replicaUpdate, seq int64) (int, error) {
+	tx := db.Begin()
+	defer tx.Rollback()
+	count := 0
+	for _, u := range updates {
+		for key, value := range u.values {
+			tx.Set(u.store.DB, key, value)
+		}
+		for _, key := range u.gone {
+			tx.Delete(u.store.DB, key)
+		}
+		count += len(u.values) + len(u.gone)
+	}
+	if seq != 0 {
+		// the records fetched may be newer, never older
+		tx.SetString(&db.ChangeDB, CHANGE_SEQ_KEY, strconv.FormatInt(seq, 10))
+	}
+	return count, tx.Commit()
+}
+
+// Replica.Sync makes the replicated storages of db equal to the ones of the
+// primary. Only the storages whose checksums differ are compared key by key,
+// and the records which differ are fetched; all of them are written in one
+// transaction, Change DB last. It returns the number of records written.
+func (r *Replica) Sync(db *TattooStorage) (int, error) {
+	// taken first, the records fetched afterwards are at least as new
+	seq, err := r.PrimarySeq()
+	if err != nil {
+		return 0, err
+	}
+	sums := make([]*ReplicaStoreSum, 0)
+	if err := r.call("GET", "/api/replica/manifest", nil, nil, &sums); err != nil {
+		return 0, err
+	}
+	primary := make(map[string]*ReplicaStoreSum)
+	for _, sum := range sums {
+		primary[sum.Name] = sum
+	}
+	updates := make([]*replicaUpdate, 0)
+	for _, store := range db.ReplicatedStores() {
+		name := store.Bucket()
+		sum, ok := primary[name]
+		if !ok {
+			return 0, fmt.Errorf("the primary has no storage '%s'", name)
+		}
+		count, local, err := StoreChecksum(store.DB)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", store.Name, err)
+		}
+		if count == sum.Count && local == sum.Sum {
+			continue
+		}
+		u, err := r.diff(store)
+		if err != nil {
+			return 0, err
+		}
+		updates = append(updates, u)
+	}
+	if len(updates) == 0 {
+		return 0, nil
+	}
+	return applyReplicaUpdates(db, updates, seq)
+}
+
+// TattooStorage.changedKeys adds the keys of the replicated storages a change
+// may have written to keys. Tag changes add none, as tag indexes are compared
+// key by key, along with the timelines, by SyncChanges.
+func (s *TattooStorage) changedKeys(change *Change, keys map[*webapp.Store]map[string]bool) {
+	add := func(st *webapp.Store, names ...string) {
+		if keys[st] == nil {
+			keys[st] = make(map[string]bool)
+		}
+		for _, name := range names {
+			if len(name) != 0 {
+				keys[st][name] = true
+			}
+		}
+	}
+	switch {
+	case isArticleKind(change.Kind):
+		for _, st := range []*webapp.Store{&s.ArticleDB, &s.ArticleHTMLDB, &s.MetadataDB, &s.CommentIndexDB} {
+			add(st, change.Name, change.OldName)
+		}
+	case change.Kind == CHANGE_KIND_COMMENT:
+		for _, st := range []*webapp.Store{&s.CommentDB, &s.CommentHTMLDB, &s.CommentMetadataDB} {
+			add(st, change.Name)
+		}
+		add(&s.CommentIndexDB, change.Article)
+	}
+	add(&s.ChangeDB, changeKey(change.Seq))
+}
+
+// Replica.SyncChanges brings db up to the primary by the changes logged after
+// since, the last change db has. Only the records the changes may have
+// written are fetched, and the timelines and tag indexes are compared key by
+// key. It returns
+// errReplicaGap if the change log of the primary can't close the gap, Sync
+// does then. What isn't logged, such as drafts, revisions and hits, is left to
+// Sync.
+func (r *Replica) SyncChanges(db *TattooStorage, since int64) (int, error) {
+	if since == 0 {
+		return 0, errReplicaGap
+	}
+	keys := make(map[*webapp.Store]map[string]bool)
+	seq := since
+	for {
+		query := url.Values{}
+		query.Set("since", strconv.FormatInt(seq, 10))
+		query.Set("limit", strconv.Itoa(CHANGE_PAGE_SIZE))
+		resp := new(ChangesResponse)
+		if err := r.call("GET", "/api/changes", query, nil, resp); err != nil {
+			return 0, err
+		}
+		if resp.Last < since || resp.Last-since > REPLICA_MAX_CHANGES {
+			return 0, errReplicaGap
+		}
+		for _, change := range resp.Changes {
+			if change.Seq != seq+1 {
+				return 0, errReplicaGap
+			}
+			db.changedKeys(change, keys)
+			seq = change.Seq
+		}
+		if !resp.More || len(resp.Changes) == 0 {
+			break
+		}
+	}
+	if seq == since {
+		return 0, nil
+	}
+	updates := make([]*replicaUpdate, 0)
+	for _, store := range db.ReplicatedStores() {
+		if store.DB == &db.TimelineDB || store.DB == &db.TagIndexDB {
+			// small, and reordered by changes which aren't logged
+			u, err := r.diff(store)
+			if err != nil {
+				return 0, err
+			}
+			updates = append(updates, u)
+			continue
+		}
+		if len(keys[store.DB]) == 0 {
+			continue
+		}
+		u := &replicaUpdate{store: store, values: make(map[string][]byte), gone: make([]string, 0)}
+		names := make([]string, 0, len(keys[store.DB]))
+		for key := range keys[store.DB] {
+			names = append(names, key)
+		}
+		if err := r.fetch(u, names); err != nil {
+			return 0, err
+		}
+		if store.DB == &db.ChangeDB && len(u.gone) != 0 {
+			// the changes were listed, they can't be gone but by a restore
+			return 0, errReplicaGap
+		}
+		updates = append(updates, u)
+	}
+	return applyReplicaUpdates(db, updates, seq)
+}
+
+// Replica.Poll syncs db by the changes the primary has logged since the last
+// one db has, or in full with full or if the changes can't tell what to
+// fetch, and updates the status.
+func (r *Replica) Poll(db *TattooStorage, full bool) (int, error) {
+	seq, err := db.LastChange()
+	if err != nil {
+		return 0, r.failed(err)
+	}
+	primarySeq, err := r.PrimarySeq()
+	if err != nil {
+		return 0, r.failed(err)
+	}
+	count := 0
+	if !full && primarySeq != seq {
+		count, err = r.SyncChanges(db, seq)
+		if err == errReplicaGap {
+			full = true
+		} else if err != nil {
+			return 0, r.failed(err)
+		}
+	}
+	if full {
+		if count, err = r.Sync(db); err != nil {
+			return 0, r.failed(err)
+		}
+	}
+	if seq, err = db.LastChange(); err != nil {
+		return count, r.failed(err)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.status.Seq = seq
+	r.status.PrimarySeq = primarySeq
+	r.status.Error = ""
+	if seq >= primarySeq {
+		r.status.SyncedTime = time.Now().Unix()
+	}
+	return count, nil
+}
+
+func (r *Replica) failed(err error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.status.Error = err.Error()
+	return err
+}
+
+// Replica.Status returns the replication status as of now.
+func (r *Replica) Status() *ReplicaStatus {
+	r.lock.Lock()
+	status := r.status
+	r.lock.Unlock()
+	if status.PrimarySeq > status.Seq {
+		status.Lag = status.PrimarySeq - status.Seq
+	}
+	if status.SyncedTime != 0 {
+		status.LagSeconds = time.Now().Unix() - status.SyncedTime
+	}
+	return &status
+}
+
+// Replica.Run polls the primary forever.
+func (r *Replica) Run(app *webapp.App) {
+	resynced := time.Now()
+	for range time.Tick(r.PollInterval) {
+		full := time.Since(resynced) >= r.ResyncInterval
+		count, err := r.Poll(TattooDB, full)
+		if err != nil {
+			app.Log("Replica", fmt.Sprintf("Sync failed: %v", err))
+			continue
+		}
+		if full {
+			resynced = time.Now()
+		}
+		if count != 0 {
+			status := r.Status()
+			app.Log("Replica", fmt.Sprintf("Synced %d record(s), at change %d of %d", count, status.Seq, status.PrimarySeq))
+		}
+	}
+}
+
+// StartReplica makes the instance a read-only follower of
+// Config.ReplicaPrimary: it syncs once, then keeps polling the primary.
+func StartReplica(app *webapp.App) error {
+	cfg := GetConfig()
+	r, err := NewReplica(cfg.ReplicaPrimary, cfg.ReplicaToken)
+	if err != nil {
+		return err
+	}
+	if cfg.ReplicaPollInterval > 0 {
+		r.PollInterval = time.Duration(cfg.ReplicaPollInterval) * time.Second
+	}
+	if cfg.ReplicaResyncInterval > 0 {
+		r.ResyncInterval = time.Duration(cfg.ReplicaResyncInterval) * time.Second
+	}
+	Follower = r
+	app.Log("Replica", fmt.Sprintf("Follow %s, poll every %v, resync every %v", r.Primary, r.PollInterval, r.ResyncInterval))
+	if count, err := r.Poll(TattooDB, true); err != nil {
+		app.Log("Replica", fmt.Sprintf("Initial sync failed, serving local data: %v", err))
+	} else {
+		app.Log("Replica", fmt.Sprintf("Initial sync: %d record(s)", count))
+	}
+	go r.Run(app)
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"github.com/shellex/tattoo/webapp"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPrimary serves the API of TattooDB as a primary does, and counts the
+// requests by path.
+type testPrimary struct {
+	lock     sync.Mutex
+	requests map[string]int
+	handler  http.Handler
+}
+
+func (p *testPrimary) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.lock.Lock()
+	p.requests[req.URL.Path] += 1
+	p.lock.Unlock()
+	p.handler.ServeHTTP(w, req)
+}
+
+func (p *testPrimary) count(path string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.requests[path]
+}
+
+// openTestReplica starts a primary serving TattooDB and returns it with a
+// follower of its own storages and a Replica following the primary.
+func openTestReplica(t *testing.T) (*testPrimary, *TattooStorage, *Replica) {
+	token := GetConfig().ReplicaToken
+	GetConfig().ReplicaToken = "test token"
+	t.Cleanup(func() { GetConfig().ReplicaToken = token })
+	primary := &testPrimary{
+		requests: make(map[string]int),
+		handler:  webapp.RootHandler{HandleFunc: HandleRoot, Application: &webapp.App{}},
+	}
+	server := httptest.NewServer(primary)
+	t.Cleanup(server.Close)
+
+	follower := new(TattooStorage)
+	follower.cache = NewTattooCache()
+	if err := follower.Open(webapp.STORAGE_BACKEND_MEMORY, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { follower.Close() })
+	if err := follower.LoadTimelines(&webapp.App{}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReplica(server.URL, "test token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return primary, follower, r
+}
+
+// checkReplicated compares the replicated storages of the follower with the
+// ones of TattooDB, but for those only a full sync brings over with logged.
+func checkReplicated(t *testing.T, follower *TattooStorage, logged bool) {
+	t.Helper()
+	stores := TattooDB.ReplicatedStores()
+	for i, store := range follower.ReplicatedStores() {
+		if logged && (store.DB == &follower.RevisionDB || store.DB == &follower.RevisionIndexDB || store.DB == &follower.TrashDB) {
+			continue
+		}
+		count, sum, err := StoreChecksum(stores[i].DB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		followerCount, followerSum, err := StoreChecksum(store.DB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if followerCount != count || followerSum != sum {
+			t.Errorf("%s differs: %d records on the follower, %d on the primary", store.Name, followerCount, count)
+		}
+	}
+	seq, _ := TattooDB.LastChange()
+	if followerSeq, _ := follower.LastChange(); followerSeq != seq {
+		t.Errorf("follower at change %d, primary at %d", followerSeq, seq)
+	}
+}
+
+func TestReplicaSync(t *testing.T) {
+	db := openTestDB(t)
+	for _, name := range []string{"a", "b"} {
+		if err := db.SaveArticle(newTestArticle(name, "text of "+name, "go"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	primary, follower, r := openTestReplica(t)
+
+	// a new follower has no change to start from
+	if count, err := r.Poll(follower, false); err != nil || count == 0 {
+		t.Fatalf("first Poll = %d, %v", count, err)
+	}
+	checkReplicated(t, follower, false)
+	if primary.count("/api/replica/manifest") != 1 {
+		t.Fatalf("first Poll didn't sync in full")
+	}
+
+	steps := []struct {
+		name   string
+		mutate func() error
+	}{
+		{"update", func() error { return db.SaveArticle(newTestArticle("a", "new text of a", "go", "web"), "a") }},
+		{"comment", func() error { return db.AddComment(newTestComment("a", "c1", "a comment")) }},
+		{"rename", func() error { return db.SaveArticle(newTestArticle("c", "text of b", "go"), "b") }},
+		{"tag rename", func() error { return db.RenameTag("go", "golang") }},
+		{"comment delete", func() error { return db.DeleteComment("c1") }},
+		{"trash", func() error { return db.TrashArticle("a") }},
+	}
+	for _, step := range steps {
+		if err := step.mutate(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		records := primary.count("/api/replica/records")
+		if count, err := r.Poll(follower, false); err != nil || count == 0 {
+			t.Fatalf("%s: Poll = %d, %v", step.name, count, err)
+		}
+		checkReplicated(t, follower, true)
+		if primary.count("/api/replica/manifest") != 1 {
+			t.Fatalf("%s: synced in full", step.name)
+		}
+		if primary.count("/api/replica/records") == records {
+			t.Fatalf("%s: fetched no record", step.name)
+		}
+	}
+	if _, err := follower.GetMeta("b"); err == nil {
+		t.Error("renamed article left under its old name")
+	}
+	if meta, err := follower.GetMeta("c"); err != nil || meta.Title != "Title of c" {
+		t.Errorf("renamed article = %v, %v", meta, err)
+	}
+
+	// nothing new, nothing fetched
+	requests, status := primary.count("/api/changes"), primary.count("/api/replica/status")
+	if count, err := r.Poll(follower, false); err != nil || count != 0 {
+		t.Fatalf("idle Poll = %d, %v", count, err)
+	}
+	if primary.count("/api/changes") != requests || primary.count("/api/replica/status") != status+1 {
+		t.Fatal("idle Poll did more than check the last change")
+	}
+
+	// a follower ahead of the primary, as after a restore of the primary,
+	// can't catch up by the log
+	seq, _ := db.LastChange()
+	follower.ChangeDB.SetString(CHANGE_SEQ_KEY, strconv.FormatInt(seq+10, 10))
+	if _, err := r.Poll(follower, false); err != nil {
+		t.Fatal(err)
+	}
+	if primary.count("/api/replica/manifest") != 2 {
+		t.Fatal("a gap in the log didn't sync in full")
+	}
+	checkReplicated(t, follower, false)
+
+	// a follower behind the changes trimmed from the log syncs in full
+	if err := db.SaveArticle(newTestArticle("d", "text of d"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveArticle(newTestArticle("e", "text of e"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.TrimChanges(time.Now().Unix() + 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Poll(follower, false); err != nil {
+		t.Fatal(err)
+	}
+	if primary.count("/api/replica/manifest") != 3 {
+		t.Fatal("trimmed changes didn't sync in full")
+	}
+	checkReplicated(t, follower, false)
+}
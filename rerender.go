@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"runtime"
+	"sync"
+)
+
+// rendered HTML records written by one transaction
+const RERENDER_BATCH_SIZE = 50
+
+func init() {
+	RegisterCommand(&Command{
+		Name:  "rerender",
+		Usage: "rerender [-all] [-workers n]",
+		Help:  "Render the HTML of articles and comments again from their sources, only the HTML rendered by an older renderer unless -all. Refused while the server is running, which rerenders stale HTML as it starts.",
+		Run:   runRerender,
+	})
+}
+
+func runRerender(app *webapp.App, args []string) error {
+	flags := flag.NewFlagSet("rerender", flag.ExitOnError)
+	all := flags.Bool("all", false, "Render all HTML, not only the stale one")
+	workers := flags.Int("workers", runtime.NumCPU(), "Records rendered at once")
+	flags.Parse(args)
+	if err := TattooDB.Load(app); err != nil {
+		return err
+	}
+	defer TattooDB.Close()
+	jobs, err := TattooDB.StaleHTML(*all)
+	if err != nil {
+		return err
+	}
+	_, err = TattooDB.Rerender(jobs, *workers, RerenderProgress(app))
+	return err
+}
+
+// RenderJob is a record of an HTML storage to render again from the record of
+// the same name in its source storage.
+type RenderJob struct {
+	Source *webapp.Store
+	HTML   *webapp.Store
+	Name   string
+	Render func(text []byte) []byte
+}
+
+type renderResult struct {
+	job    *RenderJob
+	source []byte
+	html   []byte
+	err    error
+}
+
+// TattooStorage.StaleHTML lists the articles and comments whose HTML is
+// missing or was rendered by another renderer version, or all of them.
+func (s *TattooStorage) StaleHTML(all bool) ([]*RenderJob, error) {
+	kinds := []*RenderJob{
+		{Source: &s.ArticleDB, HTML: &s.ArticleHTMLDB, Render: RenderArticleHTML},
+		{Source: &s.CommentDB, HTML: &s.CommentHTMLDB, Render: RenderCommentHTML},
+	}
+	version := RendererVersion()
+	jobs := make([]*RenderJob, 0)
+	for _, kind := range kinds {
+		for _, name := range kind.Source.Keys() {
+			if !all && kind.HTML.Has(name) {
+				buff, err := kind.HTML.Get(name)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", name, err)
+				}
+				if DecodeHTMLRecord(buff).Version == version {
+					continue
+				}
+			}
+			jobs = append(jobs, &RenderJob{kind.Source, kind.HTML, name, kind.Render})
+		}
+	}
+	return jobs, nil
+}
+
+// TattooStorage.Rerender renders jobs with a number of workers and writes the
+// HTML in batches of transactions, calling progress after each batch. A
+// record whose source changed meanwhile is left alone, its HTML was rendered
+// by the change. It returns the number of records written.
+func (s *TattooStorage) Rerender(jobs []*RenderJob, workers int, progress func(done int, total int)) (int, error) {
+	if workers <= 0 {
+		workers = 1
+	}
+	queue := make(chan *RenderJob)
+	results := make(chan *renderResult)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				source, err := job.Source.Get(job.Name)
+				result := &renderResult{job: job, source: source, err: err}
+				if err == nil {
+					result.html = job.Render(source)
+				}
+				results <- result
+			}
+		}()
+	}
+	go func() {
+		for _, job := range jobs {
+			queue <- job
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	var ret error
+	written, done := 0, 0
+	batch := make([]*renderResult, 0, RERENDER_BATCH_SIZE)
+	write := func() {
+		n, err := s.writeRendered(batch)
+		written += n
+		if err != nil && ret == nil {
+			ret = err
+		}
+		done += len(batch)
+		batch = batch[:0]
+		if progress != nil {
+			progress(done, len(jobs))
+		}
+	}
+	for result := range results {
+		if result.err != nil {
+			// gone since StaleHTML, or unreadable, which fsck reports
+			fmt.Printf("TattooStorage.Rerender, Get failed (%v):%s\n", result.job.Name, result.err)
+			done += 1
+			continue
+		}
+		batch = append(batch, result)
+		if len(batch) == RERENDER_BATCH_SIZE {
+			write()
+		}
+	}
+	if len(batch) != 0 {
+		write()
+	}
+	return written, ret
+}
+
+func (s *TattooStorage) writeRendered(batch []*renderResult) (int, error) {
+	tx := s.Begin()
+	defer tx.Rollback()
+	count := 0
+	for _, result := range batch {
+		job := result.job
+		if !tx.Has(job.Source, job.Name) {
+			continue
+		}
+		source, err := tx.Get(job.Source, job.Name)
+		if err != nil || !bytes.Equal(source, result.source) {
+			continue
+		}
+		tx.Set(job.HTML, job.Name, result.html)
+		count += 1
+	}
+	return count, tx.Commit()
+}
+
+// RerenderProgress returns a progress function logging every tenth of the
+// records and the last one.
+func RerenderProgress(app *webapp.App) func(done int, total int) {
+	logged := 0
+	return func(done int, total int) {
+		if done != total && done*10/total == logged*10/total {
+			return
+		}
+		logged = done
+		app.Log("Rerender", fmt.Sprintf("%d/%d record(s) (%d%%)", done, total, done*100/total))
+	}
+}
+
+// at most one background re-render runs at a time, a check asked for while
+// it runs is done once it's over
+var rerenderState struct {
+	lock    sync.Mutex
+	running bool
+	again   bool
+}
+
+// CheckRenderer renders the stale HTML again in the background, so a change
+// of the renderer reaches the stored articles without a command. Until it's
+// done the old HTML is served.
+func CheckRenderer(app *webapp.App) {
+	rerenderState.lock.Lock()
+	defer rerenderState.lock.Unlock()
+	if rerenderState.running {
+		rerenderState.again = true
+		return
+	}
+	rerenderState.running = true
+	go func() {
+		for {
+			rerenderStale(app)
+			rerenderState.lock.Lock()
+			if !rerenderState.again {
+				rerenderState.running = false
+				rerenderState.lock.Unlock()
+				return
+			}
+			rerenderState.again = false
+			rerenderState.lock.Unlock()
+		}
+	}()
+}
+
+// rerenderStale renders the HTML rendered by another renderer again.
+func rerenderStale(app *webapp.App) {
+	jobs, err := TattooDB.StaleHTML(false)
+	if err != nil {
+		app.Log("Rerender", fmt.Sprintf("Check failed: %v", err))
+		return
+	}
+	if len(jobs) == 0 {
+		return
+	}
+	app.Log("Rerender", fmt.Sprintf("%d record(s) rendered by another renderer, renderer version %s", len(jobs), RendererVersion()))
+	count, err := TattooDB.Rerender(jobs, runtime.NumCPU(), RerenderProgress(app))
+	if err != nil {
+		app.Log("Rerender", fmt.Sprintf("Failed: %v", err))
+		return
+	}
+	app.Log("Rerender", fmt.Sprintf("Done, %d record(s) rendered", count))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"time"
+)
+
+const (
+	ERROR_REVISION_NOT_EXISTS = "Revision doesn't exist"
+	REVISION_KEY_SEPARATOR    = "@"
+)
+
+// RevisionMetadata describes one saved version of an article. The revisions
+// of an article are numbered from 1 and kept in Revision Index DB as a list,
+// oldest first; their sources are in Revision DB under "<name>@<number>".
+type RevisionMetadata struct {
+	Number       int
+	Title        string
+	Author       string
+	CreatedTime  int64
+	RestoredFrom int
+}
+
+func (rev *RevisionMetadata) CreatedTimeHumanReading() string {
+	return TimeHumanReading(rev.CreatedTime)
+}
+
+func revisionKey(name string, number int) string {
+	return fmt.Sprintf("%s%s%d", name, REVISION_KEY_SEPARATOR, number)
+}
+
+// TattooStorage.GetRevisions returns the revisions of an article, newest first.
+func (s *TattooStorage) GetRevisions(name string) ([]*RevisionMetadata, error) {
+	revs, err := s.getRevisions(nil, name)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*RevisionMetadata, len(revs))
+	for i, rev := range revs {
+		ret[len(revs)-1-i] = rev
+	}
+	return ret, nil
+}
+
+// TattooStorage.GetRevision returns the metadata and the source of a revision.
+func (s *TattooStorage) GetRevision(name string, number int) (*RevisionMetadata, []byte, error) {
+	revs, err := s.getRevisions(nil, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, rev := range revs {
+		if rev.Number == number {
+			text, err := s.RevisionDB.Get(revisionKey(name, number))
+			if err != nil {
+				return nil, nil, err
+			}
+			return rev, text, nil
+		}
+	}
+	return nil, nil, errors.New(ERROR_REVISION_NOT_EXISTS)
+}
+
+// getRevisions reads the revision list of an article through tx, or straight
+// from the storage if tx is nil. An article without revisions has an empty list.
+func (s *TattooStorage) getRevisions(tx *webapp.Transaction, name string) ([]*RevisionMetadata, error) {
+	var buff []byte
+	var err error
+	if tx != nil {
+		if !tx.Has(&s.RevisionIndexDB, name) {
+			return []*RevisionMetadata{}, nil
+		}
+		buff, err = tx.Get(&s.RevisionIndexDB, name)
+	} else {
+		if !s.RevisionIndexDB.Has(name) {
+			return []*RevisionMetadata{}, nil
+		}
+		buff, err = s.RevisionIndexDB.Get(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	revs := make([]*RevisionMetadata, 0)
+	if err := json.Unmarshal(buff, &revs); err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
+
+// ensureRevisions returns the revision list of an article. An article saved
+// before revisions existed gets its stored source as revision 1 first, so the
+// text about to be replaced isn't lost.
+func (s *TattooStorage) ensureRevisions(tx *webapp.Transaction, name string) ([]*RevisionMetadata, error) {
+	revs, err := s.getRevisions(tx, name)
+	if err != nil || len(revs) != 0 || !tx.Has(&s.ArticleDB, name) {
+		return revs, err
+	}
+	text, err := tx.Get(&s.ArticleDB, name)
+	if err != nil {
+		return nil, err
+	}
+	rev := &RevisionMetadata{Number: 1}
+	if meta, err := s.getMeta(tx, name); err == nil {
+		rev.Title, rev.Author, rev.CreatedTime = meta.Title, meta.Author, meta.ModifiedTime
+	}
+	tx.Set(&s.RevisionDB, revisionKey(name, 1), text)
+	revs = append(revs, rev)
+	return revs, tx.SetJSON(&s.RevisionIndexDB, name, revs)
+}
+
+// addRevision records text as the newest revision of an article.
+func (s *TattooStorage) addRevision(tx *webapp.Transaction, meta *ArticleMetadata, text []byte, restoredFrom int) error {
+	revs, err := s.ensureRevisions(tx, meta.Name)
+	if err != nil {
+		return err
+	}
+	number := 1
+	if len(revs) != 0 {
+		number = revs[len(revs)-1].Number + 1
+	}
+	rev := &RevisionMetadata{
+		Number:       number,
+		Title:        meta.Title,
+		Author:       meta.Author,
+		CreatedTime:  meta.ModifiedTime,
+		RestoredFrom: restoredFrom,
+	}
+	tx.Set(&s.RevisionDB, revisionKey(meta.Name, rev.Number), text)
+	revs = append(revs, rev)
+	return tx.SetJSON(&s.RevisionIndexDB, meta.Name, revs)
+}
+
+func (s *TattooStorage) deleteRevisions(tx *webapp.Transaction, name string) {
+	revs, err := s.getRevisions(tx, name)
+	if err != nil {
+		return
+	}
+	for _, rev := range revs {
+		tx.Delete(&s.RevisionDB, revisionKey(name, rev.Number))
+	}
+	tx.Delete(&s.RevisionIndexDB, name)
+}
+
+// renameRevisions moves the revisions of an article to its new name.
+func (s *TattooStorage) renameRevisions(tx *webapp.Transaction, origName, newName string) error {
+	revs, err := s.ensureRevisions(tx, origName)
+	if err != nil || len(revs) == 0 {
+		return err
+	}
+	for _, rev := range revs {
+		text, err := tx.Get(&s.RevisionDB, revisionKey(origName, rev.Number))
+		if err != nil {
+			return err
+		}
+		tx.Set(&s.RevisionDB, revisionKey(newName, rev.Number), text)
+		tx.Delete(&s.RevisionDB, revisionKey(origName, rev.Number))
+	}
+	tx.Delete(&s.RevisionIndexDB, origName)
+	return tx.SetJSON(&s.RevisionIndexDB, newName, revs)
+}
+
+// TattooStorage.RestoreRevision makes an old revision the current text of an
+// article. It's saved like an edit, so the restore is a new revision itself.
+func (s *TattooStorage) RestoreRevision(name string, number int) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	meta, err := s.getMeta(tx, name)
+	if err != nil {
+		return err
+	}
+	text, err := tx.Get(&s.RevisionDB, revisionKey(name, number))
+	if err != nil {
+		return errors.New(ERROR_REVISION_NOT_EXISTS)
+	}
+	meta.Author = GetConfig().AuthorName
+	meta.ModifiedTime = time.Now().Unix()
+	if err := s.addRevision(tx, meta, text, number); err != nil {
+		return err
+	}
+	s.updateMetadata(tx, meta)
+	s.updateArticle(tx, name, text)
+	// drafts are ordered by modified time
+	if err := s.placeArticle(tx, name, meta); err != nil {
+		return err
+	}
+	s.logArticle(name, meta, meta)
+	return tx.Commit()
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"github.com/shellex/tattoo/webapp"
 	"html/template"
+	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -27,9 +29,22 @@ func HandleRoot(c *webapp.Context) {
 	c.Info.UseGZip = strings.Index(c.Request.Header.Get("Accept-Encoding"), "gzip") > -1
 	c.Info.StartTime = time.Now()
 
+	UseForwardedAddr(c)
 	urlPath := c.Request.URL.Path
 	pathLevels := strings.Split(strings.Trim(urlPath, "/"), "/")
-	if urlPath == "/" {
+	if DevWatcher != nil && pathLevels[0] != "api" {
+		// pages change with their templates, and can't be rendered by
+		// templates which failed to parse
+		c.SetHeader("Cache-Control", "no-cache")
+		if err := DevWatcher.Error(); err != nil {
+			RenderTemplateError(c, err)
+			return
+		}
+	}
+	if Follower != nil && IsProxiedPath(pathLevels[0]) {
+		// a follower is read-only, the primary takes writes
+		Follower.Proxy(c)
+	} else if urlPath == "/" {
 		// home page
 		if HasTemplate("HOME") {
 			HandleHome(c)
@@ -49,6 +64,8 @@ func HandleRoot(c *webapp.Context) {
 		} else if pathLevels[0] == "feed" {
 			// feed
 			HandleFeed(c, pathLevels)
+		} else if pathLevels[0] == "api" {
+			HandleAPI(c, pathLevels)
 		} else if pathLevels[0] == "tag" {
 			if len(pathLevels) >= 2 {
 				// tag
@@ -183,14 +200,16 @@ func HandleComment(c *webapp.Context) {
 			c.Redirect("/"+comment.Metadata.ArticleName+"#respond", http.StatusFound)
 			return
 		}
-		if !TattooDB.Has(comment.Metadata.ArticleName) {
+		if !TattooDB.IsPublished(comment.Metadata.ArticleName) {
 			c.Redirect("/"+comment.Metadata.ArticleName+"#respond", http.StatusFound)
 			return
 		}
 		comment.Text = template.HTML(webapp.TransformTags(string(comment.Text)))
 		comment.Metadata.EmailHash = MD5Sum(comment.Metadata.Email)
-		TattooDB.AddComment(comment)
-		TattooDB.PrependCommentTimeline(comment)
+		if err := TattooDB.AddComment(comment); err != nil {
+			c.Error(fmt.Sprintf("%s: %s", webapp.ErrInternalServerError, err), http.StatusInternalServerError)
+			return
+		}
 		c.Redirect("/"+comment.Metadata.ArticleName+"#comment_"+comment.Metadata.Name, http.StatusFound)
 	} else {
 		c.Redirect("/"+c.Request.FormValue("article_name"), http.StatusFound)
@@ -203,13 +222,9 @@ func HandleFeed(c *webapp.Context, pathLevels []string) {
 		return
 	}
 	if pathLevels[1] == "atom" {
-		var meta *ArticleMetadata
-		var err error
-		if len(TattooDB.ArticleTimeline) != 0 {
-			meta, err = TattooDB.GetMeta(TattooDB.ArticleTimeline[0])
-			if err == nil {
-				TattooDB.SetVar("LastUpdatedTime", TimeRFC3339(meta.ModifiedTime))
-			}
+		articles, err := TattooDB.GetArticleTimeline(0, 1)
+		if err == nil && len(articles) != 0 {
+			TattooDB.SetVar("LastUpdatedTime", TimeRFC3339(articles[0].Metadata.ModifiedTime))
 		}
 		err = RenderFeedAtom(c)
 		if err != nil {
@@ -219,6 +234,58 @@ func HandleFeed(c *webapp.Context, pathLevels []string) {
 	}
 }
 
+func HandleAPI(c *webapp.Context, pathLevels []string) {
+	if len(pathLevels) == 2 && pathLevels[1] == "changes" && c.Request.Method == "GET" {
+		HandleChanges(c)
+		return
+	}
+	if len(pathLevels) >= 2 && pathLevels[1] == "replica" {
+		HandleReplica(c, pathLevels)
+		return
+	}
+	c.Error(webapp.ErrNotFound, http.StatusNotFound)
+}
+
+// ChangesResponse is the reply of GET /api/changes. Next is the since of the
+// following request, More tells whether it would return anything yet.
+type ChangesResponse struct {
+	Changes []*Change
+	Last    int64
+	Next    int64
+	More    bool
+}
+
+// HandleChanges serves GET /api/changes?since=N[&limit=M], the changes logged
+// after sequence number N, oldest first, or 410 Gone if some of them have been
+// trimmed.
+func HandleChanges(c *webapp.Context) {
+	since := int64(0)
+	if value := c.Request.FormValue("since"); len(value) != 0 {
+		var err error
+		since, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || since < 0 {
+			c.Error("since must be a sequence number", http.StatusBadRequest)
+			return
+		}
+	}
+	limit, _ := strconv.Atoi(c.Request.FormValue("limit"))
+	changes, last, err := TattooDB.GetChanges(since, limit)
+	if err == errChangesTrimmed {
+		c.Error(fmt.Sprintf("%s, read the site again and go on from change %d", ERROR_CHANGES_TRIMMED, last), http.StatusGone)
+		return
+	}
+	if err != nil {
+		c.Error(fmt.Sprintf("%s: %s", webapp.ErrInternalServerError, err), http.StatusInternalServerError)
+		return
+	}
+	next := since
+	if len(changes) != 0 {
+		next = changes[len(changes)-1].Seq
+	}
+	c.SetHeader("Cache-Control", "no-cache")
+	c.WriteJSON(&ChangesResponse{Changes: changes, Last: last, Next: next, More: next < last})
+}
+
 func HandleWriter(c *webapp.Context, pathLevels []string) {
 	if ok := isAuthorized(c); !ok {
 		c.Redirect("/guard", http.StatusFound)
@@ -245,6 +312,46 @@ func HandleWriter(c *webapp.Context, pathLevels []string) {
 			err = RenderWriterComments(c, pos)
 		} else if pathLevels[1] == "settings" {
 			err = RenderWriterSettings(c, "")
+		} else if pathLevels[1] == "revisions" {
+			if len(pathLevels) < 3 {
+				c.Redirect("/writer/overview", http.StatusFound)
+				return
+			}
+			name := strings.ToLower(url.QueryEscape(pathLevels[2]))
+			from, _ := strconv.Atoi(c.Request.FormValue("from"))
+			to, _ := strconv.Atoi(c.Request.FormValue("to"))
+			err = RenderWriterRevisions(c, name, from, to)
+		} else if pathLevels[1] == "restore" {
+			if len(pathLevels) < 4 {
+				c.Redirect("/writer/overview", http.StatusFound)
+				return
+			}
+			name := strings.ToLower(url.QueryEscape(pathLevels[2]))
+			number, _ := strconv.Atoi(pathLevels[3])
+			err = TattooDB.RestoreRevision(name, number)
+			if err == nil {
+				c.Redirect("/writer/revisions/"+name, http.StatusFound)
+			}
+		} else if pathLevels[1] == "trash" {
+			err = RenderWriterTrash(c, "")
+		} else if pathLevels[1] == "trash_restore" || pathLevels[1] == "trash_purge" {
+			if len(pathLevels) < 3 {
+				c.Redirect("/writer/trash", http.StatusFound)
+				return
+			}
+			if pathLevels[1] == "trash_restore" {
+				err = TattooDB.RestoreTrash(pathLevels[2])
+			} else {
+				err = TattooDB.PurgeTrash(pathLevels[2])
+			}
+			if err != nil {
+				err = RenderWriterTrash(c, err.Error())
+			} else {
+				c.Redirect("/writer/trash", http.StatusFound)
+			}
+		} else if pathLevels[1] == "backup" {
+			HandleBackup(c)
+			return
 		} else if pathLevels[1] == "edit" {
 			var article *Article = new(Article)
 			var meta *ArticleMetadata = new(ArticleMetadata)
@@ -261,31 +368,29 @@ func HandleWriter(c *webapp.Context, pathLevels []string) {
 				}
 			} else {
 				article = new(Article)
+				article.Metadata.Status = ARTICLE_STATUS_DRAFT
 			}
 			err = RenderWriterEditor(c, article)
 		} else if pathLevels[1] == "delete" {
 			if len(pathLevels) >= 3 {
 				name := strings.ToLower(url.QueryEscape(pathLevels[2]))
 				if TattooDB.Has(name) {
-					TattooDB.DeleteArticleTagIndex(name)
-					TattooDB.DeleteArticle(name)
-					TattooDB.DeleteMetadata(name)
-					TattooDB.DeleteComments(name)
-					TattooDB.Dump()
-					TattooDB.RebuildTimeline()
-					TattooDB.RebuildCommentTimeline()
+					err = TattooDB.TrashArticle(name)
 				}
 			}
-			c.Redirect("/writer", http.StatusFound)
+			if err == nil {
+				c.Redirect("/writer", http.StatusFound)
+			}
 		} else if pathLevels[1] == "delete_comment" {
 			if len(pathLevels) >= 3 {
 				name := strings.ToLower(url.QueryEscape(pathLevels[2]))
 				if TattooDB.HasComment(name) {
-					TattooDB.DeleteComment(name)
-					TattooDB.RebuildCommentTimeline()
+					err = TattooDB.TrashComment(name)
 				}
 			}
-			c.Redirect("/writer/comments", http.StatusFound)
+			if err == nil {
+				c.Redirect("/writer/comments", http.StatusFound)
+			}
 		} else {
 			Render404page(c, NOT_FOUND_MESSAGE)
 		}
@@ -322,6 +427,20 @@ func HandleUpdateArticle(c *webapp.Context) {
 	article.Metadata.Author = GetConfig().AuthorName
 	article.Metadata.ModifiedTime = time.Now().Unix()
 	article.Text = template.HTML(c.Request.FormValue("text"))
+	article.Metadata.Status = c.Request.FormValue("status")
+	switch article.Metadata.Status {
+	case ARTICLE_STATUS_PUBLISHED, ARTICLE_STATUS_DRAFT:
+	case ARTICLE_STATUS_SCHEDULED:
+		publishAt := strings.Trim(c.Request.FormValue("publish_at"), " ")
+		t, err := time.ParseInLocation(PUBLISH_TIME_LAYOUT, publishAt, time.Local)
+		if err != nil {
+			c.Error(fmt.Sprintf("Publish time should look like %s", PUBLISH_TIME_LAYOUT), http.StatusBadRequest)
+			return
+		}
+		article.Metadata.PublishTime = t.Unix()
+	default:
+		article.Metadata.Status = ARTICLE_STATUS_DRAFT
+	}
 
 	if len(origName) == 0 {
 		isNew = true
@@ -334,12 +453,25 @@ func HandleUpdateArticle(c *webapp.Context) {
 		meta, err = TattooDB.GetMeta(origName)
 		if err == nil {
 			article.Metadata.CreatedTime = meta.CreatedTime
+			article.Metadata.FirstPublishTime = meta.FirstPublishTime
 			article.Metadata.Hits = meta.Hits
+			if article.Metadata.IsPublished() && meta.IsPublished() {
+				article.Metadata.PublishTime = meta.PublishTime
+			}
+		}
+	}
+	// an article is dated by the time it's first published, and keeps that
+	// date when it's published again
+	if article.Metadata.IsPublished() && (isNew || err != nil || !meta.IsPublished()) {
+		if article.Metadata.FirstPublishTime == 0 {
+			article.Metadata.FirstPublishTime = article.Metadata.ModifiedTime
 		}
+		article.Metadata.CreatedTime = article.Metadata.FirstPublishTime
+		article.Metadata.PublishTime = article.Metadata.FirstPublishTime
 	}
 	// check if the name is avaliable.
 	meta, err = TattooDB.GetMeta(article.Metadata.Name)
-	if isNew && err == nil {
+	if (isNew || isRename) && err == nil {
 		article.Metadata.Name = ""
 		err = RenderWriterEditor(c, article)
 		return
@@ -364,24 +496,49 @@ func HandleUpdateArticle(c *webapp.Context) {
 	for t := range tags_tmp {
 		article.Metadata.Tags = append(article.Metadata.Tags, t)
 	}
-	// update tag index
-	TattooDB.DeleteArticleTagIndex(article.Metadata.Name)
-	TattooDB.UpdateArticleTagIndex(article.Metadata.Name, article.Metadata.Tags)
-	// update metadata
-	TattooDB.UpdateMetadata(&article.Metadata)
-	TattooDB.UpdateArticle(article.Metadata.Name, []byte(string(article.Text)))
-	if isRename {
-		TattooDB.DeleteArticleTagIndex(origName)
-		TattooDB.DeleteMetadata(origName)
-		TattooDB.DeleteArticle(origName)
-		TattooDB.RenameComments(origName, article.Metadata.Name)
-	}
-	TattooDB.Dump()
-	TattooDB.RebuildTimeline()
+	// an article isn't saved with shortcodes which can't be expanded
+	if errs := CheckShortcodes([]byte(string(article.Text))); len(errs) != 0 {
+		RenderWriterEditorErrors(c, article, origName, errs)
+		return
+	}
+	// update tag index, metadata and source, move comments on rename
+	if err = TattooDB.SaveArticle(article, origName); err != nil {
+		if webapp.IsKeyError(err) {
+			c.Error(fmt.Sprintf("Invalid URL: %s", err), http.StatusBadRequest)
+			return
+		}
+		c.Error(fmt.Sprintf("%s: %s", webapp.ErrInternalServerError, err), http.StatusInternalServerError)
+		return
+	}
 	c.Redirect("/writer/overview", http.StatusFound)
 	return
 }
 
+// HandleBackup sends a backup archive, snapshotted to a temporary file first
+// so a slow download doesn't keep the writes paused.
+func HandleBackup(c *webapp.Context) {
+	filename := BackupFileName(time.Now())
+	tmp, err := SnapshotBackup("", BACKUP_FILE_PREFIX)
+	if err != nil {
+		c.Application.Log("Backup", fmt.Sprintf("Failed: %v", err))
+		c.Error(fmt.Sprintf("%s: %s", webapp.ErrInternalServerError, err), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	c.Writer.Header().Set("Content-Type", "application/gzip")
+	c.Writer.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	if info, err := tmp.Stat(); err == nil {
+		c.Writer.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	if _, err := io.Copy(c.Writer, tmp); err != nil {
+		// the response has started, all we can do is to log it
+		c.Application.Log("Backup", fmt.Sprintf("Failed to send %s: %v", filename, err))
+		return
+	}
+	c.Application.Log("Backup", "Sent "+filename)
+}
+
 func HandleUpdateSystemSettings(c *webapp.Context) {
 	portStr := strings.Trim(c.Request.FormValue("port"), " ")
 	certificate := strings.Trim(c.Request.FormValue("certificate"), " ")
@@ -393,6 +550,7 @@ func HandleUpdateSystemSettings(c *webapp.Context) {
 	author := strings.Trim(c.Request.FormValue("author"), " ")
 	timelinecountStr := strings.Trim(c.Request.FormValue("timelinecount"), " ")
 	theme := strings.Trim(c.Request.FormValue("theme"), " ")
+	feedContent := strings.Trim(c.Request.FormValue("feedcontent"), " ")
 	// verify
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
@@ -404,11 +562,15 @@ func HandleUpdateSystemSettings(c *webapp.Context) {
 		RenderWriterSettings(c, "Timeline Count should be a positive integer!")
 		return
 	}
+	if feedContent != FEED_CONTENT_FULL && feedContent != FEED_CONTENT_EXCERPT {
+		RenderWriterSettings(c, "Feed Content should be full or excerpt!")
+		return
+	}
 	if err := LoadTheme(c.Application, theme); err != nil {
 		RenderWriterSettings(c, fmt.Sprintf("Failed to load theme '%v': %v", theme, err))
 		return
 	}
-	var newConfig Config
+	newConfig := *GetConfig()
 	newConfig.Port = port
 	newConfig.Certificate = certificate
 	newConfig.SiteBase = sitebase
@@ -419,9 +581,12 @@ func HandleUpdateSystemSettings(c *webapp.Context) {
 	newConfig.AuthorName = author
 	newConfig.TimelineCount = timelinecount
 	newConfig.ThemeName = theme
+	newConfig.FeedContent = feedContent
 	cfg := GetConfig()
 	cfg.Update(&newConfig)
 	cfg.Save()
+	// the shortcodes of the theme may render the articles differently
+	CheckRenderer(c.Application)
 	c.Redirect("/writer/settings", http.StatusFound)
 }
 
@@ -441,16 +606,14 @@ func GetLastCommentMetadata(c *webapp.Context) (meta *CommentMetadata) {
 }
 
 func HandleSingle(c *webapp.Context, pagename string) {
-	if TattooDB.Has(pagename) {
+	// drafts are only visible to the writer, as a preview
+	if TattooDB.Has(pagename) && (TattooDB.IsPublished(pagename) || isAuthorized(c)) {
 		lastMeta := GetLastCommentMetadata(c)
 		err := RenderSinglePage(c, pagename, lastMeta)
 		if err != nil {
 			c.Error(fmt.Sprintf("%s: %s", webapp.ErrInternalServerError, err), http.StatusInternalServerError)
-		}
-		meta, err := TattooDB.GetMeta(pagename)
-		if err == nil {
-			meta.Hits += 1
-			TattooDB.UpdateMetadata(meta)
+		} else if TattooDB.IsPublished(pagename) {
+			Hits.Hit(c, pagename)
 		}
 	} else {
 		Render404page(c, NOT_FOUND_MESSAGE)
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/shellex/tattoo/webapp"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPreviewDraft checks the writer previews a draft, which isn't on the
+// timeline, on an empty blog and beside published articles, without
+// neighbours.
+func TestPreviewDraft(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir("srv")
+	if err := LoadThemeTemplates(GetConfig().ThemeName); err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	db := openTestDB(t)
+	token := GenerateSessionToken()
+	preview := func(name string, authorized bool) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/"+name, nil)
+		if authorized {
+			req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		}
+		HandleSingle(&webapp.Context{Writer: w, Request: req, Application: &webapp.App{}}, name)
+		return w
+	}
+
+	draft := newTestArticle("draft", "Text of the draft.")
+	draft.Metadata.Status = ARTICLE_STATUS_DRAFT
+	if err := db.SaveArticle(draft, ""); err != nil {
+		t.Fatal(err)
+	}
+	// the template error lands in the page already started
+	w := preview("draft", true)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Text of the draft.") || strings.Contains(w.Body.String(), webapp.ErrInternalServerError) {
+		t.Fatalf("preview of a draft on an empty blog = %d:\n%s", w.Code, w.Body.String())
+	}
+	if w := preview("draft", false); strings.Contains(w.Body.String(), "Text of the draft.") {
+		t.Fatalf("draft shown to a reader:\n%s", w.Body.String())
+	}
+
+	for _, name := range []string{"first", "second"} {
+		if err := db.SaveArticle(newTestArticle(name, "Text of "+name+"."), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prev, next := db.GetPrevArticleName("draft"), db.GetNextArticleName("draft"); prev != "" || next != "" {
+		t.Fatalf("draft between %q and %q", prev, next)
+	}
+	w = preview("draft", true)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), webapp.ErrInternalServerError) || strings.Contains(w.Body.String(), "/first") || strings.Contains(w.Body.String(), "/second") {
+		t.Fatalf("preview of a draft = %d, linked to published articles:\n%s", w.Code, w.Body.String())
+	}
+}
+
+// TestRepublishKeepsDate checks an article published, unpublished and
+// published again, by the editor or on schedule, keeps its date.
+func TestRepublishKeepsDate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	db := openTestDB(t)
+	save := func(origName string, name string, status string) {
+		form := url.Values{"orig_name": {origName}, "url": {name}, "title": {"Title of " + name},
+			"text": {"Text of " + name + "."}, "status": {status}, "publish_at": {"1970-01-01T01:00"}}
+		req := httptest.NewRequest("POST", "/writer/update", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		HandleUpdateArticle(&webapp.Context{Writer: w, Request: req, Application: &webapp.App{}})
+		if w.Code != http.StatusFound {
+			t.Fatalf("saving %s as %s = %d: %s", name, status, w.Code, w.Body.String())
+		}
+	}
+	dated := func(name string) (int64, int64) {
+		meta, err := db.GetMeta(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta.CreatedTime, meta.FirstPublishTime
+	}
+
+	save("", "new", ARTICLE_STATUS_PUBLISHED)
+	if created, first := dated("new"); created == 0 || first != created {
+		t.Fatalf("new article created at %d, first published at %d", created, first)
+	}
+	save("", "draft", ARTICLE_STATUS_DRAFT)
+	if _, first := dated("draft"); first != 0 {
+		t.Fatalf("draft first published at %d", first)
+	}
+
+	old := newTestArticle("old", "Text of old.")
+	old.Metadata.CreatedTime = 1000
+	if err := db.SaveArticle(old, ""); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		origName string
+		name     string
+		status   string
+	}{
+		{"old", "old", ARTICLE_STATUS_DRAFT},
+		{"old", "old", ARTICLE_STATUS_PUBLISHED},
+		{"old", "old", ARTICLE_STATUS_PUBLISHED},
+		{"old", "older", ARTICLE_STATUS_DRAFT},
+		{"older", "older", ARTICLE_STATUS_PUBLISHED},
+		{"older", "older", ARTICLE_STATUS_SCHEDULED},
+	}
+	for _, step := range steps {
+		save(step.origName, step.name, step.status)
+		if created, first := dated(step.name); created != 1000 || first != 1000 {
+			t.Fatalf("%s saved as %s, created at %d, first published at %d", step.name, step.status, created, first)
+		}
+	}
+	if names, err := db.PublishDue(time.Now().Unix()); err != nil || len(names) != 1 {
+		t.Fatalf("PublishDue = %v, %v", names, err)
+	}
+	if created, first := dated("older"); created != 1000 || first != 1000 {
+		t.Fatalf("published on schedule, created at %d, first published at %d", created, first)
+	}
+	// newest first
+	db.timelineLock.RLock()
+	at, last := db.ArticleTimelineIndex["older"], len(db.ArticleTimeline)-1
+	db.timelineLock.RUnlock()
+	if at != last {
+		t.Fatalf("republished article at %d on the timeline, not the oldest", at)
+	}
+}
+
+func TestMigrateFirstPublishTime(t *testing.T) {
+	for status, want := range map[string]float64{ARTICLE_STATUS_PUBLISHED: 1000, ARTICLE_STATUS_DRAFT: 0} {
+		buff, changed, err := MigrateRecord([]byte(`{"Version": 1, "Name": "a", "Status": "`+status+`", "CreatedTime": 1000}`), articleMetadataMigrations)
+		if err != nil || !changed {
+			t.Fatalf("MigrateRecord = %v, %v", changed, err)
+		}
+		var record map[string]interface{}
+		json.Unmarshal(buff, &record)
+		if first, _ := record["FirstPublishTime"].(float64); first != want || record["Version"].(float64) != ARTICLE_METADATA_VERSION {
+			t.Errorf("%s article migrated to %s", status, buff)
+		}
+	}
+}
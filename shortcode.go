@@ -0,0 +1,758 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a shortcode is written {{< name key=value "positional" >}} in the source of
+// an article, or {{< name >}}inner{{< /name >}} when it wraps some text, and
+// {{</* name */>}} writes the tag itself without expanding it
+const (
+	SHORTCODE_OPEN         = "{{<"
+	SHORTCODE_CLOSE        = ">}}"
+	SHORTCODE_ESCAPE_OPEN  = "{{</*"
+	SHORTCODE_ESCAPE_CLOSE = "*/>}}"
+)
+
+// the class of the element a shortcode which couldn't be expanded is rendered
+// to, it shows the source of the shortcode
+const SHORTCODE_ERROR_CLASS = "shortcode-error"
+
+var shortcodeNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// Shortcode is a shortcode found in the source of an article.
+type Shortcode struct {
+	Name       string
+	Args       map[string]string
+	Positional []string
+	// the source between the tags of a paired shortcode, nil otherwise
+	Inner []byte
+	// the line of the article the shortcode starts at
+	Line      int
+	innerLine int
+	expander  *shortcodeExpander
+}
+
+// Shortcode.Arg returns the argument called name, or the positional argument
+// at index if there is no such argument.
+func (sc *Shortcode) Arg(name string, index int) string {
+	if value, ok := sc.Args[name]; ok {
+		return value
+	}
+	if index >= 0 && index < len(sc.Positional) {
+		return sc.Positional[index]
+	}
+	return ""
+}
+
+// Shortcode.InnerHTML renders the Markdown between the tags of a paired
+// shortcode, expanding the shortcodes in it.
+func (sc *Shortcode) InnerHTML() []byte {
+	if sc.Inner == nil {
+		return nil
+	}
+	return sc.expander.render(sc.Inner, sc.innerLine)
+}
+
+// ShortcodeHandler renders a shortcode to HTML.
+type ShortcodeHandler func(sc *Shortcode) ([]byte, error)
+
+var shortcodes = make(map[string]ShortcodeHandler)
+
+// RegisterShortcode makes a built-in shortcode available to articles. A theme
+// shortcode of the same name takes its place.
+func RegisterShortcode(name string, handler ShortcodeHandler) {
+	shortcodes[name] = handler
+}
+
+// ShortcodeError is a shortcode of an article which can't be expanded.
+type ShortcodeError struct {
+	Line int
+	Name string
+	Err  string
+}
+
+func (e *ShortcodeError) Error() string {
+	if len(e.Name) == 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: shortcode '%s': %s", e.Line, e.Name, e.Err)
+}
+
+// ThemeShortcodes are the shortcodes of a theme, one template per file in
+// theme/<name>/template/shortcodes, named by the file without ".html". A
+// template is executed with ShortcodeData.
+type ThemeShortcodes struct {
+	Templates *template.Template
+	// a checksum of the templates, part of RendererVersion
+	Sum string
+}
+
+// ShortcodeData is what the template of a theme shortcode is executed with.
+type ShortcodeData struct {
+	Name       string
+	Args       map[string]string
+	Positional []string
+	// the Markdown between the tags rendered, and as written
+	Inner       template.HTML
+	InnerSource string
+}
+
+// LoadThemeShortcodes parses the shortcode templates of a theme, a theme
+// without any has no shortcodes of its own.
+func LoadThemeShortcodes(themeName string) (*ThemeShortcodes, error) {
+	files, err := filepath.Glob(fmt.Sprintf("theme/%s/template/shortcodes/*.html", themeName))
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	sort.Strings(files)
+	hash := sha256.New()
+	for _, filename := range files {
+		buff, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(hash, "%s:%d:", filepath.Base(filename), len(buff))
+		hash.Write(buff)
+	}
+	tpl, err := template.ParseFiles(files...)
+	if err != nil {
+		return nil, err
+	}
+	return &ThemeShortcodes{Templates: tpl, Sum: fmt.Sprintf("%x", hash.Sum(nil)[:4])}, nil
+}
+
+// ThemeShortcodes.Lookup returns the template of a shortcode, nil if the
+// theme doesn't have it.
+func (t *ThemeShortcodes) Lookup(name string) *template.Template {
+	if t == nil {
+		return nil
+	}
+	return t.Templates.Lookup(name + ".html")
+}
+
+func (t *ThemeShortcodes) execute(tpl *template.Template, sc *Shortcode) ([]byte, error) {
+	data := &ShortcodeData{
+		Name:        sc.Name,
+		Args:        sc.Args,
+		Positional:  sc.Positional,
+		Inner:       template.HTML(sc.InnerHTML()),
+		InnerSource: string(sc.Inner),
+	}
+	var buff bytes.Buffer
+	if err := tpl.Execute(&buff, data); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// a tag found in a source
+type shortcodeTag struct {
+	start, end  int
+	line        int
+	name        string
+	closing     bool
+	selfClosing bool
+	// the text an escaped tag stands for
+	literal    string
+	args       map[string]string
+	positional []string
+	err        string
+}
+
+// fenceAt returns the fence of a fenced code block opened on the line at pos,
+// "" if there is none.
+func fenceAt(text []byte, pos int) string {
+	i := pos
+	for i < len(text) && i-pos < 3 && text[i] == ' ' {
+		i++
+	}
+	if i >= len(text) || (text[i] != '`' && text[i] != '~') {
+		return ""
+	}
+	n := 0
+	for i+n < len(text) && text[i+n] == text[i] {
+		n++
+	}
+	if n < 3 {
+		return ""
+	}
+	return strings.Repeat(string(text[i]), n)
+}
+
+// skipFence returns the position after the fenced code block at pos, which
+// runs to the end of the text if it isn't closed.
+func skipFence(text []byte, pos int, fence string) int {
+	next := bytes.IndexByte(text[pos:], '\n')
+	for next >= 0 {
+		pos += next + 1
+		next = bytes.IndexByte(text[pos:], '\n')
+		line := text[pos:]
+		if next >= 0 {
+			line = text[pos : pos+next]
+		}
+		trimmed := bytes.TrimLeft(line, " ")
+		if len(line)-len(trimmed) > 3 || !bytes.HasPrefix(trimmed, []byte(fence)) {
+			continue
+		}
+		if len(bytes.Trim(trimmed, fence[:1]+" \t\r")) == 0 {
+			if next < 0 {
+				return len(text)
+			}
+			return pos + next + 1
+		}
+	}
+	return len(text)
+}
+
+// skipCodeSpan returns the position after the code span opened by the run of
+// backticks at pos, or after the run if it isn't closed.
+func skipCodeSpan(text []byte, pos int) int {
+	n := 0
+	for pos+n < len(text) && text[pos+n] == '`' {
+		n++
+	}
+	for i := pos + n; i < len(text); {
+		if text[i] != '`' {
+			i++
+			continue
+		}
+		m := 0
+		for i+m < len(text) && text[i+m] == '`' {
+			m++
+		}
+		if m == n {
+			return i + m
+		}
+		i += m
+	}
+	return pos + n
+}
+
+// scanShortcodeTags finds the tags of a source, leaving alone the fenced code
+// blocks and code spans.
+func scanShortcodeTags(text []byte) []*shortcodeTag {
+	tags := make([]*shortcodeTag, 0)
+	pos, lineStart := 0, true
+	for pos < len(text) {
+		if lineStart {
+			lineStart = false
+			if fence := fenceAt(text, pos); len(fence) != 0 {
+				pos = skipFence(text, pos, fence)
+				lineStart = true
+				continue
+			}
+		}
+		switch {
+		case text[pos] == '\n':
+			lineStart = true
+			pos++
+		case text[pos] == '`':
+			pos = skipCodeSpan(text, pos)
+		case bytes.HasPrefix(text[pos:], []byte(SHORTCODE_OPEN)):
+			tag := parseShortcodeTag(text, pos)
+			if tag == nil {
+				pos += len(SHORTCODE_OPEN)
+				continue
+			}
+			tags = append(tags, tag)
+			pos = tag.end
+		default:
+			pos++
+		}
+	}
+	return tags
+}
+
+// parseShortcodeTag parses the tag at pos, nil if it isn't closed.
+func parseShortcodeTag(text []byte, pos int) *shortcodeTag {
+	line := bytes.Count(text[:pos], []byte("\n")) + 1
+	if bytes.HasPrefix(text[pos:], []byte(SHORTCODE_ESCAPE_OPEN)) {
+		end := bytes.Index(text[pos:], []byte(SHORTCODE_ESCAPE_CLOSE))
+		if end < 0 {
+			return nil
+		}
+		body := text[pos+len(SHORTCODE_ESCAPE_OPEN) : pos+end]
+		return &shortcodeTag{start: pos, end: pos + end + len(SHORTCODE_ESCAPE_CLOSE), line: line,
+			literal: SHORTCODE_OPEN + string(body) + SHORTCODE_CLOSE}
+	}
+	// the tag ends at the first >}} out of quotes
+	start := pos + len(SHORTCODE_OPEN)
+	end, quoted := -1, false
+	for i := start; i < len(text); i++ {
+		if quoted && text[i] == '\\' {
+			i++
+			continue
+		}
+		if text[i] == '"' {
+			quoted = !quoted
+			continue
+		}
+		if !quoted && bytes.HasPrefix(text[i:], []byte(SHORTCODE_CLOSE)) {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		// an unterminated quote, which splitShortcodeArgs reports
+		end = bytes.Index(text[start:], []byte(SHORTCODE_CLOSE))
+		if end < 0 {
+			return nil
+		}
+		end += start
+	}
+	tag := &shortcodeTag{start: pos, end: end + len(SHORTCODE_CLOSE), line: line, args: make(map[string]string), positional: make([]string, 0)}
+	body := strings.TrimSpace(string(text[start:end]))
+	if strings.HasPrefix(body, "/") {
+		tag.closing = true
+		body = strings.TrimSpace(body[1:])
+	} else if strings.HasSuffix(body, "/") {
+		tag.selfClosing = true
+		body = strings.TrimSpace(body[:len(body)-1])
+	}
+	fields, err := splitShortcodeArgs(body)
+	if err != nil {
+		tag.err = err.Error()
+		return tag
+	}
+	if len(fields) == 0 {
+		tag.err = "missing name"
+		return tag
+	}
+	tag.name = fields[0]
+	if !shortcodeNamePattern.MatchString(tag.name) {
+		tag.err = fmt.Sprintf("invalid name '%s'", tag.name)
+		return tag
+	}
+	if tag.closing && len(fields) > 1 {
+		tag.err = "closing tag with arguments"
+		return tag
+	}
+	for _, field := range fields[1:] {
+		eq := strings.IndexByte(field, '=')
+		if eq <= 0 || strings.HasPrefix(field, `"`) {
+			value, err := unquoteShortcodeArg(field)
+			if err != nil {
+				tag.err = err.Error()
+				return tag
+			}
+			tag.positional = append(tag.positional, value)
+			continue
+		}
+		value, err := unquoteShortcodeArg(field[eq+1:])
+		if err != nil {
+			tag.err = err.Error()
+			return tag
+		}
+		tag.args[field[:eq]] = value
+	}
+	return tag
+}
+
+// splitShortcodeArgs splits the body of a tag at the spaces out of quotes.
+func splitShortcodeArgs(body string) ([]string, error) {
+	fields := make([]string, 0)
+	var field strings.Builder
+	quoted, inField := false, false
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(body):
+			field.WriteByte(c)
+			field.WriteByte(body[i+1])
+			i++
+		case c == '"':
+			quoted = !quoted
+			field.WriteByte(c)
+			inField = true
+		case !quoted && (c == ' ' || c == '\t' || c == '\n' || c == '\r'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteByte(c)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func unquoteShortcodeArg(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		return value, nil
+	}
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted argument %s", value)
+	}
+	return unquoted, nil
+}
+
+// a shortcode replaced by a placeholder until the Markdown around it is
+// rendered
+type shortcodeCall struct {
+	token  string
+	source []byte
+	sc     *Shortcode
+	err    *ShortcodeError
+}
+
+// shortcodeExpander renders the Markdown of an article with its shortcodes
+// and collects the errors of the ones which couldn't be expanded.
+type shortcodeExpander struct {
+	pipeline *MarkdownPipeline
+	themed   *ThemeShortcodes
+	errs     []error
+	// a prefix found nowhere in the source for the placeholders
+	prefix string
+	count  int
+}
+
+func newShortcodeExpander(p *MarkdownPipeline, text []byte) *shortcodeExpander {
+	prefix := "tattooshortcode"
+	for bytes.Contains(text, []byte(prefix)) {
+		prefix += "x"
+	}
+	return &shortcodeExpander{pipeline: p, themed: Templates().Shortcodes, errs: make([]error, 0), prefix: prefix}
+}
+
+// shortcodeExpander.expand replaces the shortcodes of a source starting at
+// line by placeholders. A shortcode alone on its lines gets a paragraph of
+// its own.
+func (e *shortcodeExpander) expand(text []byte, line int) ([]byte, []*shortcodeCall) {
+	tags := scanShortcodeTags(text)
+	if len(tags) == 0 {
+		return text, nil
+	}
+	calls := make([]*shortcodeCall, 0)
+	out := make([]byte, 0, len(text))
+	last := 0
+	for i := 0; i < len(tags); i++ {
+		tag := tags[i]
+		out = append(out, text[last:tag.start]...)
+		if len(tag.literal) != 0 {
+			out = append(out, tag.literal...)
+			last = tag.end
+			continue
+		}
+		call := &shortcodeCall{token: fmt.Sprintf("%s%dx", e.prefix, e.count)}
+		e.count += 1
+		end := tag.end
+		switch {
+		case len(tag.err) != 0:
+			call.err = &ShortcodeError{Line: line + tag.line - 1, Name: tag.name, Err: tag.err}
+		case tag.closing:
+			call.err = &ShortcodeError{Line: line + tag.line - 1, Name: tag.name, Err: "closing tag without an opening one"}
+		default:
+			call.sc = &Shortcode{Name: tag.name, Args: tag.args, Positional: tag.positional, Line: line + tag.line - 1, expander: e}
+			if tag.selfClosing {
+				break
+			}
+			// a tag is paired if a closing tag of its name follows it
+			if close := matchingShortcodeTag(tags, i); close > i {
+				call.sc.Inner = text[tag.end:tags[close].start]
+				call.sc.innerLine = line + bytes.Count(text[:tag.end], []byte("\n"))
+				end = tags[close].end
+				i = close
+			}
+		}
+		call.source = text[tag.start:end]
+		calls = append(calls, call)
+		block := (tag.start == 0 || text[tag.start-1] == '\n') &&
+			(end == len(text) || text[end] == '\n' || text[end] == '\r')
+		if block {
+			out = append(out, '\n')
+		}
+		out = append(out, call.token...)
+		if block {
+			out = append(out, '\n')
+		}
+		last = end
+	}
+	out = append(out, text[last:]...)
+	return out, calls
+}
+
+// matchingShortcodeTag returns the index of the tag closing tags[open], -1 if
+// there is none.
+func matchingShortcodeTag(tags []*shortcodeTag, open int) int {
+	depth := 0
+	name := tags[open].name
+	for i := open + 1; i < len(tags); i++ {
+		tag := tags[i]
+		if tag.name != name || len(tag.err) != 0 || len(tag.literal) != 0 {
+			continue
+		}
+		if tag.closing {
+			if depth == 0 {
+				return i
+			}
+			depth -= 1
+		} else if !tag.selfClosing {
+			depth += 1
+		}
+	}
+	return -1
+}
+
+// shortcodeExpander.call renders a shortcode, a theme's template before a
+// built-in handler.
+func (e *shortcodeExpander) call(call *shortcodeCall) []byte {
+	if call.err == nil {
+		sc := call.sc
+		var out []byte
+		var err error
+		if tpl := e.themed.Lookup(sc.Name); tpl != nil {
+			out, err = e.themed.execute(tpl, sc)
+		} else if handler, ok := shortcodes[sc.Name]; ok {
+			out, err = handler(sc)
+		} else {
+			err = fmt.Errorf("unknown shortcode")
+		}
+		if err == nil {
+			return out
+		}
+		call.err = &ShortcodeError{Line: sc.Line, Name: sc.Name, Err: err.Error()}
+	}
+	e.errs = append(e.errs, call.err)
+	return []byte(`<code class="` + SHORTCODE_ERROR_CLASS + `" title="` + html.EscapeString(call.err.Error()) + `">` +
+		html.EscapeString(string(call.source)) + `</code>`)
+}
+
+// shortcodeExpander.substitute puts the rendered shortcodes in the place of
+// their placeholders in the text of the HTML. Placeholders which Markdown
+// copied into attributes, such as the id made of the text of a heading, are
+// taken out of them.
+func (e *shortcodeExpander) substitute(out []byte, calls []*shortcodeCall) []byte {
+	out = stripShortcodeTokens(out, calls, false)
+	for _, call := range calls {
+		rendered := e.call(call)
+		paragraph := []byte("<p>" + call.token + "</p>")
+		if i := indexInText(out, paragraph); i >= 0 {
+			out = append(out[:i:i], append(rendered, out[i+len(paragraph):]...)...)
+			continue
+		}
+		if i := indexInText(out, []byte(call.token)); i >= 0 {
+			out = append(out[:i:i], append(rendered, out[i+len(call.token):]...)...)
+		}
+	}
+	return out
+}
+
+// indexInText returns the index of the first sep of out which isn't inside a
+// tag, -1 if there is none.
+func indexInText(out []byte, sep []byte) int {
+	for pos := 0; pos < len(out); {
+		i := bytes.Index(out[pos:], sep)
+		if i < 0 {
+			return -1
+		}
+		i += pos
+		if bytes.LastIndexByte(out[:i], '<') <= bytes.LastIndexByte(out[:i], '>') {
+			return i
+		}
+		pos = i + 1
+	}
+	return -1
+}
+
+// stripShortcodeTokens takes the placeholders of calls out of the tags of
+// out, with the dash joining one to the rest of an id, and out of the text
+// too with text, with a space joining one to the rest of it.
+func stripShortcodeTokens(out []byte, calls []*shortcodeCall, text bool) []byte {
+	if len(calls) == 0 {
+		return out
+	}
+	ret := make([]byte, 0, len(out))
+	for pos := 0; pos < len(out); {
+		start := bytes.IndexByte(out[pos:], '<')
+		if start < 0 {
+			start = len(out)
+		} else {
+			start += pos
+		}
+		end := bytes.IndexByte(out[start:], '>')
+		if end < 0 {
+			end = len(out)
+		} else {
+			end += start + 1
+		}
+		between, tag := out[pos:start], out[start:end]
+		for _, call := range calls {
+			token := []byte(call.token)
+			if text {
+				between = bytes.Replace(between, append([]byte(" "), token...), nil, -1)
+				between = bytes.Replace(between, append(token, ' '), nil, -1)
+				between = bytes.Replace(between, token, nil, -1)
+			}
+			tag = bytes.Replace(tag, append([]byte("-"), token...), nil, -1)
+			tag = bytes.Replace(tag, append(token, '-'), nil, -1)
+			tag = bytes.Replace(tag, token, nil, -1)
+		}
+		ret = append(append(ret, between...), tag...)
+		pos = end
+	}
+	return ret
+}
+
+// shortcodeExpander.render renders a piece of an article starting at line,
+// without a table of contents.
+func (e *shortcodeExpander) render(text []byte, line int) []byte {
+	text, calls := e.expand(text, line)
+	out := e.pipeline.renderMarkdown(text, e.pipeline.HTMLFlags, e.pipeline.Extensions)
+	return e.substitute(out, calls)
+}
+
+// CheckShortcodes returns the errors of the shortcodes of an article source
+// which can't be expanded, by line.
+func CheckShortcodes(text []byte) []error {
+	e := newShortcodeExpander(markdown, text)
+	markdown.renderArticle(e, text)
+	return e.errs
+}
+
+func htmlAttr(name string, value string) string {
+	if len(value) == 0 {
+		return ""
+	}
+	return " " + name + `="` + html.EscapeString(value) + `"`
+}
+
+var youtubeIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{6,20}$`)
+var gistPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+/[0-9a-fA-F]+$`)
+
+var calloutTypes = map[string]bool{"note": true, "tip": true, "warning": true, "danger": true}
+
+// {{< figure src="a.png" alt="" caption="" link="" width="" class="" >}}
+func shortcodeFigure(sc *Shortcode) ([]byte, error) {
+	src := sc.Arg("src", 0)
+	if len(src) == 0 {
+		return nil, fmt.Errorf("missing src")
+	}
+	var out bytes.Buffer
+	out.WriteString("<figure" + htmlAttr("class", sc.Args["class"]) + ">")
+	img := "<img" + htmlAttr("src", src) + ` alt="` + html.EscapeString(sc.Args["alt"]) + `"` +
+		htmlAttr("width", sc.Args["width"]) + htmlAttr("title", sc.Args["title"]) + " />"
+	if link := sc.Args["link"]; len(link) != 0 {
+		img = "<a" + htmlAttr("href", link) + ">" + img + "</a>"
+	}
+	out.WriteString(img)
+	if caption := sc.Args["caption"]; len(caption) != 0 {
+		out.WriteString("<figcaption>" + html.EscapeString(caption) + "</figcaption>")
+	}
+	out.WriteString("</figure>\n")
+	return out.Bytes(), nil
+}
+
+// {{< youtube id >}} or {{< youtube id="" start="" title="" >}}
+func shortcodeYoutube(sc *Shortcode) ([]byte, error) {
+	id := sc.Arg("id", 0)
+	if !youtubeIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("invalid video id '%s'", id)
+	}
+	src := "https://www.youtube-nocookie.com/embed/" + id
+	if start := sc.Args["start"]; len(start) != 0 {
+		if _, err := strconv.Atoi(start); err != nil {
+			return nil, fmt.Errorf("start should be a number of seconds")
+		}
+		src += "?start=" + start
+	}
+	title := sc.Args["title"]
+	if len(title) == 0 {
+		title = "YouTube video"
+	}
+	return []byte(`<div class="embed youtube"><iframe` + htmlAttr("src", src) + htmlAttr("title", title) +
+		` frameborder="0" loading="lazy" allowfullscreen></iframe></div>` + "\n"), nil
+}
+
+// {{< gist user/id >}} or {{< gist user/id file="" >}}
+func shortcodeGist(sc *Shortcode) ([]byte, error) {
+	id := sc.Arg("id", 0)
+	if !gistPattern.MatchString(id) {
+		return nil, fmt.Errorf("gist should be given as user/id, not '%s'", id)
+	}
+	src := "https://gist.github.com/" + id + ".js"
+	link := "https://gist.github.com/" + id
+	if file := sc.Args["file"]; len(file) != 0 {
+		src += "?file=" + url.QueryEscape(file)
+	}
+	return []byte(`<div class="embed gist"><script` + htmlAttr("src", src) + `></script>` +
+		`<noscript><a` + htmlAttr("href", link) + `>` + html.EscapeString(link) + `</a></noscript></div>` + "\n"), nil
+}
+
+// {{< code lang="go" title="" >}}...{{< /code >}}, the code highlighted as a
+// fenced code block of the language
+func shortcodeCode(sc *Shortcode) ([]byte, error) {
+	if sc.Inner == nil {
+		return nil, fmt.Errorf("missing {{< /code >}}")
+	}
+	code := bytes.TrimPrefix(bytes.TrimPrefix(sc.Inner, []byte("\r")), []byte("\n"))
+	code = bytes.TrimRight(code, " \t\r\n")
+	code = append(code[:len(code):len(code)], '\n')
+	lang := sc.Arg("lang", 0)
+	var out bytes.Buffer
+	out.WriteString(`<div class="code">`)
+	if title := sc.Args["title"]; len(title) != 0 {
+		out.WriteString(`<div class="code-title">` + html.EscapeString(title) + `</div>`)
+	}
+	if lexer := LookupLexer(lang); lexer != nil {
+		out.WriteString(`<pre><code class="language-` + html.EscapeString(lang) + ` highlight">`)
+		out.Write(lexer.Highlight(code))
+	} else {
+		if len(lang) != 0 {
+			out.WriteString(`<pre><code class="language-` + html.EscapeString(lang) + `">`)
+		} else {
+			out.WriteString("<pre><code>")
+		}
+		out.WriteString(html.EscapeString(string(code)))
+	}
+	out.WriteString("</code></pre></div>\n")
+	return out.Bytes(), nil
+}
+
+// {{< callout type="warning" title="" >}}Markdown{{< /callout >}}
+func shortcodeCallout(sc *Shortcode) ([]byte, error) {
+	kind := sc.Arg("type", 0)
+	if len(kind) == 0 {
+		kind = "note"
+	}
+	if !calloutTypes[kind] {
+		return nil, fmt.Errorf("type should be one of note, tip, warning and danger, not '%s'", kind)
+	}
+	var out bytes.Buffer
+	out.WriteString(`<aside class="callout callout-` + kind + `">`)
+	if title := sc.Args["title"]; len(title) != 0 {
+		out.WriteString(`<p class="callout-title">` + html.EscapeString(title) + `</p>`)
+	}
+	out.WriteString("\n")
+	out.Write(sc.InnerHTML())
+	out.WriteString("</aside>\n")
+	return out.Bytes(), nil
+}
+
+func init() {
+	RegisterShortcode("figure", shortcodeFigure)
+	RegisterShortcode("youtube", shortcodeYoutube)
+	RegisterShortcode("gist", shortcodeGist)
+	RegisterShortcode("code", shortcodeCode)
+	RegisterShortcode("callout", shortcodeCallout)
+}
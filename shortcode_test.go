@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tagNames returns the tags scanned from text, as written: "name", "/name",
+// "name/" or the literal of an escaped tag.
+func tagNames(text string) []string {
+	names := make([]string, 0)
+	for _, tag := range scanShortcodeTags([]byte(text)) {
+		switch {
+		case len(tag.literal) != 0:
+			names = append(names, tag.literal)
+		case tag.closing:
+			names = append(names, "/"+tag.name)
+		case tag.selfClosing:
+			names = append(names, tag.name+"/")
+		default:
+			names = append(names, tag.name)
+		}
+	}
+	return names
+}
+
+func TestScanShortcodeTags(t *testing.T) {
+	cases := []struct {
+		text string
+		want string
+	}{
+		{"{{< a >}} text {{< b />}}", "a b/"},
+		{"{{< a >}}inner{{< /a >}}", "a /a"},
+		{"```\n{{< fenced >}}\n```\n{{< a >}}", "a"},
+		{"~~~~ go\n{{< fenced >}}\n~~~\n{{< still >}}\n~~~~\n{{< a >}}", "a"},
+		{"   ```\n{{< indented >}}\n   ```\n{{< a >}}", "a"},
+		// four spaces are an indented code block, not a fence
+		{"    ```\n{{< a >}}", "a"},
+		{"```\n{{< unclosed >}}\n", ""},
+		{"text ```{{< a >}}```", ""},
+		{"`{{< span >}}` {{< a >}}", "a"},
+		{"``one ` {{< span >}}`` {{< a >}}", "a"},
+		// a run of backticks never closed is text
+		{"`` {{< a >}}", "a"},
+		{"{{</* a */>}}", "{{< a >}}"},
+		{"{{</* a x=\"1\" */>}} {{< b >}}", "{{< a x=\"1\" >}} b"},
+		{"{{< unclosed", ""},
+		{"{{</* unclosed", ""},
+	}
+	for _, c := range cases {
+		if got := strings.Join(tagNames(c.text), " "); got != c.want {
+			t.Errorf("tags of %q = %q, want %q", c.text, got, c.want)
+		}
+	}
+}
+
+func TestParseShortcodeTag(t *testing.T) {
+	tags := scanShortcodeTags([]byte(`{{< figure "a.png" caption="a >}} b" alt=x title="say \"hi\"" >}}`))
+	if len(tags) != 1 {
+		t.Fatalf("%d tags, want 1", len(tags))
+	}
+	tag := tags[0]
+	if len(tag.err) != 0 {
+		t.Fatal(tag.err)
+	}
+	if tag.name != "figure" || len(tag.positional) != 1 || tag.positional[0] != "a.png" {
+		t.Errorf("name %q, positional %q", tag.name, tag.positional)
+	}
+	want := map[string]string{"caption": "a >}} b", "alt": "x", "title": `say "hi"`}
+	for key, value := range want {
+		if tag.args[key] != value {
+			t.Errorf("argument %s = %q, want %q", key, tag.args[key], value)
+		}
+	}
+
+	errs := map[string]string{
+		`{{< figure src="a.png >}}`:   "unterminated quote",
+		`{{< >}}`:                     "missing name",
+		`{{< 1st >}}`:                 "invalid name '1st'",
+		`{{< /a x >}}`:                "closing tag with arguments",
+		`{{< a x="\q" >}}`:            `invalid quoted argument "\q"`,
+		"{{< a\nb=\"unterminated >}}": "unterminated quote",
+	}
+	for text, want := range errs {
+		tags := scanShortcodeTags([]byte(text))
+		if len(tags) != 1 || tags[0].err != want {
+			t.Errorf("tags of %q = %v, want the error %q", text, tags, want)
+		}
+	}
+}
+
+func TestMatchingShortcodeTag(t *testing.T) {
+	text := "{{< c >}}a{{< c >}}b{{< c />}}{{< /c >}}c{{< d >}}{{< /c >}}{{< /d >}}"
+	if got := strings.Join(tagNames(text), " "); got != "c c c/ /c d /c /d" {
+		t.Fatalf("tags = %s", got)
+	}
+	tags := scanShortcodeTags([]byte(text))
+	want := map[int]int{0: 5, 1: 3, 4: 6}
+	for open, close := range want {
+		if got := matchingShortcodeTag(tags, open); got != close {
+			t.Errorf("tag %d closed by %d, want %d", open, got, close)
+		}
+	}
+	unclosed := scanShortcodeTags([]byte("{{< c >}}{{< c >}}{{< /c >}}"))
+	if got := matchingShortcodeTag(unclosed, 0); got != -1 {
+		t.Errorf("outer tag closed by %d", got)
+	}
+}
+
+func TestShortcodeErrorLines(t *testing.T) {
+	text := "# Title\n\n{{< unknown >}}\n\n" +
+		"```\n{{< fenced >}}\n```\n\n" +
+		"{{< callout >}}\ninner\n\n{{< missing >}}\n{{< /callout >}}\n\n" +
+		"{{< figure src=\"a.png >}}\n\n" +
+		"text {{< /stray >}}\n"
+	errs := CheckShortcodes([]byte(text))
+	want := []string{
+		"line 3: shortcode 'unknown': unknown shortcode",
+		"line 12: shortcode 'missing': unknown shortcode",
+		"line 15: unterminated quote",
+		"line 17: shortcode 'stray': closing tag without an opening one",
+	}
+	got := make([]string, len(errs))
+	for i, err := range errs {
+		got[i] = err.Error()
+	}
+	// inner shortcodes are expanded while their paired one renders, so the
+	// errors come out of line order
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestShortcodeInHeading checks a shortcode in a heading is rendered in the
+// heading only, not in its id or in the table of contents.
+func TestShortcodeInHeading(t *testing.T) {
+	html, toc := markdown.RenderArticle([]byte("# Intro {{< youtube abcdefgh >}}\n\n## {{< nope >}} Second\n\n{{< youtube abcdefgh >}}\n"))
+	e := newShortcodeExpander(markdown, nil)
+	for _, out := range [][]byte{html, toc} {
+		if bytes.Contains(out, []byte(e.prefix)) {
+			t.Fatalf("placeholder left in:\n%s", out)
+		}
+	}
+	for _, want := range []string{`<h1 id="intro">Intro <div class="embed youtube">`, `<h2 id="second"><code class="shortcode-error"`} {
+		if !bytes.Contains(html, []byte(want)) {
+			t.Errorf("no %s in:\n%s", want, html)
+		}
+	}
+	if bytes.Count(html, []byte(`<div class="embed youtube">`)) != 2 {
+		t.Errorf("videos not rendered in place:\n%s", html)
+	}
+	for _, want := range []string{`<a href="#intro">Intro</a>`, `<a href="#second">Second</a>`} {
+		if !bytes.Contains(toc, []byte(want)) {
+			t.Errorf("no %s in the table of contents:\n%s", want, toc)
+		}
+	}
+}
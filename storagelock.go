@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// the file locked by the process using the storages, beside settings.json
+// and not under storage/, which restore replaces
+const STORAGE_LOCK_FILE = "tattoo.lock"
+
+const ERROR_STORAGE_LOCKED = "The storages are in use by another process"
+
+// the storage lock file held by this process, kept open as closing it
+// releases the lock
+var storageLockFile *os.File = nil
+
+// LockStorage takes the exclusive lock of the storages for this process, it
+// fails if another process holds it. The server holds it while it runs, and
+// so do the commands which need the server stopped, so neither starts while
+// the other is running. The lock goes away with the process holding it, even
+// if it crashes.
+func LockStorage() error {
+	if storageLockFile != nil {
+		return nil
+	}
+	file, err := os.OpenFile(STORAGE_LOCK_FILE, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		owner, _ := ioutil.ReadAll(file)
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("%s (pid %s), stop the server first", ERROR_STORAGE_LOCKED, strings.TrimSpace(string(owner)))
+		}
+		return err
+	}
+	// tell who holds it
+	file.Truncate(0)
+	file.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	storageLockFile = file
+	return nil
+}
+
+// UnlockStorage releases the storage lock of this process.
+func UnlockStorage() error {
+	if storageLockFile == nil {
+		return errors.New("storage isn't locked")
+	}
+	file := storageLockFile
+	storageLockFile = nil
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return file.Close()
+}
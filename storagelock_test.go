@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/shellex/tattoo/webapp"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestLockStorage(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+
+	// another process holding the lock, the lock of an open file is per file
+	// description so a second one stands for it
+	other, err := os.OpenFile(STORAGE_LOCK_FILE, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatal(err)
+	}
+	other.WriteString("12345\n")
+	err = LockStorage()
+	if err == nil || !strings.HasPrefix(err.Error(), ERROR_STORAGE_LOCKED) || !strings.Contains(err.Error(), "12345") {
+		t.Fatalf("LockStorage() = %v while another process holds the lock", err)
+	}
+	syscall.Flock(int(other.Fd()), syscall.LOCK_UN)
+
+	if err := LockStorage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Fatalf("lock taken by another process while held: %v", err)
+	}
+	if err := UnlockStorage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("lock not released: %v", err)
+	}
+}
+
+// TestRunCommandLocks checks every command runs holding the storage lock and
+// none runs while another process holds it.
+func TestRunCommandLocks(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	ran := false
+	RegisterCommand(&Command{Name: "test-lock", Locked: "try later", Run: func(app *webapp.App, args []string) error {
+		ran = true
+		if storageLockFile == nil {
+			t.Error("command run without the storage lock")
+		}
+		return nil
+	}})
+	defer delete(commands, "test-lock")
+
+	other, err := os.OpenFile(STORAGE_LOCK_FILE, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatal(err)
+	}
+	err = RunCommand(&webapp.App{}, []string{"test-lock"})
+	if err == nil || !strings.HasPrefix(err.Error(), ERROR_STORAGE_LOCKED) || !strings.HasSuffix(err.Error(), "try later") {
+		t.Fatalf("RunCommand = %v while another process holds the lock", err)
+	}
+	if ran {
+		t.Fatal("command run while another process holds the lock")
+	}
+	syscall.Flock(int(other.Fd()), syscall.LOCK_UN)
+
+	if err := RunCommand(&webapp.App{}, []string{"test-lock"}); err != nil || !ran {
+		t.Fatalf("RunCommand = %v, run %v", err, ran)
+	}
+	if storageLockFile != nil {
+		t.Fatal("storage lock kept after the command")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"sort"
+)
+
+func init() {
+	RegisterCommand(&Command{
+		Name:  "storage",
+		Usage: "storage migrate [-from backend] -to backend | storage shard",
+		Help:  "migrate copies every storage to another backend, verifies the copy and switches settings.json to it; shard converts flat file storages to the sharded layout. Both are offline, they refuse to run while the server is running.",
+		Run:   runStorage,
+	})
+}
+
+func runStorage(app *webapp.App, args []string) error {
+	if len(args) == 1 && args[0] == "shard" {
+		return ShardStorage(app)
+	}
+	if len(args) == 0 || args[0] != "migrate" {
+		return errors.New("usage: storage migrate [-from backend] -to backend | storage shard")
+	}
+	flags := flag.NewFlagSet("storage migrate", flag.ExitOnError)
+	from := flags.String("from", GetConfig().StorageBackend, "Backend the blog uses now")
+	to := flags.String("to", "", "Backend to move the blog to: file, kv")
+	flags.Parse(args[1:])
+	return MigrateStorage(app, *from, *to)
+}
+
+// StoreChecksum returns the number of records in a storage and the sha256 of
+// all its keys and values, in key order.
+func StoreChecksum(st *webapp.Store) (int, string, error) {
+	keys := st.Keys()
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		value, err := st.Get(key)
+		if err != nil {
+			return 0, "", fmt.Errorf("%s: %v", key, err)
+		}
+		fmt.Fprintf(h, "%d:%s%d:", len(key), key, len(value))
+		h.Write(value)
+	}
+	return len(keys), fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// MigrateStorage copies every storage from the backend the blog uses to
+// another one, the caller holds the storage lock so the server can't write
+// meanwhile. Whatever the target holds is replaced. The copy is reopened
+// and its record counts and checksums are compared with the source; only
+// when all of them match is Config.StorageBackend switched and saved. The
+// source is left as it is.
+func MigrateStorage(app *webapp.App, from string, to string) error {
+	if from != GetConfig().StorageBackend {
+		return fmt.Errorf("the blog uses the '%s' backend, not '%s'", GetConfig().StorageBackend, from)
+	}
+	if from == to {
+		return errors.New("source and target backend are the same")
+	}
+	if from == webapp.STORAGE_BACKEND_MEMORY || to == webapp.STORAGE_BACKEND_MEMORY {
+		return errors.New("the memory backend can't be migrated from or to")
+	}
+	src := new(TattooStorage)
+	if err := src.Open(from, ""); err != nil {
+		return err
+	}
+	defer src.Close()
+	dst := new(TattooStorage)
+	if err := dst.Open(to, ""); err != nil {
+		return err
+	}
+	srcStores, dstStores := src.Stores(), dst.Stores()
+	for i, store := range srcStores {
+		target := dstStores[i].DB
+		for _, key := range target.Keys() {
+			if err := target.Delete(key); err != nil {
+				dst.Close()
+				return fmt.Errorf("%s: clear target: %v", store.Name, err)
+			}
+		}
+		for _, key := range store.DB.Keys() {
+			value, err := store.DB.Get(key)
+			if err == nil {
+				err = target.Set(key, value)
+			}
+			if err != nil {
+				dst.Close()
+				return fmt.Errorf("%s: copy '%s': %v", store.Name, key, err)
+			}
+		}
+		app.Log("Storage", fmt.Sprintf("Copied %s: %d record(s)", store.Name, store.DB.Count()))
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	// verify what the target reads back after being reopened
+	if err := dst.Open(to, ""); err != nil {
+		return err
+	}
+	defer dst.Close()
+	dstStores = dst.Stores()
+	for i, store := range srcStores {
+		count, sum, err := StoreChecksum(store.DB)
+		if err != nil {
+			return fmt.Errorf("%s: read source: %v", store.Name, err)
+		}
+		dstCount, dstSum, err := StoreChecksum(dstStores[i].DB)
+		if err != nil {
+			return fmt.Errorf("%s: read target: %v", store.Name, err)
+		}
+		if count != dstCount || sum != dstSum {
+			return fmt.Errorf("%s: verification failed, source has %d record(s) (%s), target %d (%s)",
+				store.Name, count, sum, dstCount, dstSum)
+		}
+		app.Log("Storage", fmt.Sprintf("Verified %s: %d record(s), sha256 %s", store.Name, count, sum))
+	}
+
+	newConfig := *GetConfig()
+	newConfig.StorageBackend = to
+	if err := newConfig.Save(); err != nil {
+		return fmt.Errorf("failed to switch %s to the '%s' backend: %v", CONFIG_NAME, to, err)
+	}
+	GetConfig().Update(&newConfig)
+	app.Log("Storage", fmt.Sprintf("Switched to the '%s' backend, the '%s' data is left in place", to, from))
+	return nil
+}
+
+// ShardStorage converts every flat multiple-file storage of the file backend
+// to the sharded layout in place, see FileStorage.Shard.
+func ShardStorage(app *webapp.App) error {
+	backend := GetConfig().StorageBackend
+	if backend != "" && backend != webapp.STORAGE_BACKEND_FILE {
+		return fmt.Errorf("only the file backend has a layout, the blog uses '%s'", backend)
+	}
+	db := new(TattooStorage)
+	if err := db.Open(backend, ""); err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, store := range db.Stores() {
+		fs, ok := store.DB.Storage.(*webapp.FileStorage)
+		if !ok || fs.Mode != webapp.FILE_STORAGE_MODE_MULIPLE {
+			continue
+		}
+		if fs.Sharded {
+			app.Log("Storage", store.Name+" is sharded already")
+			continue
+		}
+		app.Log("Storage", fmt.Sprintf("Shard %s: %d record(s)", store.Name, fs.Count()))
+		if err := fs.Shard(); err != nil {
+			return fmt.Errorf("%s: %v, fsck -repair may fix missing files", store.Name, err)
+		}
+	}
+	return nil
+}
@@ -6,7 +6,9 @@ import (
 	"github.com/shellex/tattoo/webapp"
 	"log"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
 	"time"
 )
 
@@ -15,25 +17,54 @@ var startUpTime int64
 var useFCGI = flag.Bool("fcgi", false, "Use FastCGI")
 
 func LoadTheme(app *webapp.App, themeName string) error {
-	cfg := GetConfig()
 	app.Log("Use Theme", themeName)
 	if err := LoadThemeTemplates(themeName); err != nil {
 		return err
 	}
+	SetThemeVars(themeName)
+	return nil
+}
+
+// SetThemeVars sets the URLs of a theme loaded, which its templates use.
+func SetThemeVars(themeName string) {
+	cfg := GetConfig()
 	themeURL := path.Join(cfg.Path, "theme", themeName)
 	themeStaticURL := path.Join(cfg.Path, "theme", themeName, "static")
 	TattooDB.SetVar("ThemeURL", themeURL)
 	TattooDB.SetVar("ThemeStaticURL", themeStaticURL)
-	return nil
+}
+
+// HandleShutdown saves the pending hits, flushes and closes the storages
+// when the server is interrupted or terminated, then exits.
+func HandleShutdown(app *webapp.App) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		app.Log("App Stops", sig.String())
+		if err := FlushHits(); err != nil {
+			app.Log("Error", fmt.Sprintf("Failed to save hits: %v", err))
+		}
+		if err := TattooDB.Shutdown(); err != nil {
+			app.Log("Error", fmt.Sprintf("Failed to flush DB: %v", err))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
 }
 
 func main() {
+	flag.Usage = PrintUsage
 	flag.Parse()
 	if err := GetConfig().Load(); err != nil {
 		fmt.Println("Failed to load configure file")
 		return
 	}
 	cfg := GetConfig()
+	if err := ConfigureMarkdown(&cfg.Markdown); err != nil {
+		fmt.Println("Failed to configure Markdown:", err)
+		return
+	}
 	startUpTime = time.Now().Unix()
 	rootPath, _ := os.Getwd()
 	rootURL := path.Join(cfg.Path, "/")
@@ -44,26 +75,63 @@ func main() {
 	themeURL := path.Join(cfg.Path, "/theme")
 
 	app := webapp.App{}
+	if flag.NArg() != 0 {
+		// run a maintenance command instead of the server
+		if err := RunCommand(&app, flag.Args()); err != nil {
+			app.Log("Error", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 	app.Log("App Starts", "OK")
 	app.SetStaticPath(systemStaticURL, systemStaticPath)
 	app.SetStaticPath(themeURL, themePath)
 	app.SetHandler(rootURL, HandleRoot)
 
-	// Load DB
+	// Load DB, none of the commands needing the server stopped may run meanwhile
+	if err := LockStorage(); err != nil {
+		app.Log("Error", fmt.Sprintf("Failed to lock storage: %v", err))
+		return
+	}
 	app.Log("Tattoo DB", "Load DB")
-	TattooDB.Load(&app)
+	if err := TattooDB.Load(&app); err != nil {
+		app.Log("Error", fmt.Sprintf("Failed to load DB: %v", err))
+		return
+	}
+	HandleShutdown(&app)
 
 	TattooDB.SetVar("RootURL", rootURL)
 	TattooDB.SetVar("SystemStaticURL", systemStaticURL)
 
-	// load templates
-	if err := LoadSystemTemplates(); err != nil {
-		app.Log("Error", fmt.Sprintf("Failed to load system templates: %v", err))
-		return
+	// load templates, in development mode whenever they change, their errors
+	// shown in the browser
+	if *devMode {
+		StartTemplateWatcher(&app)
+	} else {
+		if err := LoadSystemTemplates(); err != nil {
+			app.Log("Error", fmt.Sprintf("Failed to load system templates: %v", err))
+			return
+		}
+		if err := LoadTheme(&app, GetConfig().ThemeName); err != nil {
+			app.Log("Error", fmt.Sprintf("Failed to load theme: %v", err))
+		}
 	}
-	if err := LoadTheme(&app, GetConfig().ThemeName); err != nil {
-		app.Log("Error", fmt.Sprintf("Failed to load theme: %v", err))
+
+	if len(cfg.ReplicaPrimary) != 0 {
+		// a follower gets published articles, purged trash, trimmed changes and
+		// rendered HTML from its primary
+		if err := StartReplica(&app); err != nil {
+			app.Log("Error", fmt.Sprintf("Failed to start replica: %v", err))
+			return
+		}
+	} else {
+		StartPublishScheduler(&app)
+		StartTrashScheduler(&app)
+		StartChangeScheduler(&app)
+		CheckRenderer(&app)
 	}
+	StartBackupScheduler(&app)
+	StartHitCounter(&app)
 
 	// Start Server.
 	if *useFCGI {
@@ -2,27 +2,51 @@ package main
 
 import (
 	"errors"
-	"github.com/russross/blackfriday"
+	"fmt"
 	"github.com/shellex/tattoo/webapp"
 	"html/template"
 	"log"
+	"path"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type TattooStorage struct {
-	ArticleDB            webapp.FileStorage
-	ArticleHTMLDB        webapp.FileStorage
-	MetadataDB           webapp.FileStorage
-	CommentDB            webapp.FileStorage
-	CommentHTMLDB        webapp.FileStorage
-	CommentMetadataDB    webapp.FileStorage
-	CommentIndexDB       webapp.FileStorage
-	TagIndexDB           webapp.FileStorage
-	VarDB                webapp.FileStorage
+	ArticleDB         webapp.Store
+	ArticleHTMLDB     webapp.Store
+	MetadataDB        webapp.Store
+	CommentDB         webapp.Store
+	CommentHTMLDB     webapp.Store
+	CommentMetadataDB webapp.Store
+	CommentIndexDB    webapp.Store
+	TagIndexDB        webapp.Store
+	VarDB             webapp.Store
+	RevisionDB        webapp.Store
+	RevisionIndexDB   webapp.Store
+	TrashDB           webapp.Store
+	TimelineDB        webapp.Store
+	ChangeDB          webapp.Store
+	// the timelines saved in TimelineDB, as lists of names
 	ArticleTimeline      []string
 	ArticleTimelineIndex map[string]int
 	PageTimeline         []string
+	DraftTimeline        []string
 	CommentTimeline      []string
+	// the timelines above as saved, by key
+	savedTimelines map[string]*savedTimeline
+	// guards the timelines above
+	timelineLock sync.RWMutex
+	// the segments the running transaction put names in, by timeline, "" for
+	// names it took off
+	timelineWhere map[string]map[string]string
+	// held by the running transaction
+	txLock sync.Mutex
+	// noted by the running transaction for the change log
+	changes []*Change
+	cache   *TattooCache
+	flusher *webapp.FlushScheduler
 }
 
 var TattooDB *TattooStorage = nil
@@ -31,135 +55,150 @@ func init() {
 	TattooDB = new(TattooStorage)
 }
 
-func (db *TattooStorage) Load(app *webapp.App) {
-	app.Log("Tattoo DB", "Init DB: Article DB")
-	db.ArticleDB.Init("storage/source/", webapp.FILE_STORAGE_MODE_MULIPLE)
-	app.Log("Tattoo DB", "Init DB: Article HTML DB")
-	db.ArticleHTMLDB.Init("storage/html/", webapp.FILE_STORAGE_MODE_MULIPLE)
-	app.Log("Tattoo DB", "Init DB: Article Metadata DB")
-	db.MetadataDB.Init("storage/metadata/", webapp.FILE_STORAGE_MODE_MULIPLE)
-	app.Log("Tattoo DB", "Init DB: Vars DB")
-	db.VarDB.Init("storage/var.json", webapp.FILE_STORAGE_MODE_SINGLE)
-
-	app.Log("Tattoo DB", "Init DB: Comment DB")
-	db.CommentDB.Init("storage/comment_source/", webapp.FILE_STORAGE_MODE_MULIPLE)
-	app.Log("Tattoo DB", "Init DB: Comment HTML DB")
-	db.CommentHTMLDB.Init("storage/comment_html/", webapp.FILE_STORAGE_MODE_MULIPLE)
-	app.Log("Tattoo DB", "Init DB: Comment Metadata DB")
-	db.CommentMetadataDB.Init("storage/comment_metadata/", webapp.FILE_STORAGE_MODE_MULIPLE)
-	app.Log("Tattoo DB", "Init DB: Comment Index DB")
-	db.CommentIndexDB.Init("storage/comment_index/", webapp.FILE_STORAGE_MODE_MULIPLE)
-
-	app.Log("Tattoo DB", "Init DB: Tag Index DB")
-	db.TagIndexDB.Init("storage/tag_index/", webapp.FILE_STORAGE_MODE_MULIPLE)
-
-	app.Log("Tattoo DB", "Rebuild Article Timeline")
-	db.RebuildTimeline()
-	app.Log("Tattoo DB", "Rebuild Comment Timeline")
-	db.RebuildCommentTimeline()
-}
-
-// TattooStorage.RebuildTimeline rebuilds an array Tattoo.ArticleTimeline
-// which contains all articles' name, order by created time.
-// And builds a mapping from articles' name to the position of according
-// articles.
-func (s *TattooStorage) RebuildTimeline() {
-	s.ArticleTimeline = make([]string, 0)
-	s.ArticleTimelineIndex = make(map[string]int)
-	s.PageTimeline = make([]string, 0)
-	tmp_a := new(KeyPairs)
-	tmp_a.Items = make([]*KeyValuePair, 0)
-	tmp_p := new(KeyPairs)
-	tmp_p.Items = make([]*KeyValuePair, 0)
-	var metadata *ArticleMetadata
-	var err error
-	for name, _ := range s.ArticleDB.Index {
-		if name == "*" {
-			continue
-		}
-		metadata, err = s.GetMeta(name)
-		if err != nil {
-			log.Printf("%v\n", err)
-		}
-		if metadata.IsPage {
-			tmp_p.Items = append(tmp_p.Items, &KeyValuePair{Key: metadata.CreatedTime, Value: name})
-		} else {
-			tmp_a.Items = append(tmp_a.Items, &KeyValuePair{Key: metadata.CreatedTime, Value: name})
-		}
+// the single file of all storages with the kv backend
+const STORAGE_KV_FILE = "storage/tattoo.kv"
+
+// StoreInfo describes one of the storages of TattooStorage. Path and Mode are
+// used by the file backend.
+type StoreInfo struct {
+	Name string
+	DB   *webapp.Store
+	Path string
+	Mode int
+}
+
+// StoreInfo.Bucket returns the name of the storage in a KV file, its Path
+// without the storage directory.
+func (info *StoreInfo) Bucket() string {
+	return strings.Trim(strings.TrimPrefix(info.Path, "storage/"), "/")
+}
+
+// TattooStorage.Stores lists every storage with its location.
+func (db *TattooStorage) Stores() []*StoreInfo {
+	return []*StoreInfo{
+		{"Article DB", &db.ArticleDB, "storage/source/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Article HTML DB", &db.ArticleHTMLDB, "storage/html/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Article Metadata DB", &db.MetadataDB, "storage/metadata/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Vars DB", &db.VarDB, "storage/var.json", webapp.FILE_STORAGE_MODE_SINGLE},
+		{"Comment DB", &db.CommentDB, "storage/comment_source/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Comment HTML DB", &db.CommentHTMLDB, "storage/comment_html/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Comment Metadata DB", &db.CommentMetadataDB, "storage/comment_metadata/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Comment Index DB", &db.CommentIndexDB, "storage/comment_index/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Tag Index DB", &db.TagIndexDB, "storage/tag_index/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Revision DB", &db.RevisionDB, "storage/revision/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Revision Index DB", &db.RevisionIndexDB, "storage/revision_index/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Trash DB", &db.TrashDB, "storage/trash/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Timeline DB", &db.TimelineDB, "storage/timeline/", webapp.FILE_STORAGE_MODE_MULIPLE},
+		{"Change DB", &db.ChangeDB, "storage/changes/", webapp.FILE_STORAGE_MODE_MULIPLE},
+	}
+}
+
+// TattooStorage.Load opens every storage with the backend set in
+// Config.StorageBackend and builds the timelines.
+func (db *TattooStorage) Load(app *webapp.App) error {
+	db.cache = NewTattooCache()
+	backend := GetConfig().StorageBackend
+	app.Log("Tattoo DB", "Open storages, backend: "+backend)
+	if backend == webapp.STORAGE_BACKEND_MEMORY {
+		app.Log("Tattoo DB", "Memory backend, nothing will be saved")
 	}
-	sort.Sort(tmp_a)
-	for i, j := 0, len(tmp_a.Items)-1; i < j; i, j = i+1, j-1 {
-		tmp_a.Items[i], tmp_a.Items[j] = tmp_a.Items[j], tmp_a.Items[i]
+	if err := db.Open(backend, ""); err != nil {
+		return err
 	}
-	sort.Sort(tmp_p)
-	for i, j := 0, len(tmp_p.Items)-1; i < j; i, j = i+1, j-1 {
-		tmp_p.Items[i], tmp_p.Items[j] = tmp_p.Items[j], tmp_p.Items[i]
+
+	app.Log("Tattoo DB", "Load Timelines")
+	return db.LoadTimelines(app)
+}
+
+// TattooStorage.Open opens every storage with a backend, "" is the file
+// backend. The file and kv backends keep their files under the directory
+// root. If a storage can't be opened the ones opened before are closed.
+func (db *TattooStorage) Open(backend string, root string) error {
+	var kv *webapp.KVFile
+	if backend == webapp.STORAGE_BACKEND_KV {
+		var err error
+		if kv, err = webapp.OpenKVFile(path.Join(root, STORAGE_KV_FILE)); err != nil {
+			return fmt.Errorf("failed to open %s: %v", STORAGE_KV_FILE, err)
+		}
 	}
-	for i := range tmp_a.Items {
-		s.ArticleTimeline = append(s.ArticleTimeline, tmp_a.Items[i].Value)
-		s.ArticleTimelineIndex[tmp_a.Items[i].Value] = i
+	for _, store := range db.Stores() {
+		switch backend {
+		case "", webapp.STORAGE_BACKEND_FILE:
+			fs := new(webapp.FileStorage)
+			if err := fs.Init(path.Join(root, store.Path), store.Mode); err != nil {
+				db.Close()
+				return fmt.Errorf("failed to init %s (%s): %v", store.Name, store.Path, err)
+			}
+			store.DB.Storage = fs
+		case webapp.STORAGE_BACKEND_KV:
+			store.DB.Storage = kv.Bucket(store.Bucket())
+		case webapp.STORAGE_BACKEND_MEMORY:
+			store.DB.Storage = webapp.NewMemoryStorage()
+		default:
+			db.Close()
+			return fmt.Errorf("unknown storage backend '%s'", backend)
+		}
 	}
-	for i := range tmp_p.Items {
-		s.PageTimeline = append(s.PageTimeline, tmp_p.Items[i].Value)
+	cfg := GetConfig()
+	flusher, err := webapp.NewFlushScheduler(cfg.FlushMode,
+		time.Duration(cfg.FlushDelay)*time.Millisecond, time.Duration(cfg.FlushInterval)*time.Second)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	for _, store := range db.Stores() {
+		flusher.Add(store.DB)
 	}
+	db.flusher = flusher
+	return nil
 }
 
-// TattooStorage.RebuildCommentTimeline rebuilds an array Tattoo.CommentTimeline
-// which contains all articles' name, order by created time.
-func (s *TattooStorage) RebuildCommentTimeline() {
-	num := s.CommentDB.Count() - 1
-	s.CommentTimeline = make([]string, num, num+1024)
-	tmp := new(KeyPairs)
-	tmp.Items = make([]*KeyValuePair, num)
-	i := 0
-	var metadata *CommentMetadata
-	var err error
-	for name, _ := range s.CommentDB.Index {
-		if name == "*" {
+// TattooStorage.Close flushes and closes every open storage.
+func (db *TattooStorage) Close() error {
+	var ret error
+	if db.flusher != nil {
+		ret = db.flusher.Close()
+		db.flusher = nil
+	}
+	for _, store := range db.Stores() {
+		if store.DB.Storage == nil {
 			continue
 		}
-		metadata, err = s.GetCommentMetadata(name)
-		if err != nil {
-			log.Printf("err: %v\n", err)
+		if err := store.DB.Close(); err != nil && ret == nil {
+			ret = fmt.Errorf("failed to close %s: %v", store.Name, err)
 		}
-		tmp.Items[i] = &KeyValuePair{Key: metadata.CreatedTime, Value: name}
-		i += 1
-	}
-	sort.Sort(tmp)
-	// reverse
-	for i, j := 0, len(tmp.Items)-1; i < j; i, j = i+1, j-1 {
-		tmp.Items[i], tmp.Items[j] = tmp.Items[j], tmp.Items[i]
-	}
-	// copy
-	for i = range tmp.Items {
-		s.CommentTimeline[i] = tmp.Items[i].Value
+		store.DB.Storage = nil
 	}
+	return ret
 }
 
-// TattooStorage.PrependCommentTimeline prepends the name of comment to current Timeline.
-func (s *TattooStorage) PrependCommentTimeline(comment *Comment) {
-	num := s.CommentDB.Count() - 1
-	tmp := make([]string, num)
-	copy(tmp[0:num], s.CommentTimeline[:])
-	s.CommentTimeline = make([]string, num, num+1024)
-	copy(s.CommentTimeline[1:num], tmp[0:num])
-	s.CommentTimeline[0] = comment.Metadata.Name
+// TattooStorage.Shutdown waits for the running transaction, then flushes and
+// closes every storage. Transactions begun afterwards block forever, it's
+// called right before the process exits.
+func (db *TattooStorage) Shutdown() error {
+	db.txLock.Lock()
+	return db.Close()
 }
 
-// TattooStorage.DeleteComment deletes the name of specified comment from the timeline.
-func (s *TattooStorage) DeleteCommentTimeline(comment *Comment) {
-	num := s.CommentDB.Count() - 1
-	idx := -1
-	for i, j := range s.CommentTimeline {
-		if j == comment.Metadata.Name {
-			idx = i
-			break
-		}
-	}
-	if idx != -1 {
-		copy(s.CommentTimeline[idx:num-1], s.CommentTimeline[idx+1:num])
-		s.CommentTimeline[num] = ""
+// TattooStorage.Begin starts a transaction over all storages. Other
+// transactions wait until it's committed or rolled back, so don't begin a
+// transaction while holding one.
+func (s *TattooStorage) Begin() *webapp.Transaction {
+	tx := webapp.NewTransaction(&s.txLock)
+	s.changes = nil
+	s.timelineWhere = make(map[string]map[string]string)
+	tx.BeforeCommit(func() error { return s.writeChanges(tx) })
+	tx.OnApply(s.invalidate)
+	return tx
+}
+
+// TattooStorage.IsPublished checks if an article exists and is public.
+func (s *TattooStorage) IsPublished(name string) bool {
+	meta, err := s.GetMeta(name)
+	if err != nil {
+		return false
 	}
+	return meta.IsPublished()
 }
 
 // TattooStorage.Has checks if an article with specified name dosen't exists in the storage.
@@ -181,58 +220,155 @@ func (db *TattooStorage) GetMetaJSON(name string) (interface{}, error) {
 
 // TattooStorage.GetMeta gets the metadata of an article specified by the name.
 func (db *TattooStorage) GetMeta(name string) (*ArticleMetadata, error) {
-	raw, err := db.GetMetaJSON(name)
+	if value, ok := db.cache.Metadata.Get(name); ok {
+		return value.(*ArticleMetadata).Clone(), nil
+	}
+	gen := db.cache.Metadata.Generation()
+	if !db.MetadataDB.Has(name) {
+		return nil, errors.New(webapp.ErrNotFound)
+	}
+	buff, err := db.MetadataDB.Get(name)
 	if err != nil {
 		return nil, err
 	}
-	meta := new(ArticleMetadata)
-	meta.BuildFromJson(raw)
+	meta, err := DecodeArticleMetadata(buff)
+	if err != nil {
+		return nil, fmt.Errorf("metadata of '%s': %v", name, err)
+	}
+	db.cache.Metadata.Put(name, meta.Clone(), gen)
 	return meta, nil
 }
 
 // TattooStorage.UpdateMetadata updates a specified metadata
-func (s *TattooStorage) UpdateMetadata(meta *ArticleMetadata) {
-	name := meta.Name
-	s.MetadataDB.SetJSON(name, meta)
-	s.MetadataDB.SaveIndex()
+func (s *TattooStorage) UpdateMetadata(meta *ArticleMetadata) error {
+	tx := s.Begin()
+	s.updateMetadata(tx, meta)
+	return tx.Commit()
+}
+
+func (s *TattooStorage) updateMetadata(tx *webapp.Transaction, meta *ArticleMetadata) {
+	meta.Version = ARTICLE_METADATA_VERSION
+	if meta.IsPublished() && meta.FirstPublishTime == 0 {
+		meta.FirstPublishTime = meta.CreatedTime
+	}
+	tx.SetJSON(&s.MetadataDB, meta.Name, meta)
 }
 
 // TattooStorage.DeleteMetadata deletes metadata by a specified name.
-func (s *TattooStorage) DeleteMetadata(name string) {
-	s.MetadataDB.Delete(name)
-	s.MetadataDB.SaveIndex()
+func (s *TattooStorage) DeleteMetadata(name string) error {
+	tx := s.Begin()
+	s.deleteMetadata(tx, name)
+	return tx.Commit()
+}
+
+func (s *TattooStorage) deleteMetadata(tx *webapp.Transaction, name string) {
+	tx.Delete(&s.MetadataDB, name)
+}
+
+// getMeta gets the metadata of an article as seen by tx.
+func (s *TattooStorage) getMeta(tx *webapp.Transaction, name string) (*ArticleMetadata, error) {
+	if !tx.Has(&s.MetadataDB, name) {
+		return nil, errors.New(webapp.ErrNotFound)
+	}
+	buff, err := tx.Get(&s.MetadataDB, name)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeArticleMetadata(buff)
 }
 
 // TattooStorage.Dump saves all Indexes of article dbs
 func (s *TattooStorage) Dump() {
-	s.MetadataDB.SaveIndex()
-	s.ArticleDB.SaveIndex()
-	s.ArticleHTMLDB.SaveIndex()
+	s.MetadataDB.Flush()
+	s.ArticleDB.Flush()
+	s.ArticleHTMLDB.Flush()
 }
 
 // TattooStorage.DumpComment saves all Indexes of comment dbs
 func (s *TattooStorage) DumpComment() {
-	s.CommentIndexDB.SaveIndex()
-	s.CommentMetadataDB.SaveIndex()
-	s.CommentDB.SaveIndex()
-	s.CommentHTMLDB.SaveIndex()
+	s.CommentIndexDB.Flush()
+	s.CommentMetadataDB.Flush()
+	s.CommentDB.Flush()
+	s.CommentHTMLDB.Flush()
 }
 
+// TattooStorage.GetArticle returns the HTML of an article, without its header
+// and table of contents.
 func (s *TattooStorage) GetArticle(name string) ([]byte, error) {
-	return s.ArticleHTMLDB.Get(name)
+	buff, err := getCachedBytes(s.cache.HTML, &s.ArticleHTMLDB, name)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeHTMLRecord(buff).HTML, nil
+}
+
+// TattooStorage.GetArticleTOC returns the table of contents of an article, it's
+// empty if the article has no headings or Config.Markdown has no TOC.
+func (s *TattooStorage) GetArticleTOC(name string) ([]byte, error) {
+	buff, err := getCachedBytes(s.cache.HTML, &s.ArticleHTMLDB, name)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeHTMLRecord(buff).TOC, nil
+}
+
+// TattooStorage.GetArticleExcerpt returns the excerpt of an article and if
+// there's more to the article: the part before EXCERPT_MARKER, else its
+// summary, else its beginning, or all of it if it's short.
+func (s *TattooStorage) GetArticleExcerpt(name string) ([]byte, bool, error) {
+	meta, err := s.GetMeta(name)
+	if err != nil {
+		return nil, false, err
+	}
+	buff, err := getCachedBytes(s.cache.HTML, &s.ArticleHTMLDB, name)
+	if err != nil {
+		return nil, false, err
+	}
+	excerpt, more := articleExcerpt(meta, DecodeHTMLRecord(buff))
+	return excerpt, more, nil
+}
+
+func articleExcerpt(meta *ArticleMetadata, record *HTMLRecord) ([]byte, bool) {
+	switch {
+	case record.Marked:
+		return record.Excerpt, true
+	case meta.HasSummary():
+		return SummaryExcerpt(meta.Summary), true
+	case record.Excerpt != nil:
+		return record.Excerpt, true
+	}
+	return record.HTML, false
+}
+
+// TattooStorage.loadArticleHTML sets the text and the excerpt of an article
+// from the HTML of the article its metadata names.
+func (s *TattooStorage) loadArticleHTML(article *Article) error {
+	buff, err := getCachedBytes(s.cache.HTML, &s.ArticleHTMLDB, article.Metadata.Name)
+	if err != nil {
+		return err
+	}
+	record := DecodeHTMLRecord(buff)
+	article.Text = template.HTML(record.HTML)
+	excerpt, more := articleExcerpt(&article.Metadata, record)
+	article.Excerpt, article.HasMore = template.HTML(excerpt), more
+	return nil
 }
 
 func (s *TattooStorage) GetPrevArticleName(name string) string {
-	idx := s.ArticleTimelineIndex[name]
-	if idx == 0 {
+	s.timelineLock.RLock()
+	defer s.timelineLock.RUnlock()
+	idx, ok := s.ArticleTimelineIndex[name]
+	if !ok || idx == 0 {
 		return ""
 	}
 	return s.ArticleTimeline[idx-1]
 }
 
 func (s *TattooStorage) GetNextArticleName(name string) string {
-	idx := s.ArticleTimelineIndex[name]
-	if idx == len(s.ArticleTimeline)-1 {
+	s.timelineLock.RLock()
+	defer s.timelineLock.RUnlock()
+	idx, ok := s.ArticleTimelineIndex[name]
+	if !ok || idx == len(s.ArticleTimeline)-1 {
 		return ""
 	}
 	return s.ArticleTimeline[idx+1]
@@ -247,10 +383,14 @@ func (s *TattooStorage) GetFullArticleCount() int {
 }
 
 func (s *TattooStorage) GetArticleCount() int {
+	s.timelineLock.RLock()
+	defer s.timelineLock.RUnlock()
 	return len(s.ArticleTimeline)
 }
 
 func (s *TattooStorage) GetPageCount() int {
+	s.timelineLock.RLock()
+	defer s.timelineLock.RUnlock()
 	return len(s.PageTimeline)
 }
 
@@ -263,12 +403,13 @@ func (s *TattooStorage) GetArticleFull(name string) (*Article, error) {
 		return nil, err
 	}
 	ret.Metadata = *meta
-	text, err := s.GetArticle(name)
-	ret.Text = template.HTML(text)
+	err = s.loadArticleHTML(ret)
 	return ret, err
 }
 
 func (s *TattooStorage) GetArticleTimeline(from int, count int) ([]*Article, error) {
+	s.timelineLock.RLock()
+	defer s.timelineLock.RUnlock()
 	if from < 0 || from > len(s.ArticleTimeline)-1 {
 		from = 0
 	}
@@ -277,7 +418,6 @@ func (s *TattooStorage) GetArticleTimeline(from int, count int) ([]*Article, err
 	}
 	var err error
 	var meta *ArticleMetadata
-	var text []byte
 	tlSlice := s.ArticleTimeline[from : from+count]
 	ret := make([]*Article, count)
 	for i := 0; i < count; i += 1 {
@@ -285,13 +425,14 @@ func (s *TattooStorage) GetArticleTimeline(from int, count int) ([]*Article, err
 		ret[i] = new(Article)
 		meta, err = s.GetMeta(name)
 		ret[i].Metadata = *meta
-		text, err = s.GetArticle(name)
-		ret[i].Text = template.HTML(text)
+		err = s.loadArticleHTML(ret[i])
 	}
 	return ret, err
 }
 
 func (s *TattooStorage) GetArticleTimelineByTag(from int, count int, tag string) ([]*Article, error) {
+	s.timelineLock.RLock()
+	defer s.timelineLock.RUnlock()
 	// @TODO
 	if from < 0 || from > len(s.ArticleTimeline)-1 {
 		from = 0
@@ -301,7 +442,6 @@ func (s *TattooStorage) GetArticleTimelineByTag(from int, count int, tag string)
 	}
 	var err error
 	var meta *ArticleMetadata
-	var text []byte
 	tlSlice := s.ArticleTimeline
 	ret := make([]*Article, 0)
 	for i := 0; i < len(s.ArticleTimeline); i += 1 {
@@ -311,8 +451,7 @@ func (s *TattooStorage) GetArticleTimelineByTag(from int, count int, tag string)
 			if tag == t {
 				a := new(Article)
 				a.Metadata = *meta
-				text, err = s.GetArticle(name)
-				a.Text = template.HTML(text)
+				err = s.loadArticleHTML(a)
 				ret = append(ret, a)
 				break
 			}
@@ -327,7 +466,39 @@ func (s *TattooStorage) GetArticleTimelineByTag(from int, count int, tag string)
 	return ret[from : from+count], err
 }
 
+// TattooStorage.GetDraftTimeline returns drafts and scheduled articles and
+// pages, the most recently modified first.
+func (s *TattooStorage) GetDraftTimeline(from int, count int) ([]*Article, error) {
+	s.timelineLock.RLock()
+	defer s.timelineLock.RUnlock()
+	if from < 0 || from > len(s.DraftTimeline)-1 {
+		from = 0
+	}
+	if from+count > len(s.DraftTimeline) {
+		count = len(s.DraftTimeline) - from
+	}
+	var err error
+	ret := make([]*Article, 0, count)
+	for _, name := range s.DraftTimeline[from : from+count] {
+		article, e := s.GetArticleFull(name)
+		if e != nil {
+			err = e
+			continue
+		}
+		ret = append(ret, article)
+	}
+	return ret, err
+}
+
+func (s *TattooStorage) GetDraftCount() int {
+	s.timelineLock.RLock()
+	defer s.timelineLock.RUnlock()
+	return len(s.DraftTimeline)
+}
+
 func (s *TattooStorage) GetPageTimeline(from int, count int) ([]*Article, error) {
+	s.timelineLock.RLock()
+	defer s.timelineLock.RUnlock()
 	if from < 0 || from > len(s.PageTimeline)-1 {
 		from = 0
 	}
@@ -336,7 +507,6 @@ func (s *TattooStorage) GetPageTimeline(from int, count int) ([]*Article, error)
 	}
 	var err error
 	var meta *ArticleMetadata
-	var text []byte
 	tlSlice := s.PageTimeline[from : from+count]
 	ret := make([]*Article, count)
 	for i := 0; i < count; i += 1 {
@@ -344,44 +514,133 @@ func (s *TattooStorage) GetPageTimeline(from int, count int) ([]*Article, error)
 		ret[i] = new(Article)
 		meta, err = s.GetMeta(name)
 		ret[i].Metadata = *meta
-		text, err = s.GetArticle(name)
-		ret[i].Text = template.HTML(text)
+		err = s.loadArticleHTML(ret[i])
 	}
 	return ret, err
 }
 
-func (s *TattooStorage) UpdateArticle(name string, text []byte) {
-	s.ArticleDB.Set(name, text)
-	md := blackfriday.MarkdownCommon(text)
-	s.ArticleHTMLDB.Set(name, md)
+func (s *TattooStorage) UpdateArticle(name string, text []byte) error {
+	tx := s.Begin()
+	s.updateArticle(tx, name, text)
+	return tx.Commit()
 }
 
-func (s *TattooStorage) DeleteArticle(name string) {
-	s.ArticleDB.Delete(name)
-	s.ArticleHTMLDB.Delete(name)
+func (s *TattooStorage) updateArticle(tx *webapp.Transaction, name string, text []byte) {
+	tx.Set(&s.ArticleDB, name, text)
+	tx.Set(&s.ArticleHTMLDB, name, RenderArticleHTML(text))
+}
+
+func (s *TattooStorage) DeleteArticle(name string) error {
+	tx := s.Begin()
+	s.deleteArticle(tx, name)
+	return tx.Commit()
+}
+
+func (s *TattooStorage) deleteArticle(tx *webapp.Transaction, name string) {
+	tx.Delete(&s.ArticleDB, name)
+	tx.Delete(&s.ArticleHTMLDB, name)
+}
+
+/* High level operation about article */
+
+// TattooStorage.SaveArticle creates or updates an article, its metadata, source
+// and tag index in one transaction, the source is kept as a new revision. Only
+// published articles are listed in the tag index. If
+// origName is given and differs from the article's name, the article is
+// renamed and its comments and revisions follow it.
+func (s *TattooStorage) SaveArticle(article *Article, origName string) error {
+	name := article.Metadata.Name
+	tx := s.Begin()
+	defer tx.Rollback()
+	// hits are counted by HitCounter, not by editing
+	var old *ArticleMetadata
+	if len(origName) != 0 {
+		if meta, err := s.getMeta(tx, origName); err == nil {
+			article.Metadata.Hits = meta.Hits
+			old = meta
+		}
+	}
+	if len(origName) != 0 && origName != name {
+		if err := s.renameRevisions(tx, origName, name); err != nil {
+			return err
+		}
+	}
+	if err := s.addRevision(tx, &article.Metadata, []byte(string(article.Text)), 0); err != nil {
+		return err
+	}
+	s.deleteArticleTagIndex(tx, name)
+	if article.Metadata.IsPublished() {
+		s.updateArticleTagIndex(tx, name, article.Metadata.Tags)
+	}
+	s.updateMetadata(tx, &article.Metadata)
+	s.updateArticle(tx, name, []byte(string(article.Text)))
+	if len(origName) != 0 && origName != name {
+		s.deleteArticleTagIndex(tx, origName)
+		s.deleteMetadata(tx, origName)
+		s.deleteArticle(tx, origName)
+		s.renameComments(tx, origName, name)
+		if err := s.placeArticle(tx, origName, nil); err != nil {
+			return err
+		}
+	}
+	if err := s.placeArticle(tx, name, &article.Metadata); err != nil {
+		return err
+	}
+	s.logArticle(origName, old, &article.Metadata)
+	return tx.Commit()
+}
+
+// TattooStorage.RemoveArticle deletes an article with its metadata, tag index
+// entries, comments and revisions in one transaction.
+func (s *TattooStorage) RemoveArticle(name string) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	if !tx.Has(&s.ArticleDB, name) {
+		return errors.New(webapp.ErrNotFound)
+	}
+	if err := s.removeArticle(tx, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *TattooStorage) removeArticle(tx *webapp.Transaction, name string) error {
+	if meta, err := s.getMeta(tx, name); err == nil {
+		s.logArticle(name, meta, nil)
+	}
+	s.deleteArticleTagIndex(tx, name)
+	s.deleteArticle(tx, name)
+	s.deleteMetadata(tx, name)
+	s.deleteRevisions(tx, name)
+	if err := s.deleteComments(tx, name); err != nil {
+		return err
+	}
+	return s.placeArticle(tx, name, nil)
 }
 
 // simple add an item to Tag Index DB if the tag doesn't exists
-func (s *TattooStorage) AddTag(tagName string) {
-	s.TagIndexDB.SetJSON(tagName, "[]")
-	return
+func (s *TattooStorage) AddTag(tagName string) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	if !tx.Has(&s.TagIndexDB, tagName) {
+		tx.SetJSON(&s.TagIndexDB, tagName, []string{})
+		s.logTag(CHANGE_CREATE, tagName)
+	}
+	return tx.Commit()
 }
 
 // for each article use the tag, update their metadata.
 // and update the Tag Index DB.
-// @TODO
-func (s *TattooStorage) RenameTag(origName string, newName string) {
-	var lst []interface{}
-	var lst_buff interface{}
-	lst_buff, err := s.TagIndexDB.GetJSON(origName)
+func (s *TattooStorage) RenameTag(origName string, newName string) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	lst, err := getNameList(tx, &s.TagIndexDB, origName)
 	if err != nil {
-		println("load tag index failed", err)
-	} else {
-		lst = lst_buff.([]interface{})
+		log.Printf("load tag index failed (%v)!\n", err)
 	}
 	newList := make([]string, 0)
 	for _, k := range lst {
-		meta, err := s.GetMeta(k.(string))
+		meta, err := s.getMeta(tx, k)
 		if err != nil {
 			continue
 		}
@@ -390,22 +649,23 @@ func (s *TattooStorage) RenameTag(origName string, newName string) {
 				meta.Tags[i] = newName
 			}
 		}
-		s.UpdateMetadata(meta)
-		newList = append(newList, k.(string))
+		s.updateMetadata(tx, meta)
+		s.logArticle(k, meta, meta)
+		newList = append(newList, k)
 	}
-	s.TagIndexDB.SetJSON(newName, newList)
-	s.TagIndexDB.Delete(origName)
-	s.TagIndexDB.SaveIndex()
-	return
+	tx.SetJSON(&s.TagIndexDB, newName, newList)
+	tx.Delete(&s.TagIndexDB, origName)
+	s.logChange(&Change{Op: CHANGE_RENAME, Kind: CHANGE_KIND_TAG, Name: newName, OldName: origName})
+	return tx.Commit()
 }
 
 func (s *TattooStorage) GetTagArticleCount(tagName string) int {
-	lst_buff, err := s.TagIndexDB.GetJSON(tagName)
-	if err != nil {
-		return 0
+	for _, t := range s.GetTags() {
+		if t.Name == tagName {
+			return t.Count
+		}
 	}
-	lst := lst_buff.([]interface{})
-	return len(lst)
+	return 0
 }
 
 func (s *TattooStorage) HasTag(tagName string) bool {
@@ -418,14 +678,20 @@ func (s *TattooStorage) DeleteTag(tagName string) {
 	return
 }
 
+// TattooStorage.GetTags returns all tags with their article count, the most
+// used first.
 func (s *TattooStorage) GetTags() []TagWrapper {
+	if value, ok := s.cache.Tags.Get(CACHE_KEY_TAGS); ok {
+		cached := value.([]TagWrapper)
+		ret := make([]TagWrapper, len(cached))
+		copy(ret, cached)
+		return ret
+	}
+	gen := s.cache.Tags.Generation()
 	tmp := new(KeyPairs)
 	tmp.Items = make([]*KeyValuePair, 0)
 	ret := make([]TagWrapper, 0)
-	for name, _ := range s.TagIndexDB.Index {
-		if name == "*" {
-			continue
-		}
+	for _, name := range s.TagIndexDB.Keys() {
 		lst_buff, _ := s.TagIndexDB.GetJSON(name)
 		count := len(lst_buff.([]interface{}))
 		tmp.Items = append(tmp.Items, &KeyValuePair{Key: int64(count), Value: name})
@@ -437,57 +703,92 @@ func (s *TattooStorage) GetTags() []TagWrapper {
 	for _, t := range tmp.Items {
 		ret = append(ret, TagWrapper{Name: t.Value, Count: int(t.Key)})
 	}
+	cached := make([]TagWrapper, len(ret))
+	copy(cached, ret)
+	s.cache.Tags.Put(CACHE_KEY_TAGS, cached, gen)
 	return ret
 }
 
 // assigns several tags to a specified article
-func (s *TattooStorage) UpdateArticleTagIndex(name string, tags []string) {
+func (s *TattooStorage) UpdateArticleTagIndex(name string, tags []string) error {
+	tx := s.Begin()
+	s.updateArticleTagIndex(tx, name, tags)
+	return tx.Commit()
+}
+
+func (s *TattooStorage) updateArticleTagIndex(tx *webapp.Transaction, name string, tags []string) {
 	// assign
 	for _, t := range tags {
-		if s.TagIndexDB.Has(t) {
-			lst_buff, _ := s.TagIndexDB.GetJSON(t)
-			articleList := lst_buff.([]interface{})
-			newList := make([]string, 0)
-			newList = append(newList, name)
-			for _, n := range articleList {
-				if n.(string) == name {
-					continue
-				}
-				newList = append(newList, n.(string))
+		if !tx.Has(&s.TagIndexDB, t) {
+			s.logTag(CHANGE_CREATE, t)
+		}
+		articleList, _ := getNameList(tx, &s.TagIndexDB, t)
+		newList := make([]string, 0)
+		newList = append(newList, name)
+		for _, n := range articleList {
+			if n == name {
+				continue
 			}
-			s.TagIndexDB.SetJSON(t, newList)
-		} else {
-			s.TagIndexDB.SetJSON(t, []string{})
+			newList = append(newList, n)
+		}
+		if len(newList) != len(articleList) {
+			s.logTag(CHANGE_UPDATE, t)
 		}
+		tx.SetJSON(&s.TagIndexDB, t, newList)
 	}
-	s.TagIndexDB.SaveIndex()
-	return
 }
 
-// assigns several tags to a specified article
-func (s *TattooStorage) DeleteArticleTagIndex(name string) {
+// detaches a specified article from all its tags
+func (s *TattooStorage) DeleteArticleTagIndex(name string) error {
+	tx := s.Begin()
+	s.deleteArticleTagIndex(tx, name)
+	return tx.Commit()
+}
+
+func (s *TattooStorage) deleteArticleTagIndex(tx *webapp.Transaction, name string) {
 	// detach
-	meta, err := s.GetMeta(name)
+	meta, err := s.getMeta(tx, name)
 	if err != nil {
 		return
 	}
 	for _, t := range meta.Tags {
-		if s.TagIndexDB.Has(t) {
-			lst_buff, _ := s.TagIndexDB.GetJSON(t)
-			articleList := lst_buff.([]interface{})
+		if tx.Has(&s.TagIndexDB, t) {
+			articleList, _ := getNameList(tx, &s.TagIndexDB, t)
 			newList := make([]string, 0)
 			for _, n := range articleList {
-				if n.(string) != name {
-					newList = append(newList, n.(string))
+				if n != name {
+					newList = append(newList, n)
 				}
 			}
-			s.TagIndexDB.SetJSON(t, newList)
+			if len(newList) != len(articleList) {
+				s.logTag(CHANGE_UPDATE, t)
+			}
+			tx.SetJSON(&s.TagIndexDB, t, newList)
+		}
+	}
+}
+
+// getNameList reads a JSON list of names, such as a tag index or a comment
+// index, as seen by tx.
+func getNameList(tx *webapp.Transaction, fs *webapp.Store, key string) ([]string, error) {
+	raw, err := tx.GetJSON(fs, key)
+	if err != nil {
+		return nil, err
+	}
+	lst := make([]string, 0)
+	if items, ok := raw.([]interface{}); ok {
+		for _, item := range items {
+			if name, ok := item.(string); ok {
+				lst = append(lst, name)
+			}
 		}
 	}
-	s.TagIndexDB.SaveIndex()
+	return lst, nil
 }
 
 func (s *TattooStorage) GetCommentTimeline(from int, count int) ([]*Comment, error) {
+	s.timelineLock.RLock()
+	defer s.timelineLock.RUnlock()
 	if from < 0 || from > len(s.CommentTimeline)-1 {
 		from = 0
 	}
@@ -526,150 +827,201 @@ func (db *TattooStorage) GetCommentMetaJSON(name string) (interface{}, error) {
 	return meta, nil
 }
 
-// TattooStorage.GetCommentMetaJSON gets the metadata of a comment specified by the name.
+// TattooStorage.GetCommentMetadata gets the metadata of a comment specified by the name.
 func (db *TattooStorage) GetCommentMetadata(name string) (*CommentMetadata, error) {
-	raw, err := db.GetCommentMetaJSON(name)
+	if value, ok := db.cache.CommentMetadata.Get(name); ok {
+		meta := *value.(*CommentMetadata)
+		return &meta, nil
+	}
+	gen := db.cache.CommentMetadata.Generation()
+	if !db.CommentMetadataDB.Has(name) {
+		return nil, errors.New(webapp.ErrNotFound)
+	}
+	buff, err := db.CommentMetadataDB.Get(name)
 	if err != nil {
 		return nil, err
 	}
-	meta := new(CommentMetadata)
-	meta.BuildFromJson(raw)
+	meta, err := DecodeCommentMetadata(buff)
+	if err != nil {
+		return nil, fmt.Errorf("metadata of comment '%s': %v", name, err)
+	}
+	cached := *meta
+	db.cache.CommentMetadata.Put(name, &cached, gen)
 	return meta, nil
 }
 
-func (s *TattooStorage) UpdateCommentMetadata(meta *CommentMetadata) {
-	uuid := meta.Name
-	s.CommentMetadataDB.SetJSON(uuid, meta)
-	s.CommentMetadataDB.SaveIndex()
+func (s *TattooStorage) UpdateCommentMetadata(meta *CommentMetadata) error {
+	tx := s.Begin()
+	s.updateCommentMetadata(tx, meta)
+	return tx.Commit()
+}
+
+func (s *TattooStorage) updateCommentMetadata(tx *webapp.Transaction, meta *CommentMetadata) {
+	meta.Version = COMMENT_METADATA_VERSION
+	tx.SetJSON(&s.CommentMetadataDB, meta.Name, meta)
 }
 
-func (s *TattooStorage) DeleteCommentMetadata(uuid string) {
-	s.CommentMetadataDB.Delete(uuid)
-	s.CommentMetadataDB.SaveIndex()
+func (s *TattooStorage) DeleteCommentMetadata(uuid string) error {
+	tx := s.Begin()
+	s.deleteCommentMetadata(tx, uuid)
+	return tx.Commit()
 }
 
+func (s *TattooStorage) deleteCommentMetadata(tx *webapp.Transaction, uuid string) {
+	tx.Delete(&s.CommentMetadataDB, uuid)
+}
+
+// getCommentMetadata gets the metadata of a comment as seen by tx.
+func (s *TattooStorage) getCommentMetadata(tx *webapp.Transaction, uuid string) (*CommentMetadata, error) {
+	if !tx.Has(&s.CommentMetadataDB, uuid) {
+		return nil, errors.New(webapp.ErrNotFound)
+	}
+	buff, err := tx.Get(&s.CommentMetadataDB, uuid)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeCommentMetadata(buff)
+}
+
+// TattooStorage.GetComment returns the HTML of a comment, without its header.
 func (s *TattooStorage) GetComment(uuid string) ([]byte, error) {
-	return s.CommentHTMLDB.Get(uuid)
+	buff, err := getCachedBytes(s.cache.CommentHTML, &s.CommentHTMLDB, uuid)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeHTMLRecord(buff).HTML, nil
 }
 
 func (s *TattooStorage) GetCommentSource(uuid string) ([]byte, error) {
 	return s.CommentDB.Get(uuid)
 }
 
-func (s *TattooStorage) UpdateComment(uuid string, text []byte) {
-	s.CommentDB.Set(uuid, text)
-	md := blackfriday.MarkdownCommon(text)
-	s.CommentHTMLDB.Set(uuid, md)
+func (s *TattooStorage) UpdateComment(uuid string, text []byte) error {
+	tx := s.Begin()
+	s.updateComment(tx, uuid, text)
+	return tx.Commit()
+}
+
+func (s *TattooStorage) updateComment(tx *webapp.Transaction, uuid string, text []byte) {
+	tx.Set(&s.CommentDB, uuid, text)
+	tx.Set(&s.CommentHTMLDB, uuid, RenderCommentHTML(text))
 }
 
 /* High level operation about comment */
 
 // DeleteComments deletes all comments under an article.
-func (s *TattooStorage) DeleteComments(name string) {
-	var lst_buff interface{}
-	var lst []interface{}
-	lst_buff, err := s.CommentIndexDB.GetJSON(name)
+func (s *TattooStorage) DeleteComments(name string) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	if err := s.deleteComments(tx, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *TattooStorage) deleteComments(tx *webapp.Transaction, name string) error {
+	lst, err := getNameList(tx, &s.CommentIndexDB, name)
 	if err != nil {
 		log.Printf("load comment index failed (%v)!\n", err)
-	} else {
-		lst = lst_buff.([]interface{})
 	}
 	for _, k := range lst {
-		s.DeleteComment(k.(string))
-		s.DeleteCommentMetadata(k.(string))
+		s.deleteCommentMetadata(tx, k)
+		tx.Delete(&s.CommentDB, k)
+		tx.Delete(&s.CommentHTMLDB, k)
+		s.logChange(&Change{Op: CHANGE_DELETE, Kind: CHANGE_KIND_COMMENT, Name: k, Article: name})
 	}
-	s.CommentDB.SaveIndex()
-	s.CommentHTMLDB.SaveIndex()
-	s.CommentMetadataDB.SaveIndex()
-	s.CommentIndexDB.Delete(name)
-	s.CommentIndexDB.SaveIndex()
+	tx.Delete(&s.CommentIndexDB, name)
+	return s.unplaceComments(tx, lst)
 }
 
 // RenameComments updates the .ArticleName field in all comments' meta under an article.
-func (s *TattooStorage) RenameComments(origName, newName string) {
-	var lst []interface{}
-	var lst_buff interface{}
-	lst_buff, err := s.CommentIndexDB.GetJSON(origName)
+func (s *TattooStorage) RenameComments(origName, newName string) error {
+	tx := s.Begin()
+	s.renameComments(tx, origName, newName)
+	return tx.Commit()
+}
+
+func (s *TattooStorage) renameComments(tx *webapp.Transaction, origName, newName string) {
+	lst, err := getNameList(tx, &s.CommentIndexDB, origName)
 	if err != nil {
 		log.Printf("load comment index failed (%v)!\n", err)
-	} else {
-		lst = lst_buff.([]interface{})
 	}
 	newList := make([]string, 0)
 	for _, k := range lst {
-		meta, err := s.GetCommentMetadata(k.(string))
+		meta, err := s.getCommentMetadata(tx, k)
 		if err != nil {
 			continue
 		}
 		meta.ArticleName = newName
-		s.UpdateCommentMetadata(meta)
-		newList = append(newList, k.(string))
+		s.updateCommentMetadata(tx, meta)
+		s.logComment(CHANGE_UPDATE, meta)
+		newList = append(newList, k)
 	}
-	s.CommentIndexDB.SetJSON(newName, newList)
-	s.CommentIndexDB.Delete(origName)
-	s.CommentIndexDB.SaveIndex()
-	s.RebuildCommentTimeline()
+	tx.SetJSON(&s.CommentIndexDB, newName, newList)
+	tx.Delete(&s.CommentIndexDB, origName)
 }
 
 // DeleteComment delete meta and content of a specified comment.
 // And remove its uuid from Comment Index DB.
-func (s *TattooStorage) DeleteComment(uuid string) {
-	var lst []interface{}
-	var lst_buff interface{}
-	var err error
-	var meta *CommentMetadata
-	meta, err = s.GetCommentMetadata(uuid)
+func (s *TattooStorage) DeleteComment(uuid string) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	meta, err := s.getCommentMetadata(tx, uuid)
 	if err != nil {
-		return
+		return err
+	}
+	if err := s.deleteComment(tx, meta); err != nil {
+		return err
 	}
-	lst_buff, err = s.CommentIndexDB.GetJSON(meta.ArticleName)
+	return tx.Commit()
+}
+
+func (s *TattooStorage) deleteComment(tx *webapp.Transaction, meta *CommentMetadata) error {
+	lst, err := getNameList(tx, &s.CommentIndexDB, meta.ArticleName)
 	if err != nil {
 		log.Printf("load comment index failed: %v\n", err)
-		return
-	} else {
-		lst = lst_buff.([]interface{})
+		return err
 	}
 	newList := make([]string, 0)
 	for _, k := range lst {
-		if uuid != k {
-			newList = append(newList, k.(string))
+		if meta.Name != k {
+			newList = append(newList, k)
 		}
 	}
-	s.CommentIndexDB.SetJSON(meta.ArticleName, newList)
-	s.CommentIndexDB.SaveIndex()
-	// save meta & text
-	s.DeleteCommentMetadata(uuid)
-	s.CommentDB.Delete(uuid)
-	s.CommentHTMLDB.Delete(uuid)
-	s.CommentMetadataDB.SaveIndex()
-	s.CommentDB.SaveIndex()
-	s.CommentHTMLDB.SaveIndex()
+	tx.SetJSON(&s.CommentIndexDB, meta.ArticleName, newList)
+	// delete meta & text
+	s.deleteCommentMetadata(tx, meta.Name)
+	tx.Delete(&s.CommentDB, meta.Name)
+	tx.Delete(&s.CommentHTMLDB, meta.Name)
+	s.logComment(CHANGE_DELETE, meta)
+	return s.unplaceComments(tx, []string{meta.Name})
 }
 
 // AddComment adds a new comment, both meta and content.
 // Also adds an item in Comment Index DB
-func (s *TattooStorage) AddComment(comment *Comment) {
-	var lst []interface{}
-	var lst_buff interface{}
-	lst_buff, err := s.CommentIndexDB.GetJSON(comment.Metadata.ArticleName)
-	if err != nil {
-		println("load comment index failed", err)
-	} else {
-		lst = lst_buff.([]interface{})
+func (s *TattooStorage) AddComment(comment *Comment) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	if err := s.addComment(tx, comment); err != nil {
+		return err
 	}
-	newList := make([]string, len(lst)+1)
-	for i, k := range lst {
-		newList[i] = k.(string)
+	return tx.Commit()
+}
+
+func (s *TattooStorage) addComment(tx *webapp.Transaction, comment *Comment) error {
+	lst, err := getNameList(tx, &s.CommentIndexDB, comment.Metadata.ArticleName)
+	if err != nil && tx.Has(&s.CommentIndexDB, comment.Metadata.ArticleName) {
+		log.Printf("load comment index failed (%v)!\n", err)
 	}
+	newList := make([]string, len(lst)+1)
+	copy(newList, lst)
 	newList[len(lst)] = comment.Metadata.Name
-	s.CommentIndexDB.SetJSON(comment.Metadata.ArticleName, newList)
-	s.CommentIndexDB.SaveIndex()
+	tx.SetJSON(&s.CommentIndexDB, comment.Metadata.ArticleName, newList)
 	// save meta & text
-	s.UpdateCommentMetadata(&comment.Metadata)
-	s.UpdateComment(comment.Metadata.Name, []byte(string(comment.Text)))
-	s.CommentMetadataDB.SaveIndex()
-	s.CommentDB.SaveIndex()
-	s.CommentHTMLDB.SaveIndex()
+	s.updateCommentMetadata(tx, &comment.Metadata)
+	s.updateComment(tx, comment.Metadata.Name, []byte(string(comment.Text)))
+	s.logComment(CHANGE_CREATE, &comment.Metadata)
+	return s.placeComments(tx, []*CommentMetadata{&comment.Metadata})
 }
 
 // GetComments get all comments of a specified article.
@@ -694,7 +1046,7 @@ func (s *TattooStorage) GetComments(name string) []*Comment {
 		}
 		comment := new(Comment)
 		comment.Metadata = *meta
-		text, err = s.CommentHTMLDB.Get(k.(string))
+		text, err = s.GetComment(k.(string))
 		comment.Text = template.HTML(text)
 		arr[i] = comment
 	}
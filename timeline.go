@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Keys of the timelines in Timeline DB.
+const (
+	TIMELINE_ARTICLE = "article"
+	TIMELINE_PAGE    = "page"
+	TIMELINE_DRAFT   = "draft"
+	TIMELINE_COMMENT = "comment"
+)
+
+// an article is on exactly one of these
+var articleTimelines = []string{TIMELINE_ARTICLE, TIMELINE_PAGE, TIMELINE_DRAFT}
+
+var allTimelines = []string{TIMELINE_ARTICLE, TIMELINE_PAGE, TIMELINE_DRAFT, TIMELINE_COMMENT}
+
+// TimelineEntry is an item of a timeline saved in Timeline DB. Timelines are
+// ordered by Time, newest first, and then by Name.
+type TimelineEntry struct {
+	Name string
+	Time int64
+}
+
+type timelineByTime []*TimelineEntry
+
+func (t timelineByTime) Len() int           { return len(t) }
+func (t timelineByTime) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t timelineByTime) Less(i, j int) bool { return timelineBefore(t[i], t[j]) }
+
+// timelineBefore tells whether a comes before b on a timeline.
+func timelineBefore(a *TimelineEntry, b *TimelineEntry) bool {
+	if a.Time != b.Time {
+		return a.Time > b.Time
+	}
+	return a.Name < b.Name
+}
+
+func timelineEqual(a []*TimelineEntry, b []*TimelineEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// articleTimelineOf returns the timeline an article belongs to and its time
+// there: drafts and scheduled articles by modified time, published pages and
+// articles by created time.
+func articleTimelineOf(meta *ArticleMetadata) (string, int64) {
+	if !meta.IsPublished() {
+		return TIMELINE_DRAFT, meta.ModifiedTime
+	}
+	if meta.IsPage {
+		return TIMELINE_PAGE, meta.CreatedTime
+	}
+	return TIMELINE_ARTICLE, meta.CreatedTime
+}
+
+func decodeTimeline(buff []byte) ([]*TimelineEntry, error) {
+	entries := make([]*TimelineEntry, 0)
+	if err := json.Unmarshal(buff, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// TimelineIndex is saved in Timeline DB under the key of a timeline, the
+// entries are saved in segments of at most TIMELINE_SEGMENT_SIZE under keys of
+// their own, so a change rewrites its segment only. Next numbers the next
+// segment created.
+type TimelineIndex struct {
+	Next     int
+	Segments []*TimelineSegment
+}
+
+// TimelineSegment is a segment of a timeline, First is its first entry.
+// Segments are in the order of the timeline and never empty.
+type TimelineSegment struct {
+	Key   string
+	First TimelineEntry
+}
+
+// entries of a timeline segment at most, a longer one is split in two
+const TIMELINE_SEGMENT_SIZE = 256
+
+func timelineSegmentKey(key string, n int) string {
+	return fmt.Sprintf("%s/%d", key, n)
+}
+
+// timelineOfKey returns the timeline of a key of Timeline DB, and whether the
+// key is one of its segments.
+func timelineOfKey(key string) (string, bool) {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i], true
+	}
+	return key, false
+}
+
+// decodeTimelineIndex decodes the index of a timeline. A timeline saved
+// before timelines were segmented is a list of entries, which is returned as
+// legacy.
+func decodeTimelineIndex(buff []byte) (index *TimelineIndex, legacy []*TimelineEntry, err error) {
+	if trimmed := bytes.TrimSpace(buff); len(trimmed) != 0 && trimmed[0] == '[' {
+		legacy, err = decodeTimeline(buff)
+		return nil, legacy, err
+	}
+	index = new(TimelineIndex)
+	if err := json.Unmarshal(buff, index); err != nil {
+		return nil, nil, err
+	}
+	return index, nil, nil
+}
+
+// timelineSegmentOf returns the segment of index an entry belongs in, by the
+// first entries of the segments.
+func timelineSegmentOf(index *TimelineIndex, entry *TimelineEntry) int {
+	i := sort.Search(len(index.Segments), func(i int) bool {
+		return timelineBefore(entry, &index.Segments[i].First)
+	})
+	if i > 0 {
+		i -= 1
+	}
+	return i
+}
+
+// timelineView is a timeline as seen by a transaction, the segments it reads
+// are kept with what they held then, to write only the ones which change.
+type timelineView struct {
+	s        *TattooStorage
+	tx       *webapp.Transaction
+	key      string
+	index    *TimelineIndex
+	entries  map[string][]*TimelineEntry
+	original map[string][]*TimelineEntry
+	changed  map[string]bool
+}
+
+func (s *TattooStorage) newTimelineView(tx *webapp.Transaction, key string) *timelineView {
+	return &timelineView{
+		s:        s,
+		tx:       tx,
+		key:      key,
+		index:    &TimelineIndex{Segments: make([]*TimelineSegment, 0)},
+		entries:  make(map[string][]*TimelineEntry),
+		original: make(map[string][]*TimelineEntry),
+		changed:  make(map[string]bool),
+	}
+}
+
+// TattooStorage.openTimeline reads the index of a timeline as seen by tx, a
+// missing timeline is empty and a legacy one is segmented in the view.
+func (s *TattooStorage) openTimeline(tx *webapp.Transaction, key string) (*timelineView, error) {
+	t := s.newTimelineView(tx, key)
+	if !tx.Has(&s.TimelineDB, key) {
+		return t, nil
+	}
+	buff, err := tx.Get(&s.TimelineDB, key)
+	if err != nil {
+		return nil, err
+	}
+	index, legacy, err := decodeTimelineIndex(buff)
+	if err != nil {
+		return nil, fmt.Errorf("timeline '%s': %v", key, err)
+	}
+	if index == nil {
+		t.replace(legacy)
+	} else {
+		t.index = index
+	}
+	return t, nil
+}
+
+// timelineView.segment returns the entries of a segment.
+func (t *timelineView) segment(segKey string) ([]*TimelineEntry, error) {
+	if entries, ok := t.entries[segKey]; ok {
+		return entries, nil
+	}
+	buff, err := t.tx.Get(&t.s.TimelineDB, segKey)
+	if err != nil {
+		return nil, fmt.Errorf("timeline segment '%s': %v", segKey, err)
+	}
+	entries, err := decodeTimeline(buff)
+	if err != nil {
+		return nil, fmt.Errorf("timeline segment '%s': %v", segKey, err)
+	}
+	// entries are never changed in place, so original stays as read
+	t.entries[segKey] = entries
+	t.original[segKey] = entries
+	return entries, nil
+}
+
+// timelineView.all returns every entry of the timeline.
+func (t *timelineView) all() ([]*TimelineEntry, error) {
+	all := make([]*TimelineEntry, 0)
+	for _, seg := range t.index.Segments {
+		entries, err := t.segment(seg.Key)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
+	}
+	return all, nil
+}
+
+// timelineView.find returns the segment holding name and its position there,
+// or -1. The segment is where the running transaction put name, or else
+// where the saved timeline has it.
+func (t *timelineView) find(name string) (int, int, error) {
+	segKey, ok := t.s.timelineWhere[t.key][name]
+	if !ok {
+		t.s.timelineLock.RLock()
+		if saved, found := t.s.savedTimelines[t.key]; found {
+			segKey, ok = saved.where[name]
+		}
+		t.s.timelineLock.RUnlock()
+	}
+	if !ok || len(segKey) == 0 {
+		return -1, -1, nil
+	}
+	for i, seg := range t.index.Segments {
+		if seg.Key != segKey {
+			continue
+		}
+		entries, err := t.segment(segKey)
+		if err != nil {
+			return -1, -1, err
+		}
+		for j, entry := range entries {
+			if entry.Name == name {
+				return i, j, nil
+			}
+		}
+	}
+	return -1, -1, nil
+}
+
+// timelineView.placed notes where a written segment puts its names for the
+// rest of the transaction, and that the names it had are gone unless they
+// were put elsewhere.
+func (t *timelineView) placed(segKey string) {
+	where, ok := t.s.timelineWhere[t.key]
+	if !ok {
+		where = make(map[string]string)
+		t.s.timelineWhere[t.key] = where
+	}
+	for _, entry := range t.original[segKey] {
+		if k, ok := where[entry.Name]; !ok || k == segKey {
+			where[entry.Name] = ""
+		}
+	}
+	for _, entry := range t.entries[segKey] {
+		where[entry.Name] = segKey
+	}
+}
+
+// timelineView.remove takes name off the timeline.
+func (t *timelineView) remove(name string) error {
+	i, j, err := t.find(name)
+	if err != nil || i < 0 {
+		return err
+	}
+	segKey := t.index.Segments[i].Key
+	entries := t.entries[segKey]
+	updated := make([]*TimelineEntry, 0, len(entries)-1)
+	updated = append(updated, entries[:j]...)
+	t.entries[segKey] = append(updated, entries[j+1:]...)
+	t.changed[segKey] = true
+	return nil
+}
+
+// timelineView.insert puts an entry on the timeline, by binary search over
+// the segments and then in its segment.
+func (t *timelineView) insert(entry *TimelineEntry) error {
+	if len(t.index.Segments) == 0 {
+		seg := &TimelineSegment{Key: t.newSegmentKey()}
+		t.index.Segments = append(t.index.Segments, seg)
+		t.entries[seg.Key] = make([]*TimelineEntry, 0)
+	}
+	segKey := t.index.Segments[timelineSegmentOf(t.index, entry)].Key
+	entries, err := t.segment(segKey)
+	if err != nil {
+		return err
+	}
+	j := sort.Search(len(entries), func(j int) bool {
+		return !timelineBefore(entries[j], entry)
+	})
+	updated := make([]*TimelineEntry, 0, len(entries)+1)
+	updated = append(updated, entries[:j]...)
+	updated = append(updated, entry)
+	t.entries[segKey] = append(updated, entries[j:]...)
+	t.changed[segKey] = true
+	return nil
+}
+
+func (t *timelineView) newSegmentKey() string {
+	t.index.Next += 1
+	return timelineSegmentKey(t.key, t.index.Next-1)
+}
+
+// timelineView.replace puts sorted entries in place of the timeline.
+func (t *timelineView) replace(entries []*TimelineEntry) {
+	for _, seg := range t.index.Segments {
+		t.entries[seg.Key] = make([]*TimelineEntry, 0)
+		t.changed[seg.Key] = true
+	}
+	t.index.Segments = make([]*TimelineSegment, 0)
+	for i := 0; i < len(entries); i += TIMELINE_SEGMENT_SIZE {
+		end := i + TIMELINE_SEGMENT_SIZE
+		if end > len(entries) {
+			end = len(entries)
+		}
+		seg := &TimelineSegment{Key: t.newSegmentKey(), First: *entries[i]}
+		t.index.Segments = append(t.index.Segments, seg)
+		t.entries[seg.Key] = entries[i:end]
+		t.changed[seg.Key] = true
+	}
+	// the index is written even if the timeline is empty
+	t.changed[t.key] = true
+}
+
+// timelineView.save writes the segments which changed, splitting the long
+// ones and deleting the empty ones, and the index if the bounds of the
+// segments changed.
+func (t *timelineView) save() error {
+	indexChanged := t.changed[t.key]
+	segments := make([]*TimelineSegment, 0, len(t.index.Segments))
+	for _, seg := range t.index.Segments {
+		entries := t.entries[seg.Key]
+		switch {
+		case !t.changed[seg.Key]:
+			segments = append(segments, seg)
+		case len(entries) == 0:
+			indexChanged = true
+		case len(entries) > TIMELINE_SEGMENT_SIZE:
+			half := &TimelineSegment{Key: t.newSegmentKey()}
+			t.entries[seg.Key] = entries[:len(entries)/2]
+			t.entries[half.Key] = entries[len(entries)/2:]
+			t.changed[half.Key] = true
+			segments = append(segments, seg, half)
+			indexChanged = true
+		default:
+			segments = append(segments, seg)
+		}
+	}
+	for _, seg := range segments {
+		if entries := t.entries[seg.Key]; len(entries) != 0 && *entries[0] != seg.First {
+			seg.First = *entries[0]
+			indexChanged = true
+		}
+	}
+	for segKey := range t.changed {
+		entries := t.entries[segKey]
+		if original, ok := t.original[segKey]; segKey == t.key || ok && timelineEqual(original, entries) {
+			continue
+		}
+		t.placed(segKey)
+		if len(entries) == 0 {
+			t.tx.Delete(&t.s.TimelineDB, segKey)
+		} else if err := t.tx.SetJSON(&t.s.TimelineDB, segKey, entries); err != nil {
+			return err
+		}
+	}
+	if !indexChanged {
+		return nil
+	}
+	t.index.Segments = segments
+	return t.tx.SetJSON(&t.s.TimelineDB, t.key, t.index)
+}
+
+// getTimeline gets a timeline as seen by tx, a missing one is empty.
+func (s *TattooStorage) getTimeline(tx *webapp.Transaction, key string) ([]*TimelineEntry, error) {
+	t, err := s.openTimeline(tx, key)
+	if err != nil {
+		return nil, err
+	}
+	return t.all()
+}
+
+// setTimeline replaces a timeline with sorted entries, even one which can't
+// be read; the segments it had are deleted.
+func (s *TattooStorage) setTimeline(tx *webapp.Transaction, key string, entries []*TimelineEntry) error {
+	t := s.newTimelineView(tx, key)
+	t.replace(entries)
+	if err := t.save(); err != nil {
+		return err
+	}
+	for _, k := range s.TimelineDB.Keys() {
+		if timeline, isSegment := timelineOfKey(k); isSegment && timeline == key && !t.changed[k] {
+			tx.Delete(&s.TimelineDB, k)
+		}
+	}
+	return nil
+}
+
+// updateTimeline takes the names in remove off a timeline and puts the
+// entries in add on it, in place of the entries with the same names. Only
+// the segments which change are written, and the index if their bounds do.
+func (s *TattooStorage) updateTimeline(tx *webapp.Transaction, key string, remove []string, add []*TimelineEntry) error {
+	t, err := s.openTimeline(tx, key)
+	if err != nil {
+		return err
+	}
+	for _, name := range remove {
+		if err := t.remove(name); err != nil {
+			return err
+		}
+	}
+	for _, entry := range add {
+		if err := t.remove(entry.Name); err != nil {
+			return err
+		}
+	}
+	for _, entry := range add {
+		if err := t.insert(entry); err != nil {
+			return err
+		}
+	}
+	return t.save()
+}
+
+// placeArticle moves an article to the timeline its metadata belongs to, a
+// nil meta takes it off the timelines.
+func (s *TattooStorage) placeArticle(tx *webapp.Transaction, name string, meta *ArticleMetadata) error {
+	key, t := "", int64(0)
+	if meta != nil {
+		key, t = articleTimelineOf(meta)
+	}
+	for _, k := range articleTimelines {
+		var err error
+		if k == key {
+			err = s.updateTimeline(tx, k, nil, []*TimelineEntry{{name, t}})
+		} else {
+			err = s.updateTimeline(tx, k, []string{name}, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// placeComments puts comments on the comment timeline.
+func (s *TattooStorage) placeComments(tx *webapp.Transaction, metas []*CommentMetadata) error {
+	add := make([]*TimelineEntry, 0, len(metas))
+	for _, meta := range metas {
+		add = append(add, &TimelineEntry{meta.Name, meta.CreatedTime})
+	}
+	return s.updateTimeline(tx, TIMELINE_COMMENT, nil, add)
+}
+
+// unplaceComments takes comments off the comment timeline.
+func (s *TattooStorage) unplaceComments(tx *webapp.Transaction, uuids []string) error {
+	return s.updateTimeline(tx, TIMELINE_COMMENT, uuids, nil)
+}
+
+// savedTimeline is a saved timeline in memory: its segments and in which
+// segment each name is.
+type savedTimeline struct {
+	index    *TimelineIndex
+	legacy   []*TimelineEntry
+	segments map[string][]*TimelineEntry
+	where    map[string]string
+}
+
+// TattooStorage.loadTimeline reads a saved timeline or a segment of one into
+// memory. It's called whenever a transaction writes one, so the timelines in
+// memory follow the saved ones; only the key written is read again.
+func (s *TattooStorage) loadTimeline(key string) error {
+	timeline, isSegment := timelineOfKey(key)
+	s.timelineLock.Lock()
+	defer s.timelineLock.Unlock()
+	if s.savedTimelines == nil {
+		s.savedTimelines = make(map[string]*savedTimeline)
+	}
+	saved, ok := s.savedTimelines[timeline]
+	if !ok {
+		saved = &savedTimeline{
+			index:    &TimelineIndex{Segments: make([]*TimelineSegment, 0)},
+			segments: make(map[string][]*TimelineEntry),
+		}
+		s.savedTimelines[timeline] = saved
+	}
+	if isSegment {
+		if err := saved.loadSegment(&s.TimelineDB, key); err != nil {
+			return err
+		}
+	} else {
+		saved.index = &TimelineIndex{Segments: make([]*TimelineSegment, 0)}
+		saved.legacy = nil
+		if s.TimelineDB.Has(key) {
+			buff, err := s.TimelineDB.Get(key)
+			if err != nil {
+				return err
+			}
+			index, legacy, err := decodeTimelineIndex(buff)
+			if err != nil {
+				return fmt.Errorf("timeline '%s': %v", key, err)
+			}
+			if index != nil {
+				saved.index = index
+			}
+			saved.legacy = legacy
+		}
+		for _, seg := range saved.index.Segments {
+			if _, ok := saved.segments[seg.Key]; !ok {
+				if err := saved.loadSegment(&s.TimelineDB, seg.Key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0)
+	if !isSegment {
+		saved.where = make(map[string]string)
+		for i, entry := range saved.legacy {
+			// the segment openTimeline puts the entry in
+			saved.where[entry.Name] = timelineSegmentKey(timeline, i/TIMELINE_SEGMENT_SIZE)
+		}
+	}
+	for _, entry := range saved.legacy {
+		names = append(names, entry.Name)
+	}
+	for _, seg := range saved.index.Segments {
+		for _, entry := range saved.segments[seg.Key] {
+			names = append(names, entry.Name)
+			if !isSegment {
+				saved.where[entry.Name] = seg.Key
+			}
+		}
+	}
+	switch timeline {
+	case TIMELINE_ARTICLE:
+		index := make(map[string]int)
+		for i, name := range names {
+			index[name] = i
+		}
+		s.ArticleTimeline = names
+		s.ArticleTimelineIndex = index
+	case TIMELINE_PAGE:
+		s.PageTimeline = names
+	case TIMELINE_DRAFT:
+		s.DraftTimeline = names
+	case TIMELINE_COMMENT:
+		s.CommentTimeline = names
+	}
+	return nil
+}
+
+// savedTimeline.loadSegment reads a segment and notes where its names are.
+func (saved *savedTimeline) loadSegment(fs *webapp.Store, segKey string) error {
+	entries := make([]*TimelineEntry, 0)
+	if fs.Has(segKey) {
+		buff, err := fs.Get(segKey)
+		if err != nil {
+			return err
+		}
+		if entries, err = decodeTimeline(buff); err != nil {
+			return fmt.Errorf("timeline segment '%s': %v", segKey, err)
+		}
+	}
+	if saved.where == nil {
+		saved.where = make(map[string]string)
+	}
+	for _, entry := range saved.segments[segKey] {
+		if saved.where[entry.Name] == segKey {
+			delete(saved.where, entry.Name)
+		}
+	}
+	for _, entry := range entries {
+		saved.where[entry.Name] = segKey
+	}
+	if len(entries) == 0 {
+		delete(saved.segments, segKey)
+	} else {
+		saved.segments[segKey] = entries
+	}
+	return nil
+}
+
+func (s *TattooStorage) loadTimelines() error {
+	for _, key := range allTimelines {
+		if err := s.loadTimeline(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TattooStorage.LoadTimelines reads the saved timelines into memory. They are
+// rebuilt from metadata if one can't be read or they don't add up to the
+// articles and comments stored, e.g. on the first start after an upgrade.
+func (s *TattooStorage) LoadTimelines(app *webapp.App) error {
+	err := s.loadTimelines()
+	if err == nil {
+		s.timelineLock.RLock()
+		articles := len(s.ArticleTimeline) + len(s.PageTimeline) + len(s.DraftTimeline)
+		comments := len(s.CommentTimeline)
+		s.timelineLock.RUnlock()
+		if articles != s.ArticleDB.Count() || comments != s.CommentDB.Count() {
+			err = fmt.Errorf("%d articles and %d comments on the timelines, %d and %d stored",
+				articles, comments, s.ArticleDB.Count(), s.CommentDB.Count())
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	app.Log("Tattoo DB", fmt.Sprintf("Rebuild timelines: %v", err))
+	if err := s.RebuildTimeline(); err != nil {
+		return err
+	}
+	return s.RebuildCommentTimeline()
+}
+
+// buildArticleTimelines puts articles on the timelines they belong to.
+func buildArticleTimelines(articles map[string]*ArticleMetadata) map[string][]*TimelineEntry {
+	timelines := make(map[string][]*TimelineEntry)
+	for _, key := range articleTimelines {
+		timelines[key] = make([]*TimelineEntry, 0)
+	}
+	for name, meta := range articles {
+		key, t := articleTimelineOf(meta)
+		timelines[key] = append(timelines[key], &TimelineEntry{name, t})
+	}
+	for _, entries := range timelines {
+		sort.Sort(timelineByTime(entries))
+	}
+	return timelines
+}
+
+func buildCommentTimeline(comments map[string]*CommentMetadata) []*TimelineEntry {
+	entries := make([]*TimelineEntry, 0, len(comments))
+	for uuid, meta := range comments {
+		entries = append(entries, &TimelineEntry{uuid, meta.CreatedTime})
+	}
+	sort.Sort(timelineByTime(entries))
+	return entries
+}
+
+// TattooStorage.RebuildTimeline rebuilds the article, page and draft
+// timelines from the metadata of every article and saves them. Articles
+// without readable metadata are left out.
+func (s *TattooStorage) RebuildTimeline() error {
+	articles := make(map[string]*ArticleMetadata)
+	for _, name := range s.ArticleDB.Keys() {
+		meta, err := s.GetMeta(name)
+		if err != nil {
+			log.Printf("%v\n", err)
+			continue
+		}
+		articles[name] = meta
+	}
+	tx := s.Begin()
+	defer tx.Rollback()
+	for key, entries := range buildArticleTimelines(articles) {
+		if err := s.setTimeline(tx, key, entries); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// TattooStorage.RebuildCommentTimeline rebuilds the comment timeline from the
+// metadata of every comment and saves it.
+func (s *TattooStorage) RebuildCommentTimeline() error {
+	comments := make(map[string]*CommentMetadata)
+	for _, uuid := range s.CommentDB.Keys() {
+		meta, err := s.GetCommentMetadata(uuid)
+		if err != nil {
+			log.Printf("err: %v\n", err)
+			continue
+		}
+		comments[uuid] = meta
+	}
+	tx := s.Begin()
+	defer tx.Rollback()
+	if err := s.setTimeline(tx, TIMELINE_COMMENT, buildCommentTimeline(comments)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
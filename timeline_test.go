@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// checkTimeline compares a timeline, as saved and in memory, with want, and
+// checks its segments are within bounds and indexed by their first entries.
+func checkTimeline(t *testing.T, db *TattooStorage, key string, want map[string]int64) {
+	t.Helper()
+	entries := make([]*TimelineEntry, 0, len(want))
+	for name, time := range want {
+		entries = append(entries, &TimelineEntry{name, time})
+	}
+	sort.Sort(timelineByTime(entries))
+	tx := db.Begin()
+	defer tx.Rollback()
+	view, err := db.openTimeline(tx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := view.all()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !timelineEqual(got, entries) {
+		t.Fatalf("timeline has %d entries, want %d", len(got), len(entries))
+	}
+	for _, seg := range view.index.Segments {
+		segEntries, _ := view.segment(seg.Key)
+		if len(segEntries) == 0 || len(segEntries) > TIMELINE_SEGMENT_SIZE {
+			t.Fatalf("segment %s has %d entries", seg.Key, len(segEntries))
+		}
+		if *segEntries[0] != seg.First {
+			t.Fatalf("segment %s indexed by %v, starts with %v", seg.Key, seg.First, *segEntries[0])
+		}
+	}
+	db.timelineLock.RLock()
+	names := db.CommentTimeline
+	db.timelineLock.RUnlock()
+	if len(names) != len(entries) {
+		t.Fatalf("%d names in memory, want %d", len(names), len(entries))
+	}
+	for i, entry := range entries {
+		if names[i] != entry.Name {
+			t.Fatalf("name %d in memory is %s, want %s", i, names[i], entry.Name)
+		}
+	}
+}
+
+func TestTimelineUpdate(t *testing.T) {
+	db := openTestDB(t)
+	rnd := rand.New(rand.NewSource(1))
+	want := make(map[string]int64)
+	for round := 0; round < 24; round++ {
+		tx := db.Begin()
+		for i := 0; i < 50; i++ {
+			name := fmt.Sprintf("c%d", rnd.Intn(3000))
+			var err error
+			if rnd.Intn(8) == 0 {
+				delete(want, name)
+				err = db.updateTimeline(tx, TIMELINE_COMMENT, []string{name}, nil)
+			} else {
+				// few times, so entries often tie and are ordered by name
+				want[name] = int64(rnd.Intn(500))
+				err = db.updateTimeline(tx, TIMELINE_COMMENT, nil, []*TimelineEntry{{name, want[name]}})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		checkTimeline(t, db, TIMELINE_COMMENT, want)
+	}
+	if len(want) < 3*TIMELINE_SEGMENT_SIZE {
+		t.Fatalf("only %d entries, too few segments", len(want))
+	}
+
+	// everything off, the segments go with it
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	for i := 0; i < len(names); i += 50 {
+		end := i + 50
+		if end > len(names) {
+			end = len(names)
+		}
+		tx := db.Begin()
+		for _, name := range names[i:end] {
+			if err := db.updateTimeline(tx, TIMELINE_COMMENT, []string{name}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkTimeline(t, db, TIMELINE_COMMENT, map[string]int64{})
+	if keys := db.TimelineDB.Keys(); len(keys) != 1 {
+		t.Fatalf("Timeline DB has %v left", keys)
+	}
+}
+
+// TestTimelineWrites checks an update writes the segment it touches and not
+// the rest of the timeline.
+func TestTimelineWrites(t *testing.T) {
+	db := openTestDB(t)
+	entries := make([]*TimelineEntry, 0)
+	for i := 0; i < 10*TIMELINE_SEGMENT_SIZE; i++ {
+		entries = append(entries, &TimelineEntry{fmt.Sprintf("c%d", i), int64(2 * i)})
+	}
+	sort.Sort(timelineByTime(entries))
+	tx := db.Begin()
+	db.setTimeline(tx, TIMELINE_COMMENT, entries)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	values := func() map[string][]byte {
+		ret := make(map[string][]byte)
+		for _, key := range db.TimelineDB.Keys() {
+			ret[key], _ = db.TimelineDB.Get(key)
+		}
+		return ret
+	}
+	for _, entry := range []*TimelineEntry{{"middle", 5001}, {"newest", 1 << 40}, {"c2000", 1}} {
+		before := values()
+		tx := db.Begin()
+		if err := db.updateTimeline(tx, TIMELINE_COMMENT, nil, []*TimelineEntry{entry}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		segments := 0
+		for key, value := range values() {
+			if bytes.Equal(before[key], value) {
+				continue
+			}
+			if _, isSegment := timelineOfKey(key); isSegment {
+				segments += 1
+			}
+		}
+		// moving an entry touches the segments it leaves and joins, which
+		// may split in two
+		if segments == 0 || segments > 3 {
+			t.Errorf("putting %v on the timeline wrote %d segments", entry, segments)
+		}
+	}
+}
+
+func TestTimelineLegacy(t *testing.T) {
+	db := openTestDB(t)
+	legacy := []*TimelineEntry{{"b", 3}, {"a", 2}, {"c", 1}}
+	db.TimelineDB.SetJSON(TIMELINE_COMMENT, legacy)
+	if err := db.loadTimeline(TIMELINE_COMMENT); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"a": 2, "b": 3, "c": 1}
+	checkTimeline(t, db, TIMELINE_COMMENT, want)
+
+	// the first update segments it
+	tx := db.Begin()
+	if err := db.updateTimeline(tx, TIMELINE_COMMENT, []string{"a"}, []*TimelineEntry{{"d", 4}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "a")
+	want["d"] = 4
+	checkTimeline(t, db, TIMELINE_COMMENT, want)
+	buff, _ := db.TimelineDB.Get(TIMELINE_COMMENT)
+	if index, _, err := decodeTimelineIndex(buff); err != nil || index == nil {
+		t.Fatalf("timeline still saved as a list: %s", buff)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"github.com/shellex/tattoo/webapp"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// failingStorage fails every write, as a full disk does.
+type failingStorage struct {
+	webapp.Storage
+}
+
+func (fs failingStorage) Set(key string, value []byte) error {
+	return errors.New("disk full")
+}
+
+func (fs failingStorage) Delete(key string) error {
+	return errors.New("disk full")
+}
+
+// storeSums returns the checksums of every storage of db, by name.
+func storeSums(t *testing.T, db *TattooStorage) map[string]string {
+	t.Helper()
+	sums := make(map[string]string)
+	for _, store := range db.Stores() {
+		_, sum, err := StoreChecksum(store.DB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums[store.Name] = sum
+	}
+	return sums
+}
+
+// timelineNames returns the names of the articles of the timeline of db.
+func timelineNames(t *testing.T, db *TattooStorage) string {
+	t.Helper()
+	articles, err := db.GetArticleTimeline(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(articles))
+	for i, article := range articles {
+		names[i] = article.Metadata.Name
+	}
+	return strings.Join(names, " ")
+}
+
+// TestTransactionRevert fails the commit of each operation on its last
+// write, the change log's, and checks the writes it made to the other
+// storages are reverted, along with the timelines, tags and caches.
+func TestTransactionRevert(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	db := openTestDB(t)
+	if err := db.SaveArticle(newTestArticle("a", "text of a", "go"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddComment(newTestComment("a", "c1", "a comment")); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name   string
+		mutate func() error
+	}{
+		{"create", func() error { return db.SaveArticle(newTestArticle("b", "text of b", "go", "web"), "") }},
+		{"update", func() error { return db.SaveArticle(newTestArticle("a", "new text of a", "web"), "a") }},
+		{"rename", func() error { return db.SaveArticle(newTestArticle("c", "text of a", "go"), "a") }},
+		{"trash", func() error { return db.TrashArticle("a") }},
+		{"comment", func() error { return db.AddComment(newTestComment("a", "c2", "another comment")) }},
+		{"comment delete", func() error { return db.DeleteComment("c1") }},
+	}
+	for _, step := range steps {
+		sums := storeSums(t, db)
+		tags := tagCounts()
+		timeline := timelineNames(t, db)
+		seq, _ := db.LastChange()
+		// warm the caches with what must stay
+		db.GetMeta("a")
+		db.GetCommentTimeline(0, 10)
+
+		storage := db.ChangeDB.Storage
+		db.ChangeDB.Storage = failingStorage{storage}
+		err := step.mutate()
+		db.ChangeDB.Storage = storage
+		if err == nil {
+			t.Fatalf("%s committed with the change log failing", step.name)
+		}
+
+		for name, sum := range storeSums(t, db) {
+			if sum != sums[name] {
+				t.Errorf("%s: %s not reverted", step.name, name)
+			}
+		}
+		if got := tagCounts(); got != tags {
+			t.Errorf("%s: tags %s, were %s", step.name, got, tags)
+		}
+		if got := timelineNames(t, db); got != timeline {
+			t.Errorf("%s: timeline %s, was %s", step.name, got, timeline)
+		}
+		if got, _ := db.LastChange(); got != seq {
+			t.Errorf("%s: change log at %d, was at %d", step.name, got, seq)
+		}
+		if meta, err := db.GetMeta("a"); err != nil || meta.Tags[0] != "go" {
+			t.Errorf("%s: article a = %v, %v", step.name, meta, err)
+		}
+		if comments, err := db.GetCommentTimeline(0, 10); err != nil || len(comments) != 1 || comments[0].Metadata.Name != "c1" {
+			t.Errorf("%s: comments = %v, %v", step.name, comments, err)
+		}
+	}
+}
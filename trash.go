@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/shellex/tattoo/webapp"
+	"sort"
+	"time"
+)
+
+const (
+	TRASH_KIND_ARTICLE     = "article"
+	TRASH_KIND_COMMENT     = "comment"
+	TRASH_PURGE_INTERVAL   = time.Hour
+	ERROR_TRASH_NOT_EXISTS = "Trash item doesn't exist"
+)
+
+// TrashedComment is a comment kept in the trash, with its source.
+type TrashedComment struct {
+	Metadata CommentMetadata
+	Source   string
+}
+
+// TrashedArticle is an article kept in the trash with everything which is
+// deleted along with it.
+type TrashedArticle struct {
+	Metadata  ArticleMetadata
+	Source    string
+	Revisions []*RevisionMetadata
+	// revision sources by revision number
+	RevisionSources map[string]string
+	Comments        []*TrashedComment
+}
+
+// TrashItem is a deleted article or comment, stored in Trash DB as JSON under
+// its Name, which is a UUID.
+type TrashItem struct {
+	Name        string
+	Kind        string
+	Title       string
+	DeletedTime int64
+	Article     *TrashedArticle `json:",omitempty"`
+	Comment     *TrashedComment `json:",omitempty"`
+}
+
+func (item *TrashItem) IsArticle() bool {
+	return item.Kind == TRASH_KIND_ARTICLE
+}
+
+func (item *TrashItem) DeletedTimeHumanReading() string {
+	return TimeHumanReading(item.DeletedTime)
+}
+
+// TrashItem.Owner returns the name of the article, or the article a comment
+// belongs to.
+func (item *TrashItem) Owner() string {
+	if item.IsArticle() {
+		return item.Article.Metadata.Name
+	}
+	return item.Comment.Metadata.ArticleName
+}
+
+func (s *TattooStorage) getTrashItem(tx *webapp.Transaction, id string) (*TrashItem, error) {
+	if !tx.Has(&s.TrashDB, id) {
+		return nil, errors.New(ERROR_TRASH_NOT_EXISTS)
+	}
+	buff, err := tx.Get(&s.TrashDB, id)
+	if err != nil {
+		return nil, err
+	}
+	item := new(TrashItem)
+	if err := json.Unmarshal(buff, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// TattooStorage.GetTrash returns all items in the trash, the most recently
+// deleted first.
+func (s *TattooStorage) GetTrash() []*TrashItem {
+	items := make([]*TrashItem, 0)
+	for _, id := range s.TrashDB.Keys() {
+		buff, err := s.TrashDB.Get(id)
+		if err != nil {
+			continue
+		}
+		item := new(TrashItem)
+		if err := json.Unmarshal(buff, item); err != nil {
+			fmt.Printf("TattooStorage.GetTrash, Unmarshal json failed (%v):%s\n", id, err)
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Sort(trashByTime(items))
+	return items
+}
+
+type trashByTime []*TrashItem
+
+func (t trashByTime) Len() int           { return len(t) }
+func (t trashByTime) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t trashByTime) Less(i, j int) bool { return t[i].DeletedTime > t[j].DeletedTime }
+
+func (s *TattooStorage) getTrashedComment(tx *webapp.Transaction, uuid string) (*TrashedComment, error) {
+	meta, err := s.getCommentMetadata(tx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	source, err := tx.Get(&s.CommentDB, uuid)
+	if err != nil {
+		return nil, err
+	}
+	return &TrashedComment{Metadata: *meta, Source: string(source)}, nil
+}
+
+// TattooStorage.TrashArticle moves an article with its source, metadata,
+// revisions and comments to the trash. Its tags are kept in the metadata.
+func (s *TattooStorage) TrashArticle(name string) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	meta, err := s.getMeta(tx, name)
+	if err != nil {
+		return err
+	}
+	source, err := tx.Get(&s.ArticleDB, name)
+	if err != nil {
+		return err
+	}
+	article := &TrashedArticle{
+		Metadata:        *meta,
+		Source:          string(source),
+		RevisionSources: make(map[string]string),
+		Comments:        make([]*TrashedComment, 0),
+	}
+	if article.Revisions, err = s.getRevisions(tx, name); err != nil {
+		return err
+	}
+	for _, rev := range article.Revisions {
+		text, err := tx.Get(&s.RevisionDB, revisionKey(name, rev.Number))
+		if err != nil {
+			return err
+		}
+		article.RevisionSources[fmt.Sprint(rev.Number)] = string(text)
+	}
+	uuids, _ := getNameList(tx, &s.CommentIndexDB, name)
+	for _, uuid := range uuids {
+		comment, err := s.getTrashedComment(tx, uuid)
+		if err != nil {
+			continue
+		}
+		article.Comments = append(article.Comments, comment)
+	}
+	item := &TrashItem{
+		Name:        UUID(),
+		Kind:        TRASH_KIND_ARTICLE,
+		Title:       meta.Title,
+		DeletedTime: time.Now().Unix(),
+		Article:     article,
+	}
+	if err := tx.SetJSON(&s.TrashDB, item.Name, item); err != nil {
+		return err
+	}
+	if err := s.removeArticle(tx, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TattooStorage.TrashComment moves a comment to the trash.
+func (s *TattooStorage) TrashComment(uuid string) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	comment, err := s.getTrashedComment(tx, uuid)
+	if err != nil {
+		return err
+	}
+	item := &TrashItem{
+		Name:        UUID(),
+		Kind:        TRASH_KIND_COMMENT,
+		Title:       comment.Metadata.Author,
+		DeletedTime: time.Now().Unix(),
+		Comment:     comment,
+	}
+	if err := tx.SetJSON(&s.TrashDB, item.Name, item); err != nil {
+		return err
+	}
+	if err := s.deleteComment(tx, &comment.Metadata); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TattooStorage.RestoreTrash puts a trashed item back where it was. An article
+// can't be restored over another one with the same name, and a comment needs
+// its article to be there.
+func (s *TattooStorage) RestoreTrash(id string) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	item, err := s.getTrashItem(tx, id)
+	if err != nil {
+		return err
+	}
+	if item.IsArticle() {
+		err = s.restoreArticle(tx, item.Article)
+	} else {
+		err = s.restoreComment(tx, item.Comment)
+	}
+	if err != nil {
+		return err
+	}
+	tx.Delete(&s.TrashDB, id)
+	return tx.Commit()
+}
+
+func (s *TattooStorage) restoreArticle(tx *webapp.Transaction, article *TrashedArticle) error {
+	meta := &article.Metadata
+	if tx.Has(&s.ArticleDB, meta.Name) || tx.Has(&s.MetadataDB, meta.Name) {
+		return fmt.Errorf("an article named '%s' already exists", meta.Name)
+	}
+	s.updateMetadata(tx, meta)
+	s.updateArticle(tx, meta.Name, []byte(article.Source))
+	if meta.IsPublished() {
+		s.updateArticleTagIndex(tx, meta.Name, meta.Tags)
+	}
+	if len(article.Revisions) != 0 {
+		for _, rev := range article.Revisions {
+			tx.SetString(&s.RevisionDB, revisionKey(meta.Name, rev.Number), article.RevisionSources[fmt.Sprint(rev.Number)])
+		}
+		if err := tx.SetJSON(&s.RevisionIndexDB, meta.Name, article.Revisions); err != nil {
+			return err
+		}
+	}
+	if err := s.placeArticle(tx, meta.Name, meta); err != nil {
+		return err
+	}
+	s.logArticle("", nil, meta)
+	uuids := make([]string, 0, len(article.Comments))
+	metas := make([]*CommentMetadata, 0, len(article.Comments))
+	for _, comment := range article.Comments {
+		s.updateCommentMetadata(tx, &comment.Metadata)
+		s.updateComment(tx, comment.Metadata.Name, []byte(comment.Source))
+		uuids = append(uuids, comment.Metadata.Name)
+		metas = append(metas, &comment.Metadata)
+		s.logComment(CHANGE_CREATE, &comment.Metadata)
+	}
+	if len(uuids) != 0 {
+		if err := tx.SetJSON(&s.CommentIndexDB, meta.Name, uuids); err != nil {
+			return err
+		}
+	}
+	return s.placeComments(tx, metas)
+}
+
+// restoreComment adds a comment back to the comment index of its article,
+// at the position given by its created time.
+func (s *TattooStorage) restoreComment(tx *webapp.Transaction, comment *TrashedComment) error {
+	meta := &comment.Metadata
+	if !tx.Has(&s.ArticleDB, meta.ArticleName) {
+		return fmt.Errorf("article '%s' of the comment doesn't exist", meta.ArticleName)
+	}
+	lst, _ := getNameList(tx, &s.CommentIndexDB, meta.ArticleName)
+	pos := len(lst)
+	for i, uuid := range lst {
+		other, err := s.getCommentMetadata(tx, uuid)
+		if err == nil && other.CreatedTime > meta.CreatedTime {
+			pos = i
+			break
+		}
+	}
+	newList := make([]string, 0, len(lst)+1)
+	newList = append(newList, lst[:pos]...)
+	newList = append(newList, meta.Name)
+	newList = append(newList, lst[pos:]...)
+	if err := tx.SetJSON(&s.CommentIndexDB, meta.ArticleName, newList); err != nil {
+		return err
+	}
+	s.updateCommentMetadata(tx, meta)
+	s.updateComment(tx, meta.Name, []byte(comment.Source))
+	s.logComment(CHANGE_CREATE, meta)
+	return s.placeComments(tx, []*CommentMetadata{meta})
+}
+
+// TattooStorage.PurgeTrash deletes a trashed item for good.
+func (s *TattooStorage) PurgeTrash(id string) error {
+	tx := s.Begin()
+	defer tx.Rollback()
+	if !tx.Has(&s.TrashDB, id) {
+		return errors.New(ERROR_TRASH_NOT_EXISTS)
+	}
+	tx.Delete(&s.TrashDB, id)
+	return tx.Commit()
+}
+
+// TattooStorage.PurgeExpiredTrash deletes the items trashed before the given
+// time and returns how many were deleted.
+func (s *TattooStorage) PurgeExpiredTrash(before int64) (int, error) {
+	tx := s.Begin()
+	defer tx.Rollback()
+	count := 0
+	for _, id := range s.TrashDB.Keys() {
+		item, err := s.getTrashItem(tx, id)
+		if err != nil || item.DeletedTime >= before {
+			continue
+		}
+		tx.Delete(&s.TrashDB, id)
+		count += 1
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return count, tx.Commit()
+}
+
+// StartTrashScheduler purges the items which have been in the trash longer
+// than Config.TrashRetention days, checking every TRASH_PURGE_INTERVAL.
+func StartTrashScheduler(app *webapp.App) {
+	purge := func() {
+		days := GetConfig().TrashRetention
+		if days <= 0 {
+			return
+		}
+		before := time.Now().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+		count, err := TattooDB.PurgeExpiredTrash(before)
+		if err != nil {
+			app.Log("Trash", fmt.Sprintf("Purge failed: %v", err))
+		} else if count != 0 {
+			app.Log("Trash", fmt.Sprintf("Purged %d item(s)", count))
+		}
+	}
+	purge()
+	go func() {
+		for range time.Tick(TRASH_PURGE_INTERVAL) {
+			purge()
+		}
+	}()
+}
@@ -0,0 +1,162 @@
+package webapp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flush modes, they decide when a store is flushed after a transaction writes
+// to it. Committed writes are recoverable in every mode, the file storage
+// journals them; flushing folds the journal into the index.
+const (
+	// flush the stores written by a transaction before Commit returns
+	FLUSH_MODE_IMMEDIATE = "immediate"
+	// flush once no transaction has committed for Delay, or after MaxDelay
+	FLUSH_MODE_BATCHED = "batched"
+	// flush every Interval only
+	FLUSH_MODE_INTERVAL = "interval"
+)
+
+const (
+	ERROR_FLUSH_MODE     = "Unknown flush mode"
+	ERROR_FLUSH_INTERVAL = "Flush interval must be positive"
+)
+
+// FlushScheduler flushes a set of Stores, only the dirty ones and at most
+// one flush of each at a time. Besides what the mode asks for, dirty stores
+// are flushed every Interval, which covers writes made outside transactions,
+// and by Close.
+type FlushScheduler struct {
+	Mode     string
+	Delay    time.Duration
+	MaxDelay time.Duration
+	Interval time.Duration
+	lock     sync.Mutex
+	stores   []*Store
+	// serializes flushes
+	flushLock sync.Mutex
+	wake      chan struct{}
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+func NewFlushScheduler(mode string, delay time.Duration, interval time.Duration) (*FlushScheduler, error) {
+	switch mode {
+	case FLUSH_MODE_IMMEDIATE, FLUSH_MODE_BATCHED, FLUSH_MODE_INTERVAL:
+	default:
+		return nil, fmt.Errorf("%s: '%s'", ERROR_FLUSH_MODE, mode)
+	}
+	if interval <= 0 {
+		return nil, errors.New(ERROR_FLUSH_INTERVAL)
+	}
+	fl := &FlushScheduler{
+		Mode:     mode,
+		Delay:    delay,
+		MaxDelay: 10 * delay,
+		Interval: interval,
+		stores:   make([]*Store, 0),
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go fl.run()
+	return fl, nil
+}
+
+// FlushScheduler.Add puts a store under the scheduler, Store.Sync reports to
+// it from then on.
+func (fl *FlushScheduler) Add(st *Store) {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	fl.stores = append(fl.stores, st)
+	st.scheduler = fl
+}
+
+// FlushScheduler.sync is called by Store.Sync when a transaction committed
+// writes to st.
+func (fl *FlushScheduler) sync(st *Store) error {
+	switch fl.Mode {
+	case FLUSH_MODE_IMMEDIATE:
+		fl.flushLock.Lock()
+		defer fl.flushLock.Unlock()
+		return st.flushDirty()
+	case FLUSH_MODE_BATCHED:
+		select {
+		case fl.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// FlushScheduler.FlushAll flushes every dirty store now and returns the first
+// error.
+func (fl *FlushScheduler) FlushAll() error {
+	fl.lock.Lock()
+	stores := append([]*Store(nil), fl.stores...)
+	fl.lock.Unlock()
+	fl.flushLock.Lock()
+	defer fl.flushLock.Unlock()
+	var ret error
+	for _, st := range stores {
+		if err := st.flushDirty(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+func (fl *FlushScheduler) run() {
+	defer close(fl.done)
+	ticker := time.NewTicker(fl.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fl.quit:
+			return
+		case <-ticker.C:
+		case <-fl.wake:
+			fl.wait()
+		}
+		if err := fl.FlushAll(); err != nil {
+			fmt.Println("FlushScheduler.run, Flush failed:", err)
+		}
+	}
+}
+
+// FlushScheduler.wait gathers the transactions committed within Delay of each
+// other, but no longer than MaxDelay.
+func (fl *FlushScheduler) wait() {
+	deadline := time.After(fl.MaxDelay)
+	for {
+		select {
+		case <-fl.quit:
+			return
+		case <-deadline:
+			return
+		case <-fl.wake:
+		case <-time.After(fl.Delay):
+			return
+		}
+	}
+}
+
+// FlushScheduler.Close stops the scheduler and flushes every dirty store. The
+// stores aren't closed, and with the immediate mode they're still flushed on
+// Sync.
+func (fl *FlushScheduler) Close() error {
+	close(fl.quit)
+	<-fl.done
+	return fl.FlushAll()
+}
+
+// Store.flushDirty flushes the store if it was written since its last flush.
+func (st *Store) flushDirty() error {
+	if atomic.LoadInt32(&st.dirty) == 0 {
+		return nil
+	}
+	return st.Flush()
+}
@@ -0,0 +1,94 @@
+package webapp
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFlushOnClose checks, in each flush mode, when a committed transaction
+// is folded into the index, and that Close folds what's left, including
+// writes made outside transactions, so the index alone holds them.
+func TestFlushOnClose(t *testing.T) {
+	modes := map[string]bool{FLUSH_MODE_IMMEDIATE: true, FLUSH_MODE_BATCHED: false, FLUSH_MODE_INTERVAL: false}
+	for mode, onCommit := range modes {
+		t.Run(mode, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "store")
+			fs := openTestStorage(t, dir, testLayoutFlat)
+			st := &Store{Storage: fs}
+			// long enough not to flush before Close
+			fl, err := NewFlushScheduler(mode, time.Hour, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fl.Add(st)
+			journaled := func() int64 {
+				info, err := os.Stat(fs.getJournalFilePath())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return info.Size()
+			}
+
+			tx := NewTransaction(new(sync.Mutex))
+			tx.SetString(st, "committed", "1")
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if flushed := journaled() == 0; flushed != onCommit {
+				t.Fatalf("flushed on commit: %v", flushed)
+			}
+			st.SetString("unsynced", "2")
+			if journaled() == 0 {
+				t.Fatal("write outside a transaction flushed")
+			}
+
+			if err := fl.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if journaled() != 0 {
+				t.Fatal("journal left after Close")
+			}
+			fs.Close()
+			os.Remove(fs.getJournalFilePath())
+			reopened := openTestStorage(t, dir, testLayoutFlat)
+			defer reopened.Close()
+			for key, want := range map[string]string{"committed": "1", "unsynced": "2"} {
+				if value, err := reopened.Get(key); err != nil || string(value) != want {
+					t.Errorf("%s = %q, %v from the index", key, value, err)
+				}
+			}
+		})
+	}
+}
+
+// TestFlushBatched checks the batched mode flushes by itself once no
+// transaction has committed for Delay.
+func TestFlushBatched(t *testing.T) {
+	fs := openTestStorage(t, filepath.Join(t.TempDir(), "store"), testLayoutFlat)
+	defer fs.Close()
+	st := &Store{Storage: fs}
+	fl, err := NewFlushScheduler(FLUSH_MODE_BATCHED, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+	fl.Add(st)
+	tx := NewTransaction(new(sync.Mutex))
+	tx.SetString(st, "key", "value")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		info, err := os.Stat(fs.getJournalFilePath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 0 {
+			return
+		}
+	}
+	t.Fatal("batched commit never flushed")
+}
@@ -0,0 +1,142 @@
+package webapp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	JOURNAL_OP_SET    = "set"
+	JOURNAL_OP_DELETE = "del"
+)
+
+// JournalEntry is one index mutation, stored as a single JSON line.
+type JournalEntry struct {
+	Op    string
+	Key   string
+	Value string `json:",omitempty"`
+}
+
+// Journal is an append-only log of index mutations which happened after the
+// index file was written. It is replayed on Init and emptied by SaveIndex.
+type Journal struct {
+	Path string
+	file *os.File
+}
+
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{Path: path, file: file}, nil
+}
+
+// Journal.Append writes an entry and syncs it to disk before returning.
+func (j *Journal) Append(entry *JournalEntry) error {
+	buff, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	buff = append(buff, '\n')
+	if _, err := j.file.Write(buff); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Journal.Reset drops all entries, it's called once they are part of the index file.
+func (j *Journal) Reset() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// ReplayJournal applies the entries of a journal file to index and returns
+// how many entries were applied. A torn last line, left by a crash in the
+// middle of Append, ends the replay.
+func ReplayJournal(path string, index map[string]string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer file.Close()
+	count := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			fmt.Printf("ReplayJournal, stop at broken entry %d (%v):%s\n", count, path, err)
+			break
+		}
+		switch entry.Op {
+		case JOURNAL_OP_SET:
+			index[entry.Key] = entry.Value
+		case JOURNAL_OP_DELETE:
+			delete(index, entry.Key)
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// WriteFileAtomic writes data to a temporary file in the same directory and
+// renames it to filename, so readers see either the old or the new content.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+TEMP_FILE_SUFFIX)
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
@@ -0,0 +1,115 @@
+package webapp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// crash drops a storage as a crash does, its journal written and its index
+// not saved.
+func crash(fs *FileStorage) {
+	fs.journal.Close()
+}
+
+// TestJournalReplay checks the writes journaled before a crash, and only
+// them, are found by the next Init, up to a torn last entry, and that the
+// journal is folded into the index so later entries don't follow the torn
+// one.
+func TestJournalReplay(t *testing.T) {
+	for _, layout := range testLayouts {
+		t.Run(layout, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "store")
+			fs := openTestStorage(t, dir, layout)
+			if err := fs.Set("saved", []byte("in the index")); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.SaveIndex(); err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range map[string]string{"a": "1", "b": "2", "saved": "overwritten", "long": strings.Repeat("x", 100000)} {
+				if err := fs.Set(key, []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := fs.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+			journalPath := fs.getJournalFilePath()
+			crash(fs)
+			// a crash in the middle of Append
+			journal, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			journal.WriteString(`{"Op":"set","Key":"torn","Val`)
+			journal.Close()
+			if layout != testLayoutSingle {
+				// and one in the middle of writing a value file
+				ioutil.WriteFile(filepath.Join(dir, ".torn"+TEMP_FILE_SUFFIX+"1"), []byte("half"), 0644)
+			}
+
+			fs = openTestStorage(t, dir, layout)
+			want := map[string]string{"a": "1", "saved": "overwritten", "long": strings.Repeat("x", 100000)}
+			for key, value := range want {
+				if got, err := fs.Get(key); err != nil || string(got) != value {
+					t.Errorf("%s after the crash = %.20q, %v", key, got, err)
+				}
+			}
+			for _, key := range []string{"b", "torn"} {
+				if fs.Has(key) {
+					t.Errorf("%s after the crash", key)
+				}
+			}
+			info, err := os.Stat(journalPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != 0 {
+				t.Fatalf("journal of %d bytes not folded into the index", info.Size())
+			}
+			if matches, _ := filepath.Glob(filepath.Join(dir, ".*"+TEMP_FILE_SUFFIX+"*")); len(matches) != 0 {
+				t.Errorf("temporary files left: %q", matches)
+			}
+
+			// entries journaled after the replay are replayed in turn
+			if err := fs.Set("after", []byte("3")); err != nil {
+				t.Fatal(err)
+			}
+			crash(fs)
+			fs = openTestStorage(t, dir, layout)
+			defer fs.Close()
+			want["after"] = "3"
+			for key, value := range want {
+				if got, err := fs.Get(key); err != nil || string(got) != value {
+					t.Errorf("%s after the second crash = %.20q, %v", key, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.journal")
+	lines := `{"Op":"set","Key":"a","Value":"1"}` + "\n" +
+		`{"Op":"set","Key":"b","Value":"2"}` + "\n" +
+		`{"Op":"del","Key":"a"}` + "\n" +
+		`{"Op":"set","Key":"c","Value":"3"}` + "\n" +
+		`{"Op":"set","Key":"d"`
+	if err := ioutil.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	index := map[string]string{"a": "0", "e": "5"}
+	count, err := ReplayJournal(path, index)
+	if err != nil || count != 4 {
+		t.Fatalf("ReplayJournal = %d, %v", count, err)
+	}
+	if len(index) != 3 || index["b"] != "2" || index["c"] != "3" || index["e"] != "5" {
+		t.Errorf("index replayed to %v", index)
+	}
+	if count, err := ReplayJournal(filepath.Join(t.TempDir(), "missing"), index); err != nil || count != 0 {
+		t.Errorf("ReplayJournal of no journal = %d, %v", count, err)
+	}
+}
@@ -0,0 +1,137 @@
+package webapp
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	ERROR_KEY_EMPTY    = "Empty key"
+	ERROR_KEY_RESERVED = "Reserved key"
+	ERROR_KEY_TOO_LONG = "Key too long"
+	ERROR_KEY_ENCODING = "Key isn't valid UTF-8"
+)
+
+// value file names longer than this leave no room for the temporary files
+// of WriteFileAtomic within the 255 bytes most file systems allow
+const MAX_KEY_FILE_NAME = 200
+
+// file names used by a multiple-file storage itself, no key may have them
+var reservedKeys = map[string]bool{
+	"*":               true,
+	INDEX_FILE_NAME:   true,
+	JOURNAL_FILE_NAME: true,
+	LAYOUT_FILE_NAME:  true,
+}
+
+// KeyError is returned by FileStorage for a key it can't store, Reason is
+// one of the ERROR_KEY_ constants.
+type KeyError struct {
+	Key    string
+	Reason string
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("%s: %q", e.Reason, e.Key)
+}
+
+// IsKeyError tells whether err rejects a key, as opposed to a failure of the
+// storage.
+func IsKeyError(err error) bool {
+	_, ok := err.(*KeyError)
+	return ok
+}
+
+// ValidateKey checks that a FileStorage can store a key: it isn't empty,
+// reserved or too long once encoded, and it's valid UTF-8, which the JSON
+// index and journal can't hold otherwise.
+func ValidateKey(key string) error {
+	if len(key) == 0 {
+		return &KeyError{key, ERROR_KEY_EMPTY}
+	}
+	if !utf8.ValidString(key) {
+		return &KeyError{key, ERROR_KEY_ENCODING}
+	}
+	if reservedKeys[key] {
+		return &KeyError{key, ERROR_KEY_RESERVED}
+	}
+	if len(EncodeKey(key)) > MAX_KEY_FILE_NAME {
+		return &KeyError{key, ERROR_KEY_TOO_LONG}
+	}
+	return nil
+}
+
+// keyByteIsSafe tells whether a byte can appear as is in a file name on
+// every common file system.
+func keyByteIsSafe(b byte) bool {
+	if b < 0x20 || b == 0x7f {
+		return false
+	}
+	return strings.IndexByte(`/\%:*?"<>|`, b) < 0
+}
+
+// EncodeKey maps a key to the name of its value file. Path separators, '%',
+// control characters, characters Windows doesn't allow and a leading '.',
+// which would hide the file or turn it into "." or "..", are escaped as %XX.
+// Every other key is its own file name, as it was before keys were encoded.
+func EncodeKey(key string) string {
+	if !needsEncoding(key) {
+		return key
+	}
+	buff := make([]byte, 0, len(key)+8)
+	for i := 0; i < len(key); i++ {
+		if !keyByteIsSafe(key[i]) || (i == 0 && key[i] == '.') {
+			buff = append(buff, fmt.Sprintf("%%%02X", key[i])...)
+		} else {
+			buff = append(buff, key[i])
+		}
+	}
+	return string(buff)
+}
+
+func needsEncoding(key string) bool {
+	if strings.HasPrefix(key, ".") {
+		return true
+	}
+	for i := 0; i < len(key); i++ {
+		if !keyByteIsSafe(key[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// FileStorage.renameLegacyFiles gives the value files written before keys
+// were encoded their encoded names. Files a key put outside the storage
+// directory are left where they are.
+func (fs *FileStorage) renameLegacyFiles() {
+	count := 0
+	for key := range fs.Index {
+		if EncodeKey(key) == key || ValidateKey(key) != nil {
+			continue
+		}
+		dst := fs.valuePath(key)
+		dir := path.Dir(dst)
+		src := path.Join(dir, key)
+		if !strings.HasPrefix(src, dir+"/") {
+			continue
+		}
+		if info, err := os.Stat(src); err != nil || info.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := os.Rename(src, dst); err != nil {
+			fmt.Printf("FileStorage.renameLegacyFiles, Rename failed (%v):%s\n", src, err)
+			continue
+		}
+		count += 1
+	}
+	if count != 0 {
+		fmt.Printf("FileStorage.renameLegacyFiles, %d value files renamed (%v)\n", count, fs.Path)
+	}
+}
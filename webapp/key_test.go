@@ -0,0 +1,234 @@
+package webapp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// storage layouts the tests run through
+const (
+	testLayoutSingle  = "single"
+	testLayoutFlat    = "flat"
+	testLayoutSharded = "sharded"
+)
+
+var testLayouts = []string{testLayoutSingle, testLayoutFlat, testLayoutSharded}
+
+// openTestStorage opens a FileStorage of a layout in dir, a sharded one is
+// converted by Shard when it's new.
+func openTestStorage(t testing.TB, dir string, layout string) *FileStorage {
+	fs := new(FileStorage)
+	var err error
+	switch layout {
+	case testLayoutSingle:
+		os.MkdirAll(dir, 0755)
+		err = fs.Init(filepath.Join(dir, "db.json"), FILE_STORAGE_MODE_SINGLE)
+	case testLayoutFlat:
+		err = fs.Init(dir, FILE_STORAGE_MODE_MULIPLE)
+	default:
+		if err = fs.Init(dir, FILE_STORAGE_MODE_MULIPLE); err == nil {
+			err = fs.Shard()
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout == testLayoutSharded && !fs.Sharded || layout == testLayoutFlat && fs.Sharded {
+		t.Fatalf("%s storage opened with Sharded %v", layout, fs.Sharded)
+	}
+	return fs
+}
+
+// keys a storage must keep inside its directory under names of its own
+var hostileKeys = []string{
+	"../x",
+	"a/../../etc",
+	"a/b",
+	"/abs",
+	".",
+	"..",
+	".hidden",
+	"a\\b",
+	"nul\x00byte",
+	"ctl\x01\x1f\x7f",
+	"tab\there\nnewline",
+	"c:con",
+	"%2e%2e",
+	// encode to names of other keys, if escaping were ambiguous
+	"a%2Fb",
+	"%2Ehidden",
+	"index.json.bak",
+	"文章/../x",
+}
+
+func TestValidateKey(t *testing.T) {
+	rejected := map[string]string{
+		"":                       ERROR_KEY_EMPTY,
+		"*":                      ERROR_KEY_RESERVED,
+		INDEX_FILE_NAME:          ERROR_KEY_RESERVED,
+		JOURNAL_FILE_NAME:        ERROR_KEY_RESERVED,
+		LAYOUT_FILE_NAME:         ERROR_KEY_RESERVED,
+		"\xff\xfe":               ERROR_KEY_ENCODING,
+		"a\xc0\x80":              ERROR_KEY_ENCODING,
+		strings.Repeat("x", 201): ERROR_KEY_TOO_LONG,
+		strings.Repeat("/", 100): ERROR_KEY_TOO_LONG,
+		strings.Repeat("文", 100): ERROR_KEY_TOO_LONG,
+	}
+	for key, reason := range rejected {
+		err := ValidateKey(key)
+		keyErr, ok := err.(*KeyError)
+		if !ok || keyErr.Reason != reason || keyErr.Key != key {
+			t.Errorf("ValidateKey(%q) = %v, want %s", key, err, reason)
+		}
+		if !IsKeyError(err) {
+			t.Errorf("IsKeyError(%v) = false", err)
+		}
+	}
+	for _, key := range append(hostileKeys, strings.Repeat("x", MAX_KEY_FILE_NAME)) {
+		if err := ValidateKey(key); err != nil {
+			t.Errorf("ValidateKey(%q) = %v", key, err)
+		}
+	}
+}
+
+func TestEncodeKey(t *testing.T) {
+	names := make(map[string]string)
+	for _, key := range hostileKeys {
+		name := EncodeKey(key)
+		if name == "." || name == ".." || strings.HasPrefix(name, ".") {
+			t.Errorf("EncodeKey(%q) = %q, a hidden or special name", key, name)
+		}
+		if strings.ContainsAny(name, "/\\:*?\"<>|") {
+			t.Errorf("EncodeKey(%q) = %q, not a plain file name", key, name)
+		}
+		for i := 0; i < len(name); i++ {
+			if name[i] < 0x20 || name[i] == 0x7f {
+				t.Errorf("EncodeKey(%q) = %q, a control byte", key, name)
+			}
+		}
+		if other, ok := names[name]; ok {
+			t.Errorf("EncodeKey(%q) = EncodeKey(%q) = %q", key, other, name)
+		}
+		names[name] = key
+	}
+	// keys needing no escape keep their names
+	for _, key := range []string{"hello-world", "文章", "a.b", "index.json.bak"} {
+		if name := EncodeKey(key); name != key {
+			t.Errorf("EncodeKey(%q) = %q", key, name)
+		}
+	}
+}
+
+// filesOutside returns the files and directories under root which aren't dir
+// or inside it.
+func filesOutside(root string, dir string) []string {
+	dir = filepath.Clean(dir)
+	outside := make([]string, 0)
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return nil
+		}
+		if p != dir && !strings.HasPrefix(p, dir+string(filepath.Separator)) {
+			outside = append(outside, p)
+		}
+		return nil
+	})
+	return outside
+}
+
+func TestHostileKeys(t *testing.T) {
+	for _, layout := range testLayouts {
+		t.Run(layout, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "store")
+			fs := openTestStorage(t, dir, layout)
+			for _, key := range hostileKeys {
+				if err := fs.Set(key, []byte("value of "+key)); err != nil {
+					t.Fatalf("Set(%q): %v", key, err)
+				}
+			}
+			if fs.Count() != len(hostileKeys) {
+				t.Fatalf("Count() = %d, want %d", fs.Count(), len(hostileKeys))
+			}
+			rejected := map[string]string{
+				"*":                      ERROR_KEY_RESERVED,
+				INDEX_FILE_NAME:          ERROR_KEY_RESERVED,
+				JOURNAL_FILE_NAME:        ERROR_KEY_RESERVED,
+				LAYOUT_FILE_NAME:         ERROR_KEY_RESERVED,
+				"":                       ERROR_KEY_EMPTY,
+				"\xff\xfe":               ERROR_KEY_ENCODING,
+				strings.Repeat("x", 300): ERROR_KEY_TOO_LONG,
+			}
+			for key, reason := range rejected {
+				if err, ok := fs.Set(key, []byte("x")).(*KeyError); !ok || err.Reason != reason {
+					t.Errorf("Set(%q) = %v, want %s", key, err, reason)
+				}
+				if _, err := fs.Get(key); !IsKeyError(err) {
+					t.Errorf("Get(%q) = %v, want a KeyError", key, err)
+				}
+				if err := fs.Delete(key); !IsKeyError(err) {
+					t.Errorf("Delete(%q) = %v, want a KeyError", key, err)
+				}
+				if fs.Has(key) {
+					t.Errorf("Has(%q)", key)
+				}
+			}
+			if outside := filesOutside(root, dir); len(outside) != 0 {
+				t.Fatalf("files outside the storage: %v", outside)
+			}
+			if problems := fs.Check(false); len(problems) != 0 {
+				t.Fatal(problems)
+			}
+			fs.Close()
+
+			fs = openTestStorage(t, dir, layout)
+			for _, key := range hostileKeys {
+				value, err := fs.Get(key)
+				if err != nil || string(value) != "value of "+key {
+					t.Errorf("Get(%q) after reopening = %q, %v", key, value, err)
+				}
+			}
+			// the index files are intact
+			if fs.Count() != len(hostileKeys) {
+				t.Fatalf("Count() after reopening = %d", fs.Count())
+			}
+			for _, key := range hostileKeys {
+				if err := fs.Delete(key); err != nil {
+					t.Fatalf("Delete(%q): %v", key, err)
+				}
+			}
+			if fs.Count() != 0 {
+				t.Fatalf("Count() after deleting = %d", fs.Count())
+			}
+			if problems := fs.Check(false); len(problems) != 0 {
+				t.Fatal(problems)
+			}
+			fs.Close()
+			if outside := filesOutside(root, dir); len(outside) != 0 {
+				t.Fatalf("files outside the storage: %v", outside)
+			}
+		})
+	}
+}
+
+func TestLegacyFileNames(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	os.MkdirAll(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".old"), []byte("o"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a:b"), []byte("ab"), 0644)
+	index := `{"*":"placeholder",".old":"` + filepath.Join(dir, ".old") + `","a:b":"` + filepath.Join(dir, "a:b") + `"}`
+	ioutil.WriteFile(filepath.Join(dir, INDEX_FILE_NAME), []byte(index), 0644)
+	fs := openTestStorage(t, dir, testLayoutFlat)
+	defer fs.Close()
+	for key, want := range map[string]string{".old": "o", "a:b": "ab"} {
+		if value, err := fs.Get(key); err != nil || string(value) != want {
+			t.Errorf("Get(%q) = %q, %v", key, value, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, EncodeKey(key))); err != nil {
+			t.Errorf("%q not renamed: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package webapp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	KV_OP_SET    = 1
+	KV_OP_DELETE = 2
+	// crc32, op, key length, value length
+	KV_HEADER_SIZE = 4 + 1 + 4 + 4
+	// Compact leaves files with less garbage than this alone
+	KV_COMPACT_MIN_GARBAGE = 1 << 20
+	KV_BUCKET_SEPARATOR    = "\x00"
+)
+
+const (
+	ERROR_KV_CLOSED  = "KV file is closed"
+	ERROR_KV_CORRUPT = "KV file is corrupt"
+)
+
+type kvEntry struct {
+	// offset and size of the whole record
+	offset int64
+	size   int64
+	// offset and size of the value
+	valueOffset int64
+	valueSize   int
+}
+
+// KVFile is an embedded key-value store keeping all its buckets in a single
+// append-only file. Every mutation appends a record
+//
+//	crc32 | op | key length | value length | key | value
+//
+// with big endian integers and a checksum of everything after it, and syncs
+// the file. Only the keys and the offsets of their values are held in memory,
+// values are read from the file on demand. Opening replays the records, the
+// newest one of a key wins; a torn record at the end, left by a crash during a
+// write, is cut off, a broken record followed by intact ones is
+// ERROR_KV_CORRUPT. Compact drops the overwritten and deleted records.
+type KVFile struct {
+	Path    string
+	lock    sync.RWMutex
+	file    *os.File
+	size    int64
+	index   map[string]*kvEntry
+	counts  map[string]int
+	garbage int64
+	// buckets not closed yet
+	refs int
+}
+
+func OpenKVFile(filename string) (*KVFile, error) {
+	dir, base := filepath.Split(filename)
+	if len(dir) != 0 {
+		os.MkdirAll(dir, 0755)
+	}
+	// leftovers of a compaction interrupted by a crash
+	removeTempFiles(dir, "."+base+TEMP_FILE_SUFFIX)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	kv := &KVFile{
+		Path:   filename,
+		file:   file,
+		index:  make(map[string]*kvEntry),
+		counts: make(map[string]int),
+	}
+	if err := kv.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return kv, nil
+}
+
+// KVFile.load replays all records of the file into the index.
+func (kv *KVFile) load() error {
+	info, err := kv.file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+	reader := bufio.NewReader(io.NewSectionReader(kv.file, 0, fileSize))
+	header := make([]byte, KV_HEADER_SIZE)
+	var offset int64
+	for offset < fileSize {
+		torn := func() error {
+			fmt.Printf("KVFile.load, Cut off torn record at %d (%v)\n", offset, kv.Path)
+			kv.size = offset
+			return kv.file.Truncate(offset)
+		}
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return torn()
+			}
+			return err
+		}
+		keySize := int64(binary.BigEndian.Uint32(header[5:9]))
+		valueSize := int64(binary.BigEndian.Uint32(header[9:13]))
+		size := KV_HEADER_SIZE + keySize + valueSize
+		if offset+size > fileSize {
+			// a bad length in the middle of the file looks the same as a
+			// torn record, only the last one may be cut off
+			if next := kv.findRecord(offset+1, fileSize); next >= 0 {
+				return fmt.Errorf("%s: bad record length at %d, a record follows at %d (%s)", ERROR_KV_CORRUPT, offset, next, kv.Path)
+			}
+			return torn()
+		}
+		body := make([]byte, keySize+valueSize)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return err
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:])
+		crc.Write(body)
+		if crc.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+			if offset+size == fileSize {
+				return torn()
+			}
+			return fmt.Errorf("%s: bad checksum at %d (%s)", ERROR_KV_CORRUPT, offset, kv.Path)
+		}
+		kv.apply(header[4], string(body[:keySize]), &kvEntry{
+			offset:      offset,
+			size:        size,
+			valueOffset: offset + KV_HEADER_SIZE + keySize,
+			valueSize:   int(valueSize),
+		})
+		offset += size
+	}
+	kv.size = offset
+	return nil
+}
+
+// KVFile.findRecord returns the offset of the first intact record at or after
+// from, -1 if there's none before fileSize.
+func (kv *KVFile) findRecord(from int64, fileSize int64) int64 {
+	header := make([]byte, KV_HEADER_SIZE)
+	for offset := from; offset+KV_HEADER_SIZE <= fileSize; offset++ {
+		if _, err := kv.file.ReadAt(header, offset); err != nil {
+			return -1
+		}
+		if header[4] != KV_OP_SET && header[4] != KV_OP_DELETE {
+			continue
+		}
+		keySize := int64(binary.BigEndian.Uint32(header[5:9]))
+		valueSize := int64(binary.BigEndian.Uint32(header[9:13]))
+		if keySize == 0 || offset+KV_HEADER_SIZE+keySize+valueSize > fileSize {
+			continue
+		}
+		body := make([]byte, keySize+valueSize)
+		if _, err := kv.file.ReadAt(body, offset+KV_HEADER_SIZE); err != nil {
+			return -1
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:])
+		crc.Write(body)
+		if crc.Sum32() == binary.BigEndian.Uint32(header[0:4]) {
+			return offset
+		}
+	}
+	return -1
+}
+
+// KVFile.apply updates the index with a record written at entry.
+func (kv *KVFile) apply(op byte, key string, entry *kvEntry) {
+	bucket := key[:strings.Index(key+KV_BUCKET_SEPARATOR, KV_BUCKET_SEPARATOR)]
+	if old, ok := kv.index[key]; ok {
+		kv.garbage += old.size
+		kv.counts[bucket] -= 1
+		delete(kv.index, key)
+	}
+	if op == KV_OP_DELETE {
+		kv.garbage += entry.size
+		return
+	}
+	kv.index[key] = entry
+	kv.counts[bucket] += 1
+}
+
+func encodeKVRecord(op byte, key string, value []byte) []byte {
+	record := make([]byte, KV_HEADER_SIZE+len(key)+len(value))
+	record[4] = op
+	binary.BigEndian.PutUint32(record[5:9], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(value)))
+	copy(record[KV_HEADER_SIZE:], key)
+	copy(record[KV_HEADER_SIZE+len(key):], value)
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// KVFile.write appends a record and syncs it to disk before it's indexed.
+func (kv *KVFile) write(op byte, key string, value []byte) error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if kv.file == nil {
+		return errors.New(ERROR_KV_CLOSED)
+	}
+	record := encodeKVRecord(op, key, value)
+	_, err := kv.file.WriteAt(record, kv.size)
+	if err == nil {
+		err = kv.file.Sync()
+	}
+	if err != nil {
+		fmt.Printf("KVFile.write, Write failed (%v):%s\n", kv.Path, err)
+		// don't leave a partial record in front of the next one
+		kv.file.Truncate(kv.size)
+		return err
+	}
+	kv.apply(op, key, &kvEntry{
+		offset:      kv.size,
+		size:        int64(len(record)),
+		valueOffset: kv.size + KV_HEADER_SIZE + int64(len(key)),
+		valueSize:   len(value),
+	})
+	kv.size += int64(len(record))
+	return nil
+}
+
+func (kv *KVFile) get(key string) ([]byte, error) {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	if kv.file == nil {
+		return nil, errors.New(ERROR_KV_CLOSED)
+	}
+	entry, ok := kv.index[key]
+	if !ok {
+		return nil, errors.New(ERROR_KEY_NOT_EXISTS)
+	}
+	value := make([]byte, entry.valueSize)
+	if _, err := kv.file.ReadAt(value, entry.valueOffset); err != nil {
+		fmt.Printf("KVFile.get, Read failed (%v):%s\n", kv.Path, err)
+		return nil, err
+	}
+	return value, nil
+}
+
+func (kv *KVFile) has(key string) bool {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	_, ok := kv.index[key]
+	return ok
+}
+
+// KVFile.keys returns the keys starting with prefix, without the prefix.
+func (kv *KVFile) keys(prefix string) []string {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	keys := make([]string, 0)
+	for k := range kv.index {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k[len(prefix):])
+		}
+	}
+	return keys
+}
+
+func (kv *KVFile) count(bucket string) int {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	return kv.counts[bucket]
+}
+
+type kvEntriesByOffset []*kvEntry
+
+func (e kvEntriesByOffset) Len() int           { return len(e) }
+func (e kvEntriesByOffset) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e kvEntriesByOffset) Less(i, j int) bool { return e[i].offset < e[j].offset }
+
+// KVFile.Compact rewrites the file with the live records only, once the
+// overwritten and deleted ones take up half of it. The new file replaces the
+// old one by a rename, so a crash leaves either of them.
+func (kv *KVFile) Compact() error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if kv.file == nil {
+		return errors.New(ERROR_KV_CLOSED)
+	}
+	if kv.garbage < KV_COMPACT_MIN_GARBAGE || kv.garbage*2 < kv.size {
+		return nil
+	}
+	dir, base := filepath.Split(kv.Path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+TEMP_FILE_SUFFIX)
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	fail := func(err error) error {
+		fmt.Printf("KVFile.Compact, Rewrite failed (%v):%s\n", kv.Path, err)
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	entries := make([]*kvEntry, 0, len(kv.index))
+	for _, entry := range kv.index {
+		entries = append(entries, entry)
+	}
+	// keep the records in the order they were written
+	sort.Sort(kvEntriesByOffset(entries))
+	moved := make(map[*kvEntry]int64)
+	writer := bufio.NewWriter(tmp)
+	var offset int64
+	for _, entry := range entries {
+		record := make([]byte, entry.size)
+		if _, err := kv.file.ReadAt(record, entry.offset); err != nil {
+			return fail(err)
+		}
+		if _, err := writer.Write(record); err != nil {
+			return fail(err)
+		}
+		moved[entry] = offset
+		offset += entry.size
+	}
+	if err := writer.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmpName, kv.Path); err != nil {
+		return fail(err)
+	}
+	syncDir(dir)
+	kv.file.Close()
+	kv.file = tmp
+	for _, entry := range entries {
+		delta := moved[entry] - entry.offset
+		entry.offset += delta
+		entry.valueOffset += delta
+	}
+	fmt.Printf("KVFile.Compact, %d bytes dropped (%v)\n", kv.size-offset, kv.Path)
+	kv.size = offset
+	kv.garbage = 0
+	return nil
+}
+
+// KVFile.Bucket returns the storage of one bucket. The file is closed when
+// all its buckets are closed.
+func (kv *KVFile) Bucket(name string) *KVBucket {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.refs += 1
+	return &KVBucket{db: kv, Name: name, prefix: name + KV_BUCKET_SEPARATOR}
+}
+
+func (kv *KVFile) release() error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.refs -= 1
+	if kv.refs > 0 || kv.file == nil {
+		return nil
+	}
+	err := kv.file.Close()
+	kv.file = nil
+	return err
+}
+
+// KVBucket is a Storage keeping its values in a bucket of a KVFile.
+type KVBucket struct {
+	Name   string
+	db     *KVFile
+	prefix string
+}
+
+func (b *KVBucket) Get(key string) ([]byte, error) {
+	return b.db.get(b.prefix + key)
+}
+
+func (b *KVBucket) Set(key string, value []byte) error {
+	return b.db.write(KV_OP_SET, b.prefix+key, value)
+}
+
+func (b *KVBucket) Delete(key string) error {
+	if !b.db.has(b.prefix + key) {
+		return nil
+	}
+	return b.db.write(KV_OP_DELETE, b.prefix+key, nil)
+}
+
+func (b *KVBucket) Has(key string) bool {
+	return b.db.has(b.prefix + key)
+}
+
+func (b *KVBucket) Keys() []string {
+	return b.db.keys(b.prefix)
+}
+
+func (b *KVBucket) Count() int {
+	return b.db.count(b.Name)
+}
+
+// KVBucket.Flush compacts the file if it's worth it, the records are on disk
+// already.
+func (b *KVBucket) Flush() error {
+	return b.db.Compact()
+}
+
+func (b *KVBucket) Close() error {
+	return b.db.release()
+}
@@ -0,0 +1,194 @@
+package webapp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestKV(t *testing.T, filename string) *KVFile {
+	t.Helper()
+	kv, err := OpenKVFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func closeTestKV(t *testing.T, buckets ...*KVBucket) {
+	t.Helper()
+	for _, b := range buckets {
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKVRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tattoo.kv")
+	kv := openTestKV(t, filename)
+	a, b := kv.Bucket("a"), kv.Bucket("b")
+	testRoundTrip(t, a)
+	// buckets don't see each other's keys
+	if b.Count() != 0 || len(b.Keys()) != 0 || b.Has("a") {
+		t.Fatalf("bucket b has %d key(s)", b.Count())
+	}
+	b.Set("a", []byte("b's a"))
+	closeTestKV(t, a, b)
+
+	kv = openTestKV(t, filename)
+	a, b = kv.Bucket("a"), kv.Bucket("b")
+	defer closeTestKV(t, a, b)
+	if got, err := a.Get("a"); err != nil || string(got) != "overwritten" {
+		t.Errorf("a.Get(a) after reopening = %q, %v", got, err)
+	}
+	if got, err := b.Get("a"); err != nil || string(got) != "b's a" {
+		t.Errorf("b.Get(a) after reopening = %q, %v", got, err)
+	}
+	if a.Has("b") {
+		t.Error("deleted key back after reopening")
+	}
+	if a.Count() != 3 || b.Count() != 1 {
+		t.Errorf("Count() after reopening = %d, %d", a.Count(), b.Count())
+	}
+}
+
+// writeTestKV writes n records to a new KV file and returns its bytes.
+func writeTestKV(t *testing.T, filename string, n int) []byte {
+	t.Helper()
+	kv := openTestKV(t, filename)
+	b := kv.Bucket("b")
+	for i := 0; i < n; i++ {
+		b.Set(string(rune('a'+i)), []byte(strings.Repeat("v", 10+i)))
+	}
+	closeTestKV(t, b)
+	buff, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buff
+}
+
+func TestKVTornTail(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "tattoo.kv")
+	buff := writeTestKV(t, filename, 3)
+	last := encodeKVRecord(KV_OP_SET, "b\x00c", []byte(strings.Repeat("v", 12)))
+	intact := len(buff) - len(last)
+	tails := map[string][]byte{
+		// cut in the header, in the key and in the value
+		"header": buff[:intact+5],
+		"key":    buff[:intact+KV_HEADER_SIZE+1],
+		"value":  buff[:len(buff)-1],
+		// written in full with a bad checksum
+		"checksum": append(append([]byte{}, buff[:len(buff)-1]...), 'x'),
+	}
+	for name, content := range tails {
+		t.Run(name, func(t *testing.T) {
+			ioutil.WriteFile(filename, content, 0644)
+			kv := openTestKV(t, filename)
+			b := kv.Bucket("b")
+			if b.Count() != 2 || b.Has("c") {
+				t.Fatalf("Count() = %d after cutting off the torn record", b.Count())
+			}
+			// the next record isn't written behind the torn one
+			if err := b.Set("d", []byte("d")); err != nil {
+				t.Fatal(err)
+			}
+			closeTestKV(t, b)
+			kv = openTestKV(t, filename)
+			b = kv.Bucket("b")
+			defer closeTestKV(t, b)
+			if got, err := b.Get("d"); err != nil || string(got) != "d" {
+				t.Errorf("Get(d) = %q, %v", got, err)
+			}
+			if got, err := b.Get("b"); err != nil || string(got) != strings.Repeat("v", 11) {
+				t.Errorf("Get(b) = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestKVCorruptMiddle(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "tattoo.kv")
+	buff := writeTestKV(t, filename, 3)
+	corruptions := map[string]func(buff []byte){
+		// the value length of the first record points past the end
+		"length": func(buff []byte) { buff[9] = 0x7f },
+		"checksum": func(buff []byte) {
+			buff[KV_HEADER_SIZE+3] ^= 0xff
+		},
+	}
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			content := append([]byte{}, buff...)
+			corrupt(content)
+			ioutil.WriteFile(filename, content, 0644)
+			kv, err := OpenKVFile(filename)
+			if err == nil {
+				kv.Bucket("b").Close()
+				t.Fatal("OpenKVFile succeeded on a corrupt file")
+			}
+			if !strings.HasPrefix(err.Error(), ERROR_KV_CORRUPT) {
+				t.Fatalf("OpenKVFile = %v, want %s", err, ERROR_KV_CORRUPT)
+			}
+			// nothing is cut off
+			after, _ := ioutil.ReadFile(filename)
+			if !bytes.Equal(after, content) {
+				t.Fatalf("corrupt file changed from %d to %d bytes", len(content), len(after))
+			}
+		})
+	}
+}
+
+func TestKVCompact(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "tattoo.kv")
+	kv := openTestKV(t, filename)
+	b := kv.Bucket("b")
+	big := bytes.Repeat([]byte("x"), KV_COMPACT_MIN_GARBAGE/4)
+	for i := 0; i < 8; i++ {
+		b.Set("big", big)
+	}
+	b.Set("kept", []byte("kept"))
+	b.Set("deleted", []byte("deleted"))
+	b.Delete("deleted")
+	before, _ := os.Stat(filename)
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(filename)
+	if after.Size() >= before.Size()/2 {
+		t.Fatalf("Compact left %d of %d bytes", after.Size(), before.Size())
+	}
+	// the index points into the new file
+	if got, err := b.Get("big"); err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("Get(big) after compacting = %d bytes, %v", len(got), err)
+	}
+	if err := b.Set("new", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	closeTestKV(t, b)
+	if files, _ := filepath.Glob(filepath.Join(dir, ".*")); len(files) != 0 {
+		t.Fatalf("temporary files left: %v", files)
+	}
+
+	kv = openTestKV(t, filename)
+	b = kv.Bucket("b")
+	defer closeTestKV(t, b)
+	for key, want := range map[string]string{"kept": "kept", "new": "new"} {
+		if got, err := b.Get(key); err != nil || string(got) != want {
+			t.Errorf("Get(%q) after reopening = %q, %v", key, got, err)
+		}
+	}
+	if got, err := b.Get("big"); err != nil || !bytes.Equal(got, big) {
+		t.Errorf("Get(big) after reopening = %d bytes, %v", len(got), err)
+	}
+	if b.Has("deleted") || b.Count() != 3 {
+		t.Errorf("Count() after reopening = %d", b.Count())
+	}
+}
@@ -0,0 +1,72 @@
+package webapp
+
+import (
+	"errors"
+	"sync"
+)
+
+// MemoryStorage keeps its values in a map and never touches the disk, it's
+// meant for tests and trying things out.
+type MemoryStorage struct {
+	lock  sync.RWMutex
+	items map[string][]byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{items: make(map[string][]byte)}
+}
+
+func (ms *MemoryStorage) Get(key string) ([]byte, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	value, ok := ms.items[key]
+	if !ok {
+		return nil, errors.New(ERROR_KEY_NOT_EXISTS)
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (ms *MemoryStorage) Set(key string, value []byte) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.items[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (ms *MemoryStorage) Delete(key string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.items, key)
+	return nil
+}
+
+func (ms *MemoryStorage) Has(key string) bool {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	_, ok := ms.items[key]
+	return ok
+}
+
+func (ms *MemoryStorage) Keys() []string {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	keys := make([]string, 0, len(ms.items))
+	for k := range ms.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (ms *MemoryStorage) Count() int {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return len(ms.items)
+}
+
+func (ms *MemoryStorage) Flush() error {
+	return nil
+}
+
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
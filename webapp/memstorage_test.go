@@ -0,0 +1,80 @@
+package webapp
+
+import (
+	"sort"
+	"testing"
+)
+
+// testRoundTrip sets, overwrites, reads and deletes keys of a storage.
+func testRoundTrip(t *testing.T, st Storage) {
+	t.Helper()
+	values := map[string]string{"a": "1", "b": "", "文章": "value\x00with\nbytes", "a/b": "2"}
+	for key, value := range values {
+		if err := st.Set(key, []byte(value)); err != nil {
+			t.Fatalf("Set(%q): %v", key, err)
+		}
+	}
+	if err := st.Set("a", []byte("overwritten")); err != nil {
+		t.Fatal(err)
+	}
+	values["a"] = "overwritten"
+	for key, value := range values {
+		if got, err := st.Get(key); err != nil || string(got) != value {
+			t.Errorf("Get(%q) = %q, %v, want %q", key, got, err, value)
+		}
+		if !st.Has(key) {
+			t.Errorf("Has(%q) = false", key)
+		}
+	}
+	if _, err := st.Get("missing"); err == nil || err.Error() != ERROR_KEY_NOT_EXISTS {
+		t.Errorf("Get(missing) = %v", err)
+	}
+	if err := st.Delete("missing"); err != nil {
+		t.Errorf("Delete(missing) = %v", err)
+	}
+	if err := st.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	delete(values, "b")
+	if st.Has("b") {
+		t.Error("Has(b) after Delete")
+	}
+	if st.Count() != len(values) {
+		t.Errorf("Count() = %d, want %d", st.Count(), len(values))
+	}
+	keys := st.Keys()
+	sort.Strings(keys)
+	want := make([]string, 0)
+	for key := range values {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+	if len(keys) != len(want) {
+		t.Fatalf("Keys() = %q, want %q", keys, want)
+	}
+	for i := range keys {
+		if keys[i] != want[i] {
+			t.Fatalf("Keys() = %q, want %q", keys, want)
+		}
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	ms := NewMemoryStorage()
+	testRoundTrip(t, ms)
+	// values are copied in and out
+	value := []byte("abc")
+	ms.Set("k", value)
+	value[0] = 'x'
+	got, _ := ms.Get("k")
+	got[1] = 'y'
+	if got, _ := ms.Get("k"); string(got) != "abc" {
+		t.Errorf("Get(k) = %q after changing the slices passed", got)
+	}
+	if err := ms.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
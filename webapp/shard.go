@@ -0,0 +1,270 @@
+package webapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// A sharded multiple-file storage keeps the value of a key in one of
+// SHARD_COUNT subdirectories picked by a hash of the key, each with an index
+// segment listing its keys. SaveIndex only rewrites the segments of the
+// shards written since the last save. The layout file marks a sharded
+// storage; flat ones keep every value and the whole index in one directory.
+// Storages are flat unless converted by Shard.
+const (
+	SHARD_COUNT            = 256
+	SHARD_DIR_PREFIX       = "_"
+	LAYOUT_FILE_NAME       = "index.layout"
+	STORAGE_LAYOUT_SHARDED = "sharded"
+)
+
+type StorageLayout struct {
+	Layout string
+	Shards int
+}
+
+var shardNames = func() []string {
+	names := make([]string, SHARD_COUNT)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s%02x", SHARD_DIR_PREFIX, i)
+	}
+	return names
+}()
+
+func shardName(i int) string {
+	return shardNames[i]
+}
+
+// shardOf picks the shard of a key by its 32-bit FNV-1a hash, inlined since
+// SaveIndex hashes every key of the index.
+func shardOf(key string) string {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return shardNames[h%SHARD_COUNT]
+}
+
+func isShardDir(name string) bool {
+	if len(name) != len(SHARD_DIR_PREFIX)+2 || !strings.HasPrefix(name, SHARD_DIR_PREFIX) {
+		return false
+	}
+	return strings.Trim(name[len(SHARD_DIR_PREFIX):], "0123456789abcdef") == ""
+}
+
+// FileStorage.valuePath returns the file keeping the value of key in a
+// multiple-file storage.
+func (fs *FileStorage) valuePath(key string) string {
+	if fs.Sharded {
+		return path.Join(fs.Path, shardOf(key), EncodeKey(key))
+	}
+	return path.Join(fs.Path, EncodeKey(key))
+}
+
+// FileStorage.initLayout tells whether a multiple-file storage is sharded: a
+// storage with a layout file is, any other isn't. New storages are created
+// flat, only Shard converts one to the sharded layout.
+func (fs *FileStorage) initLayout() error {
+	layoutPath := path.Join(fs.Path, LAYOUT_FILE_NAME)
+	buff, err := ioutil.ReadFile(layoutPath)
+	if err == nil {
+		layout := new(StorageLayout)
+		if err := json.Unmarshal(buff, layout); err != nil {
+			return fmt.Errorf("%s: %v", layoutPath, err)
+		}
+		if layout.Layout != STORAGE_LAYOUT_SHARDED || layout.Shards != SHARD_COUNT {
+			return fmt.Errorf("%s: unknown layout %s/%d", layoutPath, layout.Layout, layout.Shards)
+		}
+		fs.Sharded = true
+		// a conversion interrupted after the switch
+		if _, err := os.Stat(path.Join(fs.Path, INDEX_FILE_NAME)); err == nil {
+			fmt.Println("FileStorage.initLayout, Finish converting to sharded layout:", fs.Path)
+			return fs.removeFlatFiles()
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func writeLayout(dir string) error {
+	buff, err := json.Marshal(&StorageLayout{Layout: STORAGE_LAYOUT_SHARDED, Shards: SHARD_COUNT})
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path.Join(dir, LAYOUT_FILE_NAME), buff, 0644)
+}
+
+func (fs *FileStorage) markAllDirty() {
+	for i := 0; i < SHARD_COUNT; i++ {
+		fs.dirty[shardName(i)] = true
+	}
+}
+
+// FileStorage.saveSegments writes the index segments of the dirty shards. The
+// caller holds saveLock and lock.
+func (fs *FileStorage) saveSegments() error {
+	if len(fs.dirty) == 0 {
+		return nil
+	}
+	segments := make(map[string]map[string]string)
+	for shard := range fs.dirty {
+		segments[shard] = make(map[string]string)
+	}
+	for k, v := range fs.Index {
+		if segment, ok := segments[shardOf(k)]; ok {
+			segment[k] = v
+		}
+	}
+	for shard, segment := range segments {
+		dir := path.Join(fs.Path, shard)
+		if len(segment) == 0 {
+			if err := os.Remove(path.Join(dir, INDEX_FILE_NAME)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			delete(fs.dirty, shard)
+			continue
+		}
+		buff, err := json.Marshal(segment)
+		if err != nil {
+			fmt.Printf("FileStorage.saveSegments, Marshal json failed (%v):%s\n", dir, err)
+			return err
+		}
+		os.MkdirAll(dir, 0755)
+		if err := WriteFileAtomic(path.Join(dir, INDEX_FILE_NAME), buff, 0644); err != nil {
+			fmt.Printf("FileStorage.saveSegments, Write file failed (%v):%s\n", dir, err)
+			return err
+		}
+		delete(fs.dirty, shard)
+	}
+	return nil
+}
+
+// FileStorage.loadSegments reads the index segments of all shards.
+func (fs *FileStorage) loadSegments() error {
+	infos, err := ioutil.ReadDir(fs.Path)
+	if err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for _, info := range infos {
+		if !info.IsDir() || !isShardDir(info.Name()) {
+			continue
+		}
+		segmentPath := path.Join(fs.Path, info.Name(), INDEX_FILE_NAME)
+		buff, err := ioutil.ReadFile(segmentPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			fmt.Println("FileStorage.loadSegments, Read file failed:", err)
+			return err
+		}
+		segment := make(map[string]string)
+		if err := json.Unmarshal(buff, &segment); err != nil {
+			fmt.Printf("FileStorage.loadSegments, Unmarshal json failed (%v):%s\n", segmentPath, err)
+			return err
+		}
+		for k, v := range segment {
+			fs.Index[k] = v
+		}
+	}
+	return nil
+}
+
+// FileStorage.Shard converts a flat multiple-file storage to the sharded
+// layout in place. Every value file is linked into its shard and all index
+// segments are written before the layout file, which switches the storage
+// over; so a crash leaves either the flat storage or the sharded one. The
+// flat files are removed last.
+func (fs *FileStorage) Shard() error {
+	if fs.Mode != FILE_STORAGE_MODE_MULIPLE {
+		return fmt.Errorf("%s: only multiple-file storages can be sharded", fs.Path)
+	}
+	if fs.Sharded {
+		return nil
+	}
+	if err := fs.SaveIndex(); err != nil {
+		return err
+	}
+	fs.saveLock.Lock()
+	defer fs.saveLock.Unlock()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for key := range fs.Index {
+		if isShardDir(key) {
+			return fmt.Errorf("%s: key '%s' is reserved by the sharded layout, rename it first", fs.Path, key)
+		}
+	}
+	index := make(map[string]string)
+	for key, value := range fs.Index {
+		if key == "*" {
+			index[key] = value
+			continue
+		}
+		dst := path.Join(fs.Path, shardOf(key), EncodeKey(key))
+		os.MkdirAll(path.Dir(dst), 0755)
+		os.Remove(dst)
+		if err := linkFile(path.Join(fs.Path, EncodeKey(key)), dst); err != nil {
+			return err
+		}
+		index[key] = dst
+	}
+	flatIndex := fs.Index
+	fs.Index = index
+	fs.Sharded = true
+	fs.markAllDirty()
+	err := fs.saveSegments()
+	if err == nil {
+		err = writeLayout(fs.Path)
+	}
+	if err != nil {
+		fs.Index = flatIndex
+		fs.Sharded = false
+		fs.dirty = make(map[string]bool)
+		return err
+	}
+	fmt.Printf("FileStorage.Shard, %d keys moved to %d shards (%v)\n", len(index)-1, SHARD_COUNT, fs.Path)
+	return fs.removeFlatFiles()
+}
+
+// FileStorage.removeFlatFiles removes the flat index and the value files it
+// lists, once the storage is sharded.
+func (fs *FileStorage) removeFlatFiles() error {
+	indexPath := path.Join(fs.Path, INDEX_FILE_NAME)
+	buff, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+	flat := make(map[string]string)
+	if err := json.Unmarshal(buff, &flat); err != nil {
+		return err
+	}
+	for key := range flat {
+		if ValidateKey(key) == nil && !isShardDir(key) {
+			os.Remove(path.Join(fs.Path, EncodeKey(key)))
+		}
+	}
+	return os.Remove(indexPath)
+}
+
+// linkFile makes dst a hard link of src, or a copy where links aren't
+// supported.
+func linkFile(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	buff, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(dst, buff, 0644)
+}
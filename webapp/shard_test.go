@@ -0,0 +1,216 @@
+package webapp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fillTestStorage sets n keys and returns their values.
+func fillTestStorage(t *testing.T, fs *FileStorage, n int) map[string]string {
+	t.Helper()
+	values := make(map[string]string)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		values[key] = fmt.Sprintf("value %d", i)
+		if err := fs.Set(key, []byte(values[key])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a key escaped by EncodeKey
+	values["a/b"] = "escaped"
+	fs.Set("a/b", []byte("escaped"))
+	return values
+}
+
+// checkSharded checks that a storage in dir is sharded, holds values and
+// has no flat files left.
+func checkSharded(t *testing.T, fs *FileStorage, dir string, values map[string]string) {
+	t.Helper()
+	if !fs.Sharded {
+		t.Fatal("storage isn't sharded")
+	}
+	checkTestValues(t, fs, values)
+	infos, _ := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() && isShardDir(name) || name == LAYOUT_FILE_NAME || name == JOURNAL_FILE_NAME {
+			continue
+		}
+		t.Errorf("flat file '%s' left", name)
+	}
+	for key := range values {
+		if filepath.Dir(fs.valuePath(key)) != filepath.Join(dir, shardOf(key)) {
+			t.Errorf("value of '%s' isn't in its shard: %s", key, fs.valuePath(key))
+		}
+	}
+	if problems := fs.Check(false); len(problems) != 0 {
+		t.Fatal(problems)
+	}
+}
+
+func TestShard(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	fs := openTestStorage(t, dir, testLayoutFlat)
+	values := fillTestStorage(t, fs, 300)
+	if err := fs.Shard(); err != nil {
+		t.Fatal(err)
+	}
+	checkSharded(t, fs, dir, values)
+	// sharding twice does nothing
+	if err := fs.Shard(); err != nil {
+		t.Fatal(err)
+	}
+	fs.Set("after", []byte("sharding"))
+	values["after"] = "sharding"
+	fs.Close()
+
+	fs = openTestStorage(t, dir, testLayoutSharded)
+	defer fs.Close()
+	checkSharded(t, fs, dir, values)
+}
+
+// TestNewStorageFlat checks a new storage is created flat, it's only sharded
+// when converted.
+func TestNewStorageFlat(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	fs := new(FileStorage)
+	if err := fs.Init(dir, FILE_STORAGE_MODE_MULIPLE); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if fs.Sharded {
+		t.Fatal("new storage created sharded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, LAYOUT_FILE_NAME)); !os.IsNotExist(err) {
+		t.Fatalf("layout file written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, INDEX_FILE_NAME)); err != nil {
+		t.Fatalf("no flat index: %v", err)
+	}
+}
+
+func TestShardReservedKey(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	fs := openTestStorage(t, dir, testLayoutFlat)
+	defer fs.Close()
+	values := fillTestStorage(t, fs, 10)
+	fs.Set("_0a", []byte("a shard name"))
+	values["_0a"] = "a shard name"
+	if err := fs.Shard(); err == nil || !strings.Contains(err.Error(), "_0a") {
+		t.Fatalf("Shard() = %v with a key named like a shard", err)
+	}
+	if fs.Sharded {
+		t.Fatal("storage sharded despite the error")
+	}
+	checkTestValues(t, fs, values)
+	if _, err := os.Stat(filepath.Join(dir, LAYOUT_FILE_NAME)); !os.IsNotExist(err) {
+		t.Fatalf("layout file written: %v", err)
+	}
+}
+
+func TestShardSingleFile(t *testing.T) {
+	fs := openTestStorage(t, t.TempDir(), testLayoutSingle)
+	defer fs.Close()
+	if err := fs.Shard(); err == nil {
+		t.Fatal("a single file storage was sharded")
+	}
+}
+
+// TestShardResume reopens storages left by a conversion interrupted at
+// either side of writing the layout file.
+func TestShardResume(t *testing.T) {
+	t.Run("after the switch", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "store")
+		fs := openTestStorage(t, dir, testLayoutFlat)
+		values := fillTestStorage(t, fs, 100)
+		fs.Close()
+		// keep the flat files Shard removes, and put them back afterwards
+		flat := make(map[string][]byte)
+		infos, _ := ioutil.ReadDir(dir)
+		for _, info := range infos {
+			if !info.IsDir() && info.Name() != JOURNAL_FILE_NAME {
+				flat[info.Name()], _ = ioutil.ReadFile(filepath.Join(dir, info.Name()))
+			}
+		}
+		fs = openTestStorage(t, dir, testLayoutFlat)
+		if err := fs.Shard(); err != nil {
+			t.Fatal(err)
+		}
+		fs.Close()
+		for name, buff := range flat {
+			ioutil.WriteFile(filepath.Join(dir, name), buff, 0644)
+		}
+		if _, err := os.Stat(filepath.Join(dir, INDEX_FILE_NAME)); err != nil {
+			t.Fatal(err)
+		}
+
+		fs = openTestStorage(t, dir, testLayoutSharded)
+		checkSharded(t, fs, dir, values)
+		fs.Close()
+		fs = openTestStorage(t, dir, testLayoutSharded)
+		defer fs.Close()
+		checkSharded(t, fs, dir, values)
+	})
+	t.Run("before the switch", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "store")
+		fs := openTestStorage(t, dir, testLayoutFlat)
+		values := fillTestStorage(t, fs, 100)
+		// the links and some segments written, not the layout file
+		for key := range values {
+			dst := filepath.Join(dir, shardOf(key), EncodeKey(key))
+			os.MkdirAll(filepath.Dir(dst), 0755)
+			linkFile(filepath.Join(dir, EncodeKey(key)), dst)
+		}
+		ioutil.WriteFile(filepath.Join(dir, shardName(0), INDEX_FILE_NAME), []byte(`{"x":"y"}`), 0644)
+		fs.Close()
+
+		fs = openTestStorage(t, dir, testLayoutFlat)
+		checkTestValues(t, fs, values)
+		if err := fs.Shard(); err != nil {
+			t.Fatal(err)
+		}
+		checkSharded(t, fs, dir, values)
+		fs.Close()
+		fs = openTestStorage(t, dir, testLayoutSharded)
+		defer fs.Close()
+		checkSharded(t, fs, dir, values)
+	})
+}
+
+// BenchmarkSaveIndex100k saves the index of 100k keys after one of them is
+// written, a flat storage rewrites all of it, a sharded one a single segment.
+func BenchmarkSaveIndex100k(b *testing.B) {
+	for _, layout := range []string{testLayoutFlat, testLayoutSharded} {
+		b.Run(layout, func(b *testing.B) {
+			dir := filepath.Join(b.TempDir(), "store")
+			fs := openTestStorage(b, dir, layout)
+			defer fs.Close()
+			// index entries without value files, only the index is measured
+			fs.lock.Lock()
+			for i := 0; i < 100000; i++ {
+				key := fmt.Sprintf("article-%d", i)
+				fs.Index[key] = fs.valuePath(key)
+			}
+			if fs.Sharded {
+				fs.markAllDirty()
+			}
+			fs.lock.Unlock()
+			if err := fs.SaveIndex(); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := fs.Set(fmt.Sprintf("article-%d", i%100000), []byte("x")); err != nil {
+					b.Fatal(err)
+				}
+				if err := fs.SaveIndex(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
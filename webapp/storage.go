@@ -8,41 +8,52 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"time"
-)
-
-const (
-	OP_SAVE = 0
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// Storage is a key-value store of byte values, safe for concurrent use.
+// Applications hold a Storage through a Store.
 type Storage interface {
-	Get(string) string
-	Set(string) string
-	Delete(string) string
+	// Get returns an error with ERROR_KEY_NOT_EXISTS for a missing key
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	// Delete of a missing key is not an error
+	Delete(key string) error
+	Has(key string) bool
+	Keys() []string
+	Count() int
+	// Flush writes what the storage keeps in memory to disk
+	Flush() error
+	Close() error
 }
 
-type StorageStat struct {
-	GetCount       int64
-	SetCount       int64
-	DeleteCount    int64
-	HasCount       int64
-	SaveIndexCount int64
-}
-
-type StorageCmdItem struct {
-	Op   int
-	Arg1 interface{}
+// Checker is implemented by storages which can check their files for the
+// leftovers of a crash.
+type Checker interface {
+	Check(repair bool) []string
 }
 
+// FileStorage keeps values either inside a single JSON file or in one file per
+// key. All access to Index goes through lock, so a FileStorage can be shared
+// by every HTTP goroutine. Mutations are journaled; the index itself is only
+// written by SaveIndex, when the storage is flushed.
 type FileStorage struct {
 	Path  string
 	Mode  int
 	Index map[string]string
-	Stat  StorageStat
-	// @TODO
-	GetChan chan string
-	SetChan chan string
-	CmdChan chan *StorageCmdItem
+	// multiple-file storage with the sharded layout, see shard.go
+	Sharded bool
+	// shards whose index segment is out of date
+	dirty map[string]bool
+	// index mutations since the last SaveIndex, and their count
+	journal *Journal
+	unsaved int64
+	// guards Index, journal and the value files
+	lock sync.RWMutex
+	// serializes writers of the index file
+	saveLock sync.Mutex
 }
 
 const (
@@ -56,57 +67,100 @@ const (
 	ERROR_IMPERMEABLE_KEY = "Impereable Key"
 )
 
+const (
+	INDEX_FILE_NAME     = "index.json"
+	JOURNAL_FILE_NAME   = "index.journal"
+	JOURNAL_FILE_SUFFIX = ".journal"
+	TEMP_FILE_SUFFIX    = ".tmp"
+)
+
 func (fs *FileStorage) Init(path string, mode int) error {
 	fs.Path = path
 	fs.Mode = mode
-	fs.CmdChan = make(chan *StorageCmdItem)
-	fs.GetChan = make(chan string)
-	fs.SetChan = make(chan string)
 	fs.Index = make(map[string]string)
 	fs.Index["*"] = "placeholder"
+	fs.dirty = make(map[string]bool)
 	indexPath := fs.getIndexFilePath()
-	_, err := ioutil.ReadFile(indexPath)
-	if err != nil {
-		fmt.Println("Read index file failed, create new one:", err)
-		dir, _ := filepath.Split(indexPath)
+	dir, base := filepath.Split(indexPath)
+	if len(dir) != 0 {
 		os.MkdirAll(dir, 0755)
-		fs.SaveIndex()
-	}
-	fs.LoadIndex()
-	go fs.Master()
-	go func() {
-		for {
-			time.Sleep(120 * 1e9)
-			cmd := new(StorageCmdItem)
-			cmd.Op = OP_SAVE
-			fs.CmdChan <- cmd
-		}
-	}()
+	}
+	if fs.Mode == FILE_STORAGE_MODE_MULIPLE {
+		if err := fs.initLayout(); err != nil {
+			return err
+		}
+	}
+	// leftovers of writes interrupted by a crash
+	if fs.Mode == FILE_STORAGE_MODE_MULIPLE {
+		removeTempFiles(dir, ".")
+		if fs.Sharded {
+			for i := 0; i < SHARD_COUNT; i++ {
+				removeTempFiles(fs.Path+"/"+shardName(i), ".")
+			}
+		}
+	} else {
+		removeTempFiles(dir, "."+base+TEMP_FILE_SUFFIX)
+	}
+	if _, err := os.Stat(indexPath); os.IsNotExist(err) && !fs.Sharded {
+		fmt.Println("Index file doesn't exist, create new one:", indexPath)
+		if err := fs.SaveIndex(); err != nil {
+			return err
+		}
+	}
+	// never start from an empty index if the existing one is broken
+	if err := fs.LoadIndex(); err != nil {
+		return err
+	}
+	journalPath := fs.getJournalFilePath()
+	count, err := ReplayJournal(journalPath, fs.Index)
+	if err != nil {
+		fmt.Printf("FileStorage.Init, Replay journal failed (%v):%s\n", journalPath, err)
+		return err
+	}
+	if fs.journal, err = OpenJournal(journalPath); err != nil {
+		return err
+	}
+	if info, err := os.Stat(journalPath); err == nil && info.Size() != 0 {
+		fmt.Printf("FileStorage.Init, Replayed %d journal entries (%v)\n", count, journalPath)
+		// fold the journal into the index, a torn tail must not stay in front of new entries
+		if fs.Sharded {
+			fs.markAllDirty()
+		}
+		if err := fs.SaveIndex(); err != nil {
+			return err
+		}
+	}
+	if fs.Mode == FILE_STORAGE_MODE_MULIPLE {
+		fs.renameLegacyFiles()
+	}
 	return nil
 }
 
-func (fs *FileStorage) Master() {
-	for {
-		select {
-		case cmd := <-fs.CmdChan:
-			if cmd.Op == OP_SAVE {
-				fs.SaveIndex()
-			}
-		case v := <-fs.GetChan:
-			// @TODO get value
-			print(v)
-		case v := <-fs.SetChan:
-			// @TODO set value
-			print(v)
-		}
+// FileStorage.Close saves the index if needed and closes the journal.
+func (fs *FileStorage) Close() error {
+	err := fs.Flush()
+	if fs.journal != nil {
+		fs.journal.Close()
 	}
+	return err
+}
+
+// FileStorage.Flush saves the index if it changed since the last save. When
+// that happens is up to the caller, usually a FlushScheduler; until then the
+// journal keeps the mutations.
+func (fs *FileStorage) Flush() error {
+	if atomic.LoadInt64(&fs.unsaved) == 0 {
+		return nil
+	}
+	return fs.SaveIndex()
 }
 
 func (fs *FileStorage) Get(key string) ([]byte, error) {
-	if key == "*" {
-		return nil, errors.New(ERROR_IMPERMEABLE_KEY)
+	if err := ValidateKey(key); err != nil {
+		return nil, err
 	}
-	fs.Stat.GetCount++
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
 	if fs.Mode == FILE_STORAGE_MODE_SINGLE {
 		if val, ok := fs.Index[key]; ok {
 			return []byte(val), nil
@@ -115,7 +169,7 @@ func (fs *FileStorage) Get(key string) ([]byte, error) {
 		}
 	} else if fs.Mode == FILE_STORAGE_MODE_MULIPLE {
 		if _, ok := fs.Index[key]; ok {
-			valueFilePath := path.Join(fs.Path, key)
+			valueFilePath := fs.valuePath(key)
 			value, err := ioutil.ReadFile(valueFilePath)
 			if err != nil {
 				fmt.Println("FileStorage.Get, Read file failed:", err)
@@ -130,102 +184,207 @@ func (fs *FileStorage) Get(key string) ([]byte, error) {
 }
 
 func (fs *FileStorage) Has(key string) bool {
-	if key == "*" {
+	if ValidateKey(key) != nil {
 		return false
 	}
-	fs.Stat.HasCount++
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
 	if _, ok := fs.Index[key]; ok {
 		return true
 	}
 	return false
 }
 
+// FileStorage.Set stores a value. Keys are validated by ValidateKey, and
+// with one file per key they are encoded by EncodeKey, so no key can name a
+// file outside the storage or one of its index files.
 func (fs *FileStorage) Set(key string, value []byte) error {
-	fs.Stat.SetCount++
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
 	if fs.Mode == FILE_STORAGE_MODE_SINGLE {
+		if err := fs.journal.Append(&JournalEntry{Op: JOURNAL_OP_SET, Key: key, Value: string(value)}); err != nil {
+			return err
+		}
 		fs.Index[key] = string(value)
+		atomic.AddInt64(&fs.unsaved, 1)
 	} else if fs.Mode == FILE_STORAGE_MODE_MULIPLE {
-		valueFilePath := path.Join(fs.Path, key)
-		fs.Index[key] = valueFilePath
-		if err := ioutil.WriteFile(valueFilePath, value, 0644); err != nil {
+		valueFilePath := fs.valuePath(key)
+		if fs.Sharded {
+			os.MkdirAll(path.Dir(valueFilePath), 0755)
+			fs.dirty[shardOf(key)] = true
+		}
+		if err := WriteFileAtomic(valueFilePath, value, 0644); err != nil {
 			return err
 		}
+		if err := fs.journal.Append(&JournalEntry{Op: JOURNAL_OP_SET, Key: key, Value: valueFilePath}); err != nil {
+			return err
+		}
+		fs.Index[key] = valueFilePath
+		atomic.AddInt64(&fs.unsaved, 1)
 	}
 	return nil
 }
-func (fs *FileStorage) GetString(key string) (string, error) {
-	str, err := fs.Get(key)
-	if err != nil {
-		return "", err
-	}
-	return string(str), err
-}
 
-func (fs *FileStorage) SetString(key string, value string) error {
-	return fs.Set(key, []byte(value))
-}
-
-// Gets string form storage assigned with specified key, coverts it to json object
-// and returns.
-// if this key doesn't exists or failed to parse json, return nil, err
-func (fs *FileStorage) GetJSON(key string) (interface{}, error) {
-	var jsobj interface{}
-	str, err := fs.Get(key)
-	if err != nil {
-		return nil, err
+func (fs *FileStorage) Delete(key string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
 	}
-	if err := json.Unmarshal(str, &jsobj); err != nil {
-		fmt.Printf("FileStorage.GetJSON, Unmarshal json failed (%v):%s\n", key, err)
-		return nil, err
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if _, ok := fs.Index[key]; !ok {
+		return nil
 	}
-	return jsobj, nil
-}
-
-func (fs *FileStorage) SetJSON(key string, value interface{}) error {
-	str, err := json.Marshal(value)
-	if err != nil {
-		fmt.Printf("FileStorage.SetJSON, Marshal json failed (%v):%s\n", value, err)
+	if err := fs.journal.Append(&JournalEntry{Op: JOURNAL_OP_DELETE, Key: key}); err != nil {
 		return err
 	}
-	return fs.Set(key, str)
-}
-
-func (fs *FileStorage) Delete(key string) {
-	fs.Stat.DeleteCount++
+	atomic.AddInt64(&fs.unsaved, 1)
 	if fs.Mode == FILE_STORAGE_MODE_SINGLE {
 		delete(fs.Index, key)
 	} else if fs.Mode == FILE_STORAGE_MODE_MULIPLE {
 		delete(fs.Index, key)
-		valueFilePath := path.Join(fs.Path, key)
-		os.Remove(valueFilePath)
+		if fs.Sharded {
+			fs.dirty[shardOf(key)] = true
+		}
+		os.Remove(fs.valuePath(key))
 	}
+	return nil
 }
 
+// FileStorage.Count returns the number of keys, without the placeholder key "*".
 func (fs *FileStorage) Count() int {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	if _, ok := fs.Index["*"]; ok {
+		return len(fs.Index) - 1
+	}
 	return len(fs.Index)
 }
 
+// FileStorage.Keys returns a snapshot of all keys in the storage, the
+// placeholder key "*" is excluded.
+func (fs *FileStorage) Keys() []string {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	keys := make([]string, 0, len(fs.Index))
+	for k := range fs.Index {
+		if k == "*" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// FileStorage.Check compares the index with the value files on disk and
+// returns the problems found. With repair, index keys without a value file
+// are dropped and value files which aren't indexed are removed; both are
+// leftovers of an operation interrupted by a crash.
+func (fs *FileStorage) Check(repair bool) []string {
+	problems := make([]string, 0)
+	if fs.Mode != FILE_STORAGE_MODE_MULIPLE {
+		return problems
+	}
+	indexed := make(map[string]bool)
+	for _, key := range fs.Keys() {
+		valueFilePath := fs.valuePath(key)
+		indexed[valueFilePath] = true
+		if _, err := os.Stat(valueFilePath); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: key '%s' has no value file", fs.Path, key))
+			if repair {
+				fs.Delete(key)
+			}
+		}
+	}
+	dirs := []string{""}
+	if fs.Sharded {
+		for i := 0; i < SHARD_COUNT; i++ {
+			dirs = append(dirs, shardName(i))
+		}
+	}
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(path.Join(fs.Path, dir))
+		if os.IsNotExist(err) && len(dir) != 0 {
+			continue
+		}
+		if err != nil {
+			return append(problems, fmt.Sprintf("%s: %v", fs.Path, err))
+		}
+		for _, info := range infos {
+			name := info.Name()
+			if info.IsDir() || name == INDEX_FILE_NAME || name == JOURNAL_FILE_NAME || name == LAYOUT_FILE_NAME {
+				continue
+			}
+			if strings.HasPrefix(name, ".") && strings.Contains(name, TEMP_FILE_SUFFIX) {
+				continue
+			}
+			valueFilePath := path.Join(fs.Path, dir, name)
+			if !indexed[valueFilePath] {
+				problems = append(problems, fmt.Sprintf("%s: file '%s' isn't indexed", fs.Path, path.Join(dir, name)))
+				if repair {
+					os.Remove(valueFilePath)
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// FileStorage.SaveIndex writes the whole index to the index file, or the
+// dirty segments of a sharded storage, and empties the journal. Mutations are
+// blocked meanwhile, so no journal entry can be dropped without being part of
+// the written index.
 func (fs *FileStorage) SaveIndex() error {
 	indexPath := fs.getIndexFilePath()
+	fs.saveLock.Lock()
+	defer fs.saveLock.Unlock()
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	if fs.Sharded {
+		if err := fs.saveSegments(); err != nil {
+			return err
+		}
+		return fs.resetJournal()
+	}
 	buff, err := json.Marshal(fs.Index)
 	if err != nil {
 		fmt.Printf("FileStorage.SaveIndex, Marshal json failed (%v):%s\n", indexPath, err)
 		return err
 	}
-	fs.Stat.SaveIndexCount++
-	if err := ioutil.WriteFile(indexPath, buff, 0644); err != nil {
+	if err := WriteFileAtomic(indexPath, buff, 0644); err != nil {
+		fmt.Printf("FileStorage.SaveIndex, Write file failed (%v):%s\n", indexPath, err)
 		return err
 	}
+	return fs.resetJournal()
+}
+
+// FileStorage.resetJournal empties the journal once the index is written,
+// mutations are blocked by the caller.
+func (fs *FileStorage) resetJournal() error {
+	if fs.journal == nil {
+		return nil
+	}
+	if err := fs.journal.Reset(); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&fs.unsaved, 0)
 	return nil
 }
 
 func (fs *FileStorage) LoadIndex() error {
+	if fs.Sharded {
+		return fs.loadSegments()
+	}
 	indexPath := fs.getIndexFilePath()
 	buff, err := ioutil.ReadFile(indexPath)
 	if err != nil {
 		fmt.Println("FileStorage.LoadIndex, Read file failed:", err)
 		return err
 	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
 	if err := json.Unmarshal(buff, &fs.Index); err != nil {
 		fmt.Printf("FileStorage.LoadIndex, Unmarshal json failed (%v):%s\n", indexPath, err)
 		return err
@@ -238,7 +397,34 @@ func (fs *FileStorage) getIndexFilePath() string {
 	if fs.Mode == FILE_STORAGE_MODE_SINGLE {
 		indexPath = fs.Path
 	} else if fs.Mode == FILE_STORAGE_MODE_MULIPLE {
-		indexPath = path.Join(fs.Path, "index.json")
+		indexPath = path.Join(fs.Path, INDEX_FILE_NAME)
 	}
 	return indexPath
 }
+
+func (fs *FileStorage) getJournalFilePath() string {
+	var journalPath string
+	if fs.Mode == FILE_STORAGE_MODE_SINGLE {
+		journalPath = fs.Path + JOURNAL_FILE_SUFFIX
+	} else if fs.Mode == FILE_STORAGE_MODE_MULIPLE {
+		journalPath = path.Join(fs.Path, JOURNAL_FILE_NAME)
+	}
+	return journalPath
+}
+
+// removeTempFiles removes the temporary files in dir which name starts with prefix.
+func removeTempFiles(dir string, prefix string) {
+	if len(dir) == 0 {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() && strings.HasPrefix(name, prefix) && strings.Contains(name, TEMP_FILE_SUFFIX) {
+			os.Remove(path.Join(dir, name))
+		}
+	}
+}
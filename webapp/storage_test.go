@@ -0,0 +1,173 @@
+package webapp
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testWorkers = 8
+	testRounds  = 200
+	// keys read by every worker while their owner rewrites them
+	testSharedKeys = 16
+)
+
+// TestConcurrentAccess runs writers, readers and a background saver on one
+// storage at once; run it with -race. Each worker owns its keys, so what it
+// reads back of them is exact, the shared keys are only checked to hold one
+// of the values written to them.
+func TestConcurrentAccess(t *testing.T) {
+	for _, layout := range testLayouts {
+		t.Run(layout, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "store")
+			fs := openTestStorage(t, dir, layout)
+			st := &Store{Storage: fs}
+			fl, err := NewFlushScheduler(FLUSH_MODE_INTERVAL, time.Millisecond, time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fl.Add(st)
+			for i := 0; i < testSharedKeys; i++ {
+				st.SetString(fmt.Sprintf("shared-%d", i), "0")
+			}
+
+			quit := make(chan struct{})
+			saverDone := make(chan error, 1)
+			go func() {
+				// SaveIndex directly as well as through the scheduler, so
+				// saves also overlap with each other
+				for {
+					select {
+					case <-quit:
+						saverDone <- nil
+						return
+					default:
+					}
+					if err := fs.SaveIndex(); err != nil {
+						saverDone <- err
+						return
+					}
+					time.Sleep(100 * time.Microsecond)
+				}
+			}()
+
+			var wg sync.WaitGroup
+			errs := make(chan error, testWorkers)
+			for w := 0; w < testWorkers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					errs <- runTestWorker(st, w)
+				}(w)
+			}
+			wg.Wait()
+			close(quit)
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+			if err := <-saverDone; err != nil {
+				t.Fatal(err)
+			}
+			if err := fl.Close(); err != nil {
+				t.Fatal(err)
+			}
+			want := testFinalValues()
+			checkTestValues(t, fs, want)
+			if problems := fs.Check(false); len(problems) != 0 {
+				t.Fatal(problems)
+			}
+			fs.Close()
+
+			// whatever the saver left on disk, index or journal, is complete
+			fs = openTestStorage(t, dir, layout)
+			defer fs.Close()
+			checkTestValues(t, fs, want)
+		})
+	}
+}
+
+// runTestWorker sets, reads and deletes the keys of worker w, and reads the
+// shared keys and the key list meanwhile.
+func runTestWorker(st *Store, w int) error {
+	for round := 0; round < testRounds; round++ {
+		key := fmt.Sprintf("w%d-%d", w, round%10)
+		value := fmt.Sprintf("%d", round)
+		if err := st.SetString(key, value); err != nil {
+			return err
+		}
+		if got, err := st.GetString(key); err != nil || got != value {
+			return fmt.Errorf("Get(%q) = %q, %v, want %q", key, got, err, value)
+		}
+		if !st.Has(key) {
+			return fmt.Errorf("Has(%q) = false after Set", key)
+		}
+		if round%3 == 0 {
+			if err := st.Delete(key); err != nil {
+				return err
+			}
+			if st.Has(key) {
+				return fmt.Errorf("Has(%q) after Delete", key)
+			}
+			if _, err := st.Get(key); err == nil {
+				return fmt.Errorf("Get(%q) after Delete", key)
+			}
+		}
+		shared := fmt.Sprintf("shared-%d", (w+round)%testSharedKeys)
+		if w == 0 {
+			if err := st.SetString(shared, value); err != nil {
+				return err
+			}
+		} else if _, err := st.GetString(shared); err != nil {
+			return fmt.Errorf("Get(%q) = %v", shared, err)
+		}
+		if count := st.Count(); count < testSharedKeys {
+			return fmt.Errorf("Count() = %d, below the shared keys", count)
+		}
+		for _, k := range st.Keys() {
+			if k == "*" {
+				return fmt.Errorf("Keys() returned the placeholder key")
+			}
+		}
+	}
+	return nil
+}
+
+// testFinalValues returns the values left by the workers.
+func testFinalValues() map[string]string {
+	want := make(map[string]string)
+	for w := 0; w < testWorkers; w++ {
+		for round := 0; round < testRounds; round++ {
+			key := fmt.Sprintf("w%d-%d", w, round%10)
+			if round%3 == 0 {
+				delete(want, key)
+			} else {
+				want[key] = fmt.Sprintf("%d", round)
+			}
+		}
+	}
+	for round := 0; round < testRounds; round++ {
+		want[fmt.Sprintf("shared-%d", round%testSharedKeys)] = fmt.Sprintf("%d", round)
+	}
+	return want
+}
+
+func checkTestValues(t *testing.T, fs *FileStorage, want map[string]string) {
+	t.Helper()
+	if fs.Count() != len(want) {
+		t.Errorf("Count() = %d, want %d", fs.Count(), len(want))
+	}
+	if keys := fs.Keys(); len(keys) != len(want) {
+		t.Errorf("Keys() has %d keys, want %d", len(keys), len(want))
+	}
+	for key, value := range want {
+		if got, err := fs.Get(key); err != nil || string(got) != value {
+			t.Errorf("Get(%q) = %q, %v, want %q", key, got, err, value)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package webapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// Names of the storage backends.
+const (
+	STORAGE_BACKEND_FILE   = "file"
+	STORAGE_BACKEND_KV     = "kv"
+	STORAGE_BACKEND_MEMORY = "memory"
+)
+
+type StorageStat struct {
+	GetCount    int64
+	SetCount    int64
+	DeleteCount int64
+	HasCount    int64
+	FlushCount  int64
+}
+
+// Store is the handle applications and transactions use. It wraps the
+// Storage picked when the store is opened, counts the accesses and adds
+// helpers for string and JSON values. It also remembers whether it was
+// written since its last flush, for its FlushScheduler.
+type Store struct {
+	Storage
+	Stat      StorageStat
+	dirty     int32
+	scheduler *FlushScheduler
+}
+
+func (st *Store) Get(key string) ([]byte, error) {
+	atomic.AddInt64(&st.Stat.GetCount, 1)
+	return st.Storage.Get(key)
+}
+
+func (st *Store) Set(key string, value []byte) error {
+	atomic.AddInt64(&st.Stat.SetCount, 1)
+	atomic.StoreInt32(&st.dirty, 1)
+	return st.Storage.Set(key, value)
+}
+
+func (st *Store) Delete(key string) error {
+	atomic.AddInt64(&st.Stat.DeleteCount, 1)
+	atomic.StoreInt32(&st.dirty, 1)
+	return st.Storage.Delete(key)
+}
+
+func (st *Store) Has(key string) bool {
+	atomic.AddInt64(&st.Stat.HasCount, 1)
+	return st.Storage.Has(key)
+}
+
+// Store.Flush flushes the storage now, whether it's dirty or not.
+func (st *Store) Flush() error {
+	atomic.AddInt64(&st.Stat.FlushCount, 1)
+	atomic.StoreInt32(&st.dirty, 0)
+	if err := st.Storage.Flush(); err != nil {
+		atomic.StoreInt32(&st.dirty, 1)
+		return err
+	}
+	return nil
+}
+
+// Store.Sync tells the store that a batch of writes, e.g. a transaction, is
+// complete. Its FlushScheduler decides when it's flushed; a store without one
+// is flushed now if it's dirty.
+func (st *Store) Sync() error {
+	if fl := st.scheduler; fl != nil {
+		return fl.sync(st)
+	}
+	return st.flushDirty()
+}
+
+// Store.Check checks the files of the storage if it's a Checker, other
+// storages have nothing to check.
+func (st *Store) Check(repair bool) []string {
+	if checker, ok := st.Storage.(Checker); ok {
+		return checker.Check(repair)
+	}
+	return []string{}
+}
+
+func (st *Store) GetString(key string) (string, error) {
+	str, err := st.Get(key)
+	if err != nil {
+		return "", err
+	}
+	return string(str), err
+}
+
+func (st *Store) SetString(key string, value string) error {
+	return st.Set(key, []byte(value))
+}
+
+// Gets string form storage assigned with specified key, coverts it to json object
+// and returns.
+// if this key doesn't exists or failed to parse json, return nil, err
+func (st *Store) GetJSON(key string) (interface{}, error) {
+	var jsobj interface{}
+	str, err := st.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(str, &jsobj); err != nil {
+		fmt.Printf("Store.GetJSON, Unmarshal json failed (%v):%s\n", key, err)
+		return nil, err
+	}
+	return jsobj, nil
+}
+
+func (st *Store) SetJSON(key string, value interface{}) error {
+	str, err := json.Marshal(value)
+	if err != nil {
+		fmt.Printf("Store.SetJSON, Marshal json failed (%v):%s\n", value, err)
+		return err
+	}
+	return st.Set(key, str)
+}
@@ -0,0 +1,223 @@
+package webapp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	ERROR_TX_DONE = "Transaction has been committed or rolled back"
+)
+
+type txOp struct {
+	Store  *Store
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+// Transaction stages mutations against several Stores and applies them
+// together. The lock passed to NewTransaction is held from the beginning to
+// Commit or Rollback, so transactions sharing a lock never interleave and
+// reads made through the transaction stay valid until it commits.
+//
+// If a mutation fails during Commit, the mutations already applied are
+// reverted to the values they replaced.
+//
+// The atomicity only holds within the process: there is no commit record,
+// each Store writes its mutations on its own. A crash during Commit, or
+// during the revert of a failed one, leaves the mutations applied so far on
+// disk and the rest not, and nothing replays or undoes them on Init. The
+// application has to check its storages against each other after such a
+// crash, as the fsck command of tattoo does.
+type Transaction struct {
+	lock         sync.Locker
+	ops          []*txOp
+	staged       map[*Store]map[string]*txOp
+	onCommit     []func()
+	onApply      []func(fs *Store, key string)
+	beforeCommit []func() error
+	done         bool
+}
+
+func NewTransaction(lock sync.Locker) *Transaction {
+	lock.Lock()
+	tx := new(Transaction)
+	tx.lock = lock
+	tx.ops = make([]*txOp, 0)
+	tx.staged = make(map[*Store]map[string]*txOp)
+	return tx
+}
+
+func (tx *Transaction) stage(op *txOp) {
+	tx.ops = append(tx.ops, op)
+	if _, ok := tx.staged[op.Store]; !ok {
+		tx.staged[op.Store] = make(map[string]*txOp)
+	}
+	tx.staged[op.Store][op.Key] = op
+}
+
+func (tx *Transaction) lookup(fs *Store, key string) (*txOp, bool) {
+	if keys, ok := tx.staged[fs]; ok {
+		op, ok := keys[key]
+		return op, ok
+	}
+	return nil, false
+}
+
+func (tx *Transaction) Set(fs *Store, key string, value []byte) {
+	tx.stage(&txOp{Store: fs, Key: key, Value: value})
+}
+
+func (tx *Transaction) SetString(fs *Store, key string, value string) {
+	tx.Set(fs, key, []byte(value))
+}
+
+func (tx *Transaction) SetJSON(fs *Store, key string, value interface{}) error {
+	str, err := json.Marshal(value)
+	if err != nil {
+		fmt.Printf("Transaction.SetJSON, Marshal json failed (%v):%s\n", value, err)
+		return err
+	}
+	tx.Set(fs, key, str)
+	return nil
+}
+
+func (tx *Transaction) Delete(fs *Store, key string) {
+	tx.stage(&txOp{Store: fs, Key: key, Delete: true})
+}
+
+// Transaction.Get reads a value as it will be after the transaction commits.
+func (tx *Transaction) Get(fs *Store, key string) ([]byte, error) {
+	if op, ok := tx.lookup(fs, key); ok {
+		if op.Delete {
+			return nil, errors.New(ERROR_KEY_NOT_EXISTS)
+		}
+		return op.Value, nil
+	}
+	return fs.Get(key)
+}
+
+func (tx *Transaction) GetJSON(fs *Store, key string) (interface{}, error) {
+	var jsobj interface{}
+	str, err := tx.Get(fs, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(str, &jsobj); err != nil {
+		fmt.Printf("Transaction.GetJSON, Unmarshal json failed (%v):%s\n", key, err)
+		return nil, err
+	}
+	return jsobj, nil
+}
+
+func (tx *Transaction) Has(fs *Store, key string) bool {
+	if op, ok := tx.lookup(fs, key); ok {
+		return !op.Delete
+	}
+	return fs.Has(key)
+}
+
+// Transaction.OnCommit registers a function which runs after a successful
+// commit, while the transaction lock is still held.
+func (tx *Transaction) OnCommit(fn func()) {
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+// Transaction.OnApply registers a function which runs right after each
+// mutation is written to its storage, including the ones written to revert a
+// failed commit. It's meant for invalidating caches of the storages.
+func (tx *Transaction) OnApply(fn func(fs *Store, key string)) {
+	tx.onApply = append(tx.onApply, fn)
+}
+
+// Transaction.BeforeCommit registers fn to run when Commit starts, before
+// any mutation is applied. fn can stage more mutations; if it fails, the
+// transaction is rolled back and Commit returns the error.
+func (tx *Transaction) BeforeCommit(fn func() error) {
+	tx.beforeCommit = append(tx.beforeCommit, fn)
+}
+
+// Transaction.Commit applies all staged mutations in order and syncs the
+// touched storages, see Store.Sync. It's atomic for the other transactions
+// of this process, which wait for its lock, not against a crash, see
+// Transaction.
+func (tx *Transaction) Commit() error {
+	if tx.done {
+		return errors.New(ERROR_TX_DONE)
+	}
+	for _, fn := range tx.beforeCommit {
+		if err := fn(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	tx.done = true
+	defer tx.lock.Unlock()
+	undo := make([]*txOp, 0, len(tx.ops))
+	for _, op := range tx.ops {
+		prev := &txOp{Store: op.Store, Key: op.Key, Delete: true}
+		if op.Store.Has(op.Key) {
+			value, err := op.Store.Get(op.Key)
+			if err != nil {
+				tx.revert(undo)
+				return err
+			}
+			prev.Value = value
+			prev.Delete = false
+		}
+		err := op.apply()
+		tx.applied(op)
+		if err != nil {
+			fmt.Printf("Transaction.Commit, Apply failed (%v):%s\n", op.Key, err)
+			tx.revert(undo)
+			return err
+		}
+		undo = append(undo, prev)
+	}
+	for fs := range tx.staged {
+		fs.Sync()
+	}
+	for _, fn := range tx.onCommit {
+		fn()
+	}
+	return nil
+}
+
+// Transaction.Rollback drops all staged mutations. It's a no-op after Commit,
+// so it can be deferred right after the transaction begins.
+func (tx *Transaction) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.lock.Unlock()
+}
+
+// revert restores the values replaced by the applied mutations, newest first.
+func (tx *Transaction) revert(undo []*txOp) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := undo[i].apply(); err != nil {
+			fmt.Printf("Transaction.revert, Restore failed (%v):%s\n", undo[i].Key, err)
+		}
+		tx.applied(undo[i])
+	}
+	for fs := range tx.staged {
+		fs.Sync()
+	}
+}
+
+func (tx *Transaction) applied(op *txOp) {
+	for _, fn := range tx.onApply {
+		fn(op.Store, op.Key)
+	}
+}
+
+func (op *txOp) apply() error {
+	if op.Delete {
+		return op.Store.Delete(op.Key)
+	}
+	return op.Store.Set(op.Key, op.Value)
+}
@@ -2,6 +2,7 @@ package webapp
 
 import (
 	"compress/gzip"
+	"encoding/json"
 	"html/template"
 	"log"
 	"net"
@@ -118,6 +119,25 @@ func (ctx *Context) Execute(tpl *template.Template, data interface{}) error {
 	return err
 }
 
+// Context.WriteJSON sends data encoded as JSON.
+func (ctx *Context) WriteJSON(data interface{}) error {
+	buff, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	ctx.Info.Message = "OK"
+	ctx.Info.HttpCode = 200
+	ctx.Application.AccessLog(ctx)
+	ctx.Writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if ctx.Headers != nil {
+		for k, v := range ctx.Headers {
+			ctx.Writer.Header().Set(k, v)
+		}
+	}
+	_, err = ctx.Writer.Write(buff)
+	return err
+}
+
 func (app *App) Run(port int) {
 	app.Port = port
 	err := http.ListenAndServe(":"+strconv.Itoa(app.Port), nil)